@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"rvcx/internal/atplistener"
+	"rvcx/internal/backfill"
+	"rvcx/internal/banpolicy"
+	"rvcx/internal/config"
+	"rvcx/internal/db"
+	"rvcx/internal/log"
+	"rvcx/internal/recordmanager"
+	"strings"
+)
+
+// backfill crawls pds repos for org.xcvr records that we missed while we
+// weren't listening to jetstream. the running server only loads channels at
+// startup, so restart it after backfilling new channels
+func main() {
+	didsflag := flag.String("dids", "", "comma separated list of dids to backfill, defaults to every did in did_handles")
+	verbose := flag.Bool("v", false, "verbose logging")
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	logger := log.New(os.Stdout, *verbose)
+	if err != nil {
+		logger.Error("failed to load config", "err", err)
+		os.Exit(1)
+	}
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	logger = log.NewWith(os.Stdout, level, cfg.LogFormat)
+	err = cfg.ValidateDB()
+	if err != nil {
+		logger.Error("can't backfill", "err", err)
+		os.Exit(1)
+	}
+	store, err := db.Init(cfg)
+	if err != nil {
+		logger.Error("failed to init db", "err", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	var dids []string
+	if *didsflag != "" {
+		for _, did := range strings.Split(*didsflag, ",") {
+			did = strings.TrimSpace(did)
+			if did != "" {
+				dids = append(dids, did)
+			}
+		}
+	} else {
+		dids, err = store.GetDids(ctx)
+		if err != nil {
+			logger.Error("failed to get dids", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// backfilling only ever stores records, it never writes to a repo,
+	// serves media or tells anyone connected about what it found, so it
+	// doesn't need a password client, an oauth service, a media cache or a
+	// model
+	bans := banpolicy.New(store, logger)
+	rm := recordmanager.New(cfg, logger, store, nil, nil, bans, nil)
+	consumer := atplistener.NewConsumer("", 0, logger, store, nil, rm, bans)
+	b := backfill.New(consumer, logger)
+
+	logger.Info("backfilling", "repos", len(dids))
+	stats, err := b.BackfillRepos(ctx, dids)
+	if err != nil {
+		logger.Warn("backfill stopped early", "err", err)
+	}
+	logger.Info("backfilled", "records", stats.Records, "repos", stats.Repos, "failed", stats.Failed)
+}
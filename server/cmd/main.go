@@ -3,79 +3,195 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"net/http"
 	"os"
+	"os/signal"
 	"rvcx/internal/atplistener"
 	"rvcx/internal/atputils"
+	"rvcx/internal/banpolicy"
+	"rvcx/internal/config"
 	"rvcx/internal/db"
+	"rvcx/internal/federation"
 	"rvcx/internal/handler"
 	"rvcx/internal/log"
+	"rvcx/internal/mediacache"
+	"rvcx/internal/metrics"
 	"rvcx/internal/model"
 	"rvcx/internal/oauth"
 	"rvcx/internal/recordmanager"
-
-	"github.com/joho/godotenv"
+	"syscall"
+	"time"
 )
 
 func main() {
 	logger := log.New(os.Stdout, true)
 
-	gdeerr := godotenv.Load("../.env")
-	if gdeerr != nil {
-		logger.Println("i think you should make a .env file in the rvcx directory !\n\nExample contents:\n-------------------------------------------------------------------\nPOSTGRES_USER=xcvr\nPOSTGRES_PASSWORD=secret\nPOSTGRES_DB=xcvrdb\nPOSTGRES_PORT=15432\n-------------------------------------------------------------------\n\nGood luck !\n\n")
-		panic(gdeerr)
+	fs := flag.NewFlagSet("rvcx", flag.ExitOnError)
+	cfg, err := config.Load(fs, os.Args[1:])
+	if err != nil {
+		logger.Error("failed to load config", "err", err)
+		os.Exit(1)
 	}
-	store, err := db.Init()
-	defer store.Close()
+	logger = log.NewWith(os.Stdout, cfg.LogLevel, cfg.LogFormat)
+	args := fs.Args()
+	if len(args) > 0 && args[0] == "migrate" {
+		err = cfg.ValidateDB()
+		if err != nil {
+			logger.Error("can't migrate", "err", err)
+			os.Exit(1)
+		}
+		os.Exit(migrate(cfg, args[1:], logger))
+	}
+	err = cfg.Validate()
 	if err != nil {
-		logger.Println("failed to init db")
-		panic(err)
+		logger.Error("can't start, i think you should make a .env file in the rvcx directory ! there's an example in the README. Good luck !", "err", err)
+		os.Exit(1)
 	}
-	host, err := atputils.GetPDSFromHandle(context.Background(), atputils.GetMyHandle())
+	store, err := db.Init(cfg)
 	if err != nil {
-		panic(err)
+		logger.Error("failed to init db", "err", err)
+		os.Exit(1)
 	}
-	did := atputils.GetMyDid()
-	if did == "" {
-		panic(errors.New("WOOPS I MESSED UP THE DID"))
+	defer store.Close()
+	logger.Debug("connected to the db")
+	host, err := atputils.GetPDSFromHandle(context.Background(), cfg.Identity)
+	if err != nil {
+		logger.Error("failed to find our pds", "identity", cfg.Identity, "err", err)
+		os.Exit(1)
 	}
-	xrpc := oauth.NewPasswordClient(did, host, logger)
+	xrpc := oauth.NewPasswordClient(cfg, host, logger)
 	err = xrpc.CreateSession(context.Background())
 	if err != nil {
-		panic(err)
+		logger.Error("failed to log in to our pds", "host", host, "err", err)
+		os.Exit(1)
 	}
-	oauthclient, err := oauth.NewService(*store)
+	oauthclient, err := oauth.NewService(cfg, store)
 	if err != nil {
-		logger.Println(err.Error())
-		panic(err)
+		logger.Error("failed to set up oauth", "err", err)
+		os.Exit(1)
 	}
-	recordmanager := recordmanager.New(logger, store, xrpc, oauthclient)
-	model := model.Init(store, logger, xrpc, recordmanager)
+	bans := banpolicy.New(store, logger)
+	media, err := mediacache.New(cfg.MediaCacheDir, cfg.MediaCacheBytes, logger)
+	if err != nil {
+		logger.Error("failed to set up the media cache", "dir", cfg.MediaCacheDir, "err", err)
+		os.Exit(1)
+	}
+	recordmanager := recordmanager.New(cfg, logger, store, xrpc, oauthclient, bans, media)
+	model := model.Init(cfg, store, logger, xrpc, recordmanager, bans)
 	recordmanager.SetBroadcaster(model)
-	h := handler.New(store, logger, oauthclient, model, recordmanager)
-	go consumeLoop(context.Background(), store, logger, xrpc, recordmanager)
-	http.ListenAndServe(":8080", h.Serve())
+	metrics.WatchChannels(model.Connected)
+	fed := federation.New(cfg, logger)
+	h := handler.New(cfg, store, logger, oauthclient, model, recordmanager, bans, fed)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	outboxctx, stopOutbox := context.WithCancel(context.Background())
+	outboxDone := make(chan struct{})
+	go func() {
+		recordmanager.RunOutbox(outboxctx)
+		close(outboxDone)
+	}()
+	consumer := atplistener.NewConsumer(cfg.JetstreamAddr, cfg.MaxRewind, logger, store, xrpc, recordmanager, bans)
+	consumectx, stopConsuming := context.WithCancel(context.Background())
+	consumed := make(chan struct{})
+	go func() {
+		consumeLoop(consumectx, consumer, logger)
+		close(consumed)
+	}()
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: h.Serve()}
+	// metrics say more about the server than the public should know, so
+	// they get their own address
+	metricsSrv := &http.Server{Addr: cfg.MetricsAddr, Handler: metricsMux()}
+	for _, srv := range []*http.Server{srv, metricsSrv} {
+		go func() {
+			err := srv.ListenAndServe()
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("failed to serve", "addr", srv.Addr, "err", err)
+				stop()
+			}
+		}()
+	}
+	<-ctx.Done()
+	stop()
+
+	// everything from here on has to fit in the shutdown timeout. websockets
+	// are hijacked, so srv.Shutdown doesn't wait for them, which is what
+	// fed and model are for
+	logger.Info("shutting down", "timeout", cfg.ShutdownTimeout)
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(sctx)
+	if err != nil {
+		logger.Error("failed to drain http", "err", err)
+	}
+	err = metricsSrv.Shutdown(sctx)
+	if err != nil {
+		logger.Error("failed to stop serving metrics", "err", err)
+	}
+	fed.Shutdown(sctx)
+	// jetstream is stopped before the channels are, so nothing it ingests
+	// lands after lex stream clients were handed their goingAway cursors
+	stopConsuming()
+	select {
+	case <-consumed:
+	case <-sctx.Done():
+		logger.Warn("gave up waiting for the consumer to stop")
+	}
+	err = consumer.FlushCursor(sctx)
+	if err != nil {
+		logger.Error("failed to flush cursor", "err", err)
+	}
+	err = model.Shutdown(sctx)
+	if err != nil {
+		logger.Error("failed to stop channels cleanly", "err", err)
+	}
+	// whatever the outbox doesn't get to is still there when we start again
+	stopOutbox()
+	select {
+	case <-outboxDone:
+	case <-sctx.Done():
+		logger.Warn("gave up waiting for the outbox to stop")
+	}
+	logger.Info("bye")
+}
 
+func metricsMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	return mux
 }
 
+// consumeLoop waits longer and longer between tries while jetstream can't
+// be reached, up to consumeMaxBackoff
 const (
-	defaultServerAddr = "wss://jetstream2.us-east.bsky.network/subscribe"
+	consumeMinBackoff = time.Second
+	consumeMaxBackoff = time.Minute
 )
 
-func consumeLoop(ctx context.Context, db *db.Store, l *log.Logger, cli *oauth.PasswordClient, rm *recordmanager.RecordManager) {
-	jsServerAddr := os.Getenv("JS_SERVER_ADDR")
-	if jsServerAddr == "" {
-		jsServerAddr = defaultServerAddr
-	}
-	consumer := atplistener.NewConsumer(jsServerAddr, l, db, cli, rm)
+func consumeLoop(ctx context.Context, consumer *atplistener.Consumer, l *log.Logger) {
+	backoff := consumeMinBackoff
 	for {
+		started := time.Now()
 		err := consumer.Consume(ctx)
+		if ctx.Err() != nil {
+			l.DebugContext(ctx, "exiting consume loop")
+			return
+		}
+		// a connection that stayed up for a while was working, so whatever
+		// ended it gets a fresh start
+		if time.Since(started) > consumeMaxBackoff {
+			backoff = consumeMinBackoff
+		}
 		if err != nil {
-			l.Deprintf("error in consume loop: %s", err.Error())
-			if errors.Is(err, context.Canceled) {
-				l.Deprintf("exiting consume loop")
-				return
-			}
+			l.ErrorContext(ctx, "error in consume loop", "err", err, "retry", backoff)
+		}
+		select {
+		case <-ctx.Done():
+			l.DebugContext(ctx, "exiting consume loop")
+			return
+		case <-time.After(backoff):
 		}
+		backoff = min(backoff*2, consumeMaxBackoff)
 	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"rvcx/internal/config"
+	"rvcx/internal/db"
+	"rvcx/internal/log"
+	"strconv"
+)
+
+const migrateUsage = `usage: go run ./cmd [flags] migrate up|down [n]|status
+
+  up      apply every migration that hasn't been applied yet
+  down    roll back the last n migrations (defaults to 1)
+  status  list the migrations and which ones have been applied`
+
+// migrate runs the migrate subcommand, returning the exit code
+func migrate(cfg *config.Config, args []string, l *log.Logger) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	m, err := db.NewMigrator(cfg, l)
+	if err != nil {
+		l.Error("failed to connect", "err", err)
+		return 1
+	}
+	defer m.Close()
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		err = m.Up(ctx)
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				fmt.Fprintln(os.Stderr, migrateUsage)
+				return 2
+			}
+		}
+		err = m.Down(n, ctx)
+	case "status":
+		err = migrateStatus(m, ctx)
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	if err != nil {
+		l.Error("failed to migrate", "command", args[0], "err", err)
+		return 1
+	}
+	return 0
+}
+
+func migrateStatus(m *db.Migrator, ctx context.Context) error {
+	version, dirty, err := m.Version(ctx)
+	if err != nil {
+		return err
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		mark := " "
+		if s.Applied {
+			mark = "x"
+		}
+		fmt.Printf("[%s] %s\n", mark, s.Name)
+	}
+	fmt.Printf("schema version %d, this build needs %d", version, m.Latest())
+	if dirty {
+		fmt.Print(" (dirty)")
+	}
+	fmt.Println()
+	return nil
+}
@@ -9,10 +9,12 @@ func main() {
 	if err := cbg.WriteMapEncodersToFile("internal/lex/lexicons_cbor.go", "lex",
 		lex.ProfileRecord{},
 		lex.ChannelRecord{},
+		lex.SubRecord{},
 		lex.MessageRecord{},
 		lex.SignetRecord{},
 		lex.AspectRatio{},
 		lex.Image{},
+		lex.Video{},
 		lex.MediaRecord{}); err != nil {
 		panic(err)
 	}
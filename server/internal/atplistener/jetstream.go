@@ -10,29 +10,78 @@ import (
 	"github.com/bluesky-social/jetstream/pkg/client/schedulers/sequential"
 	"github.com/bluesky-social/jetstream/pkg/models"
 	"rvcx/internal/atputils"
-	"rvcx/internal/db"
+	"rvcx/internal/banpolicy"
 	"rvcx/internal/lex"
 	"rvcx/internal/log"
+	"rvcx/internal/metrics"
 	"rvcx/internal/oauth"
 	"rvcx/internal/recordmanager"
+	"rvcx/internal/store"
 	"rvcx/internal/types"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	cursorName          = "jetstream"
+	cursorFlushInterval = 5 * time.Second
+	// maxEventAttempts is how many times an event that failed for a reason
+	// that might go away, like the db being down or a message showing up
+	// before its signet, is tried before we give up on it
+	maxEventAttempts = 5
+)
+
+// errBadRecord marks events that will never be ingested, however many times
+// they're retried
+var errBadRecord = errors.New("bad record")
+
+func badRecord(err error) error {
+	return fmt.Errorf("%w: %w", errBadRecord, err)
+}
+
 type Consumer struct {
-	cfg     *client.ClientConfig
-	logger  *log.Logger
-	handler *handler
+	cfg       *client.ClientConfig
+	logger    *log.Logger
+	handler   *handler
+	maxRewind time.Duration
 }
 
 type handler struct {
-	db  *db.Store
-	rm  *recordmanager.RecordManager
-	l   *log.Logger
-	cli *oauth.PasswordClient
+	db   store.Store
+	rm   *recordmanager.RecordManager
+	l    *log.Logger
+	cli  *oauth.PasswordClient
+	bans *banpolicy.Policy
+
+	// lastTimeUS is the time_us of the last event we finished handling,
+	// and flushedUS is the last one we committed to the db
+	lastTimeUS atomic.Int64
+	flushedUS  atomic.Int64
+	lagUS      atomic.Int64
+
+	// failed is every event that failed for a reason that might go away,
+	// oldest first. they're retried every flush, and the flushed cursor is
+	// held at the oldest one, so that a restart retries them too. guarded by
+	// failedmu
+	failed   []*failedEvent
+	failedmu sync.Mutex
+	// handlemu keeps retries from running alongside new events, so that an
+	// old event can't be retried over the top of a newer one for the same
+	// record
+	handlemu sync.Mutex
 }
 
-func NewConsumer(jsAddr string, l *log.Logger, db *db.Store, cli *oauth.PasswordClient, rm *recordmanager.RecordManager) *Consumer {
+type failedEvent struct {
+	event    *models.Event
+	attempts int
+}
+
+// NewConsumer creates a jetstream consumer. maxRewind bounds how far back in
+// time a stored cursor is allowed to resume from, since jetstream only keeps
+// a limited window of events around anyway
+func NewConsumer(jsAddr string, maxRewind time.Duration, l *log.Logger, db store.Store, cli *oauth.PasswordClient, rm *recordmanager.RecordManager, bans *banpolicy.Policy) *Consumer {
 	cfg := client.DefaultClientConfig()
 	if jsAddr != "" {
 		cfg.WebsocketURL = jsAddr
@@ -40,35 +89,207 @@ func NewConsumer(jsAddr string, l *log.Logger, db *db.Store, cli *oauth.Password
 	cfg.WantedCollections = []string{
 		"org.xcvr.actor.profile",
 		"org.xcvr.feed.channel",
+		"org.xcvr.feed.sub",
 		"org.xcvr.lrc.message",
 		"org.xcvr.lrc.signet",
 		"org.xcvr.lrc.media",
 	}
 	cfg.WantedDids = []string{}
 	return &Consumer{
-		cfg:     cfg,
-		logger:  l,
-		handler: &handler{db: db, l: l, cli: cli, rm: rm},
+		cfg:       cfg,
+		logger:    l,
+		handler:   &handler{db: db, l: l, cli: cli, rm: rm, bans: bans},
+		maxRewind: maxRewind,
 	}
 }
 
 func (c *Consumer) Consume(ctx context.Context) error {
-	scheduler := sequential.NewScheduler("jetstream_localdev", c.logger.Slog, c.handler.HandleEvent)
+	scheduler := sequential.NewScheduler("jetstream_localdev", c.logger.Logger, c.handler.HandleEvent)
 	defer scheduler.Shutdown()
-	client, err := client.NewClient(c.cfg, c.logger.Slog, scheduler)
+	client, err := client.NewClient(c.cfg, c.logger.Logger, scheduler)
 	if err != nil {
-		return errors.New("failed to create client: " + err.Error())
+		return fmt.Errorf("failed to create client: %w", err)
 	}
-	cursor := time.Now().Add(1 * -time.Minute).UnixMicro()
+	cursor := c.resumeCursor(ctx)
+	flushctx, cancel := context.WithCancel(ctx)
+	go c.flushLoop(flushctx)
 	err = client.ConnectAndRead(ctx, &cursor)
+	cancel()
+	ferr := c.FlushCursor(context.Background())
+	if ferr != nil {
+		c.logger.Error("failed to flush cursor", "err", ferr)
+	}
+	if err != nil {
+		return fmt.Errorf("error connecting and reading: %w", err)
+	}
+	return nil
+}
+
+// Lag reports how far behind realtime the last handled event was
+func (c *Consumer) Lag() time.Duration {
+	return time.Duration(c.handler.lagUS.Load()) * time.Microsecond
+}
+
+// FlushCursor commits the time_us of the last handled event, so that a
+// restart can pick up where we left off
+func (c *Consumer) FlushCursor(ctx context.Context) error {
+	last := c.handler.cursor()
+	if last == 0 || last == c.handler.flushedUS.Load() {
+		return nil
+	}
+	err := c.handler.db.StoreCursor(cursorName, last, ctx)
 	if err != nil {
-		return errors.New("error connecting and reading: " + err.Error())
+		return err
 	}
+	c.handler.flushedUS.Store(last)
 	return nil
 }
 
+func (c *Consumer) resumeCursor(ctx context.Context) int64 {
+	now := time.Now()
+	fallback := now.Add(1 * -time.Minute).UnixMicro()
+	cursor := c.handler.lastTimeUS.Load()
+	if cursor == 0 {
+		stored, err := c.handler.db.GetCursor(cursorName, ctx)
+		if err != nil {
+			if !errors.Is(err, store.ErrNotFound) {
+				c.logger.Error("failed to get stored cursor", "err", err)
+			}
+			return fallback
+		}
+		cursor = stored
+	}
+	oldest := now.Add(-c.maxRewind).UnixMicro()
+	if c.maxRewind > 0 && cursor < oldest {
+		c.logger.Info("stored cursor is too old, so i'm skipping ahead", "max_rewind", c.maxRewind)
+		cursor = oldest
+	}
+	c.logger.Debug("resuming jetstream", "from", time.UnixMicro(cursor))
+	return cursor
+}
+
+func (c *Consumer) flushLoop(ctx context.Context) {
+	ticker := time.NewTicker(cursorFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.handler.retryFailed(ctx)
+			err := c.FlushCursor(ctx)
+			if err != nil {
+				c.logger.Error("failed to flush cursor", "err", err)
+			}
+			c.logger.Debug("jetstream lag", "lag", c.Lag())
+		}
+	}
+}
+
+// HandleRecord feeds a record that didn't come from jetstream, like one found
+// while backfilling, through the same paths as a jetstream create commit
+func (c *Consumer) HandleRecord(ctx context.Context, did string, collection string, rkey string, cid string, record json.RawMessage) error {
+	event := &models.Event{
+		Did:  did,
+		Kind: models.EventKindCommit,
+		Commit: &models.Commit{
+			Operation:  models.CommitOperationCreate,
+			Collection: collection,
+			RKey:       rkey,
+			Record:     record,
+			CID:        cid,
+		},
+	}
+	return c.handler.handleCommit(ctx, event)
+}
+
+// HandleEvent never returns an error, since that makes the jetstream client
+// hang up. events that fail are held onto and retried instead, unless they
+// never will succeed
 func (h *handler) HandleEvent(ctx context.Context, event *models.Event) error {
 	if event.Commit == nil {
+		h.markHandled(event)
+		return nil
+	}
+	metrics.JetstreamEvents.WithLabelValues(event.Commit.Collection, event.Commit.Operation).Inc()
+	h.handlemu.Lock()
+	defer h.handlemu.Unlock()
+	h.supersede(event)
+	err := h.handleCommit(ctx, event)
+	if err != nil && !errors.Is(err, errBadRecord) {
+		h.l.WarnContext(ctx, "failed to handle event, will retry", "uri", URI(event), "err", err)
+		h.failedmu.Lock()
+		h.failed = append(h.failed, &failedEvent{event, 1})
+		h.failedmu.Unlock()
+		return nil
+	}
+	if err != nil {
+		h.l.WarnContext(ctx, "skipping bad record", "uri", URI(event), "err", err)
+	}
+	h.markHandled(event)
+	return nil
+}
+
+// supersede forgets any failed event for the same record as event, which
+// is newer, so that retrying the old one can't undo it
+func (h *handler) supersede(event *models.Event) {
+	uri := URI(event)
+	h.failedmu.Lock()
+	defer h.failedmu.Unlock()
+	h.failed = slices.DeleteFunc(h.failed, func(f *failedEvent) bool {
+		return URI(f.event) == uri
+	})
+}
+
+// retryFailed has another go at every failed event, giving up on the ones
+// that have had enough goes
+func (h *handler) retryFailed(ctx context.Context) {
+	h.handlemu.Lock()
+	defer h.handlemu.Unlock()
+	h.failedmu.Lock()
+	failed := h.failed
+	h.failed = nil
+	h.failedmu.Unlock()
+	var still []*failedEvent
+	for _, f := range failed {
+		err := h.handleCommit(ctx, f.event)
+		f.attempts += 1
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errBadRecord) && f.attempts < maxEventAttempts {
+			still = append(still, f)
+			continue
+		}
+		h.l.ErrorContext(ctx, "giving up on event", "uri", URI(f.event), "attempts", f.attempts, "err", err)
+	}
+	h.failedmu.Lock()
+	h.failed = append(still, h.failed...)
+	h.failedmu.Unlock()
+}
+
+// cursor is the time_us to resume from after a restart, which is the last
+// event we handled, unless there's an older one still waiting to be retried
+func (h *handler) cursor() int64 {
+	last := h.lastTimeUS.Load()
+	h.failedmu.Lock()
+	defer h.failedmu.Unlock()
+	if len(h.failed) != 0 && h.failed[0].event.TimeUS < last {
+		return h.failed[0].event.TimeUS
+	}
+	return last
+}
+
+func (h *handler) handleCommit(ctx context.Context, event *models.Event) error {
+	ctx = log.WithAttrs(ctx,
+		"did", event.Did,
+		"uri", URI(event),
+		"operation", event.Commit.Operation,
+	)
+	// banned users can still clean up after themselves, but nothing new
+	// they write gets ingested
+	if event.Commit.Operation != models.CommitOperationDelete && h.bans.IsBanned(event.Did, ctx) {
+		h.l.DebugContext(ctx, "ignoring record from banned user")
 		return nil
 	}
 	err := h.ensureIKnowYou(event.Did, ctx)
@@ -81,6 +302,8 @@ func (h *handler) HandleEvent(ctx context.Context, event *models.Event) error {
 		return h.handleProfile(ctx, event)
 	case "org.xcvr.feed.channel":
 		return h.handleChannel(ctx, event)
+	case "org.xcvr.feed.sub":
+		return h.handleSub(ctx, event)
 	case "org.xcvr.lrc.message":
 		return h.handleMessage(ctx, event)
 	case "org.xcvr.lrc.signet":
@@ -92,26 +315,25 @@ func (h *handler) HandleEvent(ctx context.Context, event *models.Event) error {
 }
 
 func (h *handler) handleProfile(ctx context.Context, event *models.Event) error {
-	h.l.Deprintln("handling profile")
+	h.l.DebugContext(ctx, "handling profile")
 	switch event.Commit.Operation {
 	case "create", "update":
 		return h.handleProfileCreateUpdate(ctx, event)
 	case "delete":
 		return h.handleProfileDelete(ctx, event)
 	}
-	return errors.New("unsupported commit operation")
+	return badRecord(errors.New("unsupported commit operation"))
 }
 
 func (h *handler) handleProfileCreateUpdate(ctx context.Context, event *models.Event) error {
 	var pr lex.ProfileRecord
 	err := json.Unmarshal(event.Commit.Record, &pr)
 	if err != nil {
-		h.l.Println("error unmarshaling: " + err.Error())
-		return nil
+		return badRecord(err)
 	}
 	err = h.rm.AcceptProfile(pr, event.Did, ctx)
 	if err != nil {
-		h.l.Println(err.Error())
+		return fmt.Errorf("failed to ingest: %w", err)
 	}
 	return nil
 }
@@ -119,13 +341,13 @@ func (h *handler) handleProfileCreateUpdate(ctx context.Context, event *models.E
 func (h *handler) handleProfileDelete(ctx context.Context, event *models.Event) error {
 	err := h.rm.DeleteProfile(event.Did, event.Commit.CID, ctx)
 	if err != nil {
-		h.l.Println(err.Error())
+		return fmt.Errorf("failed to ingest: %w", err)
 	}
 	return nil
 }
 
 func (h *handler) handleChannel(ctx context.Context, event *models.Event) error {
-	h.l.Deprintln("handling channel")
+	h.l.DebugContext(ctx, "handling channel")
 	switch event.Commit.Operation {
 	case "create":
 		return h.handleChannelCreate(ctx, event)
@@ -140,12 +362,11 @@ func (h *handler) handleChannel(ctx context.Context, event *models.Event) error
 func (h *handler) handleChannelCreate(ctx context.Context, event *models.Event) error {
 	channel, err := parseChannelRecord(event)
 	if err != nil {
-		h.l.Println("i couldn't create the channel: " + err.Error())
-		return nil
+		return badRecord(err)
 	}
 	err = h.rm.AcceptChannel(channel, ctx)
 	if err != nil {
-		h.l.Println(err.Error())
+		return fmt.Errorf("failed to ingest: %w", err)
 	}
 	return nil
 }
@@ -153,12 +374,11 @@ func (h *handler) handleChannelCreate(ctx context.Context, event *models.Event)
 func (h *handler) handleChannelUpdate(ctx context.Context, event *models.Event) error {
 	channel, err := parseChannelRecord(event)
 	if err != nil {
-		h.l.Println("i couldn't create the channel: " + err.Error())
-		return nil
+		return badRecord(err)
 	}
 	err = h.rm.AcceptChannelUpdate(channel, ctx)
 	if err != nil {
-		h.l.Println(err.Error())
+		return fmt.Errorf("failed to ingest: %w", err)
 	}
 	return nil
 }
@@ -167,7 +387,7 @@ func parseChannelRecord(event *models.Event) (*types.Channel, error) {
 	var cr lex.ChannelRecord
 	err := json.Unmarshal(event.Commit.Record, &cr)
 	if err != nil {
-		return nil, errors.New("error unmarshl: " + err.Error())
+		return nil, fmt.Errorf("error unmarshl: %w", err)
 	}
 	then, err := syntax.ParseDatetimeTime(cr.CreatedAt)
 	if err != nil {
@@ -188,13 +408,81 @@ func parseChannelRecord(event *models.Event) (*types.Channel, error) {
 func (h *handler) handleChannelDelete(ctx context.Context, event *models.Event) error {
 	err := h.rm.AcceptChannelDelete(URI(event), ctx)
 	if err != nil {
-		h.l.Println(err.Error())
+		return fmt.Errorf("failed to ingest: %w", err)
+	}
+	return nil
+}
+
+func (h *handler) handleSub(ctx context.Context, event *models.Event) error {
+	h.l.DebugContext(ctx, "handling sub")
+	switch event.Commit.Operation {
+	case "create":
+		return h.handleSubCreate(ctx, event)
+	case "update":
+		return h.handleSubUpdate(ctx, event)
+	case "delete":
+		return h.handleSubDelete(ctx, event)
+	}
+	return nil
+}
+
+func (h *handler) handleSubCreate(ctx context.Context, event *models.Event) error {
+	sub, err := parseSubRecord(event)
+	if err != nil {
+		return badRecord(err)
+	}
+	err = h.rm.AcceptSub(sub, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to ingest: %w", err)
+	}
+	return nil
+}
+
+func (h *handler) handleSubUpdate(ctx context.Context, event *models.Event) error {
+	sub, err := parseSubRecord(event)
+	if err != nil {
+		return badRecord(err)
+	}
+	err = h.rm.AcceptSubUpdate(sub, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to ingest: %w", err)
+	}
+	return nil
+}
+
+func (h *handler) handleSubDelete(ctx context.Context, event *models.Event) error {
+	err := h.rm.AcceptSubDelete(URI(event), ctx)
+	if err != nil {
+		return fmt.Errorf("failed to ingest: %w", err)
 	}
 	return nil
 }
 
+func parseSubRecord(event *models.Event) (*types.Sub, error) {
+	var sr lex.SubRecord
+	err := json.Unmarshal(event.Commit.Record, &sr)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshl: %w", err)
+	}
+	if sr.ChannelURI == "" {
+		return nil, errors.New("sub has no channelUri")
+	}
+	then, err := syntax.ParseDatetimeTime(sr.CreatedAt)
+	if err != nil {
+		then = time.Now()
+	}
+	sub := types.Sub{
+		URI:        URI(event),
+		CID:        event.Commit.CID,
+		DID:        event.Did,
+		ChannelURI: sr.ChannelURI,
+		CreatedAt:  then,
+	}
+	return &sub, nil
+}
+
 func (h *handler) handleMessage(ctx context.Context, event *models.Event) error {
-	h.l.Deprintln("handling message")
+	h.l.DebugContext(ctx, "handling message")
 	switch event.Commit.Operation {
 	case "create":
 		return h.handleMessageCreate(ctx, event)
@@ -203,18 +491,17 @@ func (h *handler) handleMessage(ctx context.Context, event *models.Event) error
 	case "delete":
 		return h.handleMessageDelete(ctx, event)
 	}
-	return errors.New("unimplemented Operation")
+	return badRecord(errors.New("unimplemented Operation"))
 }
 
 func (h *handler) handleMessageCreate(ctx context.Context, event *models.Event) error {
 	message, err := parseMessageRecord(event)
 	if err != nil {
-		h.l.Println("error parsing: " + err.Error())
-		return nil
+		return badRecord(err)
 	}
 	err = h.rm.AcceptMessage(message, ctx)
 	if err != nil {
-		h.l.Println(err.Error())
+		return fmt.Errorf("failed to ingest: %w", err)
 	}
 	return nil
 }
@@ -222,11 +509,11 @@ func (h *handler) handleMessageCreate(ctx context.Context, event *models.Event)
 func (h *handler) handleMessageUpdate(ctx context.Context, event *models.Event) error {
 	message, err := parseMessageRecord(event)
 	if err != nil {
-		h.l.Println("error parsing: " + err.Error())
+		return badRecord(err)
 	}
 	err = h.rm.AcceptMessageUpdate(message, event.Did, ctx)
 	if err != nil {
-		h.l.Println(err.Error())
+		return fmt.Errorf("failed to ingest: %w", err)
 	}
 	return nil
 }
@@ -234,7 +521,7 @@ func (h *handler) handleMessageUpdate(ctx context.Context, event *models.Event)
 func (h *handler) handleMessageDelete(ctx context.Context, event *models.Event) error {
 	err := h.rm.AcceptMessageDelete(URI(event), ctx)
 	if err != nil {
-		h.l.Println(err.Error())
+		return fmt.Errorf("failed to ingest: %w", err)
 	}
 	return nil
 }
@@ -243,7 +530,7 @@ func parseMessageRecord(event *models.Event) (*types.Message, error) {
 	var mr lex.MessageRecord
 	err := json.Unmarshal(event.Commit.Record, &mr)
 	if err != nil {
-		return nil, errors.New("error unmarshl: " + err.Error())
+		return nil, fmt.Errorf("error unmarshl: %w", err)
 	}
 	then, err := syntax.ParseDatetimeTime(mr.PostedAt)
 	if err != nil {
@@ -268,7 +555,7 @@ func parseMessageRecord(event *models.Event) (*types.Message, error) {
 }
 
 func (h *handler) handleSignet(ctx context.Context, event *models.Event) error {
-	h.l.Deprintln("handling signet")
+	h.l.DebugContext(ctx, "handling signet")
 	switch event.Commit.Operation {
 	case "create":
 		return h.handleSignetCreate(ctx, event)
@@ -277,18 +564,17 @@ func (h *handler) handleSignet(ctx context.Context, event *models.Event) error {
 	case "delete":
 		return h.handleSignetDelete(ctx, event)
 	}
-	return errors.New("unimplemented Operation")
+	return badRecord(errors.New("unimplemented Operation"))
 }
 
 func (h *handler) handleSignetCreate(ctx context.Context, event *models.Event) error {
 	signet, err := parseSignetRecord(event)
 	if err != nil {
-		h.l.Println("failed to parse: " + err.Error())
-		return nil
+		return badRecord(err)
 	}
 	err = h.rm.AcceptSignet(signet, ctx)
 	if err != nil {
-		h.l.Println(err.Error())
+		return fmt.Errorf("failed to ingest: %w", err)
 	}
 	return nil
 }
@@ -296,19 +582,18 @@ func (h *handler) handleSignetCreate(ctx context.Context, event *models.Event) e
 func (h *handler) handleSignetUpdate(ctx context.Context, event *models.Event) error {
 	signet, err := parseSignetRecord(event)
 	if err != nil {
-		h.l.Println("failed to parse: " + err.Error())
-		return nil
+		return badRecord(err)
 	}
 	err = h.rm.AcceptSignetUpdate(signet, ctx)
 	if err != nil {
-		h.l.Println(err.Error())
+		return fmt.Errorf("failed to ingest: %w", err)
 	}
 	return nil
 }
 func (h *handler) handleSignetDelete(ctx context.Context, event *models.Event) error {
 	err := h.rm.AcceptSignetDelete(URI(event), ctx)
 	if err != nil {
-		h.l.Println(err.Error())
+		return fmt.Errorf("failed to ingest: %w", err)
 	}
 	return nil
 }
@@ -317,7 +602,7 @@ func parseSignetRecord(event *models.Event) (*types.Signet, error) {
 	var sr lex.SignetRecord
 	err := json.Unmarshal(event.Commit.Record, &sr)
 	if err != nil {
-		return nil, errors.New("error unmarshl: " + err.Error())
+		return nil, fmt.Errorf("error unmarshl: %w", err)
 	}
 	var then time.Time
 	if sr.StartedAt != nil {
@@ -342,7 +627,7 @@ func parseSignetRecord(event *models.Event) (*types.Signet, error) {
 }
 
 func (h *handler) handleMedia(ctx context.Context, event *models.Event) error {
-	h.l.Deprintln("handling media")
+	h.l.DebugContext(ctx, "handling media")
 	switch event.Commit.Operation {
 	case "create":
 		return h.handleMediaCreate(ctx, event)
@@ -351,25 +636,33 @@ func (h *handler) handleMedia(ctx context.Context, event *models.Event) error {
 	case "delete":
 		return h.handleMediaDelete(ctx, event)
 	}
-	return errors.New("unimplemented Operation")
+	return badRecord(errors.New("unimplemented Operation"))
 }
 
 func (h *handler) handleMediaCreate(ctx context.Context, event *models.Event) error {
 	mr, err := parseMediaRecord(event)
 	if err != nil {
-		h.l.Deprintln(err.Error())
-		return nil
+		return badRecord(err)
 	}
 	if mr.Image != nil {
 		image, err := wrangeMediaRecordIntoImage(event, mr)
 		if err != nil {
-			h.l.Deprintln(err.Error())
-			return nil
+			return badRecord(err)
 		}
 		err = h.rm.AcceptImage(image, ctx)
 		if err != nil {
-			h.l.Deprintln(err.Error())
-			return nil
+			return fmt.Errorf("failed to ingest: %w", err)
+		}
+		return nil
+	}
+	if mr.Video != nil {
+		video, err := wrangeMediaRecordIntoVideo(event, mr)
+		if err != nil {
+			return badRecord(err)
+		}
+		err = h.rm.AcceptVideo(video, ctx)
+		if err != nil {
+			return fmt.Errorf("failed to ingest: %w", err)
 		}
 		return nil
 	}
@@ -379,52 +672,48 @@ func (h *handler) handleMediaCreate(ctx context.Context, event *models.Event) er
 func (h *handler) handleMediaUpdate(ctx context.Context, event *models.Event) error {
 	mr, err := parseMediaRecord(event)
 	if err != nil {
-		h.l.Deprintln(err.Error())
-		return nil
+		return badRecord(err)
 	}
 	if mr.Image != nil {
 		image, err := wrangeMediaRecordIntoImage(event, mr)
 		if err != nil {
-			h.l.Deprintln(err.Error())
-			return nil
+			return badRecord(err)
 		}
 		err = h.rm.AcceptImageUpdate(image, ctx)
 		if err != nil {
-			h.l.Deprintln(err.Error())
-			return nil
+			return fmt.Errorf("failed to ingest: %w", err)
 		}
 		return nil
 	}
-	return nil
-}
-
-func (h *handler) handleMediaDelete(ctx context.Context, event *models.Event) error {
-	mr, err := parseMediaRecord(event)
-	if err != nil {
-		h.l.Deprintln(err.Error())
-		return nil
-	}
-	if mr.Image != nil {
-		image, err := wrangeMediaRecordIntoImage(event, mr)
+	if mr.Video != nil {
+		video, err := wrangeMediaRecordIntoVideo(event, mr)
 		if err != nil {
-			h.l.Deprintln(err.Error())
-			return nil
+			return badRecord(err)
 		}
-		err = h.rm.AcceptImageDelete(image, ctx)
+		err = h.rm.AcceptVideoUpdate(video, ctx)
 		if err != nil {
-			h.l.Deprintln(err.Error())
-			return nil
+			return fmt.Errorf("failed to ingest: %w", err)
 		}
 		return nil
 	}
 	return nil
 }
 
+// handleMediaDelete only has the uri to go on, since deletes don't carry the
+// record that was deleted
+func (h *handler) handleMediaDelete(ctx context.Context, event *models.Event) error {
+	err := h.rm.AcceptMediaDelete(URI(event), ctx)
+	if err != nil {
+		return fmt.Errorf("failed to ingest: %w", err)
+	}
+	return nil
+}
+
 func parseMediaRecord(event *models.Event) (*lex.MediaRecord, error) {
 	var mr lex.MediaRecord
 	err := json.Unmarshal(event.Commit.Record, &mr)
 	if err != nil {
-		return nil, errors.New("error unmarshl: " + err.Error())
+		return nil, fmt.Errorf("error unmarshl: %w", err)
 	}
 	return &mr, nil
 }
@@ -475,6 +764,58 @@ func wrangeMediaRecordIntoImage(event *models.Event, mr *lex.MediaRecord) (*type
 
 }
 
+func wrangeMediaRecordIntoVideo(event *models.Event, mr *lex.MediaRecord) (*types.Video, error) {
+	if mr.Video == nil {
+		return nil, errors.New("video should be non nil")
+	}
+	then, err := syntax.ParseDatetimeTime(mr.PostedAt)
+	if err != nil {
+		then = time.Now()
+	}
+	var color *uint32
+	if mr.Color != nil {
+		c := uint32(*mr.Color)
+		color = &c
+	}
+	var blobcid *string
+	var blobmime *string
+	if mr.Video.Blob != nil {
+		bcid := mr.Video.Blob.Ref.String()
+		bmime := mr.Video.Blob.MimeType
+		blobcid = &bcid
+		blobmime = &bmime
+	}
+	var width, height *int64
+	if mr.Video.AspectRatio != nil {
+		w := mr.Video.AspectRatio.Width
+		h := mr.Video.AspectRatio.Height
+		width = &w
+		height = &h
+	}
+	video := types.Video{
+		URI:       URI(event),
+		DID:       event.Did,
+		SignetURI: mr.SignetURI,
+		BlobCID:   blobcid,
+		BlobMIME:  blobmime,
+		Alt:       mr.Video.Alt,
+		Nick:      mr.Nick,
+		Color:     color,
+		CID:       event.Commit.CID,
+		Width:     width,
+		Height:    height,
+		PostedAt:  then,
+	}
+	return &video, nil
+}
+
+func (h *handler) markHandled(event *models.Event) {
+	h.lastTimeUS.Store(event.TimeUS)
+	lag := time.Now().UnixMicro() - event.TimeUS
+	h.lagUS.Store(lag)
+	metrics.JetstreamLag.Set((time.Duration(lag) * time.Microsecond).Seconds())
+}
+
 func URI(event *models.Event) string {
 	return atputils.URI(event.Did, event.Commit.Collection, event.Commit.RKey)
 }
@@ -484,11 +825,11 @@ func (h *handler) ensureIKnowYou(did string, ctx context.Context) error {
 	if err != nil {
 		handle, err := atputils.TryLookupDid(ctx, did)
 		if err != nil {
-			return errors.New("failed to lookup previously unknown user: " + err.Error())
+			return fmt.Errorf("failed to lookup previously unknown user: %w", err)
 		}
 		err = h.db.StoreDidHandle(did, handle, ctx)
 		if err != nil {
-			return errors.New("failed to store did_handle for a previously unknown user")
+			return fmt.Errorf("failed to store did_handle for a previously unknown user: %w", err)
 		}
 	}
 	return nil
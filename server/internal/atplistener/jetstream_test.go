@@ -0,0 +1,158 @@
+package atplistener
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"rvcx/internal/banpolicy"
+	"rvcx/internal/config"
+	"rvcx/internal/lex"
+	"rvcx/internal/log"
+	"rvcx/internal/memstore"
+	"rvcx/internal/model"
+	"rvcx/internal/recordmanager"
+	"rvcx/internal/types"
+	"testing"
+
+	"github.com/bluesky-social/jetstream/pkg/models"
+)
+
+const (
+	testChannel = "at://did:plc:there/org.xcvr.feed.channel/a"
+	testSignet  = "at://did:plc:there/org.xcvr.lrc.signet/s"
+)
+
+func newTestHandler(t *testing.T) (*handler, *memstore.Store) {
+	t.Helper()
+	cfg := &config.Config{DID: "did:plc:here", Identity: "here.test"}
+	s := memstore.New(cfg)
+	ctx := context.Background()
+	_, err := s.StoreChannel(&types.Channel{URI: testChannel, Host: "did:plc:there"}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// so that nothing goes looking for them over the network
+	for did, handle := range map[string]string{"did:plc:alice": "alice.test", "did:plc:there": "there.test"} {
+		err = s.StoreDidHandle(did, handle, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.InitializeProfile("did:plc:alice", nil, nil, nil, nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New(io.Discard, false)
+	bans := banpolicy.New(s, logger)
+	rm := recordmanager.New(cfg, logger, s, nil, nil, bans, nil)
+	rm.SetBroadcaster(model.Init(cfg, s, logger, nil, rm, bans))
+	return &handler{db: s, rm: rm, l: logger, bans: bans}, s
+}
+
+func event(t *testing.T, timeUS int64, did string, collection string, rkey string, record any) *models.Event {
+	t.Helper()
+	raw, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &models.Event{
+		Did:    did,
+		TimeUS: timeUS,
+		Kind:   models.EventKindCommit,
+		Commit: &models.Commit{
+			Operation:  models.CommitOperationCreate,
+			Collection: collection,
+			RKey:       rkey,
+			Record:     raw,
+			CID:        rkey,
+		},
+	}
+}
+
+func messageEvent(t *testing.T, timeUS int64, rkey string, signetURI string) *models.Event {
+	return event(t, timeUS, "did:plc:alice", "org.xcvr.lrc.message", rkey, lex.MessageRecord{SignetURI: signetURI, Body: "hi"})
+}
+
+func signetEvent(t *testing.T, timeUS int64) *models.Event {
+	handle := "alice.test"
+	return event(t, timeUS, "did:plc:there", "org.xcvr.lrc.signet", "s", lex.SignetRecord{ChannelURI: testChannel, LRCID: 1, Author: "did:plc:alice", AuthorHandle: &handle})
+}
+
+func handle(t *testing.T, h *handler, e *models.Event) {
+	t.Helper()
+	err := h.HandleEvent(context.Background(), e)
+	if err != nil {
+		t.Fatalf("HandleEvent returned %s, which would hang up on jetstream", err)
+	}
+}
+
+// a message that shows up before its signet fails, and until it's retried
+// the cursor can't move past it, or a restart would lose it for good
+func TestFailedEventsHoldTheCursor(t *testing.T) {
+	h, s := newTestHandler(t)
+	handle(t, h, messageEvent(t, 100, "m", testSignet))
+	if got := h.cursor(); got != 0 {
+		t.Errorf("cursor is %d with nothing handled before the failure", got)
+	}
+	// a bad record is never going to work, so it isn't held onto
+	handle(t, h, event(t, 200, "did:plc:alice", "org.xcvr.feed.channel", "bad", "not a channel"))
+	if got := h.cursor(); got != 100 {
+		t.Errorf("cursor is %d, want it held at the failed message", got)
+	}
+	handle(t, h, signetEvent(t, 300))
+	if got := h.cursor(); got != 100 {
+		t.Errorf("cursor is %d, want it held at the failed message", got)
+	}
+
+	h.retryFailed(context.Background())
+	if got := h.cursor(); got != 300 {
+		t.Errorf("cursor is %d after the retry went through, want 300", got)
+	}
+	msgs, err := s.GetMessages(testChannel, 10, nil, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Errorf("got %d messages after retrying, want the one that came early", len(msgs))
+	}
+}
+
+func TestFailedEventsAreGivenUpOn(t *testing.T) {
+	h, _ := newTestHandler(t)
+	handle(t, h, messageEvent(t, 100, "m", "at://did:plc:there/org.xcvr.lrc.signet/never"))
+	handle(t, h, signetEvent(t, 200))
+	for range maxEventAttempts - 1 {
+		if got := h.cursor(); got != 100 {
+			t.Fatalf("cursor is %d, want it held at the failed message", got)
+		}
+		h.retryFailed(context.Background())
+	}
+	if got := h.cursor(); got != 200 {
+		t.Errorf("cursor is %d after giving up, want 200", got)
+	}
+}
+
+// a newer event for the same record wins over an older one being retried
+func TestNewerEventsSupersedeFailedOnes(t *testing.T) {
+	h, _ := newTestHandler(t)
+	handle(t, h, messageEvent(t, 100, "m", testSignet))
+	handle(t, h, signetEvent(t, 200))
+	handle(t, h, messageEvent(t, 300, "m", testSignet))
+	if got := h.cursor(); got != 300 {
+		t.Errorf("cursor is %d, want nothing held", got)
+	}
+}
+
+// backfill counts what it couldn't ingest, so HandleRecord has to say
+func TestHandleRecordReturnsErrors(t *testing.T) {
+	h, _ := newTestHandler(t)
+	c := &Consumer{handler: h, logger: h.l}
+	err := c.HandleRecord(context.Background(), "did:plc:alice", "org.xcvr.lrc.message", "m", "cid", json.RawMessage(`{"signetURI":"`+testSignet+`","body":"hi"}`))
+	if err == nil {
+		t.Error("ingested a message whose signet doesn't exist")
+	}
+	err = c.HandleRecord(context.Background(), "did:plc:alice", "org.xcvr.feed.channel", "c", "cid", json.RawMessage(`"nope"`))
+	if err == nil {
+		t.Error("ingested a channel that isn't one")
+	}
+}
@@ -9,45 +9,18 @@ import (
 	"github.com/bluesky-social/indigo/atproto/syntax"
 	"io"
 	"net/http"
-	"os"
 	"strings"
 )
 
-var (
-	my_handle *string
-	my_did    *string
-)
-
-func GetMyHandle() string {
-	if my_handle != nil {
-		return *my_handle
-	}
-	handle := os.Getenv("MY_IDENTITY")
-	my_handle = &handle
-	return *my_handle
-}
-
-func GetMyDid() string {
-	if my_did != nil {
-		return *my_did
-	}
-	if my_handle == nil {
-		GetMyHandle()
-	}
-	did := os.Getenv("MY_DID")
-	my_did = &did
-	return did
-}
-
 func TryLookupHandle(ctx context.Context, handle string) (did string, err error) {
 	hdl, err := syntax.ParseHandle(handle)
 	if err != nil {
-		err = errors.New("handle failed to parse: " + err.Error())
+		err = fmt.Errorf("handle failed to parse: %w", err)
 		return
 	}
 	id, err := identity.DefaultDirectory().LookupHandle(ctx, hdl)
 	if err != nil {
-		err = errors.New("handle failed to loopup: " + err.Error())
+		err = fmt.Errorf("handle failed to loopup: %w", err)
 		return
 	}
 	did = id.DID.String()
@@ -57,12 +30,12 @@ func TryLookupHandle(ctx context.Context, handle string) (did string, err error)
 func TryLookupDid(ctx context.Context, did string) (handle string, err error) {
 	d, err := syntax.ParseDID(did)
 	if err != nil {
-		err = errors.New("did failed to parse: " + err.Error())
+		err = fmt.Errorf("did failed to parse: %w", err)
 		return
 	}
 	id, err := identity.DefaultDirectory().LookupDID(ctx, d)
 	if err != nil {
-		err = errors.New("did failed to lookup: " + err.Error())
+		err = fmt.Errorf("did failed to lookup: %w", err)
 		return
 	}
 	handle = id.Handle.String()
@@ -72,13 +45,13 @@ func TryLookupDid(ctx context.Context, did string) (handle string, err error) {
 func GetHandleFromDid(ctx context.Context, did string) (string, error) {
 	sdid, err := syntax.ParseDID(did)
 	if err != nil {
-		return "", errors.New("did did not parse: " + err.Error())
+		return "", fmt.Errorf("did did not parse: %w", err)
 	}
 	resolver := identity.DefaultDirectory()
 
 	ident, err := resolver.LookupDID(ctx, sdid)
 	if err != nil {
-		return "", errors.New("failed to lookupDID: " + err.Error())
+		return "", fmt.Errorf("failed to lookupDID: %w", err)
 	}
 	return ident.Handle.String(), nil
 }
@@ -86,12 +59,12 @@ func GetHandleFromDid(ctx context.Context, did string) (string, error) {
 func GetDidFromHandle(ctx context.Context, handle string) (string, error) {
 	shandle, err := syntax.ParseHandle(handle)
 	if err != nil {
-		return "", errors.New("handle did not parse: " + err.Error())
+		return "", fmt.Errorf("handle did not parse: %w", err)
 	}
 	resolver := identity.DefaultDirectory()
 	ident, err := resolver.LookupHandle(ctx, shandle)
 	if err != nil {
-		return "", errors.New("failed to lookupHandle: " + err.Error())
+		return "", fmt.Errorf("failed to lookupHandle: %w", err)
 	}
 	return ident.DID.String(), nil
 }
@@ -99,12 +72,18 @@ func GetDidFromHandle(ctx context.Context, handle string) (string, error) {
 func GetPDSFromHandle(ctx context.Context, handle string) (string, error) {
 	did, err := GetDidFromHandle(ctx, handle)
 	if err != nil {
-		return "", errors.New("failed to find did from handle in handle->pds: " + err.Error())
+		return "", fmt.Errorf("failed to find did from handle in handle->pds: %w", err)
 	}
 	return GetPDSFromDid(ctx, did, http.DefaultClient)
 }
 
 func GetPDSFromDid(ctx context.Context, did string, cli *http.Client) (string, error) {
+	return GetServiceFromDid(ctx, did, "#atproto_pds", cli)
+}
+
+// GetServiceFromDid finds the endpoint of the service with the given id, like
+// #atproto_pds, in a did's did document
+func GetServiceFromDid(ctx context.Context, did string, id string, cli *http.Client) (string, error) {
 	type Identity struct {
 		Service []struct {
 			ID              string `json:"id"`
@@ -122,11 +101,11 @@ func GetPDSFromDid(ctx context.Context, did string, cli *http.Client) (string, e
 	}
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return "", errors.New("error crafting request:" + err.Error())
+		return "", fmt.Errorf("error crafting request:%w", err)
 	}
 	resp, err := cli.Do(req)
 	if err != nil {
-		return "", errors.New("error evaluating request:" + err.Error())
+		return "", fmt.Errorf("error evaluating request:%w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
@@ -134,21 +113,21 @@ func GetPDSFromDid(ctx context.Context, did string, cli *http.Client) (string, e
 	}
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", errors.New("error reading response body:" + err.Error())
+		return "", fmt.Errorf("error reading response body:%w", err)
 	}
 	var identity Identity
 	err = json.Unmarshal(b, &identity)
 	if err != nil {
-		return "", errors.New("error unmarshaling to identity:" + err.Error())
+		return "", fmt.Errorf("error unmarshaling to identity:%w", err)
 	}
 	var service *string
 	for _, svc := range identity.Service {
-		if svc.ID == "#atproto_pds" {
+		if svc.ID == id || svc.ID == did+id {
 			service = &svc.ServiceEndpoint
 		}
 	}
 	if service == nil {
-		return "", errors.New("could not find atproto_pds service in resolved did's services")
+		return "", fmt.Errorf("could not find %s service in resolved did's services", id)
 	}
 	return *service, nil
 }
@@ -51,3 +51,16 @@ func RkeyFromUri(uri string) (rkey string, err error) {
 	rkey = ss[2]
 	return
 }
+
+func CollectionFromUri(uri string) (collection string, err error) {
+	s, err := trimScheme(uri)
+	if err != nil {
+		return
+	}
+	ss, err := uriFragSplit(s)
+	if err != nil {
+		return
+	}
+	collection = ss[1]
+	return
+}
@@ -0,0 +1,155 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"rvcx/internal/atputils"
+	"rvcx/internal/log"
+
+	"github.com/bluesky-social/indigo/atproto/client"
+)
+
+// Collections is every org.xcvr collection we know how to ingest, in the
+// order they have to be ingested in. signets point at channels, and messages
+// and media point at signets, so a channel has to be stored before anything
+// that happened in it
+var Collections = []string{
+	"org.xcvr.actor.profile",
+	"org.xcvr.feed.channel",
+	"org.xcvr.feed.sub",
+	"org.xcvr.lrc.signet",
+	"org.xcvr.lrc.message",
+	"org.xcvr.lrc.media",
+}
+
+const pageSize = 100
+
+type RecordHandler interface {
+	HandleRecord(ctx context.Context, did string, collection string, rkey string, cid string, record json.RawMessage) error
+}
+
+type Backfiller struct {
+	logger     *log.Logger
+	rh         RecordHandler
+	httpClient *http.Client
+	resolvePDS func(ctx context.Context, did string) (string, error)
+}
+
+func New(rh RecordHandler, l *log.Logger) *Backfiller {
+	b := &Backfiller{
+		logger:     l,
+		rh:         rh,
+		httpClient: http.DefaultClient,
+	}
+	b.resolvePDS = func(ctx context.Context, did string) (string, error) {
+		return atputils.GetPDSFromDid(ctx, did, b.httpClient)
+	}
+	return b
+}
+
+// SetPDSResolver overrides how a did gets mapped to the host of its repo,
+// which is mostly useful for pointing the backfiller at a fake pds
+func (b *Backfiller) SetPDSResolver(f func(ctx context.Context, did string) (string, error)) {
+	b.resolvePDS = f
+}
+
+func (b *Backfiller) SetHTTPClient(c *http.Client) {
+	b.httpClient = c
+}
+
+type Stats struct {
+	Repos   int
+	Records int
+	Failed  int
+}
+
+// BackfillRepo crawls a single repo. it is safe to run repeatedly, since
+// everything that was already ingested just gets ignored
+func (b *Backfiller) BackfillRepo(ctx context.Context, did string) (*Stats, error) {
+	return b.BackfillRepos(ctx, []string{did})
+}
+
+// BackfillRepos crawls every org.xcvr collection of every did. it goes
+// collection by collection rather than repo by repo, since messages in one
+// repo point at signets that live in another
+func (b *Backfiller) BackfillRepos(ctx context.Context, dids []string) (*Stats, error) {
+	stats := &Stats{}
+	hosts := make(map[string]string, len(dids))
+	for _, did := range dids {
+		host, err := b.resolvePDS(ctx, did)
+		if err != nil {
+			b.logger.WarnContext(ctx, "skipping repo, couldn't find its pds", "did", did, "err", err)
+			continue
+		}
+		hosts[did] = host
+	}
+	stats.Repos = len(hosts)
+	for _, collection := range Collections {
+		for _, did := range dids {
+			host, ok := hosts[did]
+			if !ok {
+				continue
+			}
+			err := b.backfillCollection(ctx, host, did, collection, stats)
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					return stats, err
+				}
+				b.logger.ErrorContext(ctx, "failed to backfill", "collection", collection, "did", did, "err", err)
+			}
+		}
+	}
+	return stats, nil
+}
+
+type listRecordsOut struct {
+	Cursor  *string `json:"cursor,omitempty"`
+	Records []struct {
+		URI   string          `json:"uri"`
+		CID   string          `json:"cid"`
+		Value json.RawMessage `json:"value"`
+	} `json:"records"`
+}
+
+func (b *Backfiller) backfillCollection(ctx context.Context, host string, did string, collection string, stats *Stats) error {
+	c := client.NewAPIClient(host)
+	c.Client = b.httpClient
+	cursor := ""
+	for {
+		params := map[string]any{
+			"repo":       did,
+			"collection": collection,
+			"limit":      pageSize,
+		}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+		var out listRecordsOut
+		err := c.LexDo(ctx, "GET", "", "com.atproto.repo.listRecords", params, nil, &out)
+		if err != nil {
+			return fmt.Errorf("failed to list records: %w", err)
+		}
+		for _, rec := range out.Records {
+			rkey, err := atputils.RkeyFromUri(rec.URI)
+			if err != nil {
+				b.logger.DebugContext(ctx, "got a weird uri", "uri", rec.URI, "err", err)
+				stats.Failed += 1
+				continue
+			}
+			err = b.rh.HandleRecord(ctx, did, collection, rkey, rec.CID, rec.Value)
+			if err != nil {
+				b.logger.DebugContext(ctx, "failed to handle record", "uri", rec.URI, "err", err)
+				stats.Failed += 1
+				continue
+			}
+			stats.Records += 1
+		}
+		if out.Cursor == nil || *out.Cursor == "" || len(out.Records) == 0 {
+			return nil
+		}
+		cursor = *out.Cursor
+	}
+}
@@ -0,0 +1,244 @@
+package backfill
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"rvcx/internal/atplistener"
+	"rvcx/internal/banpolicy"
+	"rvcx/internal/config"
+	"rvcx/internal/log"
+	"rvcx/internal/memstore"
+	"rvcx/internal/recordmanager"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakePDS serves listRecords out of repos, which maps a did to its
+// collections to their records' rkeys, a page at a time. records are {}
+// unless they're in values, by rkey
+type fakePDS struct {
+	repos    map[string]map[string][]string
+	values   map[string]string
+	pageSize int
+	broken   string
+}
+
+func (p *fakePDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/xrpc/com.atproto.repo.listRecords" {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	did, collection := q.Get("repo"), q.Get("collection")
+	if collection == p.broken {
+		http.Error(w, `{"error":"InternalServerError"}`, http.StatusInternalServerError)
+		return
+	}
+	start, _ := strconv.Atoi(q.Get("cursor"))
+	rkeys := p.repos[did][collection]
+	end := min(start+p.pageSize, len(rkeys))
+	var out listRecordsOut
+	for _, rkey := range rkeys[start:end] {
+		uri := fmt.Sprintf("at://%s/%s/%s", did, collection, rkey)
+		if rkey == "weird" {
+			uri = "weird"
+		}
+		value, ok := p.values[rkey]
+		if !ok {
+			value = `{}`
+		}
+		out.Records = append(out.Records, struct {
+			URI   string          `json:"uri"`
+			CID   string          `json:"cid"`
+			Value json.RawMessage `json:"value"`
+		}{uri, "cid", json.RawMessage(value)})
+	}
+	if end < len(rkeys) {
+		cursor := strconv.Itoa(end)
+		out.Cursor = &cursor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+type recorder struct {
+	mu      sync.Mutex
+	handled []string
+	reject  string
+}
+
+func (r *recorder) HandleRecord(ctx context.Context, did string, collection string, rkey string, cid string, record json.RawMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rkey == r.reject {
+		return errors.New("no thanks")
+	}
+	r.handled = append(r.handled, did+" "+collection+" "+rkey)
+	return nil
+}
+
+func newTestBackfiller(t *testing.T, pds *fakePDS) (*Backfiller, *recorder) {
+	t.Helper()
+	rh := &recorder{}
+	return newTestBackfillerWith(t, pds, rh), rh
+}
+
+func newTestBackfillerWith(t *testing.T, pds *fakePDS, rh RecordHandler) *Backfiller {
+	t.Helper()
+	srv := httptest.NewServer(pds)
+	t.Cleanup(srv.Close)
+	b := New(rh, log.New(io.Discard, false))
+	b.SetHTTPClient(srv.Client())
+	b.SetPDSResolver(func(ctx context.Context, did string) (string, error) {
+		if _, ok := pds.repos[did]; !ok {
+			return "", errors.New("no such did")
+		}
+		return srv.URL, nil
+	})
+	return b
+}
+
+// messages in alice's repo hang off of signets in the host's repo, so every
+// repo's signets have to be in before anyone's messages
+func TestBackfillRepos(t *testing.T) {
+	pds := &fakePDS{
+		pageSize: 2,
+		repos: map[string]map[string][]string{
+			"did:plc:alice": {
+				"org.xcvr.lrc.message":   {"m1", "m2", "m3"},
+				"org.xcvr.actor.profile": {"self"},
+			},
+			"did:plc:host": {
+				"org.xcvr.lrc.signet":   {"s1", "s2"},
+				"org.xcvr.feed.channel": {"c"},
+			},
+		},
+	}
+	b, rh := newTestBackfiller(t, pds)
+	stats, err := b.BackfillRepos(context.Background(), []string{"did:plc:alice", "did:plc:nobody", "did:plc:host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"did:plc:alice org.xcvr.actor.profile self",
+		"did:plc:host org.xcvr.feed.channel c",
+		"did:plc:host org.xcvr.lrc.signet s1",
+		"did:plc:host org.xcvr.lrc.signet s2",
+		"did:plc:alice org.xcvr.lrc.message m1",
+		"did:plc:alice org.xcvr.lrc.message m2",
+		"did:plc:alice org.xcvr.lrc.message m3",
+	}
+	if !slices.Equal(rh.handled, want) {
+		t.Errorf("handled\n%v\nwant\n%v", rh.handled, want)
+	}
+	if *stats != (Stats{Repos: 2, Records: 7}) {
+		t.Errorf("got %+v", *stats)
+	}
+}
+
+// one bad record, or one collection the pds won't list, doesn't stop the rest
+func TestBackfillRepoCarriesOn(t *testing.T) {
+	pds := &fakePDS{
+		pageSize: 10,
+		broken:   "org.xcvr.feed.sub",
+		repos: map[string]map[string][]string{
+			"did:plc:alice": {
+				"org.xcvr.feed.channel": {"a", "weird", "bad", "b"},
+				"org.xcvr.feed.sub":     {"s"},
+				"org.xcvr.lrc.signet":   {"c"},
+			},
+		},
+	}
+	b, rh := newTestBackfiller(t, pds)
+	rh.reject = "bad"
+	stats, err := b.BackfillRepo(context.Background(), "did:plc:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"did:plc:alice org.xcvr.feed.channel a",
+		"did:plc:alice org.xcvr.feed.channel b",
+		"did:plc:alice org.xcvr.lrc.signet c",
+	}
+	if !slices.Equal(rh.handled, want) {
+		t.Errorf("handled\n%v\nwant\n%v", rh.handled, want)
+	}
+	if *stats != (Stats{Repos: 1, Records: 3, Failed: 2}) {
+		t.Errorf("got %+v", *stats)
+	}
+}
+
+func TestBackfillRepoStopsWhenCanceled(t *testing.T) {
+	pds := &fakePDS{
+		pageSize: 10,
+		repos: map[string]map[string][]string{
+			"did:plc:alice": {"org.xcvr.feed.channel": {"a"}},
+		},
+	}
+	b, rh := newTestBackfiller(t, pds)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := b.BackfillRepo(ctx, "did:plc:alice")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if len(rh.handled) != 0 {
+		t.Errorf("handled %v after being canceled", rh.handled)
+	}
+}
+
+// records are ingested the way the running server would, minus telling
+// anyone, and the ones that couldn't be are counted as failed rather than
+// backfilled
+func TestBackfillIntoStore(t *testing.T) {
+	cfg := &config.Config{DID: "did:plc:here", Identity: "here.test"}
+	s := memstore.New(cfg)
+	ctx := context.Background()
+	for did, handle := range map[string]string{"did:plc:alice": "alice.test", "did:plc:host": "host.test"} {
+		err := s.StoreDidHandle(did, handle, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger := log.New(io.Discard, false)
+	bans := banpolicy.New(s, logger)
+	rm := recordmanager.New(cfg, logger, s, nil, nil, bans, nil)
+	consumer := atplistener.NewConsumer("", 0, logger, s, nil, rm, bans)
+	channel := "at://did:plc:host/org.xcvr.feed.channel/c"
+	pds := &fakePDS{
+		pageSize: 10,
+		repos: map[string]map[string][]string{
+			"did:plc:host": {
+				"org.xcvr.feed.channel": {"c"},
+				"org.xcvr.lrc.signet":   {"s", "lost"},
+			},
+		},
+		values: map[string]string{
+			"c":    `{"title":"c","host":"did:plc:host","createdAt":"2025-01-01T00:00:00Z"}`,
+			"s":    `{"channelURI":"` + channel + `","lrcID":1,"author":"did:plc:alice"}`,
+			"lost": `{"channelURI":"at://did:plc:host/org.xcvr.feed.channel/gone","lrcID":2,"author":"did:plc:alice"}`,
+		},
+	}
+	b := newTestBackfillerWith(t, pds, consumer)
+	stats, err := b.BackfillRepo(ctx, "did:plc:host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stats != (Stats{Repos: 1, Records: 2, Failed: 1}) {
+		t.Errorf("got %+v, want the signet in a channel we don't have counted as failed", *stats)
+	}
+	uris, err := s.GetChannelURIs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uris) != 1 || uris[0].URI != channel {
+		t.Errorf("got channels %+v", uris)
+	}
+}
@@ -0,0 +1,91 @@
+package banpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rvcx/internal/log"
+	"rvcx/internal/store"
+	"rvcx/internal/types"
+	"sync"
+	"time"
+)
+
+// cacheFor is how long we trust a lookup before asking the db again. bans
+// made through this backend invalidate the cache straight away, so this only
+// matters for bans inserted by hand
+const cacheFor = time.Minute
+
+// Policy is the one place that decides whether a did is banned. it sits in
+// front of the bans table so that hot paths, like every jetstream event, don't
+// each cost a query
+type Policy struct {
+	store  store.Store
+	logger *log.Logger
+	mu     sync.Mutex
+	cache  map[string]entry
+}
+
+type entry struct {
+	ban     *types.Ban
+	expires time.Time
+}
+
+func New(store store.Store, l *log.Logger) *Policy {
+	return &Policy{
+		store:  store,
+		logger: l,
+		cache:  make(map[string]entry),
+	}
+}
+
+// Ban returns the ban that applies to did right now, or nil if there isn't
+// one. time limited bans stop applying once their till has passed
+func (p *Policy) Ban(did string, ctx context.Context) (*types.Ban, error) {
+	if p == nil || did == "" {
+		return nil, nil
+	}
+	now := time.Now()
+	p.mu.Lock()
+	e, ok := p.cache[did]
+	p.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.ban, nil
+	}
+	ban, err := p.store.GetActiveBan(did, ctx)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			return nil, fmt.Errorf("failed to check ban: %w", err)
+		}
+		ban = nil
+	}
+	expires := now.Add(cacheFor)
+	if ban != nil && ban.Till != nil && ban.Till.Before(expires) {
+		expires = *ban.Till
+	}
+	p.mu.Lock()
+	p.cache[did] = entry{ban, expires}
+	p.mu.Unlock()
+	return ban, nil
+}
+
+// IsBanned reports whether did is banned. if we can't tell, we err on the side
+// of letting them through, and log it
+func (p *Policy) IsBanned(did string, ctx context.Context) bool {
+	ban, err := p.Ban(did, ctx)
+	if err != nil {
+		p.logger.WarnContext(ctx, "couldn't tell if someone is banned, letting them through", "did", did, "err", err)
+		return false
+	}
+	return ban != nil
+}
+
+// Invalidate forgets what we know about did, call it after changing its bans
+func (p *Policy) Invalidate(did string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	delete(p.cache, did)
+	p.mu.Unlock()
+}
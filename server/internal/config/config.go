@@ -0,0 +1,378 @@
+// Package config reads everything rvcx can be configured with into one place
+// at startup, so that nothing else has to go digging through the environment
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"os"
+	"rvcx/internal/log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/joho/godotenv"
+)
+
+const (
+	DefaultEnvFile         = "../.env"
+	DefaultListenAddr      = ":8080"
+	DefaultMetricsAddr     = "localhost:9091"
+	DefaultPostgresHost    = "localhost"
+	DefaultJetstreamAddr   = "wss://jetstream2.us-east.bsky.network/subscribe"
+	DefaultMaxRewind       = 24 * time.Hour
+	DefaultLexStreamBuffer = 64
+	DefaultFederationMode  = "proxy"
+	DefaultMediaCacheDir   = "./uploads"
+	DefaultMediaCacheBytes = 1 << 30
+	DefaultShutdownTimeout = 15 * time.Second
+	DefaultLogLevel        = slog.LevelDebug
+	DefaultLogFormat       = log.FormatText
+)
+
+type Config struct {
+	// Identity is the backend's hostname, which is also the handle of its
+	// repo
+	Identity string
+	// DID is the did of the backend's repo, channels hosted here have it as
+	// their host
+	DID string
+	// Secret is the app password for the backend's repo
+	Secret string
+
+	Name          string
+	MetadataPath  string
+	TOSPath       string
+	PolicyPath    string
+	LogoPath      string
+	OAuthCallback string
+	JWKSPath      string
+
+	ClientSecretKey   string
+	ClientSecretKeyID string
+	SessionKey        string
+	LrcdSecret        string
+
+	// AdminDID is the did of whoever gets to moderate
+	AdminDID string
+	// BanEndpoint is where banned users get sent, with the ban's id tacked
+	// on the end
+	BanEndpoint string
+
+	ListenAddr string
+	// MetricsAddr is where /metrics is served, away from everything public
+	MetricsAddr string
+	// TrustedProxies are the addresses we believe the X-Real-IP of, since
+	// anyone else could put whatever they like in it
+	TrustedProxies []netip.Prefix
+	Postgres       Postgres
+
+	JetstreamAddr   string
+	MaxRewind       time.Duration
+	LexStreamBuffer int
+	FederationMode  string
+	MediaCacheDir   string
+	MediaCacheBytes int64
+	// ShutdownTimeout is how long we wait for things to wrap up after being
+	// told to stop
+	ShutdownTimeout time.Duration
+	LogLevel        slog.Level
+	LogFormat       log.Format
+
+	// set is which settings were given a value
+	set map[string]bool
+}
+
+type Postgres struct {
+	User     string
+	Password string
+	Host     string
+	Port     string
+	DB       string
+}
+
+func (p Postgres) URL() string {
+	return fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", p.User, p.Password, p.Host, p.Port, p.DB)
+}
+
+// TrustsProxy reports whether addr is one of TrustedProxies
+func (c *Config) TrustsProxy(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, p := range c.TrustedProxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientURI is the https url of the backend, which the oauth metadata paths
+// hang off of
+func (c *Config) ClientURI() string {
+	return "https://" + c.Identity
+}
+
+// setting is one thing that can be configured. it is read from the env file
+// and the environment as env, and from flags as env in lowercase with dashes,
+// so MY_IDENTITY is -my-identity
+type setting struct {
+	env      string
+	usage    string
+	required bool
+	set      func(c *Config, v string) error
+}
+
+func str(f func(c *Config) *string) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		*f(c) = v
+		return nil
+	}
+}
+
+var settings = []setting{
+	{"MY_IDENTITY", "hostname of the backend, also the handle of its repo", true, str(func(c *Config) *string { return &c.Identity })},
+	{"MY_DID", "did of the backend's repo", true, func(c *Config, v string) error {
+		_, err := syntax.ParseDID(v)
+		if err != nil {
+			return err
+		}
+		c.DID = v
+		return nil
+	}},
+	{"MY_SECRET", "app password for the backend's repo", true, str(func(c *Config) *string { return &c.Secret })},
+	{"MY_NAME", "client name shown during oauth", false, str(func(c *Config) *string { return &c.Name })},
+	{"MY_METADATA_PATH", "path the oauth client metadata is served at", true, str(func(c *Config) *string { return &c.MetadataPath })},
+	{"MY_TOS_PATH", "path the terms of service are served at", false, str(func(c *Config) *string { return &c.TOSPath })},
+	{"MY_POLICY_PATH", "path the privacy policy is served at", false, str(func(c *Config) *string { return &c.PolicyPath })},
+	{"MY_LOGO_PATH", "path the logo is served at", false, str(func(c *Config) *string { return &c.LogoPath })},
+	{"MY_OAUTH_CALLBACK", "path of the oauth callback", true, str(func(c *Config) *string { return &c.OAuthCallback })},
+	{"MY_JWKS_PATH", "path the jwks is served at", true, str(func(c *Config) *string { return &c.JWKSPath })},
+	{"CLIENT_SECRET_KEY", "multibase private key the oauth client signs with", true, str(func(c *Config) *string { return &c.ClientSecretKey })},
+	{"CLIENT_SECRET_KEY_ID", "id of CLIENT_SECRET_KEY in the jwks", true, str(func(c *Config) *string { return &c.ClientSecretKeyID })},
+	{"SESSION_KEY", "key the session cookies are encrypted with", true, str(func(c *Config) *string { return &c.SessionKey })},
+	{"LRCD_SECRET", "secret lrc message nonces are generated from", true, str(func(c *Config) *string { return &c.LrcdSecret })},
+	{"ADMIN_DID", "did of the admin", false, func(c *Config, v string) error {
+		_, err := syntax.ParseDID(v)
+		if err != nil {
+			return err
+		}
+		c.AdminDID = v
+		return nil
+	}},
+	{"ADMIN_HANDLE", "no longer used, set ADMIN_DID instead", false, func(c *Config, v string) error {
+		if c.AdminDID != "" {
+			return nil
+		}
+		return errors.New("the admin is identified by ADMIN_DID now, since handles can change")
+	}},
+	{"BAN_ENDPOINT", "url banned users are sent to, followed by the ban's id", false, str(func(c *Config) *string { return &c.BanEndpoint })},
+	{"LISTEN_ADDR", "address to serve http on", false, str(func(c *Config) *string { return &c.ListenAddr })},
+	{"METRICS_ADDR", "address to serve prometheus metrics on", false, str(func(c *Config) *string { return &c.MetricsAddr })},
+	{"TRUSTED_PROXIES", "comma separated addresses or cidrs of proxies whose X-Real-IP is believed", false, func(c *Config, v string) error {
+		var proxies []netip.Prefix
+		for _, p := range strings.Split(v, ",") {
+			p = strings.TrimSpace(p)
+			if p == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(p)
+			if err != nil {
+				addr, aerr := netip.ParseAddr(p)
+				if aerr != nil {
+					return fmt.Errorf("%s isn't an address or a cidr", p)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			proxies = append(proxies, prefix.Masked())
+		}
+		c.TrustedProxies = proxies
+		return nil
+	}},
+	{"POSTGRES_USER", "postgres user", true, str(func(c *Config) *string { return &c.Postgres.User })},
+	{"POSTGRES_PASSWORD", "postgres password", true, str(func(c *Config) *string { return &c.Postgres.Password })},
+	{"POSTGRES_HOST", "postgres host", false, str(func(c *Config) *string { return &c.Postgres.Host })},
+	{"POSTGRES_PORT", "postgres port", true, str(func(c *Config) *string { return &c.Postgres.Port })},
+	{"POSTGRES_DB", "postgres database", true, str(func(c *Config) *string { return &c.Postgres.DB })},
+	{"JS_SERVER_ADDR", "jetstream instance to consume from", false, str(func(c *Config) *string { return &c.JetstreamAddr })},
+	{"JS_MAX_REWIND", "how far back a stored jetstream cursor may be, like 6h", false, func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		c.MaxRewind = d
+		return nil
+	}},
+	{"LEX_STREAM_BUFFER", "how many events a lex stream client can fall behind by", false, func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return errors.New("must be positive")
+		}
+		c.LexStreamBuffer = n
+		return nil
+	}},
+	{"FEDERATION_MODE", "proxy or redirect websockets for channels hosted elsewhere", false, func(c *Config, v string) error {
+		if v != "proxy" && v != "redirect" {
+			return errors.New("must be proxy or redirect")
+		}
+		c.FederationMode = v
+		return nil
+	}},
+	{"MEDIA_CACHE_DIR", "directory blobs are cached in", false, str(func(c *Config) *string { return &c.MediaCacheDir })},
+	{"MEDIA_CACHE_BYTES", "how many bytes of blobs to cache", false, func(c *Config, v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		if n <= 0 {
+			return errors.New("must be positive")
+		}
+		c.MediaCacheBytes = n
+		return nil
+	}},
+	{"SHUTDOWN_TIMEOUT", "how long to wait for things to wrap up when shutting down, like 30s", false, func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return errors.New("must be positive")
+		}
+		c.ShutdownTimeout = d
+		return nil
+	}},
+	{"LOG_LEVEL", "least important level to log, debug, info, warn or error", false, func(c *Config, v string) error {
+		level, err := log.ParseLevel(v)
+		if err != nil {
+			return err
+		}
+		c.LogLevel = level
+		return nil
+	}},
+	{"LOG_FORMAT", "text or json", false, func(c *Config, v string) error {
+		format, err := log.ParseFormat(v)
+		if err != nil {
+			return err
+		}
+		c.LogFormat = format
+		return nil
+	}},
+}
+
+func flagName(env string) string {
+	return strings.ReplaceAll(strings.ToLower(env), "_", "-")
+}
+
+func defaults() *Config {
+	return &Config{
+		ListenAddr:      DefaultListenAddr,
+		MetricsAddr:     DefaultMetricsAddr,
+		Postgres:        Postgres{Host: DefaultPostgresHost},
+		JetstreamAddr:   DefaultJetstreamAddr,
+		MaxRewind:       DefaultMaxRewind,
+		LexStreamBuffer: DefaultLexStreamBuffer,
+		FederationMode:  DefaultFederationMode,
+		MediaCacheDir:   DefaultMediaCacheDir,
+		MediaCacheBytes: DefaultMediaCacheBytes,
+		ShutdownTimeout: DefaultShutdownTimeout,
+		LogLevel:        DefaultLogLevel,
+		LogFormat:       DefaultLogFormat,
+		set:             make(map[string]bool),
+	}
+}
+
+// Load reads the config from an env file, then the environment, and then
+// flags, each overriding the last. the env file is ../.env unless -env says
+// otherwise, and it's fine for it to be missing unless -env was given. fs
+// can have flags of its own, and is left parsed so the caller can get at them
+// and at fs.Args(). Load doesn't check that anything required is there, call
+// Validate or ValidateDB for that
+func Load(fset *flag.FlagSet, args []string) (*Config, error) {
+	envFile := fset.String("env", DefaultEnvFile, "env file to read settings from")
+	flags := make(map[string]*string, len(settings))
+	for _, s := range settings {
+		flags[s.env] = fset.String(flagName(s.env), "", s.usage+" ("+s.env+")")
+	}
+	err := fset.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	given := make(map[string]bool)
+	fset.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	values, err := godotenv.Read(*envFile)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) || given["env"] {
+			return nil, fmt.Errorf("couldn't read %s: %w", *envFile, err)
+		}
+		values = make(map[string]string)
+	}
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok {
+			values[s.env] = v
+		}
+		if given[flagName(s.env)] {
+			values[s.env] = *flags[s.env]
+		}
+	}
+
+	c := defaults()
+	var errs []string
+	for _, s := range settings {
+		v, ok := values[s.env]
+		if !ok || v == "" {
+			continue
+		}
+		err := s.set(c, v)
+		if err != nil {
+			errs = append(errs, s.env+": "+err.Error())
+		}
+		c.set[s.env] = true
+	}
+	if len(errs) != 0 {
+		return nil, fmt.Errorf("bad config:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return c, nil
+}
+
+// Validate makes sure everything the server needs is set, naming everything
+// that's missing at once rather than one at a time
+func (c *Config) Validate() error {
+	return c.missing(func(s setting) bool { return s.required })
+}
+
+// ValidateDB only makes sure we can connect to postgres, which is all that
+// tools like migrate need
+func (c *Config) ValidateDB() error {
+	return c.missing(func(s setting) bool {
+		return s.required && strings.HasPrefix(s.env, "POSTGRES_")
+	})
+}
+
+func (c *Config) missing(needed func(s setting) bool) error {
+	var missing []string
+	for _, s := range settings {
+		if needed(s) && !c.set[s.env] {
+			missing = append(missing, s.env)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("missing config, set these in the env file, the environment, or with flags: %s", strings.Join(missing, ", "))
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rvcx/internal/store"
+	"rvcx/internal/types"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// insertCounted runs insert, which stores a message or media posted by did
+// under signetURI, and if it stored anything new, counts it towards its
+// channel's activity in the same transaction
+func (s *Store) insertCounted(ctx context.Context, signetURI string, did string, insert string, args ...any) (wasNew bool, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	commandTag, err := tx.Exec(ctx, insert, args...)
+	if err != nil {
+		return false, err
+	}
+	if commandTag.RowsAffected() == 0 {
+		return false, nil
+	}
+	err = countActivity(ctx, tx, signetURI, did, time.Now())
+	if err != nil {
+		return false, fmt.Errorf("failed to count activity: %w", err)
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to commit: %w", err)
+	}
+	return true, nil
+}
+
+// countActivity adds one to the decaying message count of the channel
+// signetURI is in, and if did hasn't been counted as a poster there within
+// store.PosterWindow, one to its count of posters too. see store.Rank for
+// how the counts are kept
+func countActivity(ctx context.Context, tx pgx.Tx, signetURI string, did string, at time.Time) error {
+	var channelURI string
+	err := tx.QueryRow(ctx, `SELECT channel_uri FROM signets WHERE uri = $1`, signetURI).Scan(&channelURI)
+	if err != nil {
+		return fmt.Errorf("error finding channel: %w", err)
+	}
+	// a poster's row is only touched when they count again, so counted_at
+	// is when they last counted rather than when they last posted
+	var newPoster bool
+	err = tx.QueryRow(ctx, `
+		INSERT INTO channel_posters (
+			channel_uri,
+			did,
+			counted_at
+		) VALUES (
+			$1, $2, $3
+		) ON CONFLICT (channel_uri, did) DO UPDATE SET
+			counted_at = EXCLUDED.counted_at
+		WHERE channel_posters.counted_at <= $4
+		RETURNING true
+		`, channelURI, did, at, at.Add(-store.PosterWindow)).Scan(&newPoster)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("error counting poster: %w", err)
+	}
+	var popularRank *float64
+	if newPoster {
+		r := store.Rank(at, store.PopularHalfLife)
+		popularRank = &r
+	}
+	// this is store.AddRanks. exp underflowing is an error in postgres, so
+	// differences too big to matter are clamped
+	_, err = tx.Exec(ctx, `
+		INSERT INTO channel_activity (
+			channel_uri,
+			active_rank,
+			popular_rank,
+			last_active_at
+		) VALUES (
+			$1, $2, $3, $4
+		) ON CONFLICT (channel_uri) DO UPDATE SET
+			active_rank = GREATEST(channel_activity.active_rank, EXCLUDED.active_rank)
+				+ ln(1 + exp(-LEAST(abs(channel_activity.active_rank - EXCLUDED.active_rank), 700))),
+			popular_rank = CASE
+				WHEN EXCLUDED.popular_rank IS NULL THEN channel_activity.popular_rank
+				WHEN channel_activity.popular_rank IS NULL THEN EXCLUDED.popular_rank
+				ELSE GREATEST(channel_activity.popular_rank, EXCLUDED.popular_rank)
+					+ ln(1 + exp(-LEAST(abs(channel_activity.popular_rank - EXCLUDED.popular_rank), 700)))
+			END,
+			last_active_at = GREATEST(channel_activity.last_active_at, EXCLUDED.last_active_at)
+		`, channelURI, store.Rank(at, store.ActiveHalfLife), popularRank, at)
+	if err != nil {
+		return fmt.Errorf("error counting message: %w", err)
+	}
+	return nil
+}
+
+// GetRankedChannelViews pages through channels by how active or popular they
+// are right now. channels nothing has happened in since activity started
+// being counted come last
+func (s *Store) GetRankedChannelViews(sort types.ChannelSort, limit int, cursor *types.RankCursor, ctx context.Context) ([]types.ChannelView, error) {
+	var rank string
+	switch sort {
+	case types.SortActive:
+		rank = "a.active_rank"
+	case types.SortPopular:
+		rank = "a.popular_rank"
+	default:
+		return nil, fmt.Errorf("can't rank channels by %s", sort)
+	}
+	queryFmt := `
+		SELECT * FROM (
+			SELECT
+				channels.uri,
+				channels.host,
+				channels.title,
+				channels.topic,
+				channels.created_at,
+				did_handles.did,
+				did_handles.handle,
+				profiles.display_name,
+				profiles.status,
+				profiles.color,
+				profiles.avatar_cid,
+				a.last_active_at,
+				COALESCE(%s, '-Infinity') AS rank
+			FROM channels
+			LEFT JOIN profiles ON channels.did = profiles.did
+			LEFT JOIN did_handles ON profiles.did = did_handles.did
+			LEFT JOIN channel_activity a ON channels.uri = a.channel_uri
+		) ranked
+		%s
+		ORDER BY rank DESC, uri DESC
+		LIMIT $1
+		`
+	args := []any{limit}
+	query := fmt.Sprintf(queryFmt, rank, "")
+	if cursor != nil {
+		query = fmt.Sprintf(queryFmt, rank, "WHERE (rank, uri) < ($2, $3)")
+		args = append(args, cursor.Rank, cursor.URI)
+	}
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chans := make([]types.ChannelView, 0, limit)
+	for rows.Next() {
+		var c types.ChannelView
+		var p types.ProfileView
+		err := rows.Scan(&c.URI, &c.Host, &c.Title, &c.Topic, &c.CreatedAt, &p.DID, &p.Handle, &p.DisplayName, &p.Status, &p.Color, &p.Avatar, &c.LastActiveAt, &c.Rank)
+		if err != nil {
+			return nil, err
+		}
+		c.Creator = p
+		chans = append(chans, c)
+	}
+	return chans, rows.Err()
+}
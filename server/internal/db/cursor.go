@@ -0,0 +1,40 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rvcx/internal/store"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func (s *Store) GetCursor(name string, ctx context.Context) (int64, error) {
+	row := s.pool.QueryRow(ctx, `SELECT c.time_us FROM cursors c WHERE c.name = $1`, name)
+	var timeUS int64
+	err := row.Scan(&timeUS)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, store.ErrNotFound
+		}
+		return 0, err
+	}
+	return timeUS, nil
+}
+
+func (s *Store) StoreCursor(name string, timeUS int64, ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO cursors (
+			name,
+			time_us
+		) VALUES (
+			$1, $2
+		) ON CONFLICT (name) DO UPDATE SET
+			time_us = EXCLUDED.time_us,
+			updated_at = now()
+		`, name, timeUS)
+	if err != nil {
+		return fmt.Errorf("error storing cursor: %w", err)
+	}
+	return nil
+}
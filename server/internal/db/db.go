@@ -4,9 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
 	"rvcx/internal/atputils"
+	"rvcx/internal/config"
 	"rvcx/internal/lex"
+	"rvcx/internal/store"
 	"rvcx/internal/types"
 	"time"
 
@@ -16,33 +17,36 @@ import (
 
 type Store struct {
 	pool *pgxpool.Pool
+	// identity is our hostname, which media srcs point at
+	identity string
 }
 
-func Init() (*Store, error) {
-	pool, err := initialize()
-	return &Store{pool}, err
+var _ store.Store = (*Store)(nil)
+
+// Init connects to postgres, and fails if the schema hasn't been migrated up
+// to what this build expects
+func Init(cfg *config.Config) (*Store, error) {
+	pool, err := initialize(cfg.Postgres.URL())
+	if err != nil {
+		return &Store{pool, cfg.Identity}, err
+	}
+	return &Store{pool, cfg.Identity}, checkSchema(pool)
 }
 
 func (s *Store) Close() {
 	s.pool.Close()
 }
 
-func initialize() (*pgxpool.Pool, error) {
-	dbuser := os.Getenv("POSTGRES_USER")
-	dbpass := os.Getenv("POSTGRES_PASSWORD")
-	dbhost := "localhost"
-	dbport := os.Getenv("POSTGRES_PORT")
-	dbdb := os.Getenv("POSTGRES_DB")
-	dburl := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", dbuser, dbpass, dbhost, dbport, dbdb)
+func initialize(dburl string) (*pgxpool.Pool, error) {
 	pool, err := pgxpool.New(context.Background(), dburl)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
-	pingErr := pool.Ping(context.Background())
-	if pingErr != nil {
-		return nil, pingErr
+	err = pool.Ping(context.Background())
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to ping: %w", err)
 	}
-	fmt.Println("connected!")
 	return pool, nil
 }
 
@@ -63,7 +67,7 @@ func (s *Store) FullResolveHandle(hdl string, ctx context.Context) (string, erro
 	}
 	did, err = atputils.TryLookupHandle(ctx, hdl)
 	if err != nil {
-		return "", errors.New("couldn't resolve: " + err.Error())
+		return "", fmt.Errorf("couldn't resolve: %w", err)
 	}
 	s.StoreDidHandle(did, hdl, ctx)
 	return did, nil
@@ -74,7 +78,7 @@ func (s *Store) ResolveDid(did string, ctx context.Context) (string, error) {
 	var handle string
 	err := row.Scan(&handle)
 	if err != nil {
-		return "", errors.New("error scanning row for handle: " + err.Error())
+		return "", fmt.Errorf("error scanning row for handle: %w", err)
 	}
 	return handle, nil
 }
@@ -86,19 +90,37 @@ func (s *Store) FullResolveDid(did string, ctx context.Context) (string, error)
 	}
 	hdl, err = atputils.TryLookupDid(ctx, did)
 	if err != nil {
-		return "", errors.New("couldn't resolve: " + err.Error())
+		return "", fmt.Errorf("couldn't resolve: %w", err)
 	}
 	s.StoreDidHandle(did, hdl, ctx)
 	return hdl, nil
 }
 
+func (s *Store) GetDids(ctx context.Context) ([]string, error) {
+	rows, err := s.pool.Query(ctx, `SELECT h.did FROM did_handles h ORDER BY h.indexed_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	dids := make([]string, 0)
+	for rows.Next() {
+		var did string
+		err := rows.Scan(&did)
+		if err != nil {
+			return nil, err
+		}
+		dids = append(dids, did)
+	}
+	return dids, nil
+}
+
 func (s *Store) StoreDidHandle(did string, handle string, ctx context.Context) error {
 	_, err := s.pool.Exec(ctx, `INSERT INTO did_handles (
 			handle,
 			did
 		) VALUES ($1, $2) ON CONFLICT (handle) DO NOTHING`, handle, did)
 	if err != nil {
-		return errors.New("error storing did/handle: " + err.Error())
+		return fmt.Errorf("error storing did/handle: %w", err)
 	}
 	return nil
 }
@@ -115,8 +137,7 @@ func (s *Store) GetLastSeen(did string, ctx context.Context) (where *string, whe
 	return
 }
 
-func (s *Store) GetHistory(channelURI string, limit int, cursor *int, ctx context.Context) ([]types.SignedItemView, error) {
-	queryFmt := `
+const historyQueryFmt = `
 	SELECT
 		'message' AS content_type,
 		m.uri,
@@ -142,7 +163,8 @@ func (s *Store) GetHistory(channelURI string, limit int, cursor *int, ctx contex
 		s.author,
 		s.author_handle,
 		s.started_at,
-		m.posted_at
+		m.posted_at,
+		m.edited_at
 	FROM signets s
 	JOIN messages m ON s.uri = m.signet_uri
 	JOIN did_handles dh ON m.did = dh.did
@@ -176,26 +198,125 @@ func (s *Store) GetHistory(channelURI string, limit int, cursor *int, ctx contex
 		s.author,
 		s.author_handle,
 		s.started_at,
-		i.posted_at
+		i.posted_at,
+		NULL AS edited_at
 	FROM signets s
 	JOIN images i ON s.uri = i.signet_uri
 	JOIN did_handles dh ON i.did = dh.did
 	JOIN profiles p ON i.did = p.did
 	WHERE s.channel_uri = $2 AND i.did = s.author %s
 
+	UNION ALL
+
+	SELECT
+		'video' AS content_type,
+		v.uri,
+		v.did,
+		dh.handle,
+		p.display_name,
+		p.status,
+		p.color,
+		p.avatar_cid,
+		p.default_nick,
+		NULL AS body,
+		v.blob_cid,
+		v.blob_mime,
+		v.alt,
+		v.height,
+		v.width,
+		COALESCE(v.nick, ''),
+		COALESCE(v.color, 0),
+		s.uri,
+		s.issuer_did,
+		s.channel_uri,
+		s.message_id,
+		s.author,
+		s.author_handle,
+		s.started_at,
+		v.posted_at,
+		NULL AS edited_at
+	FROM signets s
+	JOIN videos v ON s.uri = v.signet_uri
+	JOIN did_handles dh ON v.did = dh.did
+	JOIN profiles p ON v.did = p.did
+	WHERE s.channel_uri = $2 AND v.did = s.author %s
+
 	ORDER BY message_id DESC
 	LIMIT $1
 	`
+
+func (s *Store) GetHistory(channelURI string, limit int, cursor *int, ctx context.Context) ([]types.SignedItemView, error) {
 	var query string
 	if cursor != nil {
-		query = fmt.Sprintf(queryFmt, "AND s.message_id < $3", "AND s.message_id < $3")
-		return s.evalGetItems(query, ctx, limit, channelURI, *cursor)
+		query = fmt.Sprintf(historyQueryFmt, "AND s.message_id < $3", "AND s.message_id < $3", "AND s.message_id < $3")
+		return s.evalGetItems(query, ctx, &limit, channelURI, *cursor)
 	} else {
-		query = fmt.Sprintf(queryFmt, "", "")
-		return s.evalGetItems(query, ctx, limit, channelURI)
+		query = fmt.Sprintf(historyQueryFmt, "", "", "")
+		return s.evalGetItems(query, ctx, &limit, channelURI)
 	}
 }
-func (s *Store) evalGetItems(query string, ctx context.Context, limit int, params ...any) ([]types.SignedItemView, error) {
+
+// GetHistoryBetween gets every item in a channel whose signet's lrcID is
+// after after and no later than through, newest first just like GetHistory
+func (s *Store) GetHistoryBetween(channelURI string, after uint32, through uint32, ctx context.Context) ([]types.SignedItemView, error) {
+	filter := "AND s.message_id > $3 AND s.message_id <= $4"
+	query := fmt.Sprintf(historyQueryFmt, filter, filter, filter)
+	return s.evalGetItems(query, ctx, nil, channelURI, after, through)
+}
+
+// GetSignetsAfter gets the first limit signets in a channel with an lrcID
+// greater than after, oldest first
+func (s *Store) GetSignetsAfter(channelURI string, limit int, after uint32, ctx context.Context) ([]types.SignetView, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT
+			s.uri,
+			s.issuer_did,
+			s.channel_uri,
+			s.message_id,
+			s.author,
+			s.author_handle,
+			s.started_at
+		FROM signets s
+		WHERE s.channel_uri = $2 AND s.message_id > $3
+		ORDER BY s.message_id ASC
+		LIMIT $1
+		`, limit, channelURI, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	signets := make([]types.SignetView, 0, limit)
+	for rows.Next() {
+		var sv types.SignetView
+		err := rows.Scan(&sv.URI, &sv.Issuer, &sv.ChannelURI, &sv.LrcId, &sv.Author, &sv.AuthorHandle, &sv.StartedAt)
+		if err != nil {
+			return nil, err
+		}
+		signets = append(signets, sv)
+	}
+	return signets, nil
+}
+
+// GetSignetIDAt gets the lrcID of the last signet in a channel that started
+// at or before t, or 0 if there isn't one
+func (s *Store) GetSignetIDAt(channelURI string, t time.Time, ctx context.Context) (uint32, error) {
+	row := s.pool.QueryRow(ctx, `
+		SELECT COALESCE(MAX(s.message_id), 0)
+		FROM signets s
+		WHERE s.channel_uri = $1 AND s.started_at <= $2
+		`, channelURI, t)
+	var id uint32
+	err := row.Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("error scanning signet id: %w", err)
+	}
+	return id, nil
+}
+
+// evalGetItems runs one of the history queries. limit fills in $1, and nil
+// means no limit, since LIMIT NULL is the same as none
+func (s *Store) evalGetItems(query string, ctx context.Context, limit *int, params ...any) ([]types.SignedItemView, error) {
+	base := s.identity
 	args := []any{limit}
 	args = append(args, params...)
 	rows, err := s.pool.Query(ctx, query, args...)
@@ -214,6 +335,7 @@ func (s *Store) evalGetItems(query string, ctx context.Context, limit int, param
 		var nick string
 		var color uint32
 		var s types.SignetView
+		var editedAt *time.Time
 		var time time.Time
 
 		err := rows.Scan(
@@ -244,6 +366,7 @@ func (s *Store) evalGetItems(query string, ctx context.Context, limit int, param
 			&s.AuthorHandle,
 			&s.StartedAt,
 			&time,
+			&editedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -263,6 +386,8 @@ func (s *Store) evalGetItems(query string, ctx context.Context, limit int, param
 			msg.Author = p
 			msg.Signet = s
 			msg.PostedAt = time
+			msg.Edited = editedAt != nil
+			msg.EditedAt = editedAt
 			msg.URI = uri
 
 			items = append(items, msg)
@@ -278,7 +403,6 @@ func (s *Store) evalGetItems(query string, ctx context.Context, limit int, param
 			if alt != nil {
 				imgview.Alt = *alt
 			}
-			base := os.Getenv("MY_IDENTITY")
 			src := fmt.Sprintf("https://%s/xrpc/org.xcvr.lrc.getImage?uri=%s", base, uri)
 			imgview.Src = &src
 			img.Image = &imgview
@@ -294,8 +418,35 @@ func (s *Store) evalGetItems(query string, ctx context.Context, limit int, param
 			img.URI = uri
 
 			items = append(items, img)
+		} else if t == "video" {
+			var vid types.SignedMediaView
+			var vidview types.VideoView
+			if image.Height != nil && image.Width != nil {
+				var aspect lex.AspectRatio
+				aspect.Width = *image.Width
+				aspect.Height = *image.Height
+				vidview.AspectRatio = &aspect
+			}
+			if alt != nil {
+				vidview.Alt = *alt
+			}
+			src := fmt.Sprintf("https://%s/xrpc/org.xcvr.lrc.getVideo?uri=%s", base, uri)
+			vidview.Src = &src
+			vid.Video = &vidview
+			if nick != "" {
+				vid.Nick = &nick
+			}
+			if color != 0 {
+				vid.Color = &color
+			}
+			vid.Author = p
+			vid.Signet = s
+			vid.PostedAt = time
+			vid.URI = uri
+
+			items = append(items, vid)
 		} else {
-			return nil, errors.New("recieved strange type t: " + t)
+			return nil, fmt.Errorf("recieved strange type t: %s", t)
 		}
 	}
 	return items, nil
@@ -322,7 +473,8 @@ func (s *Store) GetMessages(channelURI string, limit int, cursor *int, ctx conte
 			s.message_id,
 			s.author_handle,
 			s.started_at,
-			m.posted_at
+			m.posted_at,
+			m.edited_at
 		FROM messages m 
 		JOIN signets s ON m.signet_uri = s.uri
 		JOIN did_handles dh ON m.did = dh.did
@@ -376,10 +528,12 @@ func (s *Store) evalGetMessages(query string, ctx context.Context, limit int, pa
 			&msg.Signet.StartedAt,
 
 			&msg.PostedAt,
+			&msg.EditedAt,
 		)
 		if err != nil {
 			return nil, err
 		}
+		msg.Edited = msg.EditedAt != nil
 		msgs = append(msgs, msg)
 	}
 	return msgs, nil
@@ -408,29 +562,24 @@ func (s *Store) GetChannelURI(handle string, title string, ctx context.Context)
 	return uri, nil
 }
 
-type URIHost struct {
-	URI    string
-	Host   string
-	Topic  string
-	LastID uint32
-}
-
-func (s *Store) GetChannelURIs(ctx context.Context) ([]URIHost, error) {
+func (s *Store) GetChannelURIs(ctx context.Context) ([]types.URIHost, error) {
 	rows, err := s.pool.Query(ctx, `
 		SELECT
 			channels.uri,
 			channels.host,
-			channels.topic
+			channels.topic,
+			channels.last_id
 		FROM channels
 		`)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var urihosts = make([]URIHost, 0, 100)
+	var urihosts = make([]types.URIHost, 0, 100)
 	for rows.Next() {
-		var urihost URIHost
-		err := rows.Scan(&urihost.URI, &urihost.Host, &urihost.Topic)
+		var urihost types.URIHost
+		var lastID int64
+		err := rows.Scan(&urihost.URI, &urihost.Host, &urihost.Topic, &lastID)
 		if err != nil {
 			return nil, err
 		}
@@ -443,14 +592,26 @@ func (s *Store) GetChannelURIs(ctx context.Context) ([]URIHost, error) {
 		if err != nil {
 			return nil, err
 		}
-		urihost.LastID = maxMessageID
+		// ids can be handed out without a signet ever being stored, so
+		// whichever is further along wins
+		urihost.LastID = max(maxMessageID, uint32(lastID))
 		urihosts = append(urihosts, urihost)
 	}
 	return urihosts, nil
 }
 
-func (s *Store) GetChannelViews(limit int, ctx context.Context) ([]types.ChannelView, error) {
-	rows, err := s.pool.Query(ctx, `
+// StoreLastID remembers the last id an lrcd server handed out, so that ids
+// aren't reused after it stops
+func (s *Store) StoreLastID(uri string, lastID uint32, ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, `
+		UPDATE channels SET last_id = GREATEST(last_id, $2)
+		WHERE uri = $1
+		`, uri, int64(lastID))
+	return err
+}
+
+func (s *Store) GetChannelViews(limit int, cursor *types.KeysetCursor, ctx context.Context) ([]types.ChannelView, error) {
+	queryFmt := `
 		SELECT 
 			channels.uri,  
 			channels.host, 
@@ -466,9 +627,17 @@ func (s *Store) GetChannelViews(limit int, ctx context.Context) ([]types.Channel
 		FROM channels
 		LEFT JOIN profiles ON channels.did = profiles.did
 		LEFT JOIN did_handles ON profiles.did = did_handles.did
-		ORDER BY channels.created_at DESC
+		%s
+		ORDER BY channels.created_at DESC, channels.uri DESC
 		LIMIT $1
-		`, limit)
+		`
+	args := []any{limit}
+	query := fmt.Sprintf(queryFmt, "")
+	if cursor != nil {
+		query = fmt.Sprintf(queryFmt, "WHERE (channels.created_at, channels.uri) < ($2, $3)")
+		args = append(args, cursor.At, cursor.URI)
+	}
+	rows, err := s.pool.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -598,21 +767,37 @@ func (s *Store) AddBan(did string, reason *string, till *time.Time, ctx context.
 	return err
 }
 
-func (s *Store) IsBanned(did string, ctx context.Context) (bool, error) {
-	ban, err := s.GetBanned(did, ctx)
-	if ban != nil {
-		defbanned := false
-		if ban.Till == nil {
-			defbanned = true
-		} else {
-			defbanned = time.Now().Before(*ban.Till)
-		}
-		if defbanned {
-			return true, nil
+// GetActiveBan gets the ban that currently applies to did, preferring
+// permanent bans and then whichever lasts the longest
+func (s *Store) GetActiveBan(did string, ctx context.Context) (*types.Ban, error) {
+	row := s.pool.QueryRow(ctx, `SELECT 
+		id,
+		reason,
+		till,
+		banned_at
+		FROM bans
+		WHERE did = $1 AND (till IS NULL OR till > now())
+		ORDER BY till DESC NULLS FIRST
+		LIMIT 1`, did)
+	var ban types.Ban
+	err := row.Scan(&ban.Id, &ban.Reason, &ban.Till, &ban.BannedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, store.ErrNotFound
 		}
+		return nil, err
 	}
-	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+	ban.Did = did
+	return &ban, nil
+}
+
+func (s *Store) IsBanned(did string, ctx context.Context) (bool, error) {
+	_, err := s.GetActiveBan(did, ctx)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return false, nil
+		}
 		return false, err
 	}
-	return false, nil
+	return true, nil
 }
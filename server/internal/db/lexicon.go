@@ -3,7 +3,11 @@ package db
 import (
 	"context"
 	"errors"
+	"fmt"
+	"rvcx/internal/store"
 	"rvcx/internal/types"
+
+	"github.com/jackc/pgx/v5"
 )
 
 func (s *Store) InitializeProfile(did string,
@@ -24,7 +28,7 @@ func (s *Store) InitializeProfile(did string,
 		) ON CONFLICT (did) DO NOTHING
 		`, did, displayname, defaultnick, status, color)
 	if err != nil {
-		return errors.New("i'm not sure what happened: " + err.Error())
+		return fmt.Errorf("i'm not sure what happened: %w", err)
 	}
 	return nil
 }
@@ -39,10 +43,15 @@ func (s *Store) UpdateProfile(did string, displayname *string, defaultnick *stri
 			color
 		) VALUES (
 		$1, $2, $3, $4, $5
-		)
+		) ON CONFLICT (did) DO UPDATE SET
+			display_name = EXCLUDED.display_name,
+			default_nick = EXCLUDED.default_nick,
+			status = EXCLUDED.status,
+			color = EXCLUDED.color,
+			indexed_at = now()
 		`, did, displayname, defaultnick, status, color)
 	if err != nil {
-		return errors.New("i'm not sure what happened: " + err.Error())
+		return fmt.Errorf("i'm not sure what happened: %w", err)
 	}
 	return nil
 }
@@ -76,7 +85,7 @@ func (s *Store) GetProfileView(did string, ctx context.Context) (*types.ProfileV
 		&p.Avatar,
 		&p.DefaultNick)
 	if err != nil {
-		return nil, errors.New("error scanning profile: " + err.Error())
+		return nil, fmt.Errorf("error scanning profile: %w", err)
 	}
 	return &p, nil
 }
@@ -126,7 +135,7 @@ func (s *Store) DeleteMessage(uri string, ctx context.Context) error {
 }
 
 func (s *Store) StoreMessage(message *types.Message, ctx context.Context) (wasNew bool, err error) {
-	commandTag, err := s.pool.Exec(ctx, `
+	return s.insertCounted(ctx, message.SignetURI, message.DID, `
 		INSERT INTO messages (
 		  uri,
 			cid,
@@ -140,36 +149,99 @@ func (s *Store) StoreMessage(message *types.Message, ctx context.Context) (wasNe
 			$1, $2, $3, $4, $5, $6, $7, $8
 		) ON CONFLICT (uri) DO NOTHING
 		`, message.URI, message.CID, message.DID, message.SignetURI, message.Body, message.Nick, message.Color, message.PostedAt)
-	if err != nil {
-		return
-	}
-	wasNew = commandTag.RowsAffected() > 0
-	return
 }
 
-func (s *Store) UpdateMessage(message *types.Message, ctx context.Context) error {
-	_, err := s.pool.Exec(ctx, `
-		INSERT INTO messages (
-		  uri,
+func (s *Store) UpdateMessage(message *types.Message, ctx context.Context) (edited bool, err error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	var cid string
+	err = tx.QueryRow(ctx, `SELECT m.cid FROM messages m WHERE m.uri = $1 FOR UPDATE`, message.URI).Scan(&cid)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, store.ErrNotFound
+		}
+		return false, fmt.Errorf("error finding message: %w", err)
+	}
+	if cid == message.CID {
+		return false, nil
+	}
+	_, err = tx.Exec(ctx, `
+		INSERT INTO message_revisions (
+			message_uri,
 			cid,
-			did,
-			signet_uri,
 			body,
 			nick,
 			color,
-			posted_at
-		) VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8
-		)
-		`, message.URI, message.CID, message.DID, message.SignetURI, message.Body, message.Nick, message.Color, message.PostedAt)
-	return err
+			written_at
+		) SELECT
+			m.uri,
+			m.cid,
+			m.body,
+			m.nick,
+			m.color,
+			COALESCE(m.edited_at, m.posted_at)
+		FROM messages m WHERE m.uri = $1
+		`, message.URI)
+	if err != nil {
+		return false, fmt.Errorf("error storing revision: %w", err)
+	}
+	err = tx.QueryRow(ctx, `
+		UPDATE messages m SET
+			cid = $2,
+			body = $3,
+			nick = $4,
+			color = $5,
+			edited_at = now()
+		WHERE m.uri = $1
+		RETURNING m.edited_at
+		`, message.URI, message.CID, message.Body, message.Nick, message.Color).Scan(&message.EditedAt)
+	if err != nil {
+		return false, fmt.Errorf("error updating message: %w", err)
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to commit: %w", err)
+	}
+	return true, nil
+}
+
+func (s *Store) GetMessageRevisions(uri string, ctx context.Context) ([]types.MessageRevisionView, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT
+			r.cid,
+			COALESCE(r.body, ''),
+			r.nick,
+			r.color,
+			r.written_at,
+			r.revised_at
+		FROM message_revisions r
+		WHERE r.message_uri = $1
+		ORDER BY r.id DESC
+		`, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	revisions := make([]types.MessageRevisionView, 0)
+	for rows.Next() {
+		var rev types.MessageRevisionView
+		err := rows.Scan(&rev.CID, &rev.Body, &rev.Nick, &rev.Color, &rev.WrittenAt, &rev.RevisedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning revision: %w", err)
+		}
+		revisions = append(revisions, rev)
+	}
+	return revisions, rows.Err()
 }
 
 func (s *Store) QuerySignet(channelUri string, id uint32, ctx context.Context) (signetUri string, signetHandle string, err error) {
 	row := s.pool.QueryRow(ctx, `SELECT s.uri, s.author_handle FROM signets s WHERE s.channel_uri = $1 AND s.message_id = $2`, channelUri, id)
 	err = row.Scan(&signetUri, &signetHandle)
 	if err != nil {
-		err = errors.New("error scanning: " + err.Error())
+		err = fmt.Errorf("error scanning: %w", err)
 	}
 	return
 }
@@ -181,7 +253,7 @@ func (s *Store) QuerySignetHandle(uri string, ctx context.Context) (string, erro
 	var handle string
 	err := row.Scan(&handle)
 	if err != nil {
-		return "", errors.New("BOBOBOBOBOBOL " + err.Error())
+		return "", fmt.Errorf("BOBOBOBOBOBOL %w", err)
 	}
 	return handle, nil
 }
@@ -190,7 +262,7 @@ func (s *Store) QuerySignetDid(uri string, ctx context.Context) (string, error)
 	var did string
 	err := row.Scan(&did)
 	if err != nil {
-		return "", errors.New("BOBOBOBOBOBOL " + err.Error())
+		return "", fmt.Errorf("BOBOBOBOBOBOL %w", err)
 	}
 	return did, nil
 }
@@ -199,7 +271,7 @@ func (s *Store) QuerySignetChannelIdNum(uri string, ctx context.Context) (channe
 	row := s.pool.QueryRow(ctx, `SELECT s.channel_uri, s.message_id FROM signets s WHERE s.uri = $1`, uri)
 	err = row.Scan(&channelUri, &messageID)
 	if err != nil {
-		err = errors.New("BOBOBOBOBOBOL " + err.Error())
+		err = fmt.Errorf("BOBOBOBOBOBOL %w", err)
 	}
 	return
 }
@@ -209,7 +281,37 @@ func (s *Store) GetMsgChannelURI(signetURI string, ctx context.Context) (string,
 	var channelURI string
 	err := row.Scan(&channelURI)
 	if err != nil {
-		return "", errors.New("error scanning: " + err.Error())
+		return "", fmt.Errorf("error scanning: %w", err)
+	}
+	return channelURI, nil
+}
+
+// GetMessageChannelURI finds the channel a message was posted in by way of
+// its signet
+func (s *Store) GetMessageChannelURI(uri string, ctx context.Context) (string, error) {
+	row := s.pool.QueryRow(ctx, `
+		SELECT s.channel_uri FROM messages m
+		JOIN signets s ON m.signet_uri = s.uri
+		WHERE m.uri = $1`, uri)
+	var channelURI string
+	err := row.Scan(&channelURI)
+	if err != nil {
+		return "", fmt.Errorf("error scanning: %w", err)
+	}
+	return channelURI, nil
+}
+
+// GetImageChannelURI finds the channel an image was posted in by way of its
+// signet
+func (s *Store) GetImageChannelURI(uri string, ctx context.Context) (string, error) {
+	row := s.pool.QueryRow(ctx, `
+		SELECT s.channel_uri FROM images i
+		JOIN signets s ON i.signet_uri = s.uri
+		WHERE i.uri = $1`, uri)
+	var channelURI string
+	err := row.Scan(&channelURI)
+	if err != nil {
+		return "", fmt.Errorf("error scanning: %w", err)
 	}
 	return channelURI, nil
 }
@@ -230,7 +332,7 @@ func (s *Store) StoreSignet(signet *types.Signet, ctx context.Context) (wasNew b
 		) ON CONFLICT (uri) DO NOTHING
 		`, signet.URI, signet.IssuerDID, signet.Author, signet.AuthorHandle, signet.ChannelURI, signet.MessageID, signet.CID, signet.StartedAt)
 	if err != nil {
-		err = errors.New("SOMETHING BAD HAPPENED: " + err.Error())
+		err = fmt.Errorf("SOMETHING BAD HAPPENED: %w", err)
 		return
 	}
 	wasNew = commandTag.RowsAffected() > 0
@@ -253,7 +355,7 @@ func (s *Store) UpdateSignet(signet *types.Signet, ctx context.Context) error {
 		)
 		`, signet.URI, signet.IssuerDID, signet.Author, signet.AuthorHandle, signet.ChannelURI, signet.MessageID, signet.CID, signet.StartedAt)
 	if err != nil {
-		err = errors.New("SOMETHING BAD HAPPENED: " + err.Error())
+		err = fmt.Errorf("SOMETHING BAD HAPPENED: %w", err)
 	}
 	return err
 }
@@ -266,7 +368,7 @@ func (s *Store) DeleteSignet(uri string, ctx context.Context) error {
 }
 
 func (s *Store) StoreImage(image *types.Image, ctx context.Context) (wasNew bool, err error) {
-	commandTag, err := s.pool.Exec(ctx, `INSERT INTO images (
+	wasNew, err = s.insertCounted(ctx, image.SignetURI, image.DID, `INSERT INTO images (
 		uri,
 		did,
 		signet_uri,
@@ -295,10 +397,8 @@ func (s *Store) StoreImage(image *types.Image, ctx context.Context) (wasNew bool
 		image.CID,
 		image.PostedAt)
 	if err != nil {
-		err = errors.New("effor storing image: " + err.Error())
-		return
+		err = fmt.Errorf("effor storing image: %w", err)
 	}
-	wasNew = commandTag.RowsAffected() > 0
 	return
 }
 
@@ -318,7 +418,15 @@ func (s *Store) UpdateImage(image *types.Image, ctx context.Context) error {
 		posted_at
 		) VALUES (
 		$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12
-		)`,
+		) ON CONFLICT (uri) DO UPDATE SET
+		blob_cid = EXCLUDED.blob_cid,
+		blob_mime = EXCLUDED.blob_mime,
+		alt = EXCLUDED.alt,
+		height = EXCLUDED.height,
+		width = EXCLUDED.width,
+		nick = EXCLUDED.nick,
+		color = EXCLUDED.color,
+		cid = EXCLUDED.cid`,
 		image.URI,
 		image.DID,
 		image.SignetURI,
@@ -332,7 +440,7 @@ func (s *Store) UpdateImage(image *types.Image, ctx context.Context) error {
 		image.CID,
 		image.PostedAt)
 	if err != nil {
-		return errors.New("effor updating image: " + err.Error())
+		return fmt.Errorf("effor updating image: %w", err)
 	}
 	return nil
 }
@@ -340,7 +448,7 @@ func (s *Store) UpdateImage(image *types.Image, ctx context.Context) error {
 func (s *Store) DeleteImage(uri string, ctx context.Context) error {
 	_, err := s.pool.Exec(ctx, `DELETE from images i WHERE i.uri = $1`, uri)
 	if err != nil {
-		return errors.New("bep bep bop: " + err.Error())
+		return fmt.Errorf("bep bep bop: %w", err)
 	}
 	return nil
 }
@@ -372,7 +480,7 @@ func (s *Store) GetImage(uri string, ctx context.Context) (*types.Image, error)
 		&image.CID,
 		&image.PostedAt)
 	if err != nil {
-		return nil, errors.New("effor storing image: " + err.Error())
+		return nil, fmt.Errorf("effor storing image: %w", err)
 	}
 	image.URI = uri
 	return &image, nil
@@ -404,7 +512,7 @@ func (s *Store) GetImageDidCID(did string, cid string, ctx context.Context) (*ty
 		&image.Color,
 		&image.PostedAt)
 	if err != nil {
-		return nil, errors.New("error getting image: " + err.Error())
+		return nil, fmt.Errorf("error getting image: %w", err)
 	}
 	image.DID = did
 	image.BlobCID = &cid
@@ -0,0 +1,292 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"rvcx/internal/config"
+	"rvcx/internal/log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+// migrationLock is the advisory lock held while migrating, so that two
+// servers starting at once don't both try to apply the same migration
+const migrationLock = 0x72766378
+
+type migration struct {
+	version uint
+	name    string
+	up      string
+	down    string
+}
+
+// migrations are read from NNN_name.up.sql and NNN_name.down.sql, every
+// version needs both
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationFS, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[uint]*migration)
+	for _, file := range files {
+		base := path.Base(file)
+		name, direction, ok := strings.Cut(strings.TrimSuffix(base, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("strange migration name: %s", base)
+		}
+		vstr, _, _ := strings.Cut(name, "_")
+		version, err := strconv.ParseUint(vstr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("strange migration version: %s", base)
+		}
+		b, err := migrationFS.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[uint(version)]
+		if !ok {
+			m = &migration{version: uint(version), name: name}
+			byVersion[uint(version)] = m
+		}
+		if direction == "up" {
+			m.up = string(b)
+		} else {
+			m.down = string(b)
+		}
+	}
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %s needs both an up and a down", m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// Migrator applies the migrations that are embedded in the binary. it keeps
+// track of them in the same schema_migrations table golang-migrate uses, so a
+// database that was set up with the old migrateup script carries on from
+// where it was
+type Migrator struct {
+	pool       *pgxpool.Pool
+	logger     *log.Logger
+	migrations []migration
+}
+
+func NewMigrator(cfg *config.Config, l *log.Logger) (*Migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+	pool, err := initialize(cfg.Postgres.URL())
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{pool, l, migrations}, nil
+}
+
+func (m *Migrator) Close() {
+	m.pool.Close()
+}
+
+// Latest is the version the database should be at to run this build
+func (m *Migrator) Latest() uint {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].version
+}
+
+// Version is the version the database is at, 0 meaning no migrations have
+// been applied. if dirty, a migration failed halfway through under
+// golang-migrate and someone has to look at it
+func (m *Migrator) Version(ctx context.Context) (version uint, dirty bool, err error) {
+	return schemaVersion(ctx, m.pool)
+}
+
+type querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func schemaVersion(ctx context.Context, q querier) (version uint, dirty bool, err error) {
+	_, err = q.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT NOT NULL PRIMARY KEY,
+		dirty BOOLEAN NOT NULL
+		)`)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	var v int64
+	err = q.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&v, &dirty)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	return uint(v), dirty, nil
+}
+
+func setSchemaVersion(ctx context.Context, tx pgx.Tx, version uint) error {
+	_, err := tx.Exec(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return nil
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, int64(version))
+	return err
+}
+
+// Up applies every migration that hasn't been applied yet
+func (m *Migrator) Up(ctx context.Context) error {
+	for {
+		done, err := m.step(true, ctx)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// Down rolls back the last n migrations
+func (m *Migrator) Down(n int, ctx context.Context) error {
+	for range n {
+		done, err := m.step(false, ctx)
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+// step applies the next migration up or rolls back the current one. each
+// migration runs in its own transaction along with the version bump, so a
+// failure leaves the database where it was rather than dirty
+func (m *Migrator) step(up bool, ctx context.Context) (done bool, err error) {
+	tx, err := m.pool.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock)
+	if err != nil {
+		return false, fmt.Errorf("failed to lock: %w", err)
+	}
+	version, dirty, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	if dirty {
+		return false, fmt.Errorf("database is dirty at version %d, fix it by hand and then clear the dirty flag in schema_migrations", version)
+	}
+	var mig *migration
+	var sql string
+	var to uint
+	if up {
+		for i := range m.migrations {
+			if m.migrations[i].version > version {
+				mig = &m.migrations[i]
+				sql = mig.up
+				to = mig.version
+				break
+			}
+		}
+	} else {
+		for i := range m.migrations {
+			if m.migrations[i].version == version {
+				mig = &m.migrations[i]
+				sql = mig.down
+				if i > 0 {
+					to = m.migrations[i-1].version
+				}
+				break
+			}
+		}
+		if mig == nil && version != 0 {
+			return false, fmt.Errorf("database is at version %d, which this build doesn't know how to roll back", version)
+		}
+	}
+	if mig == nil {
+		return true, nil
+	}
+	_, err = tx.Exec(ctx, sql)
+	if err != nil {
+		return false, fmt.Errorf("failed to apply %s: %w", mig.name, err)
+	}
+	err = setSchemaVersion(ctx, tx, to)
+	if err != nil {
+		return false, fmt.Errorf("failed to set schema version: %w", err)
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to commit %s: %w", mig.name, err)
+	}
+	if up {
+		m.logger.InfoContext(ctx, "applied migration", "migration", mig.name)
+	} else {
+		m.logger.InfoContext(ctx, "rolled back migration", "migration", mig.name)
+	}
+	return false, nil
+}
+
+type MigrationStatus struct {
+	Name    string
+	Applied bool
+}
+
+// Status lists every migration this build knows about and whether it has
+// been applied
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	version, _, err := m.Version(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		statuses = append(statuses, MigrationStatus{mig.name, mig.version <= version})
+	}
+	return statuses, nil
+}
+
+// checkSchema refuses to go any further if the database is behind the
+// migrations this build was made with, since queries would fail in strange
+// ways otherwise
+func checkSchema(pool *pgxpool.Pool) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return fmt.Errorf("failed to load migrations: %w", err)
+	}
+	if len(migrations) == 0 {
+		return nil
+	}
+	latest := migrations[len(migrations)-1].version
+	version, dirty, err := schemaVersion(context.Background(), pool)
+	if err != nil {
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("database is dirty at version %d, fix it by hand before starting", version)
+	}
+	if version < latest {
+		return fmt.Errorf("database is at schema version %d but this build needs %d, run `go run ./cmd migrate up` first", version, latest)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"context"
+	"io"
+	"os"
+	"rvcx/internal/log"
+	"testing"
+)
+
+// testDBEnv names a postgres url for the database tests to run against. it
+// gets migrated up and down, so it must be a throwaway one
+const testDBEnv = "RVCX_TEST_DATABASE_URL"
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, m := range migrations {
+		if m.version != uint(i+1) {
+			t.Errorf("%s is version %d, want %d", m.name, m.version, i+1)
+		}
+	}
+}
+
+// every migration has to apply on top of the one before it, and every down
+// has to undo its up well enough that the up applies again afterwards
+func TestMigrateUpAndDown(t *testing.T) {
+	url := os.Getenv(testDBEnv)
+	if url == "" {
+		// ci has a database for this, so not having one there means the
+		// migrations silently went untested
+		if os.Getenv("CI") != "" {
+			t.Fatal(testDBEnv + " isn't set in ci")
+		}
+		t.Skip("set " + testDBEnv + " to a throwaway database to run this")
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := initialize(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	m := &Migrator{pool, log.New(io.Discard, false), migrations}
+	ctx := context.Background()
+	version, _, err := m.Version(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Fatalf("test database is already at version %d, it should be empty", version)
+	}
+	defer m.Down(len(migrations), ctx)
+
+	for _, mig := range migrations {
+		done, err := m.step(true, ctx)
+		if err != nil || done {
+			t.Fatalf("applying %s: done %t, %v", mig.name, done, err)
+		}
+	}
+	err = checkSchema(pool)
+	if err != nil {
+		t.Fatalf("schema isn't up to date after migrating up: %s", err)
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		done, err := m.step(false, ctx)
+		if err != nil || done {
+			t.Fatalf("rolling back %s: done %t, %v", migrations[i].name, done, err)
+		}
+	}
+	version, _, err = m.Version(ctx)
+	if err != nil || version != 0 {
+		t.Fatalf("at version %d after migrating down, %v", version, err)
+	}
+	err = m.Up(ctx)
+	if err != nil {
+		t.Fatalf("migrating up again after migrating down: %s", err)
+	}
+}
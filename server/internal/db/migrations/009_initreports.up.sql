@@ -4,5 +4,5 @@ CREATE TABLE reports (
   reason TEXT NOT NULL,
   did TEXT,
   addr TEXT,
-  posted_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+  posted_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
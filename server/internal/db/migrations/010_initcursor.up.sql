@@ -0,0 +1,5 @@
+CREATE TABLE cursors (
+  name TEXT PRIMARY KEY,
+  time_us BIGINT NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS reports_addr_posted_at_idx;
+DROP INDEX IF EXISTS reports_posted_at_idx;
+ALTER TABLE reports DROP COLUMN ban_id;
+ALTER TABLE reports DROP COLUMN resolved_by;
+ALTER TABLE reports DROP COLUMN resolved_at;
@@ -0,0 +1,6 @@
+ALTER TABLE reports ADD COLUMN resolved_at TIMESTAMPTZ;
+ALTER TABLE reports ADD COLUMN resolved_by TEXT;
+ALTER TABLE reports ADD COLUMN ban_id INTEGER REFERENCES bans(id) ON DELETE SET NULL;
+
+CREATE INDEX ON reports (posted_at DESC) WHERE resolved_at IS NULL;
+CREATE INDEX ON reports (addr, posted_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS videos_did_blob_cid_idx;
+DROP INDEX IF EXISTS videos_signet_uri_idx;
+DROP TABLE IF EXISTS videos;
@@ -0,0 +1,19 @@
+CREATE TABLE videos (
+	uri TEXT PRIMARY KEY,
+	did TEXT NOT NULL,
+	signet_uri TEXT NOT NULL,
+	FOREIGN KEY (signet_uri) REFERENCES signets(uri) ON DELETE CASCADE,
+	blob_cid TEXT,
+	blob_mime TEXT,
+	alt TEXT,
+	height INTEGER,
+	width INTEGER,
+	nick TEXT,
+	color INTEGER CHECK (color BETWEEN 0 AND 16777215),
+	cid TEXT NOT NULL,
+	posted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	indexed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON videos (signet_uri);
+CREATE INDEX ON videos (did, blob_cid);
@@ -0,0 +1 @@
+ALTER TABLE channels ADD COLUMN last_id BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+ALTER TABLE messages ADD COLUMN body_tsv tsvector
+	GENERATED ALWAYS AS (to_tsvector('simple', body)) STORED;
+CREATE INDEX ON messages USING GIN (body_tsv);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS subs_channel_uri_idx;
+DROP INDEX IF EXISTS subs_did_created_at_idx;
+DROP TABLE IF EXISTS subs;
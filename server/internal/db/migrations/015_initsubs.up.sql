@@ -0,0 +1,11 @@
+CREATE TABLE subs (
+	uri TEXT PRIMARY KEY,
+	did TEXT NOT NULL,
+	channel_uri TEXT NOT NULL,
+	cid TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	indexed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON subs (did, created_at DESC);
+CREATE INDEX ON subs (channel_uri);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS channel_posters;
+DROP INDEX IF EXISTS channel_activity_popular_rank_idx;
+DROP INDEX IF EXISTS channel_activity_active_rank_idx;
+DROP TABLE IF EXISTS channel_activity;
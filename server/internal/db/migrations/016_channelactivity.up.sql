@@ -0,0 +1,18 @@
+CREATE TABLE channel_activity (
+	channel_uri TEXT PRIMARY KEY,
+	FOREIGN KEY (channel_uri) REFERENCES channels(uri) ON DELETE CASCADE,
+	active_rank DOUBLE PRECISION NOT NULL,
+	popular_rank DOUBLE PRECISION,
+	last_active_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON channel_activity (active_rank DESC);
+CREATE INDEX ON channel_activity (popular_rank DESC NULLS LAST);
+
+CREATE TABLE channel_posters (
+	channel_uri TEXT NOT NULL,
+	FOREIGN KEY (channel_uri) REFERENCES channels(uri) ON DELETE CASCADE,
+	did TEXT NOT NULL,
+	counted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (channel_uri, did)
+);
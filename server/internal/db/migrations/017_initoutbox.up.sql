@@ -0,0 +1,15 @@
+CREATE TABLE outbox (
+	id SERIAL PRIMARY KEY,
+	uri TEXT NOT NULL UNIQUE,
+	collection TEXT NOT NULL,
+	rkey TEXT NOT NULL,
+	record JSONB NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	last_error TEXT,
+	failed_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON outbox (next_attempt_at) WHERE failed_at IS NULL;
+CREATE INDEX ON outbox (id DESC) WHERE failed_at IS NOT NULL;
@@ -0,0 +1,15 @@
+ALTER TABLE messages ADD COLUMN edited_at TIMESTAMPTZ;
+
+CREATE TABLE message_revisions (
+	id SERIAL PRIMARY KEY,
+	message_uri TEXT NOT NULL,
+	FOREIGN KEY (message_uri) REFERENCES messages(uri) ON DELETE CASCADE,
+	cid TEXT NOT NULL,
+	body TEXT,
+	nick TEXT,
+	color INTEGER CHECK (color BETWEEN 0 AND 16777215),
+	written_at TIMESTAMPTZ NOT NULL,
+	revised_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON message_revisions (message_uri, id DESC);
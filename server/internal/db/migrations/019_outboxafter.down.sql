@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS outbox_after_uri_idx;
+ALTER TABLE outbox DROP COLUMN IF EXISTS after_uri;
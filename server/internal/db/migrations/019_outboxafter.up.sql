@@ -0,0 +1,3 @@
+ALTER TABLE outbox ADD COLUMN after_uri TEXT;
+
+CREATE INDEX ON outbox (after_uri) WHERE after_uri IS NOT NULL;
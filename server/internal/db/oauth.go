@@ -2,7 +2,6 @@ package db
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"strings"
 
@@ -39,7 +38,7 @@ func (s Store) GetSession(ctx context.Context, did syntax.DID, sessionID string)
 		&csd.DPoPPrivateKeyMultibase,
 	)
 	if err != nil {
-		return nil, errors.New("error scanning: " + err.Error())
+		return nil, fmt.Errorf("error scanning: %w", err)
 	}
 	scopes := strings.Fields(scope)
 	csd.Scopes = scopes
@@ -88,7 +87,7 @@ func (s Store) SaveSession(ctx context.Context, sess oauth.ClientSessionData) er
 		sess.DPoPPrivateKeyMultibase,
 	)
 	if err != nil {
-		return errors.New("failed to insert: " + err.Error())
+		return fmt.Errorf("failed to insert: %w", err)
 	}
 	return nil
 }
@@ -96,7 +95,7 @@ func (s Store) SaveSession(ctx context.Context, sess oauth.ClientSessionData) er
 func (s Store) DeleteSession(ctx context.Context, did syntax.DID, sessionID string) error {
 	_, err := s.pool.Exec(ctx, `DELETE FROM sessions WHERE account_did = $1 AND session_id = $2`, did.String(), sessionID)
 	if err != nil {
-		return errors.New("failed to delete: " + err.Error())
+		return fmt.Errorf("failed to delete: %w", err)
 	}
 	return nil
 }
@@ -135,13 +134,13 @@ func (s Store) GetAuthRequestInfo(ctx context.Context, state string) (*oauth.Aut
 		&ari.DPoPPrivateKeyMultibase,
 	)
 	if err != nil {
-		return nil, errors.New("failed to scan: " + err.Error())
+		return nil, fmt.Errorf("failed to scan: %w", err)
 	}
 	scopes := strings.Fields(scope)
 	ari.Scopes = scopes
 	sdid, err := syntax.ParseDID(did)
 	if err != nil {
-		return nil, errors.New("failed to parse did: " + err.Error())
+		return nil, fmt.Errorf("failed to parse did: %w", err)
 	}
 	ari.AccountDID = &sdid
 	return &ari, nil
@@ -172,7 +171,7 @@ func (s Store) SaveAuthRequestInfo(ctx context.Context, info oauth.AuthRequestDa
 		info.DPoPPrivateKeyMultibase,
 	)
 	if err != nil {
-		return errors.New("failed to insert: " + err.Error())
+		return fmt.Errorf("failed to insert: %w", err)
 	}
 	return nil
 }
@@ -180,7 +179,7 @@ func (s Store) SaveAuthRequestInfo(ctx context.Context, info oauth.AuthRequestDa
 func (s Store) DeleteAuthRequestInfo(ctx context.Context, state string) error {
 	_, err := s.pool.Exec(ctx, `DELETE FROM requests WHERE state = $1`, state)
 	if err != nil {
-		return errors.New("failed to delete: " + err.Error())
+		return fmt.Errorf("failed to delete: %w", err)
 	}
 	return nil
 }
@@ -190,7 +189,7 @@ func (s *Store) SetDpopPdsNonce(id int, dpopnonce string) error {
 			UPDATE oauthsessions SET dpop_pds_nonce = $1 WHERE id = $2
 		`, dpopnonce, id)
 	if err != nil {
-		return errors.New(fmt.Sprintf("error updating dpop nonce for id %d: %s", id, err.Error()))
+		return fmt.Errorf("error updating dpop nonce for id %d: %w", id, err)
 	}
 	return nil
 }
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rvcx/internal/store"
+	"rvcx/internal/types"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// outboxTables are the tables holding the records each collection in the
+// outbox is written for
+var outboxTables = map[string]string{
+	"org.xcvr.lrc.signet":  "signets",
+	"org.xcvr.lrc.message": "messages",
+}
+
+func (s *Store) EnqueueWrite(item *types.OutboxItem, ctx context.Context) error {
+	row := s.pool.QueryRow(ctx, `
+		INSERT INTO outbox (
+			uri,
+			collection,
+			rkey,
+			record,
+			after_uri
+		) VALUES (
+			$1, $2, $3, $4, $5
+		) RETURNING id, next_attempt_at, created_at
+		`, item.URI, item.Collection, item.Rkey, item.Record, item.After)
+	err := row.Scan(&item.Id, &item.NextAttemptAt, &item.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error enqueueing write: %w", err)
+	}
+	return nil
+}
+
+const outboxColumns = `
+	o.id,
+	o.uri,
+	o.collection,
+	o.rkey,
+	o.record,
+	o.after_uri,
+	o.attempts,
+	o.next_attempt_at,
+	o.last_error,
+	o.failed_at,
+	o.created_at`
+
+func scanOutboxItems(rows pgx.Rows, limit int) ([]types.OutboxItem, error) {
+	defer rows.Close()
+	items := make([]types.OutboxItem, 0, limit)
+	for rows.Next() {
+		var item types.OutboxItem
+		err := rows.Scan(
+			&item.Id,
+			&item.URI,
+			&item.Collection,
+			&item.Rkey,
+			&item.Record,
+			&item.After,
+			&item.Attempts,
+			&item.NextAttemptAt,
+			&item.LastError,
+			&item.FailedAt,
+			&item.CreatedAt,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning write: %w", err)
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s *Store) GetDueWrites(now time.Time, limit int, ctx context.Context) ([]types.OutboxItem, error) {
+	rows, err := s.pool.Query(ctx, `SELECT `+outboxColumns+`
+		FROM outbox o
+		WHERE o.failed_at IS NULL AND o.next_attempt_at <= $2
+		AND NOT EXISTS (
+			SELECT 1 FROM outbox a
+			WHERE a.uri = o.after_uri
+			AND (a.failed_at IS NOT NULL OR a.next_attempt_at > $2)
+		)
+		ORDER BY o.id ASC
+		LIMIT $1`, limit, now)
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxItems(rows, limit)
+}
+
+func (s *Store) CompleteWrite(id int, cid string, ctx context.Context) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	var uri, collection string
+	err = tx.QueryRow(ctx, `DELETE FROM outbox o WHERE o.id = $1 RETURNING o.uri, o.collection`, id).Scan(&uri, &collection)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return store.ErrNotFound
+		}
+		return fmt.Errorf("failed to dequeue write: %w", err)
+	}
+	table, ok := outboxTables[collection]
+	if ok {
+		_, err = tx.Exec(ctx, `UPDATE `+table+` SET cid = $2 WHERE uri = $1`, uri, cid)
+		if err != nil {
+			return fmt.Errorf("failed to set cid: %w", err)
+		}
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) DeferWrite(id int, lastErr string, next time.Time, ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, `
+		UPDATE outbox o SET
+			attempts = o.attempts + 1,
+			last_error = $2,
+			next_attempt_at = $3
+		WHERE o.id = $1`, id, lastErr, next)
+	if err != nil {
+		return fmt.Errorf("error deferring write: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) FailWrite(id int, lastErr string, ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, `
+		UPDATE outbox o SET
+			attempts = o.attempts + 1,
+			last_error = $2,
+			failed_at = now()
+		WHERE o.id = $1`, id, lastErr)
+	if err != nil {
+		return fmt.Errorf("error failing write: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) FailWritesAfter(uri string, lastErr string, ctx context.Context) ([]types.OutboxItem, error) {
+	rows, err := s.pool.Query(ctx, `
+		UPDATE outbox o SET
+			last_error = $2,
+			failed_at = now()
+		WHERE o.after_uri = $1 AND o.failed_at IS NULL
+		RETURNING `+outboxColumns, uri, lastErr)
+	if err != nil {
+		return nil, fmt.Errorf("error failing writes: %w", err)
+	}
+	return scanOutboxItems(rows, 0)
+}
+
+func (s *Store) CancelWrite(uri string, ctx context.Context) (bool, error) {
+	commandTag, err := s.pool.Exec(ctx, `DELETE FROM outbox o WHERE o.uri = $1`, uri)
+	if err != nil {
+		return false, fmt.Errorf("error cancelling write: %w", err)
+	}
+	return commandTag.RowsAffected() > 0, nil
+}
+
+func (s *Store) GetFailedWrites(limit int, cursor *int, ctx context.Context) ([]types.OutboxItem, error) {
+	queryFmt := `SELECT ` + outboxColumns + `
+		FROM outbox o
+		WHERE o.failed_at IS NOT NULL %s
+		ORDER BY o.id DESC
+		LIMIT $1`
+	var rows pgx.Rows
+	var err error
+	if cursor != nil {
+		rows, err = s.pool.Query(ctx, fmt.Sprintf(queryFmt, "AND o.id < $2"), limit, *cursor)
+	} else {
+		rows, err = s.pool.Query(ctx, fmt.Sprintf(queryFmt, ""), limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scanOutboxItems(rows, limit)
+}
+
+func (s *Store) RequeueWrite(id int, ctx context.Context) error {
+	commandTag, err := s.pool.Exec(ctx, `
+		UPDATE outbox o SET
+			attempts = 0,
+			failed_at = NULL,
+			next_attempt_at = now()
+		WHERE o.id = $1 AND o.failed_at IS NOT NULL`, id)
+	if err != nil {
+		return fmt.Errorf("error requeueing write: %w", err)
+	}
+	if commandTag.RowsAffected() == 0 {
+		return store.ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rvcx/internal/types"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func (s *Store) StoreAuthReport(report *types.AuthReport, ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO reports (
+			uri,
+			reason,
+			did,
+			posted_at
+		) VALUES (
+			$1, $2, $3, $4
+		)`, report.URI, report.Reason, report.DID, report.ReportedAt)
+	if err != nil {
+		return fmt.Errorf("error storing report: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) StoreAnonReport(report *types.AnonReport, ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO reports (
+			uri,
+			reason,
+			addr,
+			posted_at
+		) VALUES (
+			$1, $2, $3, $4
+		)`, report.URI, report.Reason, report.Addr, report.ReportedAt)
+	if err != nil {
+		return fmt.Errorf("error storing report: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) CountReportsFromAddr(addr string, since time.Time, ctx context.Context) (int, error) {
+	row := s.pool.QueryRow(ctx, `SELECT COUNT(*) FROM reports r WHERE r.addr = $1 AND r.posted_at > $2`, addr, since)
+	var count int
+	err := row.Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting reports: %w", err)
+	}
+	return count, nil
+}
+
+const reportColumns = `
+	r.id,
+	r.uri,
+	r.reason,
+	r.did,
+	r.addr,
+	r.posted_at,
+	r.resolved_at,
+	r.resolved_by,
+	r.ban_id`
+
+func scanReport(row pgx.Row) (*types.Report, error) {
+	var report types.Report
+	err := row.Scan(
+		&report.Id,
+		&report.URI,
+		&report.Reason,
+		&report.DID,
+		&report.Addr,
+		&report.ReportedAt,
+		&report.ResolvedAt,
+		&report.ResolvedBy,
+		&report.BanId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// GetReports pages through reports newest first. the cursor is the id of the
+// last report on the previous page
+func (s *Store) GetReports(resolved bool, limit int, cursor *int, ctx context.Context) ([]types.Report, error) {
+	queryFmt := `SELECT ` + reportColumns + `
+		FROM reports r
+		WHERE (r.resolved_at IS NOT NULL) = $2 %s
+		ORDER BY r.id DESC
+		LIMIT $1`
+	var rows pgx.Rows
+	var err error
+	if cursor != nil {
+		rows, err = s.pool.Query(ctx, fmt.Sprintf(queryFmt, "AND r.id < $3"), limit, resolved, *cursor)
+	} else {
+		rows, err = s.pool.Query(ctx, fmt.Sprintf(queryFmt, ""), limit, resolved)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reports := make([]types.Report, 0, limit)
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning report: %w", err)
+		}
+		reports = append(reports, *report)
+	}
+	return reports, nil
+}
+
+func (s *Store) GetReport(id int, ctx context.Context) (*types.Report, error) {
+	row := s.pool.QueryRow(ctx, `SELECT `+reportColumns+` FROM reports r WHERE r.id = $1`, id)
+	report, err := scanReport(row)
+	if err != nil {
+		return nil, fmt.Errorf("error getting report: %w", err)
+	}
+	return report, nil
+}
+
+// ResolveReport marks a report as dealt with. if ban is non nil, the ban is
+// created in the same transaction and attached to the report
+func (s *Store) ResolveReport(id int, resolvedBy string, ban *types.Ban, ctx context.Context) (*types.Report, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin: %w", err)
+	}
+	defer tx.Rollback(ctx)
+	var banId *int
+	if ban != nil {
+		var bid int
+		err = tx.QueryRow(ctx, `INSERT INTO bans (
+			did,
+			reason,
+			till
+			) VALUES (
+			$1, $2, $3
+			) RETURNING id`, ban.Did, ban.Reason, ban.Till).Scan(&bid)
+		if err != nil {
+			return nil, fmt.Errorf("failed to ban: %w", err)
+		}
+		banId = &bid
+	}
+	row := tx.QueryRow(ctx, `
+		UPDATE reports r SET
+			resolved_at = now(),
+			resolved_by = $2,
+			ban_id = $3
+		WHERE r.id = $1 AND r.resolved_at IS NULL
+		RETURNING `+reportColumns, id, resolvedBy, banId)
+	report, err := scanReport(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errors.New("report doesn't exist or was already resolved")
+		}
+		return nil, fmt.Errorf("failed to resolve report: %w", err)
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return report, nil
+}
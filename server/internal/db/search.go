@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"rvcx/internal/types"
+	"strings"
+)
+
+// headlineOpts is how ts_headline cuts snippets out of a message body
+const headlineOpts = `StartSel=<mark>, StopSel=</mark>, MaxWords=24, MinWords=8, MaxFragments=2, FragmentDelimiter=" … "`
+
+// escapedBody is the message body escaped the same way html.EscapeString
+// does it. snippets are html, so the body is escaped before ts_headline marks
+// it up, leaving <mark> as the only markup in them
+const escapedBody = `replace(replace(replace(replace(replace(m.body,
+	'&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&#34;'), '''', '&#39;')`
+
+const searchQueryFmt = `
+	SELECT
+		m.uri,
+		m.did,
+		dh.handle,
+		p.display_name,
+		p.status,
+		p.color,
+		p.avatar_cid,
+		p.default_nick,
+		m.body,
+		m.nick,
+		m.color,
+		s.uri,
+		issuer_dh.handle,
+		s.channel_uri,
+		s.message_id,
+		s.author_handle,
+		s.started_at,
+		m.posted_at,
+		m.edited_at,
+		ts_headline('simple', %s, q, '%s')
+	FROM messages m
+	JOIN signets s ON m.signet_uri = s.uri
+	JOIN did_handles dh ON m.did = dh.did
+	LEFT JOIN profiles p ON m.did = p.did
+	JOIN did_handles issuer_dh ON s.issuer_did = issuer_dh.did
+	CROSS JOIN websearch_to_tsquery('simple', $2) q
+	WHERE m.body_tsv @@ q
+		AND m.did = s.author
+		AND dh.handle = s.author_handle
+		AND NOT EXISTS (
+			SELECT 1 FROM bans b
+			WHERE b.did = m.did AND (b.till IS NULL OR b.till > now())
+		) %s
+	ORDER BY m.posted_at DESC, m.uri DESC
+	LIMIT $1
+	`
+
+// SearchMessages finds messages whose body matches params.Query, newest
+// first. like history, messages only count if they were posted by whoever
+// their signet was issued to, and nothing by someone who is banned is found
+func (s *Store) SearchMessages(params types.SearchMessagesParams, ctx context.Context) ([]types.SearchResult, error) {
+	args := []any{params.Limit, params.Query}
+	var filters strings.Builder
+	filter := func(cond string, arg any) {
+		args = append(args, arg)
+		fmt.Fprintf(&filters, "\n\t\tAND "+cond, len(args))
+	}
+	if params.ChannelURI != nil {
+		filter("s.channel_uri = $%d", *params.ChannelURI)
+	}
+	if params.AuthorDID != nil {
+		filter("m.did = $%d", *params.AuthorDID)
+	}
+	if params.AuthorHandle != nil {
+		filter("dh.handle = $%d", *params.AuthorHandle)
+	}
+	if params.Since != nil {
+		filter("m.posted_at >= $%d", *params.Since)
+	}
+	if params.Until != nil {
+		filter("m.posted_at < $%d", *params.Until)
+	}
+	if params.Cursor != nil {
+		args = append(args, params.Cursor.At, params.Cursor.URI)
+		fmt.Fprintf(&filters, "\n\t\tAND (m.posted_at, m.uri) < ($%d, $%d)", len(args)-1, len(args))
+	}
+	query := fmt.Sprintf(searchQueryFmt, escapedBody, headlineOpts, filters.String())
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error searching messages: %w", err)
+	}
+	defer rows.Close()
+	results := make([]types.SearchResult, 0)
+	for rows.Next() {
+		var res types.SearchResult
+		msg := &res.Message
+		err := rows.Scan(
+			&msg.URI,
+
+			&msg.Author.DID,
+			&msg.Author.Handle,
+			&msg.Author.DisplayName,
+			&msg.Author.Status,
+			&msg.Author.Color,
+			&msg.Author.Avatar,
+			&msg.Author.DefaultNick,
+
+			&msg.Body,
+			&msg.Nick,
+			&msg.Color,
+
+			&msg.Signet.URI,
+			&msg.Signet.Issuer,
+			&msg.Signet.ChannelURI,
+			&msg.Signet.LrcId,
+			&msg.Signet.AuthorHandle,
+			&msg.Signet.StartedAt,
+
+			&msg.PostedAt,
+			&msg.EditedAt,
+			&res.Snippet,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning search result: %w", err)
+		}
+		msg.Edited = msg.EditedAt != nil
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
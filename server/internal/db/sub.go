@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"rvcx/internal/types"
+)
+
+func (s *Store) StoreSub(sub *types.Sub, ctx context.Context) (wasNew bool, err error) {
+	commandTag, err := s.pool.Exec(ctx, `
+		INSERT INTO subs (
+			uri,
+			did,
+			channel_uri,
+			cid,
+			created_at
+		) VALUES (
+			$1, $2, $3, $4, $5
+		) ON CONFLICT (uri) DO NOTHING
+		`, sub.URI, sub.DID, sub.ChannelURI, sub.CID, sub.CreatedAt)
+	if err != nil {
+		err = fmt.Errorf("error storing sub: %w", err)
+		return
+	}
+	wasNew = commandTag.RowsAffected() > 0
+	return
+}
+
+func (s *Store) UpdateSub(sub *types.Sub, ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO subs (
+			uri,
+			did,
+			channel_uri,
+			cid,
+			created_at
+		) VALUES (
+			$1, $2, $3, $4, $5
+		) ON CONFLICT (uri) DO UPDATE SET
+			channel_uri = EXCLUDED.channel_uri,
+			cid = EXCLUDED.cid,
+			created_at = EXCLUDED.created_at,
+			indexed_at = now()
+		`, sub.URI, sub.DID, sub.ChannelURI, sub.CID, sub.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error updating sub: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) DeleteSub(uri string, ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM subs WHERE uri = $1`, uri)
+	return err
+}
+
+// GetSubURIs gets every sub did has for channelURI. there is usually just
+// the one, but nothing stops someone from writing more
+func (s *Store) GetSubURIs(did string, channelURI string, ctx context.Context) ([]string, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT uri FROM subs WHERE did = $1 AND channel_uri = $2
+		`, did, channelURI)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	uris := make([]string, 0, 1)
+	for rows.Next() {
+		var uri string
+		err := rows.Scan(&uri)
+		if err != nil {
+			return nil, err
+		}
+		uris = append(uris, uri)
+	}
+	return uris, rows.Err()
+}
+
+func (s *Store) GetSubscriptions(did string, limit int, cursor *types.KeysetCursor, ctx context.Context) ([]types.SubView, error) {
+	queryFmt := `
+		SELECT
+			sub.uri,
+			sub.created_at,
+			c.uri,
+			c.host,
+			c.title,
+			c.topic,
+			c.created_at,
+			dh.did,
+			dh.handle,
+			p.display_name,
+			p.status,
+			p.color,
+			p.avatar_cid
+		FROM subs sub
+		JOIN channels c ON sub.channel_uri = c.uri
+		JOIN did_handles dh ON c.did = dh.did
+		LEFT JOIN profiles p ON c.did = p.did
+		WHERE sub.did = $2 %s
+		ORDER BY sub.created_at DESC, sub.uri DESC
+		LIMIT $1
+		`
+	args := []any{limit, did}
+	query := fmt.Sprintf(queryFmt, "")
+	if cursor != nil {
+		query = fmt.Sprintf(queryFmt, "AND (sub.created_at, sub.uri) < ($3, $4)")
+		args = append(args, cursor.At, cursor.URI)
+	}
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	subs := make([]types.SubView, 0, limit)
+	for rows.Next() {
+		var sv types.SubView
+		c := &sv.Channel
+		err := rows.Scan(&sv.URI, &sv.CreatedAt, &c.URI, &c.Host, &c.Title, &c.Topic, &c.CreatedAt, &c.Creator.DID, &c.Creator.Handle, &c.Creator.DisplayName, &c.Creator.Status, &c.Creator.Color, &c.Creator.Avatar)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sv)
+	}
+	return subs, rows.Err()
+}
+
+func (s *Store) GetMyChannels(did string, limit int, cursor *types.KeysetCursor, ctx context.Context) ([]types.ChannelView, error) {
+	queryFmt := `
+		SELECT * FROM (
+			SELECT
+				c.uri,
+				c.host,
+				c.title,
+				c.topic,
+				c.created_at,
+				dh.did,
+				dh.handle,
+				p.display_name,
+				p.status,
+				p.color,
+				p.avatar_cid,
+				COALESCE(latest.started_at, c.created_at) AS active_at
+			FROM channels c
+			JOIN did_handles dh ON c.did = dh.did
+			LEFT JOIN profiles p ON c.did = p.did
+			LEFT JOIN LATERAL (
+				SELECT s.started_at
+				FROM signets s
+				WHERE s.channel_uri = c.uri
+				ORDER BY s.message_id DESC
+				LIMIT 1
+			) latest ON true
+			WHERE EXISTS (
+				SELECT 1 FROM subs sub
+				WHERE sub.did = $2 AND sub.channel_uri = c.uri
+			)
+		) mine
+		%s
+		ORDER BY active_at DESC, uri DESC
+		LIMIT $1
+		`
+	args := []any{limit, did}
+	query := fmt.Sprintf(queryFmt, "")
+	if cursor != nil {
+		query = fmt.Sprintf(queryFmt, "WHERE (active_at, uri) < ($3, $4)")
+		args = append(args, cursor.At, cursor.URI)
+	}
+	rows, err := s.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chans := make([]types.ChannelView, 0, limit)
+	for rows.Next() {
+		var c types.ChannelView
+		var p types.ProfileView
+		err := rows.Scan(&c.URI, &c.Host, &c.Title, &c.Topic, &c.CreatedAt, &p.DID, &p.Handle, &p.DisplayName, &p.Status, &p.Color, &p.Avatar, &c.LastActiveAt)
+		if err != nil {
+			return nil, err
+		}
+		c.Creator = p
+		chans = append(chans, c)
+	}
+	return chans, rows.Err()
+}
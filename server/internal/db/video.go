@@ -0,0 +1,168 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"rvcx/internal/types"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func (s *Store) StoreVideo(video *types.Video, ctx context.Context) (wasNew bool, err error) {
+	wasNew, err = s.insertCounted(ctx, video.SignetURI, video.DID, `INSERT INTO videos (
+		uri,
+		did,
+		signet_uri,
+		blob_cid,
+		blob_mime,
+		alt,
+		height,
+		width,
+		nick,
+		color,
+		cid,
+		posted_at
+		) VALUES (
+		$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12
+		) ON CONFLICT (uri) DO NOTHING`,
+		video.URI,
+		video.DID,
+		video.SignetURI,
+		video.BlobCID,
+		video.BlobMIME,
+		video.Alt,
+		video.Height,
+		video.Width,
+		video.Nick,
+		video.Color,
+		video.CID,
+		video.PostedAt)
+	if err != nil {
+		err = fmt.Errorf("error storing video: %w", err)
+	}
+	return
+}
+
+func (s *Store) UpdateVideo(video *types.Video, ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, `INSERT INTO videos (
+		uri,
+		did,
+		signet_uri,
+		blob_cid,
+		blob_mime,
+		alt,
+		height,
+		width,
+		nick,
+		color,
+		cid,
+		posted_at
+		) VALUES (
+		$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12
+		) ON CONFLICT (uri) DO UPDATE SET
+		blob_cid = EXCLUDED.blob_cid,
+		blob_mime = EXCLUDED.blob_mime,
+		alt = EXCLUDED.alt,
+		height = EXCLUDED.height,
+		width = EXCLUDED.width,
+		nick = EXCLUDED.nick,
+		color = EXCLUDED.color,
+		cid = EXCLUDED.cid`,
+		video.URI,
+		video.DID,
+		video.SignetURI,
+		video.BlobCID,
+		video.BlobMIME,
+		video.Alt,
+		video.Height,
+		video.Width,
+		video.Nick,
+		video.Color,
+		video.CID,
+		video.PostedAt)
+	if err != nil {
+		return fmt.Errorf("error updating video: %w", err)
+	}
+	return nil
+}
+
+func (s *Store) DeleteVideo(uri string, ctx context.Context) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM videos v WHERE v.uri = $1`, uri)
+	if err != nil {
+		return fmt.Errorf("error deleting video: %w", err)
+	}
+	return nil
+}
+
+const videoColumns = `
+	v.uri,
+	v.did,
+	v.signet_uri,
+	v.blob_cid,
+	v.blob_mime,
+	v.alt,
+	v.height,
+	v.width,
+	v.nick,
+	v.color,
+	v.cid,
+	v.posted_at`
+
+func scanVideo(row pgx.Row) (*types.Video, error) {
+	var video types.Video
+	var alt *string
+	err := row.Scan(
+		&video.URI,
+		&video.DID,
+		&video.SignetURI,
+		&video.BlobCID,
+		&video.BlobMIME,
+		&alt,
+		&video.Height,
+		&video.Width,
+		&video.Nick,
+		&video.Color,
+		&video.CID,
+		&video.PostedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if alt != nil {
+		video.Alt = *alt
+	}
+	return &video, nil
+}
+
+func (s *Store) GetVideo(uri string, ctx context.Context) (*types.Video, error) {
+	row := s.pool.QueryRow(ctx, `SELECT `+videoColumns+` FROM videos v WHERE v.uri = $1`, uri)
+	video, err := scanVideo(row)
+	if err != nil {
+		return nil, fmt.Errorf("error getting video: %w", err)
+	}
+	return video, nil
+}
+
+func (s *Store) GetVideoDidCID(did string, cid string, ctx context.Context) (*types.Video, error) {
+	row := s.pool.QueryRow(ctx, `SELECT `+videoColumns+` FROM videos v WHERE v.did = $1 AND v.blob_cid = $2`, did, cid)
+	video, err := scanVideo(row)
+	if err != nil {
+		return nil, fmt.Errorf("error getting video: %w", err)
+	}
+	return video, nil
+}
+
+// GetVideoChannelURI finds the channel a video was posted in by way of its
+// signet
+func (s *Store) GetVideoChannelURI(uri string, ctx context.Context) (string, error) {
+	row := s.pool.QueryRow(ctx, `
+		SELECT s.channel_uri FROM videos v
+		JOIN signets s ON v.signet_uri = s.uri
+		WHERE v.uri = $1`, uri)
+	var channelURI string
+	err := row.Scan(&channelURI)
+	if err != nil {
+		return "", fmt.Errorf("error scanning: %w", err)
+	}
+	return channelURI, nil
+}
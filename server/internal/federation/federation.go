@@ -0,0 +1,189 @@
+package federation
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"rvcx/internal/atputils"
+	"rvcx/internal/config"
+	"rvcx/internal/log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ServiceID is the id of the service entry an rvcx backend puts in its did
+// document, pointing at where it can be reached, e.g.
+//
+//	{"id": "#xcvr_lrc", "type": "XcvrLrcServer", "serviceEndpoint": "https://xcvr.org"}
+const ServiceID = "#xcvr_lrc"
+
+// cacheFor is how long we remember where a backend lives. did documents
+// rarely change, but when they do we don't want to be stuck with the old one
+const cacheFor = 10 * time.Minute
+
+type Mode string
+
+const (
+	// ModeProxy sits between the client and the remote backend, so clients
+	// only ever talk to us
+	ModeProxy Mode = "proxy"
+	// ModeRedirect hands clients the remote backend's url to connect to
+	// themselves
+	ModeRedirect Mode = "redirect"
+)
+
+// ErrNotAllowed is returned for backends we won't connect to: anything that
+// isn't https, that resolves to an address inside our network, or that is us
+var ErrNotAllowed = errors.New("backend isn't somewhere we'll connect to")
+
+// Federation finds the backends that host channels we don't, and gets
+// clients connected to them
+type Federation struct {
+	logger     *log.Logger
+	mode       Mode
+	did        string
+	host       string
+	httpClient *http.Client
+	resolve    func(ctx context.Context, did string) (string, error)
+	// allowed says whether we'll connect to ip. a did document can say
+	// anything, so by default only public addresses are
+	allowed func(ip net.IP) bool
+	// tlsConfig is used when dialing remote backends, nil means the defaults
+	tlsConfig *tls.Config
+
+	mu    sync.Mutex
+	cache map[string]entry
+	// proxied is every client we're proxying for, guarded by mu. once
+	// closing, no more are let in
+	proxied map[*websocket.Conn]bool
+	closing bool
+}
+
+type entry struct {
+	endpoint string
+	expires  time.Time
+}
+
+func New(cfg *config.Config, l *log.Logger) *Federation {
+	mode := Mode(cfg.FederationMode)
+	if mode != ModeRedirect {
+		mode = ModeProxy
+	}
+	f := &Federation{
+		logger:     l,
+		mode:       mode,
+		did:        cfg.DID,
+		host:       strings.ToLower(cfg.Identity),
+		httpClient: http.DefaultClient,
+		allowed:    isPublic,
+		cache:      make(map[string]entry),
+		proxied:    make(map[*websocket.Conn]bool),
+	}
+	f.resolve = func(ctx context.Context, did string) (string, error) {
+		return atputils.GetServiceFromDid(ctx, did, ServiceID, f.httpClient)
+	}
+	return f
+}
+
+// SetResolver overrides how a host did gets mapped to its backend, which is
+// mostly useful for pointing two backends at each other locally
+func (f *Federation) SetResolver(r func(ctx context.Context, did string) (string, error)) {
+	f.resolve = r
+}
+
+func (f *Federation) Mode() Mode {
+	return f.mode
+}
+
+// Endpoint returns the base url of the backend that hosts channels for
+// hostDID, like https://xcvr.org
+func (f *Federation) Endpoint(ctx context.Context, hostDID string) (string, error) {
+	if hostDID == f.did {
+		return "", fmt.Errorf("%s is us: %w", hostDID, ErrNotAllowed)
+	}
+	now := time.Now()
+	f.mu.Lock()
+	e, ok := f.cache[hostDID]
+	f.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.endpoint, nil
+	}
+	endpoint, err := f.resolve(ctx, hostDID)
+	if err != nil {
+		return "", fmt.Errorf("failed to find backend for %s: %w", hostDID, err)
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	err = f.check(ctx, endpoint)
+	if err != nil {
+		f.logger.WarnContext(ctx, "refusing backend", "host", hostDID, "endpoint", endpoint, "err", err)
+		return "", err
+	}
+	f.mu.Lock()
+	f.cache[hostDID] = entry{endpoint, now.Add(cacheFor)}
+	f.mu.Unlock()
+	return endpoint, nil
+}
+
+// WSURL is the url of a channel's lrc websocket on the backend that hosts it
+func (f *Federation) WSURL(ctx context.Context, hostDID string, did string, rkey string) (string, error) {
+	endpoint, err := f.Endpoint(ctx, hostDID)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("backend has a strange endpoint: %w", err)
+	}
+	u.Scheme = "wss"
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/lrc/" + did + "/" + rkey + "/ws"
+	return u.String(), nil
+}
+
+// check makes sure endpoint is an https url that isn't us and doesn't resolve
+// to anywhere private. the proxy dialer checks the address again when it
+// connects, since dns can change its mind in between
+func (f *Federation) check(ctx context.Context, endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("backend has a strange endpoint: %w", err)
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("%s isn't https: %w", endpoint, ErrNotAllowed)
+	}
+	if u.User != nil || u.Hostname() == "" {
+		return fmt.Errorf("%s isn't a plain host: %w", endpoint, ErrNotAllowed)
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == f.host {
+		return fmt.Errorf("%s is us: %w", endpoint, ErrNotAllowed)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+	for _, ip := range ips {
+		if !f.allowed(ip) {
+			return fmt.Errorf("%s resolves to %s: %w", host, ip, ErrNotAllowed)
+		}
+	}
+	return nil
+}
+
+// isPublic is whether ip is somewhere on the internet rather than on our
+// machine or network
+func isPublic(ip net.IP) bool {
+	return !(ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast())
+}
@@ -0,0 +1,164 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// forwardedHeaders are passed through to the remote backend when dialing it,
+// everything websocket specific is handled by the dialer
+var forwardedHeaders = []string{
+	"Origin",
+	"User-Agent",
+	"X-Real-IP",
+}
+
+// viaHeader is set on every websocket we proxy. a backend that gets a
+// request which already has it doesn't proxy it again, so two backends that
+// each think the other hosts a channel can't bounce a client between them
+const viaHeader = "Xcvr-Via"
+
+// ProxyWS connects to the websocket at target, upgrades the client, and
+// passes frames between the two until either side goes away. if the remote
+// end can't be reached, the client gets an error response rather than an
+// upgrade
+func (f *Federation) ProxyWS(w http.ResponseWriter, r *http.Request, target string) error {
+	if via := r.Header.Get(viaHeader); via != "" {
+		http.Error(w, "channel is already being proxied", http.StatusLoopDetected)
+		return fmt.Errorf("already proxied by %s: %w", via, ErrNotAllowed)
+	}
+	hdr := http.Header{}
+	for _, k := range forwardedHeaders {
+		if v := r.Header.Get(k); v != "" {
+			hdr.Set(k, v)
+		}
+	}
+	hdr.Set(viaHeader, f.host)
+	subprotocols := websocket.Subprotocols(r)
+	netDialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: f.control,
+	}
+	dialer := &websocket.Dialer{
+		NetDialContext:   netDialer.DialContext,
+		HandshakeTimeout: 10 * time.Second,
+		Subprotocols:     subprotocols,
+		TLSClientConfig:  f.tlsConfig,
+	}
+	remote, resp, err := dialer.DialContext(r.Context(), target, hdr)
+	if err != nil {
+		http.Error(w, "couldn't reach the channel's backend", http.StatusBadGateway)
+		if resp != nil {
+			return fmt.Errorf("remote backend refused websocket: %s", resp.Status)
+		}
+		return fmt.Errorf("failed to dial remote backend: %w", err)
+	}
+	defer remote.Close()
+
+	upgrader := &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	var respHdr http.Header
+	if sp := remote.Subprotocol(); sp != "" {
+		respHdr = http.Header{"Sec-Websocket-Protocol": {sp}}
+	}
+	client, err := upgrader.Upgrade(w, r, respHdr)
+	if err != nil {
+		return fmt.Errorf("failed to upgrade client: %w", err)
+	}
+	defer client.Close()
+	if !f.track(client) {
+		goingAway(client, time.Now().Add(5*time.Second))
+		return nil
+	}
+	defer f.untrack(client)
+
+	done := make(chan struct{}, 2)
+	go pipe(remote, client, done)
+	go pipe(client, remote, done)
+	<-done
+	return nil
+}
+
+// control runs right before each connection to a remote backend, once the
+// address is resolved, so a backend whose dns changes after Endpoint checked it
+// still can't point us inside our network
+func (f *Federation) control(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !f.allowed(ip) {
+		return fmt.Errorf("dialing %s: %w", address, ErrNotAllowed)
+	}
+	return nil
+}
+
+func (f *Federation) track(client *websocket.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closing {
+		return false
+	}
+	f.proxied[client] = true
+	return true
+}
+
+func (f *Federation) untrack(client *websocket.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.proxied, client)
+}
+
+// Shutdown tells every client we're proxying for that we're going away and
+// closes their connections, which closes the remote ends too
+func (f *Federation) Shutdown(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closing = true
+	for client := range f.proxied {
+		goingAway(client, deadline)
+		client.Close()
+	}
+}
+
+func goingAway(conn *websocket.Conn, deadline time.Time) {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "shutting down")
+	conn.WriteControl(websocket.CloseMessage, msg, deadline)
+}
+
+// pipe copies frames from src to dst. when src closes, the close is passed on
+// to dst so that the other side finds out
+func pipe(dst *websocket.Conn, src *websocket.Conn, done chan<- struct{}) {
+	defer func() { done <- struct{}{} }()
+	for {
+		mt, b, err := src.ReadMessage()
+		if err != nil {
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) && ce.Code != websocket.CloseNoStatusReceived {
+				msg = websocket.FormatCloseMessage(ce.Code, ce.Text)
+			}
+			dst.WriteControl(websocket.CloseMessage, msg, time.Now().Add(5*time.Second))
+			return
+		}
+		err = dst.WriteMessage(mt, b)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"rvcx/internal/types"
+	"strconv"
+	"strings"
+
+	atoauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
+)
+
+func (h *Handler) subscribe(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
+	if cs == nil {
+		h.badRequest(w, r, errors.New("must be authorized to subscribe"))
+		return
+	}
+	var sr types.SubscribeRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&sr)
+	if err != nil || sr.ChannelURI == "" {
+		h.badRequest(w, r, fmt.Errorf("couldn't decode subscribe request: %w", err))
+		return
+	}
+	uri, err := h.rm.Subscribe(cs, sr.ChannelURI, r.Context())
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to subscribe: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(types.SubscribeOut{URI: uri})
+}
+
+func (h *Handler) unsubscribe(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
+	if cs == nil {
+		h.badRequest(w, r, errors.New("must be authorized to unsubscribe"))
+		return
+	}
+	var sr types.SubscribeRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&sr)
+	if err != nil || sr.ChannelURI == "" {
+		h.badRequest(w, r, fmt.Errorf("couldn't decode unsubscribe request: %w", err))
+		return
+	}
+	err = h.rm.Unsubscribe(cs, sr.ChannelURI, r.Context())
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to unsubscribe: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *Handler) getSubscriptions(w http.ResponseWriter, r *http.Request) {
+	actor := r.URL.Query().Get("actor")
+	if actor == "" {
+		h.badRequest(w, r, errors.New("did not provide actor"))
+		return
+	}
+	did := actor
+	if !strings.HasPrefix(actor, "did:") {
+		var err error
+		did, err = h.db.FullResolveHandle(actor, r.Context())
+		if err != nil {
+			h.notFound(w, r, err)
+			return
+		}
+	}
+	limit, cursor, ok := h.parsePage(w, r)
+	if !ok {
+		return
+	}
+	subs, err := h.db.GetSubscriptions(did, limit, cursor, r.Context())
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to get subscriptions: %w", err))
+		return
+	}
+	var gso types.GetSubscriptionsOut
+	gso.Subscriptions = subs
+	if len(subs) == limit {
+		last := subs[len(subs)-1]
+		cursor := types.KeysetCursor{At: last.CreatedAt, URI: last.URI}.String()
+		gso.Cursor = &cursor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(gso)
+}
+
+// getMyChannels is the channels the session is subscribed to, with whichever
+// had something said in it most recently first
+func (h *Handler) getMyChannels(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
+	if cs == nil {
+		h.badRequest(w, r, errors.New("must be authorized to get your channels"))
+		return
+	}
+	limit, cursor, ok := h.parsePage(w, r)
+	if !ok {
+		return
+	}
+	chans, err := h.db.GetMyChannels(cs.Data.AccountDID.String(), limit, cursor, r.Context())
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to get my channels: %w", err))
+		return
+	}
+	h.liven(chans)
+	var gmo types.GetMyChannelsOut
+	gmo.Channels = chans
+	if len(chans) == limit {
+		last := chans[len(chans)-1]
+		cursor := types.KeysetCursor{At: *last.LastActiveAt, URI: last.URI}.String()
+		gmo.Cursor = &cursor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(gmo)
+}
+
+// parsePage reads the limit and keyset cursor of a paginated query, and
+// writes an error if the cursor is malformed
+func (h *Handler) parsePage(w http.ResponseWriter, r *http.Request) (limit int, cursor *types.KeysetCursor, ok bool) {
+	limit = parseLimit(r)
+	cursorstr := r.URL.Query().Get("cursor")
+	if cursorstr != "" {
+		var err error
+		cursor, err = types.ParseKeysetCursor(cursorstr)
+		if err != nil {
+			h.badRequest(w, r, err)
+			return 0, nil, false
+		}
+	}
+	return limit, cursor, true
+}
+
+// parseLimit reads the limit of a paginated query, which defaults to 50 and
+// is at most 100
+func parseLimit(r *http.Request) int {
+	limitstr := r.URL.Query().Get("limit")
+	if limitstr != "" {
+		l, err := strconv.Atoi(limitstr)
+		if err == nil {
+			return max(min(l, 100), 1)
+		}
+	}
+	return 50
+}
@@ -1,38 +1,59 @@
 package handler
 
 import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/gorilla/sessions"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-	"os"
-	"rvcx/internal/db"
+	"rvcx/internal/banpolicy"
+	"rvcx/internal/config"
+	"rvcx/internal/federation"
 	"rvcx/internal/log"
+	"rvcx/internal/metrics"
 	"rvcx/internal/model"
 	"rvcx/internal/oauth"
 	"rvcx/internal/recordmanager"
+	"rvcx/internal/store"
+	"rvcx/internal/types"
 )
 
 type Handler struct {
-	db           *db.Store
+	cfg          *config.Config
+	db           store.Store
 	sessionStore *sessions.CookieStore
 	router       *http.ServeMux
 	logger       *log.Logger
 	oauth        *oauth.Service
 	model        *model.Model
 	rm           *recordmanager.RecordManager
+	bans         *banpolicy.Policy
+	fed          *federation.Federation
 }
 
-func New(db *db.Store, logger *log.Logger, oauthserv *oauth.Service, model *model.Model, recordmanager *recordmanager.RecordManager) *Handler {
+func New(cfg *config.Config, db store.Store, logger *log.Logger, oauthserv *oauth.Service, model *model.Model, recordmanager *recordmanager.RecordManager, bans *banpolicy.Policy, fed *federation.Federation) *Handler {
 	mux := http.NewServeMux()
-	sessionStore := sessions.NewCookieStore([]byte(os.Getenv("SESSION_KEY")))
-	h := &Handler{db, sessionStore, mux, logger, oauthserv, model, recordmanager}
+	sessionStore := sessions.NewCookieStore([]byte(cfg.SessionKey))
+	h := &Handler{cfg, db, sessionStore, mux, logger, oauthserv, model, recordmanager, bans, fed}
 	// lrc handlers
 	mux.HandleFunc("GET /lrc/{user}/{rkey}/ws", h.WithCORS(h.acceptWebsocket))
 	mux.HandleFunc("DELETE /lrc/{user}/{rkey}/ws", h.oauthMiddleware(h.deleteChannel))
 	mux.HandleFunc("POST /lrc/channel", h.oauthMiddleware(h.postChannel))
 	mux.HandleFunc("POST /lrc/message", h.oauthMiddleware(h.postMessage))
+	mux.HandleFunc("PUT /lrc/message", h.oauthMiddleware(h.editMessage))
+	mux.HandleFunc("DELETE /lrc/message", h.oauthMiddleware(h.deleteMessage))
 	mux.HandleFunc("POST /lrc/image", h.oauthMiddleware(h.uploadImage))
+	mux.HandleFunc("POST /lrc/video", h.oauthMiddleware(h.uploadVideo))
 	mux.HandleFunc("POST /lrc/media", h.oauthMiddleware(h.postMedia))
+	mux.HandleFunc("PUT /lrc/media", h.oauthMiddleware(h.editMedia))
+	mux.HandleFunc("DELETE /lrc/media", h.oauthMiddleware(h.deleteMedia))
 	mux.HandleFunc("GET  /lrc/image", h.WithCORS(h.getImage))
 	mux.HandleFunc("POST /lrc/mymessage", h.postMyMessage)
 	// xcvr handlers
@@ -41,30 +62,43 @@ func New(db *db.Store, logger *log.Logger, oauthserv *oauth.Service, model *mode
 	// lexicon handlers
 	mux.HandleFunc("GET /xrpc/org.xcvr.feed.getChannels", h.WithCORS(h.getChannels))
 	mux.HandleFunc("GET /xrpc/org.xcvr.feed.getChannel", h.WithCORS(h.getChannel))
+	mux.HandleFunc("GET /xrpc/org.xcvr.feed.getSubscriptions", h.WithCORS(h.getSubscriptions))
+	mux.HandleFunc("GET /xrpc/org.xcvr.feed.getMyChannels", h.WithCORS(h.oauthMiddleware(h.getMyChannels)))
+	mux.HandleFunc("POST /xrpc/org.xcvr.feed.subscribe", h.WithCORS(h.oauthMiddleware(h.subscribe)))
+	mux.HandleFunc("POST /xrpc/org.xcvr.feed.unsubscribe", h.WithCORS(h.oauthMiddleware(h.unsubscribe)))
 	mux.HandleFunc("GET /xrpc/org.xcvr.lrc.getMessages", h.WithCORS(h.getMessages))
+	mux.HandleFunc("GET /xrpc/org.xcvr.lrc.getMessageRevisions", h.WithCORS(h.getMessageRevisions))
 	mux.HandleFunc("GET /xrpc/org.xcvr.lrc.getHistory", h.WithCORS(h.getHistory))
+	mux.HandleFunc("GET /xrpc/org.xcvr.lrc.searchMessages", h.WithCORS(h.searchMessages))
 	mux.HandleFunc("GET /xrpc/org.xcvr.lrc.getImage", h.WithCORS(h.getImage))
+	mux.HandleFunc("GET /xrpc/org.xcvr.lrc.getVideo", h.WithCORS(h.getVideo))
 	mux.HandleFunc("GET /xrpc/org.xcvr.actor.resolveChannel", h.WithCORS(h.resolveChannel))
 	mux.HandleFunc("GET /xrpc/org.xcvr.actor.getProfileView", h.WithCORS(h.getProfileView))
 	mux.HandleFunc("GET /xrpc/org.xcvr.lrc.subscribeLexStream", h.WithCORS(h.subscribeLexStream))
 	mux.HandleFunc("GET /xrpc/org.xcvr.actor.getLastSeen", h.WithCORS(h.getLastSeen))
 	// backend metadata handlers
-	mux.HandleFunc(clientMetadataPath(), h.WithCORS(h.serveClientMetadata))
-	mux.HandleFunc(clientTOSPath(), h.WithCORS(h.serveTOS))
-	mux.HandleFunc(clientPolicyPath(), h.WithCORS(h.servePolicy))
+	mux.HandleFunc(h.clientMetadataPath(), h.WithCORS(h.serveClientMetadata))
+	mux.HandleFunc(h.clientTOSPath(), h.WithCORS(h.serveTOS))
+	mux.HandleFunc(h.clientPolicyPath(), h.WithCORS(h.servePolicy))
 	// oauth handlers
-	mux.HandleFunc(oauthJWKSPath(), h.WithCORS(h.serveJWKS))
+	mux.HandleFunc(h.oauthJWKSPath(), h.WithCORS(h.serveJWKS))
 	mux.HandleFunc("POST /oauth/login", h.oauthLogin)
 	mux.HandleFunc("POST /oauth/logout", h.oauthMiddleware(h.oauthLogout))
 	mux.HandleFunc("POST /oauth/ban", h.postBan)
 	mux.HandleFunc("GET /oauth/ban", h.getBan)
 	mux.HandleFunc("GET /oauth/whoami", h.getSession)
-	mux.HandleFunc(oauthCallbackPath(), h.WithCORS(h.oauthCallback))
+	// moderation handlers
+	mux.HandleFunc("POST /xrpc/org.xcvr.moderation.createReport", h.WithCORS(h.oauthMiddleware(h.createReport)))
+	mux.HandleFunc("GET /xrpc/org.xcvr.moderation.getReports", h.getReports)
+	mux.HandleFunc("POST /xrpc/org.xcvr.moderation.resolveReport", h.resolveReport)
+	mux.HandleFunc("GET /xrpc/org.xcvr.moderation.getFailedWrites", h.getFailedWrites)
+	mux.HandleFunc("POST /xrpc/org.xcvr.moderation.retryWrite", h.retryWrite)
+	mux.HandleFunc(h.oauthCallbackPath(), h.WithCORS(h.oauthCallback))
 	return h
 }
 
-func (h *Handler) badRequest(w http.ResponseWriter, err error) {
-	h.logger.Deprintln(err.Error())
+func (h *Handler) badRequest(w http.ResponseWriter, r *http.Request, err error) {
+	h.logger.DebugContext(r.Context(), "bad request", "err", err)
 	w.Header().Set("Content-Type", "application/json")
 	http.Error(w, `{
 		"error":"Invalid JSON", 
@@ -72,21 +106,52 @@ func (h *Handler) badRequest(w http.ResponseWriter, err error) {
 	}`, http.StatusBadRequest)
 }
 
-func (h *Handler) serverError(w http.ResponseWriter, err error) {
-	h.logger.Println(err.Error())
+func (h *Handler) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	h.logger.ErrorContext(r.Context(), "server error", "err", err)
 	w.Header().Set("Content-Type", "application/json")
 	http.Error(w, `{"error":"Internal server error", "message":"Something went wrong"}`, http.StatusInternalServerError)
 }
 
-func (h *Handler) notFound(w http.ResponseWriter, err error) {
-	h.logger.Println(err.Error())
+func (h *Handler) notFound(w http.ResponseWriter, r *http.Request, err error) {
+	h.logger.InfoContext(r.Context(), "not found", "err", err)
 	w.Header().Set("Content-Type", "application/json")
 	http.Error(w, `{"error":"Not Found","message":"I couldn't find your resource"}`, http.StatusNotFound)
 }
 
+func (h *Handler) unauthorized(w http.ResponseWriter, r *http.Request, err error) {
+	h.logger.InfoContext(r.Context(), "unauthorized", "err", err)
+	w.Header().Set("Content-Type", "application/json")
+	http.Error(w, `{"error":"Unauthorized","message":"You need to log in"}`, http.StatusUnauthorized)
+}
+
+func (h *Handler) forbidden(w http.ResponseWriter, r *http.Request, err error) {
+	h.logger.InfoContext(r.Context(), "forbidden", "err", err)
+	w.Header().Set("Content-Type", "application/json")
+	http.Error(w, `{"error":"Forbidden","message":"You aren't allowed to do that"}`, http.StatusForbidden)
+}
+
+// isAdmin reports whether did is the admin's. if no admin is configured,
+// nobody is
+func (h *Handler) isAdmin(did string) bool {
+	return h.cfg.AdminDID != "" && did == h.cfg.AdminDID
+}
+
+func (h *Handler) banned(w http.ResponseWriter, r *http.Request, ban *types.Ban) {
+	h.logger.DebugContext(r.Context(), "turned away banned user", "did", ban.Did, "ban", ban.Id)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("%s%d", h.cfg.BanEndpoint, ban.Id))
+	http.Error(w, `{"error":"Banned","message":"You are banned"}`, http.StatusForbidden)
+}
+
+func (h *Handler) tooManyRequests(w http.ResponseWriter, r *http.Request, err error) {
+	h.logger.DebugContext(r.Context(), "too many requests", "err", err)
+	w.Header().Set("Content-Type", "application/json")
+	http.Error(w, `{"error":"Too Many Requests","message":"Slow down a little"}`, http.StatusTooManyRequests)
+}
+
 func (h *Handler) WithCORSAll() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		h.logger.Deprintf("incoming request: %s %s", r.Method, r.URL.Path)
+		h.logger.DebugContext(r.Context(), "incoming request", "method", r.Method, "path", r.URL.Path)
 		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
@@ -114,7 +179,73 @@ func (h *Handler) WithCORS(f func(w http.ResponseWriter, r *http.Request)) func(
 
 func (h *Handler) Serve() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		h.logger.Deprintf("incoming request: %s %s", r.Method, r.URL.Path)
-		h.router.ServeHTTP(w, r)
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set("X-Request-Id", id)
+		r = r.WithContext(log.WithAttrs(r.Context(), "request_id", id))
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.router.ServeHTTP(sr, r)
+		observeXRPC(r, sr, start)
+		h.logger.DebugContext(r.Context(), "handled request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sr.status,
+			"duration", time.Since(start),
+		)
 	})
 }
+
+// requestID is whatever a proxy in front of us called the request, or
+// something random if nothing did
+func requestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-Id")
+	if id != "" && len(id) <= 64 {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status a handler wrote, for metrics. it has to
+// let websockets hijack the connection from underneath it
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("can't hijack this connection")
+	}
+	sr.hijacked = true
+	sr.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// observeXRPC records how long an xrpc request took. subscriptions are left
+// out, since how long they last says nothing about how quick we are, and so
+// is anything that didn't match a route, so that junk paths don't each get
+// their own label
+func observeXRPC(r *http.Request, sr *statusRecorder, start time.Time) {
+	if sr.hijacked {
+		return
+	}
+	_, path, _ := strings.Cut(r.Pattern, " ")
+	nsid, ok := strings.CutPrefix(path, "/xrpc/")
+	if !ok {
+		return
+	}
+	metrics.XRPCDuration.WithLabelValues(nsid, strconv.Itoa(sr.status)).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,381 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"rvcx/internal/banpolicy"
+	"rvcx/internal/config"
+	"rvcx/internal/federation"
+	"rvcx/internal/log"
+	"rvcx/internal/memstore"
+	"rvcx/internal/model"
+	"rvcx/internal/recordmanager"
+	"rvcx/internal/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	hereChannel  = "at://did:plc:here/org.xcvr.feed.channel/here"
+	thereChannel = "at://did:plc:there/org.xcvr.feed.channel/there"
+)
+
+// newTestHandler serves everything out of a memstore, with a channel hosted
+// here and one hosted by did:plc:there, whose backend is at endpoint
+func newTestHandler(t *testing.T, mode federation.Mode, endpoint string) (http.Handler, *memstore.Store) {
+	t.Helper()
+	cfg := testConfig()
+	cfg.FederationMode = string(mode)
+	h, s := newHandler(t, cfg, endpoint)
+	return h.Serve(), s
+}
+
+func testConfig() *config.Config {
+	return &config.Config{
+		DID:            "did:plc:here",
+		Identity:       "here.test",
+		SessionKey:     "test",
+		FederationMode: string(federation.ModeProxy),
+		MetadataPath:   "/oauth-client-metadata.json",
+		TOSPath:        "/tos",
+		PolicyPath:     "/policy",
+		OAuthCallback:  "/oauth/callback",
+		JWKSPath:       "/oauth/jwks.json",
+	}
+}
+
+func newHandler(t *testing.T, cfg *config.Config, endpoint string) (*Handler, *memstore.Store) {
+	t.Helper()
+	s := memstore.New(cfg)
+	ctx := context.Background()
+	for _, c := range []types.Channel{
+		{URI: hereChannel, Host: "did:plc:here", Title: "here", CreatedAt: time.Now().Add(-time.Minute)},
+		{URI: thereChannel, Host: "did:plc:there", Title: "there", CreatedAt: time.Now()},
+	} {
+		_, err := s.StoreChannel(&c, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for did, handle := range map[string]string{"did:plc:here": "here.test", "did:plc:there": "there.test", "did:plc:alice": "alice.test"} {
+		err := s.StoreDidHandle(did, handle, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := "alice"
+	err := s.InitializeProfile("did:plc:alice", &name, nil, nil, nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New(io.Discard, false)
+	bans := banpolicy.New(s, logger)
+	rm := recordmanager.New(cfg, logger, s, nil, nil, bans, nil)
+	m := model.Init(cfg, s, logger, nil, rm, bans)
+	rm.SetBroadcaster(m)
+	fed := federation.New(cfg, logger)
+	fed.SetResolver(func(ctx context.Context, did string) (string, error) {
+		return endpoint, nil
+	})
+	return New(cfg, s, logger, nil, m, rm, bans, fed), s
+}
+
+func get(t *testing.T, h http.Handler, path string, out any) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	if out != nil && w.Code == http.StatusOK {
+		err := json.Unmarshal(w.Body.Bytes(), out)
+		if err != nil {
+			t.Fatalf("GET %s: %s in %s", path, err, w.Body.String())
+		}
+	}
+	return w
+}
+
+func TestGetChannels(t *testing.T) {
+	h, _ := newTestHandler(t, federation.ModeProxy, "")
+	var out types.GetChannelsOut
+	w := get(t, h, "/xrpc/org.xcvr.feed.getChannels?limit=1", &out)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if len(out.Channels) != 1 || out.Channels[0].URI != thereChannel || out.Cursor == nil {
+		t.Fatalf("got %+v, want the newest channel and a cursor", out)
+	}
+	var next types.GetChannelsOut
+	get(t, h, "/xrpc/org.xcvr.feed.getChannels?limit=1&cursor="+*out.Cursor, &next)
+	if len(next.Channels) != 1 || next.Channels[0].URI != hereChannel {
+		t.Fatalf("got %+v on the next page, want the older channel", next)
+	}
+	w = get(t, h, "/xrpc/org.xcvr.feed.getChannels?sort=nonsense", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for a strange sort, want bad request", w.Code)
+	}
+}
+
+func TestGetProfileView(t *testing.T) {
+	h, _ := newTestHandler(t, federation.ModeProxy, "")
+	var pv types.ProfileView
+	w := get(t, h, "/xrpc/org.xcvr.actor.getProfileView?did=did:plc:alice", &pv)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if pv.DID != "did:plc:alice" || pv.DisplayName == nil || *pv.DisplayName != "alice" {
+		t.Errorf("got %+v", pv)
+	}
+	w = get(t, h, "/xrpc/org.xcvr.actor.getProfileView?did=did:plc:nobody", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d for someone without a profile, want not found", w.Code)
+	}
+	w = get(t, h, "/xrpc/org.xcvr.actor.getProfileView", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %d for nobody at all, want bad request", w.Code)
+	}
+}
+
+func TestResolveChannel(t *testing.T) {
+	tests := []struct {
+		name string
+		mode federation.Mode
+		rkey string
+		did  string
+		want string
+	}{
+		{"here", federation.ModeProxy, "here", "did:plc:here", "/lrc/did:plc:here/here/ws"},
+		{"here redirecting", federation.ModeRedirect, "here", "did:plc:here", "/lrc/did:plc:here/here/ws"},
+		{"there proxied", federation.ModeProxy, "there", "did:plc:there", "/lrc/did:plc:there/there/ws"},
+		{"there redirected", federation.ModeRedirect, "there", "did:plc:there", "wss://93.184.215.14/lrc/did:plc:there/there/ws"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestHandler(t, tt.mode, "https://93.184.215.14")
+			var out types.ResolveChannelResponse
+			w := get(t, h, "/xrpc/org.xcvr.actor.resolveChannel?did="+tt.did+"&rkey="+tt.rkey, &out)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got %d: %s", w.Code, w.Body.String())
+			}
+			if out.URL != tt.want {
+				t.Errorf("got %s, want %s", out.URL, tt.want)
+			}
+		})
+	}
+}
+
+// a channel whose host points somewhere we won't go can't be connected to
+func TestResolveChannelRefusesPrivateBackend(t *testing.T) {
+	h, _ := newTestHandler(t, federation.ModeRedirect, "https://127.0.0.1")
+	w := get(t, h, "/xrpc/org.xcvr.actor.resolveChannel?did=did:plc:there&rkey=there", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d, want not found", w.Code)
+	}
+	w = get(t, h, "/lrc/did:plc:there/there/ws", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d connecting, want not found", w.Code)
+	}
+}
+
+func TestGetHistory(t *testing.T) {
+	h, s := newTestHandler(t, federation.ModeProxy, "")
+	ctx := context.Background()
+	handle := "alice.test"
+	for i := range uint32(3) {
+		signet := &types.Signet{
+			URI:          "at://did:plc:here/org.xcvr.lrc.signet/" + string(rune('a'+i)),
+			IssuerDID:    "did:plc:here",
+			Author:       "did:plc:alice",
+			AuthorHandle: &handle,
+			ChannelURI:   hereChannel,
+			MessageID:    i + 3,
+			StartedAt:    time.Now(),
+		}
+		_, err := s.StoreSignet(signet, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.StoreMessage(&types.Message{
+			URI:       "at://did:plc:alice/org.xcvr.lrc.message/" + string(rune('a'+i)),
+			DID:       "did:plc:alice",
+			SignetURI: signet.URI,
+			Body:      "hi",
+			PostedAt:  time.Now(),
+		}, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out types.GetMessagesOut
+	w := get(t, h, "/xrpc/org.xcvr.lrc.getMessages?channelURI="+hereChannel+"&limit=2", &out)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	if len(out.Messages) != 2 || out.Messages[0].Signet.LrcId != 5 || out.Cursor == nil || *out.Cursor != "4" {
+		t.Fatalf("got %+v, want the newest two messages and a cursor", out)
+	}
+	var rest types.GetMessagesOut
+	get(t, h, "/xrpc/org.xcvr.lrc.getMessages?channelURI="+hereChannel+"&cursor="+*out.Cursor, &rest)
+	if len(rest.Messages) != 1 || rest.Messages[0].Signet.LrcId != 3 || rest.Cursor == nil {
+		t.Fatalf("got %+v on the next page, want the oldest message", rest)
+	}
+	var none types.GetMessagesOut
+	get(t, h, "/xrpc/org.xcvr.lrc.getMessages?channelURI="+hereChannel+"&cursor="+*rest.Cursor, &none)
+	if len(none.Messages) != 0 || none.Cursor != nil {
+		t.Fatalf("got %+v past the oldest message, want nothing", none)
+	}
+
+	w = get(t, h, "/xrpc/org.xcvr.lrc.getHistory?channelURI="+hereChannel, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	var history struct {
+		Items []json.RawMessage `json:"items"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Items) != 3 {
+		t.Errorf("got %d items of history, want 3", len(history.Items))
+	}
+}
+
+func TestServeSetsRequestID(t *testing.T) {
+	h, _ := newTestHandler(t, federation.ModeProxy, "")
+	r := httptest.NewRequest("GET", "/tos", nil)
+	r.Header.Set("X-Request-Id", "abc")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("X-Request-Id") != "abc" {
+		t.Errorf("got request id %q, want the one passed in", w.Header().Get("X-Request-Id"))
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/tos", nil))
+	if w.Header().Get("X-Request-Id") == "" {
+		t.Error("no request id made up")
+	}
+}
+
+func report(h http.Handler, remoteAddr string, realIP string) int {
+	body := `{"uri":"at://did:plc:alice/org.xcvr.lrc.message/m","reason":"rude"}`
+	r := httptest.NewRequest("POST", "/xrpc/org.xcvr.moderation.createReport", strings.NewReader(body))
+	r.RemoteAddr = remoteAddr
+	r.Header.Set("X-Real-IP", realIP)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+// anyone can say they're someone else in X-Real-IP, so it only counts coming
+// from the proxy
+func TestAnonReportLimit(t *testing.T) {
+	h, _ := newTestHandler(t, federation.ModeProxy, "")
+	for i := range anonReportLimit {
+		if got := report(h, "192.0.2.1:1234", "198.51.100."+string(rune('0'+i))); got != http.StatusOK {
+			t.Fatalf("got %d for report %d", got, i)
+		}
+	}
+	if got := report(h, "192.0.2.1:1234", "198.51.100.9"); got != http.StatusTooManyRequests {
+		t.Errorf("got %d making up a new X-Real-IP, want too many requests", got)
+	}
+
+	cfg := testConfig()
+	cfg.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+	hh, _ := newHandler(t, cfg, "")
+	ph := hh.Serve()
+	for i := range anonReportLimit {
+		if got := report(ph, "127.0.0.1:1234", "198.51.100.1"); got != http.StatusOK {
+			t.Fatalf("got %d for report %d", got, i)
+		}
+	}
+	if got := report(ph, "127.0.0.1:1234", "198.51.100.1"); got != http.StatusTooManyRequests {
+		t.Errorf("got %d, want the proxied address limited", got)
+	}
+	if got := report(ph, "127.0.0.1:1234", "198.51.100.2"); got != http.StatusOK {
+		t.Errorf("got %d, want someone else behind the proxy to get through", got)
+	}
+}
+
+func TestGetReportsNeedsAdmin(t *testing.T) {
+	cfg := testConfig()
+	cfg.AdminDID = "did:plc:here"
+	hh, _ := newHandler(t, cfg, "")
+	h := hh.Serve()
+	w := get(t, h, "/xrpc/org.xcvr.moderation.getReports", nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got %d without a session, want unauthorized", w.Code)
+	}
+
+	for did, want := range map[string]int{"did:plc:alice": http.StatusForbidden, "did:plc:here": http.StatusOK} {
+		r := httptest.NewRequest("GET", "/xrpc/org.xcvr.moderation.getReports", nil)
+		s, _ := hh.sessionStore.Get(r, "oauthsession")
+		s.Values["id"] = "session"
+		s.Values["did"] = did
+		saved := httptest.NewRecorder()
+		err := s.Save(r, saved)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = httptest.NewRequest("GET", "/xrpc/org.xcvr.moderation.getReports", nil)
+		for _, c := range saved.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("got %d for %s, want %d", w.Code, did, want)
+		}
+	}
+}
+
+// snippets are html, so the body around the marks has to come out escaped
+func TestSearchSnippetsAreEscaped(t *testing.T) {
+	h, s := newTestHandler(t, federation.ModeProxy, "")
+	ctx := context.Background()
+	handle := "alice.test"
+	signet := &types.Signet{
+		URI:          "at://did:plc:here/org.xcvr.lrc.signet/a",
+		IssuerDID:    "did:plc:here",
+		Author:       "did:plc:alice",
+		AuthorHandle: &handle,
+		ChannelURI:   hereChannel,
+		MessageID:    1,
+		StartedAt:    time.Now(),
+	}
+	_, err := s.StoreSignet(signet, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.StoreMessage(&types.Message{
+		URI:       "at://did:plc:alice/org.xcvr.lrc.message/a",
+		DID:       "did:plc:alice",
+		SignetURI: signet.URI,
+		Body:      `<img src=x onerror="alert('hi')"> hi & bye`,
+		PostedAt:  time.Now(),
+	}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out types.SearchMessagesOut
+	w := get(t, h, "/xrpc/org.xcvr.lrc.searchMessages?q=bye", &out)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	want := `&lt;img src=x onerror=&#34;alert(&#39;hi&#39;)&#34;&gt; hi &amp; <mark>bye</mark>`
+	if len(out.Results) != 1 || out.Results[0].Snippet != want {
+		t.Errorf("got %+v, want the snippet %s", out.Results, want)
+	}
+}
+
+// metrics are served on their own address, never next to everything public
+func TestMetricsArentPublic(t *testing.T) {
+	h, _ := newTestHandler(t, federation.ModeProxy, "")
+	w := get(t, h, "/metrics", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d for /metrics, want not found", w.Code)
+	}
+}
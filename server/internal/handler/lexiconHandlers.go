@@ -7,29 +7,92 @@ import (
 	"fmt"
 	"net/http"
 	"rvcx/internal/atputils"
+	"rvcx/internal/federation"
 	"rvcx/internal/types"
 	"strconv"
+	"strings"
 	"time"
 )
 
 func (h *Handler) getChannels(w http.ResponseWriter, r *http.Request) {
-	limitstr := r.URL.Query().Get("limit")
-	limit := 50
-	if limitstr != "" {
-		l, err := strconv.Atoi(limitstr)
-		if err == nil {
-			limit = max(min(l, 100), 1)
+	sort, err := types.ParseChannelSort(r.URL.Query().Get("sort"))
+	if err != nil {
+		h.badRequest(w, r, err)
+		return
+	}
+	if sort != types.SortRecent {
+		h.getRankedChannels(sort, w, r)
+		return
+	}
+	limit, cursor, ok := h.parsePage(w, r)
+	if !ok {
+		return
+	}
+	cvs, err := h.db.GetChannelViews(limit, cursor, r.Context())
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("db.GetChannels failed! %w", err))
+		return
+	}
+	h.liven(cvs)
+	var gco types.GetChannelsOut
+	gco.Channels = cvs
+	if len(cvs) == limit {
+		last := cvs[len(cvs)-1]
+		cursor := types.KeysetCursor{At: last.CreatedAt, URI: last.URI}.String()
+		gco.Cursor = &cursor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(gco)
+}
+
+// getRankedChannels is getChannels for the sorts that aren't by creation,
+// whose cursors are ranks rather than times
+func (h *Handler) getRankedChannels(sort types.ChannelSort, w http.ResponseWriter, r *http.Request) {
+	limit := parseLimit(r)
+	var cursor *types.RankCursor
+	cursorstr := r.URL.Query().Get("cursor")
+	if cursorstr != "" {
+		var err error
+		cursor, err = types.ParseRankCursor(cursorstr)
+		if err != nil {
+			h.badRequest(w, r, err)
+			return
 		}
 	}
-	cvs, err := h.db.GetChannelViews(limit, r.Context())
+	cvs, err := h.db.GetRankedChannelViews(sort, limit, cursor, r.Context())
 	if err != nil {
-		h.serverError(w, err)
-		h.logger.Printf("db.GetChannels failed! %s", err.Error())
+		h.serverError(w, r, fmt.Errorf("db.GetRankedChannelViews failed! %w", err))
 		return
 	}
+	h.liven(cvs)
+	var gco types.GetChannelsOut
+	gco.Channels = cvs
+	if len(cvs) == limit {
+		last := cvs[len(cvs)-1]
+		cursor := types.RankCursor{Rank: last.Rank, URI: last.URI}.String()
+		gco.Cursor = &cursor
+	}
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
-	encoder.Encode(cvs)
+	encoder.Encode(gco)
+}
+
+// liven fills in whether each channel is hosted here, and if it is, how many
+// people are connected to it right now, which the db can't know
+func (h *Handler) liven(cvs []types.ChannelView) {
+	uris := make([]string, 0, len(cvs))
+	for _, cv := range cvs {
+		uris = append(uris, cv.URI)
+	}
+	connected := h.model.ConnectedHere(uris)
+	for i := range cvs {
+		n, here := connected[cvs[i].URI]
+		cvs[i].HostedHere = &here
+		if here {
+			cvs[i].ConnectedCount = &n
+		}
+	}
 }
 func (h *Handler) getChannel(w http.ResponseWriter, r *http.Request) {
 	uri := r.URL.Query().Get("uri")
@@ -43,12 +106,14 @@ func (h *Handler) getChannel(w http.ResponseWriter, r *http.Request) {
 		cv, err = h.db.GetChannelViewHR(handle, rkey, r.Context())
 	}
 	if err != nil {
-		h.notFound(w, err)
+		h.notFound(w, r, err)
 		return
 	}
+	cvs := []types.ChannelView{*cv}
+	h.liven(cvs)
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
-	encoder.Encode(cv)
+	encoder.Encode(cvs[0])
 }
 
 func (h *Handler) getMessages(w http.ResponseWriter, r *http.Request) {
@@ -71,7 +136,7 @@ func (h *Handler) getMessages(w http.ResponseWriter, r *http.Request) {
 	channelURI := r.URL.Query().Get("channelURI")
 	messages, err := h.db.GetMessages(channelURI, limit, cursor, r.Context())
 	if err != nil {
-		h.serverError(w, errors.New("something went south: "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("something went south: %w", err))
 		return
 	}
 	var gmo types.GetMessagesOut
@@ -88,6 +153,34 @@ func (h *Handler) getMessages(w http.ResponseWriter, r *http.Request) {
 	encoder.Encode(gmo)
 }
 
+// getMessageRevisions gets what a message said before it was edited. the
+// message as it is now comes from getMessages or getHistory
+func (h *Handler) getMessageRevisions(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		h.badRequest(w, r, errors.New("must provide a uri"))
+		return
+	}
+	did, err := atputils.DidFromUri(uri)
+	if err != nil {
+		h.badRequest(w, r, fmt.Errorf("strange uri: %w", err))
+		return
+	}
+	if h.bans.IsBanned(did, r.Context()) {
+		h.notFound(w, r, errors.New("i don't serve banned content"))
+		return
+	}
+	revisions, err := h.db.GetMessageRevisions(uri, r.Context())
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to get revisions: %w", err))
+		return
+	}
+	gmro := types.GetMessageRevisionsOut{URI: uri, Revisions: revisions}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(gmro)
+}
+
 func (h *Handler) getHistory(w http.ResponseWriter, r *http.Request) {
 	limitstr := r.URL.Query().Get("limit")
 	limit := 50
@@ -108,7 +201,7 @@ func (h *Handler) getHistory(w http.ResponseWriter, r *http.Request) {
 	channelURI := r.URL.Query().Get("channelURI")
 	items, err := h.db.GetHistory(channelURI, limit, cursor, r.Context())
 	if err != nil {
-		h.serverError(w, errors.New("something went south: "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("something went south: %w", err))
 		return
 	}
 	if len(items) != 0 {
@@ -121,7 +214,7 @@ func (h *Handler) getHistory(w http.ResponseWriter, r *http.Request) {
 			message, _ := smv.ToSignedMessageView()
 			signet = message.Signet
 		} else {
-			h.serverError(w, errors.New("last item is invalid Signed Item"))
+			h.serverError(w, r, errors.New("last item is invalid Signed Item"))
 			return
 		}
 		if int(signet.LrcId) > 2 {
@@ -129,7 +222,7 @@ func (h *Handler) getHistory(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			jsitems, err := types.MarshalItems(items)
 			if err != nil {
-				h.serverError(w, err)
+				h.serverError(w, r, err)
 			}
 			fmt.Fprintf(w, "{\"items\": %s, \"cursor\": %s}", jsitems, cursor)
 			return
@@ -138,18 +231,84 @@ func (h *Handler) getHistory(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	jsitems, err := types.MarshalItems(items)
 	if err != nil {
-		h.serverError(w, err)
+		h.serverError(w, r, err)
 	}
 	fmt.Fprintf(w, "{\"items\": %s}", jsitems)
 }
 
+func (h *Handler) searchMessages(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	params := types.SearchMessagesParams{Query: q.Get("q"), Limit: 25}
+	if strings.TrimSpace(params.Query) == "" {
+		h.badRequest(w, r, errors.New("did not provide q"))
+		return
+	}
+	limitstr := q.Get("limit")
+	if limitstr != "" {
+		l, err := strconv.Atoi(limitstr)
+		if err == nil {
+			params.Limit = max(min(l, 100), 1)
+		}
+	}
+	if channelURI := q.Get("channelURI"); channelURI != "" {
+		params.ChannelURI = &channelURI
+	}
+	// author can be either a did or a handle
+	if author := q.Get("author"); author != "" {
+		if strings.HasPrefix(author, "did:") {
+			params.AuthorDID = &author
+		} else {
+			params.AuthorHandle = &author
+		}
+	}
+	if since := q.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			h.badRequest(w, r, fmt.Errorf("bad since: %w", err))
+			return
+		}
+		params.Since = &t
+	}
+	if until := q.Get("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			h.badRequest(w, r, fmt.Errorf("bad until: %w", err))
+			return
+		}
+		params.Until = &t
+	}
+	if cursorstr := q.Get("cursor"); cursorstr != "" {
+		cursor, err := types.ParseKeysetCursor(cursorstr)
+		if err != nil {
+			h.badRequest(w, r, err)
+			return
+		}
+		params.Cursor = cursor
+	}
+	results, err := h.db.SearchMessages(params, r.Context())
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to search messages: %w", err))
+		return
+	}
+	var smo types.SearchMessagesOut
+	smo.Results = results
+	if len(results) == params.Limit {
+		last := results[len(results)-1].Message
+		cursor := types.KeysetCursor{At: last.PostedAt, URI: last.URI}.String()
+		smo.Cursor = &cursor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(smo)
+}
+
 func (h *Handler) resolveChannel(w http.ResponseWriter, r *http.Request) {
 	handle := r.URL.Query().Get("handle")
 	did := r.URL.Query().Get("did")
 	rkey := r.URL.Query().Get("rkey")
 	if did == "" {
 		if handle == "" {
-			h.badRequest(w, errors.New("did not provide did or handle"))
+			h.badRequest(w, r, errors.New("did not provide did or handle"))
 			return
 		}
 		var err error
@@ -157,7 +316,7 @@ func (h *Handler) resolveChannel(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			did, err = atputils.TryLookupHandle(r.Context(), handle)
 			if err != nil {
-				h.serverError(w, errors.New("i think the handle might not exist?"+err.Error()))
+				h.serverError(w, r, fmt.Errorf("i think the handle might not exist?%w", err))
 				return
 			}
 			go h.db.StoreDidHandle(did, handle, context.Background())
@@ -165,6 +324,16 @@ func (h *Handler) resolveChannel(w http.ResponseWriter, r *http.Request) {
 	}
 	url := fmt.Sprintf("/lrc/%s/%s/ws", did, rkey)
 	uri := fmt.Sprintf("at://%s/org.xcvr.feed.channel/%s", did, rkey)
+	// channels hosted elsewhere are proxied through our own url, unless
+	// we're set up to send clients straight to the backend that hosts it
+	host, local, err := h.model.ChannelHost(uri)
+	if err == nil && !local && h.fed.Mode() == federation.ModeRedirect {
+		url, err = h.fed.WSURL(r.Context(), host, did, rkey)
+		if err != nil {
+			h.notFound(w, r, err)
+			return
+		}
+	}
 	rchanres := types.ResolveChannelResponse{URL: url, URI: &uri}
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
@@ -176,7 +345,7 @@ func (h *Handler) getProfileView(w http.ResponseWriter, r *http.Request) {
 	did := r.URL.Query().Get("did")
 	if did == "" {
 		if handle == "" {
-			h.badRequest(w, errors.New("did not provide did or handle"))
+			h.badRequest(w, r, errors.New("did not provide did or handle"))
 			return
 		}
 		var err error
@@ -184,7 +353,7 @@ func (h *Handler) getProfileView(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			did, err = atputils.TryLookupHandle(r.Context(), handle)
 			if err != nil {
-				h.serverError(w, errors.New("i think the handle might not exist?"+err.Error()))
+				h.serverError(w, r, fmt.Errorf("i think the handle might not exist?%w", err))
 				return
 			}
 			go h.db.StoreDidHandle(did, handle, context.Background())
@@ -196,7 +365,7 @@ func (h *Handler) getProfileView(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) serveProfileView(did string, handle string, w http.ResponseWriter, r *http.Request) {
 	profile, err := h.db.GetProfileView(did, r.Context())
 	if err != nil {
-		h.notFound(w, errors.New(fmt.Sprintf("couldn't find profile for handle %s / did %s: %s", handle, did, err.Error())))
+		h.notFound(w, r, fmt.Errorf("couldn't find profile for handle %s / did %s: %w", handle, did, err))
 		return
 	}
 	profile.Handle = handle
@@ -210,7 +379,7 @@ func (h *Handler) getLastSeen(w http.ResponseWriter, r *http.Request) {
 	did := r.URL.Query().Get("did")
 	if did == "" {
 		if handle == "" {
-			h.badRequest(w, errors.New("did not provide did or handle"))
+			h.badRequest(w, r, errors.New("did not provide did or handle"))
 			return
 		}
 		var err error
@@ -218,7 +387,7 @@ func (h *Handler) getLastSeen(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			did, err = atputils.TryLookupHandle(r.Context(), handle)
 			if err != nil {
-				h.serverError(w, errors.New("i think the handle might not exist?"+err.Error()))
+				h.serverError(w, r, fmt.Errorf("i think the handle might not exist?%w", err))
 				return
 			}
 			go h.db.StoreDidHandle(did, handle, context.Background())
@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"rvcx/internal/atputils"
+	"rvcx/internal/federation"
+	"rvcx/internal/recordmanager"
+	"rvcx/internal/store"
 	"rvcx/internal/types"
 	"strings"
 
@@ -15,23 +18,61 @@ import (
 )
 
 func (h *Handler) acceptWebsocket(w http.ResponseWriter, r *http.Request) {
+	s, _ := h.sessionStore.Get(r, "oauthsession")
+	did, ok := s.Values["did"].(string)
+	if ok {
+		ban, err := h.bans.Ban(did, r.Context())
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		if ban != nil {
+			h.banned(w, r, ban)
+			return
+		}
+	}
 	rkey := r.PathValue("rkey")
 	user := r.PathValue("user")
 	uri := fmt.Sprintf("at://%s/org.xcvr.feed.channel/%s", user, rkey)
+	host, local, err := h.model.ChannelHost(uri)
+	if err == nil && !local {
+		h.acceptRemoteWebsocket(w, r, host, user, rkey)
+		return
+	}
 	f, err := h.model.GetWSHandlerFrom(uri)
 	if err != nil {
 		http.NotFound(w, r)
-		h.logger.Deprintf("couldn't find user %s's server %s", user, rkey)
-		h.logger.Println(err.Error())
+		h.logger.InfoContext(r.Context(), "couldn't find channel server", "channel", uri, "err", err)
 		return
 	}
 	f(w, r)
 }
 
+// acceptRemoteWebsocket gets a client connected to a channel that another
+// backend hosts, either by sending them there or by proxying
+func (h *Handler) acceptRemoteWebsocket(w http.ResponseWriter, r *http.Request, host string, user string, rkey string) {
+	target, err := h.fed.WSURL(r.Context(), host, user, rkey)
+	if err != nil {
+		h.notFound(w, r, err)
+		return
+	}
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	if h.fed.Mode() == federation.ModeRedirect {
+		http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+		return
+	}
+	err = h.fed.ProxyWS(w, r, target)
+	if err != nil {
+		h.logger.DebugContext(r.Context(), "failed to proxy websocket", "err", err)
+	}
+}
+
 func (h *Handler) postChannel(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
 	cr, err := h.parseChannelRequest(r)
 	if err != nil {
-		h.badRequest(w, err)
+		h.badRequest(w, r, err)
 		return
 	}
 	var did, uri string
@@ -41,14 +82,14 @@ func (h *Handler) postChannel(cs *atoauth.ClientSession, w http.ResponseWriter,
 		did, uri, err = h.rm.PostChannel(cs, r.Context(), cr)
 	}
 	if err != nil {
-		h.serverError(w, err)
+		h.serverError(w, r, err)
 		return
 	}
 	handle, err := h.db.ResolveDid(did, r.Context())
 	if err != nil {
 		handle, err = atputils.TryLookupDid(r.Context(), did)
 		if err != nil {
-			h.serverError(w, errors.New(fmt.Sprintf("couldn't find handle for did %s: %s", did, err.Error())))
+			h.serverError(w, r, fmt.Errorf("couldn't find handle for did %s: %w", did, err))
 			return
 		}
 		go h.db.StoreDidHandle(did, handle, context.Background())
@@ -62,7 +103,7 @@ func (h *Handler) parseChannelRequest(r *http.Request) (*types.PostChannelReques
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&cr)
 	if err != nil {
-		return nil, errors.New("i think they messed up: " + err.Error())
+		return nil, fmt.Errorf("i think they messed up: %w", err)
 	}
 	return &cr, nil
 }
@@ -72,7 +113,7 @@ func (h *Handler) parseMessageRequest(r *http.Request) (*types.PostMessageReques
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&mr)
 	if err != nil {
-		return nil, errors.New("couldn't decode: " + err.Error())
+		return nil, fmt.Errorf("couldn't decode: %w", err)
 	}
 	return &mr, nil
 }
@@ -80,7 +121,7 @@ func (h *Handler) parseMessageRequest(r *http.Request) (*types.PostMessageReques
 func (h *Handler) postMessage(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
 	pmr, err := h.parseMessageRequest(r)
 	if err != nil {
-		h.badRequest(w, errors.New("failed to parse message request: "+err.Error()))
+		h.badRequest(w, r, fmt.Errorf("failed to parse message request: %w", err))
 		return
 	}
 	if cs == nil {
@@ -89,28 +130,78 @@ func (h *Handler) postMessage(cs *atoauth.ClientSession, w http.ResponseWriter,
 		err = h.rm.PostMessage(cs, r.Context(), pmr)
 	}
 	if err != nil {
-		h.serverError(w, errors.New("error posting message: "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("error posting message: %w", err))
 		return
 	}
 	w.Write(nil)
 }
 
+func (h *Handler) editMessage(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
+	if cs == nil {
+		h.badRequest(w, r, errors.New("must be authorized to edit messages"))
+		return
+	}
+	var emr types.EditMessageRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&emr)
+	if err != nil || emr.URI == "" {
+		h.badRequest(w, r, fmt.Errorf("couldn't decode edit: %w", err))
+		return
+	}
+	err = h.rm.EditMessage(cs, &emr, r.Context())
+	if err != nil {
+		h.recordError(w, r, fmt.Errorf("error editing message: %w", err))
+		return
+	}
+	w.Write(nil)
+}
+
+func (h *Handler) deleteMessage(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
+	if cs == nil {
+		h.badRequest(w, r, errors.New("must be authorized to delete messages"))
+		return
+	}
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		h.badRequest(w, r, errors.New("must provide a uri"))
+		return
+	}
+	err := h.rm.DeleteMessage(cs, uri, r.Context())
+	if err != nil {
+		h.recordError(w, r, fmt.Errorf("error deleting message: %w", err))
+		return
+	}
+	w.Write(nil)
+}
+
+// recordError tells whoever tried to change a record why they couldn't
+func (h *Handler) recordError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, recordmanager.ErrNotYours):
+		h.forbidden(w, r, err)
+	case errors.Is(err, store.ErrNotFound):
+		h.notFound(w, r, err)
+	default:
+		h.serverError(w, r, err)
+	}
+}
+
 func (h *Handler) postMyMessage(w http.ResponseWriter, r *http.Request) {
 	pmr, err := h.parseMessageRequest(r)
 	if err != nil {
-		h.badRequest(w, errors.New("failed to parse message request: "+err.Error()))
+		h.badRequest(w, r, fmt.Errorf("failed to parse message request: %w", err))
 		return
 	}
 	err = h.rm.PostMyMessage(r.Context(), pmr)
 	if err != nil {
-		h.serverError(w, errors.New("error posting message: "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("error posting message: %w", err))
 	}
 	w.Write(nil)
 }
 
 func (h *Handler) deleteChannel(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
 	if cs == nil {
-		h.logger.Deprintln("tried to anonymously delete")
+		h.logger.DebugContext(r.Context(), "tried to anonymously delete")
 		return
 	}
 	rkey := r.PathValue("rkey")
@@ -118,12 +209,12 @@ func (h *Handler) deleteChannel(cs *atoauth.ClientSession, w http.ResponseWriter
 	var err error
 	if cs.Data.AccountDID.String() == user {
 		err = h.rm.DeleteChannel(cs, rkey, r.Context())
-	} else if cs.Data.AccountDID.String() == os.Getenv("ADMIN_DID") {
+	} else if h.isAdmin(cs.Data.AccountDID.String()) {
 		uri := fmt.Sprintf("at://%s/org.xcvr.feed.channel/%s", user, rkey)
 		err = h.rm.AcceptChannelDelete(uri, r.Context())
 	}
 	if err != nil {
-		h.logger.Deprintln("failed to delete")
+		h.logger.DebugContext(r.Context(), "failed to delete")
 		return
 	}
 	h.getChannels(w, r)
@@ -134,8 +225,7 @@ func (h *Handler) subscribeLexStream(w http.ResponseWriter, r *http.Request) {
 	f, err := h.model.GetLexStreamFrom(uri)
 	if err != nil {
 		http.NotFound(w, r)
-		h.logger.Deprintf("couldn't find server %s", uri)
-		h.logger.Println(err.Error())
+		h.logger.InfoContext(r.Context(), "couldn't find channel server", "channel", uri, "err", err)
 		return
 	}
 	f(w, r)
@@ -143,37 +233,37 @@ func (h *Handler) subscribeLexStream(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) uploadImage(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
 	if cs == nil {
-		h.badRequest(w, errors.New("must be authorized to post image"))
+		h.badRequest(w, r, errors.New("must be authorized to post image"))
 		return
 	}
 	err := r.ParseMultipartForm(1 << 21)
 	if err != nil {
-		h.badRequest(w, errors.New("beep bop bad image: "+err.Error()))
+		h.badRequest(w, r, fmt.Errorf("beep bop bad image: %w", err))
 		return
 	}
 	uuid := r.FormValue("uuid")
 	if uuid == "" {
-		h.badRequest(w, errors.New("uuid is required"))
+		h.badRequest(w, r, errors.New("uuid is required"))
 		return
 	}
 	file, fheader, err := r.FormFile("image")
 	if err != nil {
-		h.badRequest(w, errors.New("failed to formfile: "+err.Error()))
+		h.badRequest(w, r, fmt.Errorf("failed to formfile: %w", err))
 		return
 	}
 	defer file.Close()
 	ct := fheader.Header.Get("Content-Type")
 	if !strings.HasPrefix(ct, "image/") {
-		h.badRequest(w, errors.New("must post an image"))
+		h.badRequest(w, r, errors.New("must post an image"))
 		return
 	}
 	blob, err := h.rm.PostImage(cs, file, fheader, r.Context())
 	if err != nil {
-		h.serverError(w, errors.New("failed to upload: "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("failed to upload: %w", err))
 		return
 	}
 	if blob == nil {
-		h.logger.Deprintln("blob is nil")
+		h.logger.DebugContext(r.Context(), "blob is nil")
 	}
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
@@ -185,23 +275,61 @@ func (h *Handler) uploadImage(cs *atoauth.ClientSession, w http.ResponseWriter,
 	}
 	err = encoder.Encode(response)
 	if err != nil {
-		h.badRequest(w, err)
+		h.badRequest(w, r, err)
 		return
 	}
 }
 
 func (h *Handler) postMedia(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
 	if cs == nil {
-		h.badRequest(w, errors.New("must be authorized to post media"))
+		h.badRequest(w, r, errors.New("must be authorized to post media"))
 	}
 	mr, err := h.parseMediaRequest(r)
 	if err != nil {
-		h.badRequest(w, err)
+		h.badRequest(w, r, err)
 		return
 	}
 	err = h.rm.PostMedia(cs, mr, r.Context())
 	if err != nil {
-		h.serverError(w, errors.New("failing to post the media :c"+err.Error()))
+		h.serverError(w, r, fmt.Errorf("failing to post the media :c%w", err))
+		return
+	}
+	w.Write(nil)
+}
+
+func (h *Handler) editMedia(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
+	if cs == nil {
+		h.badRequest(w, r, errors.New("must be authorized to edit media"))
+		return
+	}
+	var emr types.EditMediaRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&emr)
+	if err != nil || emr.URI == "" {
+		h.badRequest(w, r, fmt.Errorf("couldn't decode edit: %w", err))
+		return
+	}
+	err = h.rm.EditMedia(cs, &emr, r.Context())
+	if err != nil {
+		h.recordError(w, r, fmt.Errorf("error editing media: %w", err))
+		return
+	}
+	w.Write(nil)
+}
+
+func (h *Handler) deleteMedia(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
+	if cs == nil {
+		h.badRequest(w, r, errors.New("must be authorized to delete media"))
+		return
+	}
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		h.badRequest(w, r, errors.New("must provide a uri"))
+		return
+	}
+	err := h.rm.DeleteMedia(cs, uri, r.Context())
+	if err != nil {
+		h.recordError(w, r, fmt.Errorf("error deleting media: %w", err))
 		return
 	}
 	w.Write(nil)
@@ -212,7 +340,7 @@ func (h *Handler) parseMediaRequest(r *http.Request) (*types.ParseMediaRequest,
 	var mr types.ParseMediaRequest
 	err := beep.Decode(&mr)
 	if err != nil {
-		return nil, errors.New("A aaaaaa : " + err.Error())
+		return nil, fmt.Errorf("A aaaaaa : %w", err)
 	}
 	return &mr, nil
 }
@@ -238,52 +366,52 @@ func (h *Handler) getImage(w http.ResponseWriter, r *http.Request) {
 		if did == "" {
 			handle := vals.Get("handle")
 			if handle == "" {
-				h.badRequest(w, errors.New("must provide an identity"))
+				h.badRequest(w, r, errors.New("must provide an identity"))
 				return
 			}
 			did, err = h.db.ResolveHandle(handle, r.Context())
 			if err != nil {
-				h.badRequest(w, errors.New("failed to resolve handle"))
+				h.badRequest(w, r, errors.New("failed to resolve handle"))
 				return
 			}
 		}
 	}
 	if did == "" {
-		h.serverError(w, errors.New("empty did"))
+		h.serverError(w, r, errors.New("empty did"))
 		return
 	}
-	ib, _ := h.db.IsBanned(did, r.Context())
-	if ib {
-		h.badRequest(w, errors.New("i don't serve banned content"))
+	if h.bans.IsBanned(did, r.Context()) {
+		h.badRequest(w, r, errors.New("i don't serve banned content"))
 		return
 	}
 	if cid == "" {
 		cid = vals.Get("cid")
 	}
 	if cid == "" {
-		h.serverError(w, errors.New("empty cid"))
+		h.serverError(w, r, errors.New("empty cid"))
 		return
 	}
-	imgPath, err := h.rm.AddImageToCache(did, cid, r.Context())
+	img, err := h.rm.OpenBlob(did, cid, r.Context())
 	if err != nil {
-		h.serverError(w, errors.New("beep: "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("beep: %w", err))
 		return
 	}
+	defer img.Close()
 
-	stats, err := os.Stat(imgPath)
+	stats, err := img.Stat()
 	if err != nil {
-		h.serverError(w, errors.New("yikes, file not there even though it should?: "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("yikes, file not there even though it should?: %w", err))
 		return
 	}
 
 	if image == nil {
 		image, err = h.db.GetImageDidCID(did, cid, r.Context())
 		if err != nil {
-			h.serverError(w, err)
+			h.serverError(w, r, err)
 			return
 		}
 		if image == nil {
-			h.serverError(w, errors.New("beep obop i didn't cache it"))
+			h.serverError(w, r, errors.New("beep obop i didn't cache it"))
 			return
 		}
 	}
@@ -293,11 +421,129 @@ func (h *Handler) getImage(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Add("Content-Type", mime)
 	w.Header().Add("Content-Length", fmt.Sprintf("%d", stats.Size()))
+	io.Copy(w, img)
+}
+
+// maxVideoSize matches the maxSize of a video blob in org.xcvr.lrc.media
+const maxVideoSize = 50_000_000
 
-	img, err := os.Open(imgPath)
+func (h *Handler) uploadVideo(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
+	if cs == nil {
+		h.badRequest(w, r, errors.New("must be authorized to post video"))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxVideoSize+(1<<20))
+	err := r.ParseMultipartForm(1 << 21)
+	if err != nil {
+		h.badRequest(w, r, fmt.Errorf("bad video: %w", err))
+		return
+	}
+	uuid := r.FormValue("uuid")
+	if uuid == "" {
+		h.badRequest(w, r, errors.New("uuid is required"))
+		return
+	}
+	file, fheader, err := r.FormFile("video")
+	if err != nil {
+		h.badRequest(w, r, fmt.Errorf("failed to formfile: %w", err))
+		return
+	}
+	defer file.Close()
+	ct := fheader.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "video/") {
+		h.badRequest(w, r, errors.New("must post a video"))
+		return
+	}
+	if fheader.Size > maxVideoSize {
+		h.badRequest(w, r, errors.New("video too big"))
+		return
+	}
+	blob, err := h.rm.PostImage(cs, file, fheader, r.Context())
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to upload: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	response := struct {
+		Blob any    `json:"blob"`
+		UUID string `json:"uuid"`
+	}{
+		Blob: blob, UUID: uuid,
+	}
+	err = encoder.Encode(response)
 	if err != nil {
-		h.serverError(w, err)
+		h.badRequest(w, r, err)
 		return
 	}
-	img.WriteTo(w)
+}
+
+// getVideo serves a video blob. unlike images, videos are big enough that
+// players want to seek around in them, so this goes through
+// http.ServeContent, which handles range requests for us
+func (h *Handler) getVideo(w http.ResponseWriter, r *http.Request) {
+	vals := r.URL.Query()
+	var video *types.Video
+	var err error
+	did := vals.Get("did")
+	cid := vals.Get("cid")
+	uri := vals.Get("uri")
+	if uri != "" {
+		video, err = h.db.GetVideo(uri, r.Context())
+		if err != nil {
+			h.notFound(w, r, err)
+			return
+		}
+		did = video.DID
+		if video.BlobCID != nil {
+			cid = *video.BlobCID
+		}
+	}
+	if did == "" {
+		handle := vals.Get("handle")
+		if handle == "" {
+			h.badRequest(w, r, errors.New("must provide an identity"))
+			return
+		}
+		did, err = h.db.ResolveHandle(handle, r.Context())
+		if err != nil {
+			h.badRequest(w, r, errors.New("failed to resolve handle"))
+			return
+		}
+	}
+	if cid == "" {
+		h.badRequest(w, r, errors.New("empty cid"))
+		return
+	}
+	if h.bans.IsBanned(did, r.Context()) {
+		h.badRequest(w, r, errors.New("i don't serve banned content"))
+		return
+	}
+	if video == nil {
+		video, err = h.db.GetVideoDidCID(did, cid, r.Context())
+		if err != nil {
+			h.notFound(w, r, err)
+			return
+		}
+	}
+	f, err := h.rm.OpenBlob(did, cid, r.Context())
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to cache video: %w", err))
+		return
+	}
+	defer f.Close()
+	stats, err := f.Stat()
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	mime := "application/octet-stream"
+	if video.BlobMIME != nil {
+		mime = *video.BlobMIME
+	}
+	w.Header().Set("Content-Type", mime)
+	// blobs are content addressed, so the cid makes a perfect etag
+	w.Header().Set("ETag", `"`+cid+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", stats.ModTime(), f)
 }
@@ -4,13 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"rvcx/internal/oauth"
 )
 
 func (h *Handler) serveClientMetadata(w http.ResponseWriter, r *http.Request) {
 	doc := h.oauth.App.Config.ClientMetadata()
-	jwksuri := oauth.GetClientMetadata().JWKSUri
+	jwksuri := oauth.NewClientMetadata(h.cfg).JWKSUri
 	doc.JWKSURI = &jwksuri
 	w.Header().Set("Content-Type", "application/json")
 	encoder := json.NewEncoder(w)
@@ -24,17 +23,14 @@ func (h *Handler) servePolicy(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "i'll be normal i'll be normal i'll be normal i'll be normal")
 }
 
-func clientMetadataPath() string {
-	mp := os.Getenv("MY_METADATA_PATH")
-	return fmt.Sprintf("GET %s", mp)
+func (h *Handler) clientMetadataPath() string {
+	return fmt.Sprintf("GET %s", h.cfg.MetadataPath)
 }
 
-func clientTOSPath() string {
-	mp := os.Getenv("MY_TOS_PATH")
-	return fmt.Sprintf("GET %s", mp)
+func (h *Handler) clientTOSPath() string {
+	return fmt.Sprintf("GET %s", h.cfg.TOSPath)
 }
 
-func clientPolicyPath() string {
-	mp := os.Getenv("MY_POLICY_PATH")
-	return fmt.Sprintf("GET %s", mp)
+func (h *Handler) clientPolicyPath() string {
+	return fmt.Sprintf("GET %s", h.cfg.PolicyPath)
 }
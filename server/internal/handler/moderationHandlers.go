@@ -0,0 +1,261 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"rvcx/internal/atputils"
+	"rvcx/internal/store"
+	"rvcx/internal/types"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	atoauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
+)
+
+const (
+	anonReportLimit  = 5
+	anonReportWindow = time.Hour
+)
+
+var reportableCollections = []string{
+	"org.xcvr.lrc.message",
+	"org.xcvr.lrc.media",
+	"org.xcvr.feed.channel",
+}
+
+func (h *Handler) createReport(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
+	var rr types.ReportRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rr)
+	if err != nil {
+		h.badRequest(w, r, fmt.Errorf("couldn't decode report: %w", err))
+		return
+	}
+	err = validateReport(&rr)
+	if err != nil {
+		h.badRequest(w, r, err)
+		return
+	}
+	now := time.Now()
+	if cs != nil {
+		report := types.AuthReport{
+			DID:        cs.Data.AccountDID.String(),
+			URI:        rr.URI,
+			Reason:     rr.Reason,
+			ReportedAt: now,
+		}
+		err = h.db.StoreAuthReport(&report, r.Context())
+	} else {
+		addr := h.clientAddr(r)
+		count, cerr := h.db.CountReportsFromAddr(addr, now.Add(-anonReportWindow), r.Context())
+		if cerr != nil {
+			h.serverError(w, r, cerr)
+			return
+		}
+		if count >= anonReportLimit {
+			h.tooManyRequests(w, r, fmt.Errorf("too many anonymous reports from %s", addr))
+			return
+		}
+		report := types.AnonReport{
+			Addr:       addr,
+			URI:        rr.URI,
+			Reason:     rr.Reason,
+			ReportedAt: now,
+		}
+		err = h.db.StoreAnonReport(&report, r.Context())
+	}
+	if err != nil {
+		h.serverError(w, r, err)
+		return
+	}
+	w.Write(nil)
+}
+
+func validateReport(rr *types.ReportRequest) error {
+	collection, err := atputils.CollectionFromUri(rr.URI)
+	if err != nil {
+		return fmt.Errorf("can't report that: %w", err)
+	}
+	if !slices.Contains(reportableCollections, collection) {
+		return fmt.Errorf("can't report a %s", collection)
+	}
+	rr.Reason = strings.TrimSpace(rr.Reason)
+	if rr.Reason == "" || atputils.ValidateGraphemesAndLength(rr.Reason, 300, 3000) {
+		return errors.New("reason empty or too long")
+	}
+	return nil
+}
+
+// clientAddr is the address of whoever made the request. nginx sits in front
+// of us and forwards the address it got the request from in X-Real-IP, but
+// anyone can set that, so it's only believed coming from a trusted proxy
+func (h *Handler) clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr := r.Header.Get("X-Real-IP")
+	if addr != "" && h.cfg.TrustsProxy(host) {
+		return addr
+	}
+	return host
+}
+
+func (h *Handler) getReports(w http.ResponseWriter, r *http.Request) {
+	_, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	limitstr := r.URL.Query().Get("limit")
+	limit := 50
+	if limitstr != "" {
+		l, err := strconv.Atoi(limitstr)
+		if err == nil {
+			limit = max(min(l, 100), 1)
+		}
+	}
+	cursorstr := r.URL.Query().Get("cursor")
+	var cursor *int
+	if cursorstr != "" {
+		c, err := strconv.Atoi(cursorstr)
+		if err == nil {
+			cursor = &c
+		}
+	}
+	resolved := r.URL.Query().Get("resolved") == "true"
+	reports, err := h.db.GetReports(resolved, limit, cursor, r.Context())
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to get reports: %w", err))
+		return
+	}
+	var gro types.GetReportsOut
+	gro.Reports = reports
+	if len(reports) == limit {
+		cursor := strconv.Itoa(reports[len(reports)-1].Id)
+		gro.Cursor = &cursor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(gro)
+}
+
+func (h *Handler) resolveReport(w http.ResponseWriter, r *http.Request) {
+	admin, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	var rrr types.ResolveReportRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rrr)
+	if err != nil {
+		h.badRequest(w, r, fmt.Errorf("couldn't decode resolution: %w", err))
+		return
+	}
+	var ban *types.Ban
+	if rrr.Ban != nil {
+		report, err := h.db.GetReport(rrr.Id, r.Context())
+		if err != nil {
+			h.notFound(w, r, err)
+			return
+		}
+		did, err := atputils.DidFromUri(report.URI)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("reported uri is strange: %w", err))
+			return
+		}
+		ban = &types.Ban{Did: did, Reason: rrr.Ban.Reason}
+		if ban.Reason == nil {
+			reason := fmt.Sprintf("report %d: %s", report.Id, report.Reason)
+			ban.Reason = &reason
+		}
+		if rrr.Ban.Days != nil {
+			till := time.Now().Add(time.Hour * 24 * time.Duration(*rrr.Ban.Days))
+			ban.Till = &till
+		}
+	}
+	report, err := h.db.ResolveReport(rrr.Id, admin, ban, r.Context())
+	if err != nil {
+		h.badRequest(w, r, err)
+		return
+	}
+	if ban != nil {
+		h.bans.Invalidate(ban.Did)
+		h.rm.PurgeMedia(ban.Did)
+		err = h.db.DeleteAllSessions(r.Context(), ban.Did)
+		if err != nil {
+			h.serverError(w, r, fmt.Errorf("failed to kick user %s%w", ban.Did, err))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(report)
+}
+
+// getFailedWrites lists writes to my repo that the outbox gave up on, so the
+// signets and messages they were for never made it into the atmosphere
+func (h *Handler) getFailedWrites(w http.ResponseWriter, r *http.Request) {
+	_, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	limitstr := r.URL.Query().Get("limit")
+	limit := 50
+	if limitstr != "" {
+		l, err := strconv.Atoi(limitstr)
+		if err == nil {
+			limit = max(min(l, 100), 1)
+		}
+	}
+	cursorstr := r.URL.Query().Get("cursor")
+	var cursor *int
+	if cursorstr != "" {
+		c, err := strconv.Atoi(cursorstr)
+		if err == nil {
+			cursor = &c
+		}
+	}
+	writes, err := h.db.GetFailedWrites(limit, cursor, r.Context())
+	if err != nil {
+		h.serverError(w, r, fmt.Errorf("failed to get failed writes: %w", err))
+		return
+	}
+	var gfwo types.GetFailedWritesOut
+	gfwo.Writes = writes
+	if len(writes) == limit {
+		cursor := strconv.Itoa(writes[len(writes)-1].Id)
+		gfwo.Cursor = &cursor
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.Encode(gfwo)
+}
+
+func (h *Handler) retryWrite(w http.ResponseWriter, r *http.Request) {
+	_, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	var rwr types.RetryWriteRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&rwr)
+	if err != nil {
+		h.badRequest(w, r, fmt.Errorf("couldn't decode retry: %w", err))
+		return
+	}
+	err = h.rm.RetryWrite(rwr.Id, r.Context())
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			h.notFound(w, r, fmt.Errorf("no failed write %d", rwr.Id))
+			return
+		}
+		h.serverError(w, r, err)
+		return
+	}
+	w.Write(nil)
+}
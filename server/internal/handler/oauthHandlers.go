@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"rvcx/internal/atputils"
 	"rvcx/internal/oauth"
 	"strconv"
@@ -18,23 +17,23 @@ import (
 )
 
 func (h *Handler) serveJWKS(w http.ResponseWriter, r *http.Request) {
-	key, err := oauth.GetPrivateKey()
+	key, err := oauth.GetPrivateKey(h.cfg.ClientSecretKey)
 	if err != nil {
-		h.serverError(w, err)
+		h.serverError(w, r, err)
 		return
 	}
 	pubKey, err := key.PublicKey()
 	if err != nil {
-		h.serverError(w, err)
+		h.serverError(w, r, err)
 		return
 	}
 	ro, err := pubKey.JWK()
 	if err != nil {
-		h.serverError(w, err)
+		h.serverError(w, r, err)
 		return
 	}
 
-	cski := os.Getenv("CLIENT_SECRET_KEY_ID")
+	cski := h.cfg.ClientSecretKeyID
 	ro.KeyID = &cski
 	rro := map[string]any{"keys": []any{ro}}
 	w.Header().Set("Content-Type", "application/json")
@@ -45,13 +44,13 @@ func (h *Handler) serveJWKS(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) oauthLogin(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
-		h.badRequest(w, err)
+		h.badRequest(w, r, err)
 		return
 	}
 	identifier := strings.TrimSpace(r.FormValue("identifier"))
 	redirectURL, err := h.oauth.StartAuthFlow(r.Context(), identifier)
 	if err != nil {
-		h.serverError(w, err)
+		h.serverError(w, r, err)
 		return
 	}
 	http.Redirect(w, r, redirectURL, http.StatusFound)
@@ -60,23 +59,22 @@ func (h *Handler) oauthLogin(w http.ResponseWriter, r *http.Request) {
 func (h *Handler) oauthCallback(w http.ResponseWriter, r *http.Request) {
 	sessData, err := h.oauth.OauthCallback(r.Context(), r.URL.Query())
 	if err != nil {
-		h.serverError(w, errors.New("my god.... :"+err.Error()))
+		h.serverError(w, r, fmt.Errorf("my god.... :%w", err))
 		return
 	}
-	isban, err := h.db.IsBanned(sessData.AccountDID.String(), r.Context())
+	ban, err := h.bans.Ban(sessData.AccountDID.String(), r.Context())
 	if err != nil {
-		h.serverError(w, errors.New("i'm not sure if user is banned, error, "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("i'm not sure if user is banned, error, %w", err))
 		return
 	}
-	if isban {
-		ban, _ := h.db.GetBanned(sessData.AccountDID.String(), r.Context())
-		http.Redirect(w, r, fmt.Sprintf("%s%d", os.Getenv("BAN_ENDPOINT"), ban.Id), http.StatusSeeOther)
+	if ban != nil {
+		http.Redirect(w, r, fmt.Sprintf("%s%d", h.cfg.BanEndpoint, ban.Id), http.StatusSeeOther)
 		return
 	}
 
 	err = h.rm.CreateInitialProfile(sessData, r.Context())
 	if err != nil {
-		h.serverError(w, err)
+		h.serverError(w, r, err)
 		return
 	}
 	session, _ := h.sessionStore.Get(r, "oauthsession")
@@ -92,32 +90,30 @@ func (h *Handler) oauthCallback(w http.ResponseWriter, r *http.Request) {
 	session.Values["scopes"] = strings.Join(sessData.Scopes, " ")
 	err = session.Save(r, w)
 	if err != nil {
-		h.serverError(w, err)
+		h.serverError(w, r, err)
 		return
 	}
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-func oauthCallbackPath() string {
-	mp := os.Getenv("MY_OAUTH_CALLBACK")
-	return fmt.Sprintf("GET %s", mp)
+func (h *Handler) oauthCallbackPath() string {
+	return fmt.Sprintf("GET %s", h.cfg.OAuthCallback)
 }
 
-func oauthJWKSPath() string {
-	mp := os.Getenv("MY_JWKS_PATH")
-	return fmt.Sprintf("GET %s", mp)
+func (h *Handler) oauthJWKSPath() string {
+	return fmt.Sprintf("GET %s", h.cfg.JWKSPath)
 }
 
 func (h *Handler) getSession(w http.ResponseWriter, r *http.Request) {
 	s, _ := h.sessionStore.Get(r, "oauthsession")
 	did, ok := s.Values["did"].(string)
 	if !ok {
-		h.notFound(w, errors.New("couldn't find profile"))
+		h.notFound(w, r, errors.New("couldn't find profile"))
 		return
 	}
 	handle, err := h.db.FullResolveDid(did, r.Context())
 	if err != nil {
-		h.notFound(w, errors.New("coudln't resolve did: "+err.Error()))
+		h.notFound(w, r, fmt.Errorf("coudln't resolve did: %w", err))
 		return
 	}
 	h.serveProfileView(did, handle, w, r)
@@ -125,25 +121,25 @@ func (h *Handler) getSession(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) oauthLogout(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
 	if cs != nil {
-		h.logger.Deprintln("deleting session to log out!")
+		h.logger.DebugContext(r.Context(), "deleting session to log out!")
 		err := h.db.DeleteSession(r.Context(), cs.Data.AccountDID, cs.Data.SessionID)
 		if err != nil {
-			h.serverError(w, errors.New("couldn't log out: "+err.Error()))
+			h.serverError(w, r, fmt.Errorf("couldn't log out: %w", err))
 			return
 		}
-		h.logger.Deprintln("deleted session to log out!")
+		h.logger.DebugContext(r.Context(), "deleted session to log out!")
 	}
 
 	s, _ := h.sessionStore.Get(r, "oauthsession")
 	s.Values = make(map[any]any)
 	s.Options.MaxAge = -1
-	h.logger.Deprintln("saving cookie to log out!")
+	h.logger.DebugContext(r.Context(), "saving cookie to log out!")
 	err := s.Save(r, w)
 	if err != nil {
-		h.serverError(w, errors.New("issue logging out: "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("issue logging out: %w", err))
 		return
 	}
-	h.logger.Deprintln("saved cookie to log out!")
+	h.logger.DebugContext(r.Context(), "saved cookie to log out!")
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
@@ -166,35 +162,49 @@ func (h *Handler) oauthMiddleware(f func(cs *atoauth.ClientSession, w http.Respo
 			f(nil, w, r)
 			return
 		}
+		ban, err := h.bans.Ban(did, r.Context())
+		if err != nil {
+			h.serverError(w, r, err)
+			return
+		}
+		if ban != nil {
+			h.banned(w, r, ban)
+			return
+		}
 		f(cs, w, r)
 	}
 }
 
-func (h *Handler) postBan(w http.ResponseWriter, r *http.Request) {
+// requireAdmin checks that the request comes from the admin's session, and
+// if it doesn't, writes an error and returns false
+func (h *Handler) requireAdmin(w http.ResponseWriter, r *http.Request) (did string, ok bool) {
 	s, _ := h.sessionStore.Get(r, "oauthsession")
 	did, bok := s.Values["did"].(string)
 	if !bok {
-		h.badRequest(w, errors.New("not authorized"))
-		return
+		h.unauthorized(w, r, errors.New("not logged in"))
+		return "", false
 	}
-	handle, err := h.db.ResolveDid(did, r.Context())
-	if err != nil {
-		h.serverError(w, errors.New("failed to resolve"+err.Error()))
-		return
+	if !h.isAdmin(did) {
+		h.forbidden(w, r, errors.New("must be admin"))
+		return "", false
 	}
-	if handle != os.Getenv("ADMIN_HANDLE") {
-		h.badRequest(w, errors.New("must be admin to ban"))
+	return did, true
+}
+
+func (h *Handler) postBan(w http.ResponseWriter, r *http.Request) {
+	_, ok := h.requireAdmin(w, r)
+	if !ok {
 		return
 	}
-	err = r.ParseForm()
+	err := r.ParseForm()
 	if err != nil {
-		h.badRequest(w, err)
+		h.badRequest(w, r, err)
 		return
 	}
 	userhandle := r.FormValue("user")
 	userdid, err := atputils.GetDidFromHandle(r.Context(), userhandle)
 	if err != nil {
-		h.badRequest(w, errors.New("failed to resolve user handle"))
+		h.badRequest(w, r, errors.New("failed to resolve user handle"))
 		return
 	}
 	daysstring := r.FormValue("days")
@@ -211,20 +221,22 @@ func (h *Handler) postBan(w http.ResponseWriter, r *http.Request) {
 	}
 	err = h.db.AddBan(userdid, reason, till, r.Context())
 	if err != nil {
-		h.serverError(w, errors.New("failed to ban, "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("failed to ban, %w", err))
 		return
 	}
+	h.bans.Invalidate(userdid)
+	h.rm.PurgeMedia(userdid)
 	ban, err := h.db.GetBanned(userdid, r.Context())
 	if err != nil {
-		h.serverError(w, errors.New("succeeded to ban and then failed again"+err.Error()))
+		h.serverError(w, r, fmt.Errorf("succeeded to ban and then failed again%w", err))
 		return
 	}
 	err = h.db.DeleteAllSessions(r.Context(), ban.Did)
 	if err != nil {
-		h.serverError(w, errors.New("failed to kick user "+ban.Did+err.Error()))
+		h.serverError(w, r, fmt.Errorf("failed to kick user %s%w", ban.Did, err))
 		return
 	}
-	w.Header().Set("Location", fmt.Sprintf("%s%d", os.Getenv("BAN_ENDPOINT"), ban.Id))
+	w.Header().Set("Location", fmt.Sprintf("%s%d", h.cfg.BanEndpoint, ban.Id))
 	w.WriteHeader(http.StatusCreated)
 	w.Write(nil)
 }
@@ -233,12 +245,12 @@ func (h *Handler) getBan(w http.ResponseWriter, r *http.Request) {
 	banid := r.URL.Query().Get("id")
 	id, err := strconv.Atoi(banid)
 	if err != nil {
-		h.badRequest(w, err)
+		h.badRequest(w, r, err)
 		return
 	}
 	ban, err := h.db.GetBanId(id, r.Context())
 	if err != nil {
-		h.serverError(w, err)
+		h.serverError(w, r, err)
 		return
 	}
 	encoder := json.NewEncoder(w)
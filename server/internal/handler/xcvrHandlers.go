@@ -3,6 +3,7 @@ package handler
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	atoauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
 	"net/http"
 	"rvcx/internal/types"
@@ -10,24 +11,24 @@ import (
 
 func (h *Handler) postProfile(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
 	if cs == nil {
-		h.badRequest(w, errors.New("must be logged in!"))
+		h.badRequest(w, r, errors.New("must be logged in!"))
 		return
 	}
 	var p types.PostProfileRequest
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&p)
 	if err != nil {
-		h.badRequest(w, errors.New("error decoding post profile request: "+err.Error()))
+		h.badRequest(w, r, fmt.Errorf("error decoding post profile request: %w", err))
 		return
 	}
 	err = h.rm.PostProfile(cs, r.Context(), &p)
 	if err != nil {
-		h.serverError(w, errors.New("erroring in postprofile flow: "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("erroring in postprofile flow: %w", err))
 	}
 	did := cs.Data.AccountDID.String()
 	handle, err := h.db.FullResolveDid(did, r.Context())
 	if err != nil {
-		h.serverError(w, errors.New("error couldn't resolve did? "+err.Error()))
+		h.serverError(w, r, fmt.Errorf("error couldn't resolve did? %w", err))
 		return
 	}
 	h.serveProfileView(did, handle, w, r)
@@ -35,12 +36,12 @@ func (h *Handler) postProfile(cs *atoauth.ClientSession, w http.ResponseWriter,
 
 func (h *Handler) beep(cs *atoauth.ClientSession, w http.ResponseWriter, r *http.Request) {
 	if cs == nil {
-		h.badRequest(w, errors.New("must be logged in!"))
+		h.badRequest(w, r, errors.New("must be logged in!"))
 		return
 	}
 	err := h.rm.Beep(cs, r.Context())
 	if err != nil {
-		h.badRequest(w, err)
+		h.badRequest(w, r, err)
 		return
 	}
 	w.Write(nil)
@@ -7,6 +7,7 @@ import (
 func init() {
 	util.RegisterType("org.xcvr.actor.profile", &ProfileRecord{})
 	util.RegisterType("org.xcvr.feed.channel", &ChannelRecord{})
+	util.RegisterType("org.xcvr.feed.sub", &SubRecord{})
 	util.RegisterType("org.xcvr.lrc.message", &MessageRecord{})
 	util.RegisterType("org.xcvr.lrc.signet", &SignetRecord{})
 }
@@ -28,6 +29,12 @@ type ChannelRecord struct {
 	Host          string  `json:"host" cborgen:"host"`
 }
 
+type SubRecord struct {
+	LexiconTypeID string `json:"$type,const=org.xcvr.feed.sub" cborgen:"$type,const=org.xcvr.feed.sub"`
+	ChannelURI    string `json:"channelUri" cborgen:"channelUri"`
+	CreatedAt     string `json:"createdAt" cborgen:"createdAt"`
+}
+
 type MessageRecord struct {
 	LexiconTypeID string  `json:"$type,const=org.xcvr.lrc.message" cborgen:"$type,const=org.xcvr.lrc.message"`
 	SignetURI     string  `json:"signetURI" cborgen:"signetURI"`
@@ -50,6 +57,7 @@ type MediaRecord struct {
 	LexiconTypeID string  `json:"$type,const=org.xcvr.lrc.media" cborgen:"$type,const=org.xcvr.lrc.media"`
 	SignetURI     string  `json:"signetURI" cborgen:"signetURI"`
 	Image         *Image  `json:"image,omitempty" cborgen:"image,omitempty"`
+	Video         *Video  `json:"video,omitempty" cborgen:"video,omitempty"`
 	Nick          *string `json:"nick,omitempty" cborgen:"nick,omitempty"`
 	Color         *uint64 `json:"color,omitempty" cborgen:"color,omitempty"`
 	PostedAt      string  `json:"postedAt" cborgen:"postedAt"`
@@ -62,6 +70,13 @@ type Image struct {
 	Blob          *util.BlobSchema `json:"blob,omitempty" cborgen:"blob,omitempty"`
 }
 
+type Video struct {
+	LexiconTypeID string           `json:"$type,const=org.xcvr.lrc.video" cborgen:"$type,const=org.xcvr.lrc.video"`
+	Alt           string           `json:"alt" cborgen:"alt"`
+	AspectRatio   *AspectRatio     `json:"aspectRatio,omitempty" cborgen:"aspectRatio,omitempty"`
+	Blob          *util.BlobSchema `json:"blob,omitempty" cborgen:"blob,omitempty"`
+}
+
 type AspectRatio struct {
 	Height int64 `json:"height" cborgen:"height"`
 	Width  int64 `json:"width" cborgen:"width"`
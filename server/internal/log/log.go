@@ -1,44 +1,101 @@
 package log
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"io"
-	"log"
 	"log/slog"
+	"strings"
 )
 
+// Logger is an slog.Logger that also picks up attributes stashed in the
+// context with WithAttrs, so a request id or channel uri set once at the top
+// of a call shows up on everything logged underneath it
 type Logger struct {
-	debugLogger *log.Logger
-	prodLogger  *log.Logger
-	Slog        *slog.Logger
+	*slog.Logger
 }
 
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
 func New(w io.Writer, verbose bool) *Logger {
-	l := Logger{}
-	l.prodLogger = log.New(w, "[log]", log.Ldate|log.Ltime)
+	level := slog.LevelInfo
 	if verbose {
-		l.debugLogger = log.New(w, "[debug]", log.Ldate|log.Ltime)
+		level = slog.LevelDebug
+	}
+	return NewWith(w, level, FormatText)
+}
+
+func NewWith(w io.Writer, level slog.Level, format Format) *Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if format == FormatJSON {
+		h = slog.NewJSONHandler(w, opts)
+	} else {
+		h = slog.NewTextHandler(w, opts)
+	}
+	return &Logger{slog.New(contextHandler{h})}
+}
+
+// ParseLevel reads debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	if err != nil {
+		return 0, errors.New("must be debug, info, warn or error")
 	}
-	l.Slog = slog.New(slog.NewTextHandler(w, nil))
-	return &l
+	return level, nil
 }
 
-func (l *Logger) Deprintln(s string) {
-	if l.debugLogger != nil {
-		l.debugLogger.Println(s)
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case FormatText, FormatJSON:
+		return f, nil
 	}
+	return "", errors.New("must be text or json")
+}
+
+// With returns a Logger that adds args to everything it logs
+func (l *Logger) With(args ...any) *Logger {
+	return &Logger{l.Logger.With(args...)}
+}
+
+type ctxKey struct{}
+
+// WithAttrs returns a context that adds args, which are key value pairs like
+// slog takes, to everything logged with it
+func WithAttrs(ctx context.Context, args ...any) context.Context {
+	var r slog.Record
+	r.Add(args...)
+	prev, _ := ctx.Value(ctxKey{}).([]slog.Attr)
+	attrs := make([]slog.Attr, len(prev), len(prev)+r.NumAttrs())
+	copy(attrs, prev)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return context.WithValue(ctx, ctxKey{}, attrs)
 }
 
-func (l *Logger) Deprintf(format string, args ...any) {
-	l.Deprintln(fmt.Sprintf(format, args...))
+type contextHandler struct {
+	slog.Handler
 }
 
-func (l *Logger) Println(s string) {
-	if l.prodLogger != nil {
-		l.prodLogger.Println(s)
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(ctxKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
 	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
 }
 
-func (l *Logger) Printf(format string, args ...any) {
-	l.Println(fmt.Sprintf(format, args...))
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
 }
@@ -0,0 +1,320 @@
+package mediacache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"rvcx/internal/atputils"
+	"rvcx/internal/log"
+	"rvcx/internal/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/ipfs/go-cid"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// fetchTimeout bounds a single blob fetch. fetches are shared between
+	// everyone asking for the same blob, so they can't use any one
+	// request's context
+	fetchTimeout = time.Minute
+)
+
+// Cache keeps blobs from pds's on disk so that we don't fetch them every time
+// they're viewed. blobs live at dir/<did>/<cid>, and once the cache holds
+// more than budget bytes the least recently used ones get evicted
+type Cache struct {
+	dir    string
+	budget int64
+	logger *log.Logger
+	fetch  func(did string, cid string, ctx context.Context) ([]byte, error)
+	group  singleflight.Group
+
+	mu      sync.Mutex
+	used    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	did  string
+	cid  string
+	size int64
+}
+
+func New(dir string, budget int64, l *log.Logger) (*Cache, error) {
+	c := &Cache{
+		dir:     dir,
+		budget:  budget,
+		logger:  l,
+		fetch:   atputils.SyncGetBlob,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make cache dir: %w", err)
+	}
+	err = c.load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cache: %w", err)
+	}
+	return c, nil
+}
+
+// SetFetcher overrides how blobs are fetched, which is mostly useful for
+// pointing the cache at a fake pds
+func (c *Cache) SetFetcher(f func(did string, cid string, ctx context.Context) ([]byte, error)) {
+	c.fetch = f
+}
+
+func key(did string, cid string) string {
+	return did + "/" + cid
+}
+
+func (c *Cache) path(did string, cid string) string {
+	return filepath.Join(c.dir, did, cid)
+}
+
+// load indexes whatever is already on disk, oldest first, so a restart
+// doesn't forget about the cache. anything that isn't at dir/<did>/<cid>,
+// like leftovers from the old flat layout, is removed
+func (c *Cache) load() error {
+	type found struct {
+		entry
+		mod time.Time
+	}
+	var files []found
+	removed := 0
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(rel, string(filepath.Separator))
+		if len(parts) != 2 || strings.HasPrefix(parts[1], ".") || validate(parts[0], parts[1]) != nil {
+			removed += 1
+			return os.Remove(path)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, found{entry{parts[0], parts[1], info.Size()}, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if removed != 0 {
+		c.logger.Info("removed stray files from the media cache", "removed", removed)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mod.After(files[j].mod)
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range files {
+		e := f.entry
+		c.entries[key(e.did, e.cid)] = c.lru.PushBack(&e)
+		c.used += e.size
+	}
+	c.evict(nil)
+	return nil
+}
+
+// validate makes sure did and cid are what they say they are, which also
+// keeps them from escaping the cache dir
+func validate(did string, c string) error {
+	_, err := syntax.ParseDID(did)
+	if err != nil {
+		return fmt.Errorf("bad did: %w", err)
+	}
+	_, err = cid.Decode(c)
+	if err != nil {
+		return fmt.Errorf("bad cid: %w", err)
+	}
+	return nil
+}
+
+// Open returns the blob cid from did's repo, fetching it if we don't have it
+// yet. the caller has to close the file
+func (c *Cache) Open(did string, cid string, ctx context.Context) (*os.File, error) {
+	err := validate(did, cid)
+	if err != nil {
+		return nil, err
+	}
+	k := key(did, cid)
+	c.mu.Lock()
+	el, ok := c.entries[k]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if ok {
+		f, err := os.Open(c.path(did, cid))
+		if err == nil {
+			metrics.MediaCache.WithLabelValues("hit").Inc()
+			return f, nil
+		}
+		// someone removed it behind our back, so forget about it and
+		// fetch it again
+		c.Purge(did, cid)
+	}
+	metrics.MediaCache.WithLabelValues("miss").Inc()
+	_, err, _ = c.group.Do(k, func() (any, error) {
+		fctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), fetchTimeout)
+		defer cancel()
+		return nil, c.fill(fctx, did, cid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(c.path(did, cid))
+}
+
+// fill fetches a blob, checks that it hashes to its cid, and writes it to
+// disk, evicting whatever it has to to stay under budget
+func (c *Cache) fill(ctx context.Context, did string, cidstr string) error {
+	blob, err := c.fetch(did, cidstr, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch blob: %w", err)
+	}
+	err = verify(cidstr, blob)
+	if err != nil {
+		return err
+	}
+	size := int64(len(blob))
+	if size > c.budget {
+		return fmt.Errorf("blob is %d bytes, which is more than the whole cache", size)
+	}
+	err = os.MkdirAll(filepath.Join(c.dir, did), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to make dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Join(c.dir, did), "."+cidstr+"-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	_, err = tmp.Write(blob)
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	err = os.Rename(tmp.Name(), c.path(did, cidstr))
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to move blob into place: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := key(did, cidstr)
+	if old, ok := c.entries[k]; ok {
+		c.used -= old.Value.(*entry).size
+		c.lru.Remove(old)
+	}
+	el := c.lru.PushFront(&entry{did, cidstr, size})
+	c.entries[k] = el
+	c.used += size
+	c.evict(el)
+	return nil
+}
+
+func verify(cidstr string, blob []byte) error {
+	want, err := cid.Decode(cidstr)
+	if err != nil {
+		return fmt.Errorf("bad cid: %w", err)
+	}
+	got, err := want.Prefix().Sum(blob)
+	if err != nil {
+		return fmt.Errorf("failed to hash blob: %w", err)
+	}
+	if !got.Equals(want) {
+		return fmt.Errorf("blob doesn't match its cid %s", cidstr)
+	}
+	return nil
+}
+
+// evict removes the least recently used blobs until we're under budget,
+// except for keep, which was just added. must hold mu
+func (c *Cache) evict(keep *list.Element) {
+	for c.used > c.budget {
+		el := c.lru.Back()
+		if el == nil || el == keep {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+// remove forgets about a blob and deletes it. files that are open stay
+// readable until they're closed, so this is safe to do while serving it. must
+// hold mu
+func (c *Cache) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	c.lru.Remove(el)
+	delete(c.entries, key(e.did, e.cid))
+	c.used -= e.size
+	err := os.Remove(c.path(e.did, e.cid))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		c.logger.Error("failed to remove cached blob", "did", e.did, "cid", e.cid, "err", err)
+	}
+}
+
+// Purge removes a single blob, call it when the record that pointed to it is
+// deleted
+func (c *Cache) Purge(did string, cid string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key(did, cid)]
+	if ok {
+		c.remove(el)
+	}
+}
+
+// PurgeDid removes every blob from did, call it when did gets banned
+func (c *Cache) PurgeDid(did string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*entry).did == did {
+			c.remove(el)
+		}
+		el = next
+	}
+	if _, err := syntax.ParseDID(did); err == nil {
+		os.RemoveAll(filepath.Join(c.dir, did))
+	}
+}
+
+// Used returns how many bytes the cache is holding
+func (c *Cache) Used() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used
+}
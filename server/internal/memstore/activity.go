@@ -0,0 +1,84 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"rvcx/internal/store"
+	"rvcx/internal/types"
+	"sort"
+	"time"
+)
+
+// activity is a channel's row of channel_activity. popular is -Inf until
+// someone counts as a poster
+type activity struct {
+	active       float64
+	popular      float64
+	lastActiveAt time.Time
+}
+
+// countActivity is db's countActivity, and must be called holding mu
+func (s *Store) countActivity(signetURI string, did string, at time.Time) {
+	sig, ok := s.signets[signetURI]
+	if !ok {
+		return
+	}
+	a, ok := s.activity[sig.ChannelURI]
+	if !ok {
+		a = &activity{active: math.Inf(-1), popular: math.Inf(-1)}
+		s.activity[sig.ChannelURI] = a
+	}
+	a.active = store.AddRanks(a.active, store.Rank(at, store.ActiveHalfLife))
+	if at.After(a.lastActiveAt) {
+		a.lastActiveAt = at
+	}
+	posters, ok := s.posters[sig.ChannelURI]
+	if !ok {
+		posters = make(map[string]time.Time)
+		s.posters[sig.ChannelURI] = posters
+	}
+	counted, ok := posters[did]
+	if ok && counted.After(at.Add(-store.PosterWindow)) {
+		return
+	}
+	posters[did] = at
+	a.popular = store.AddRanks(a.popular, store.Rank(at, store.PopularHalfLife))
+}
+
+func (s *Store) GetRankedChannelViews(srt types.ChannelSort, limit int, cursor *types.RankCursor, ctx context.Context) ([]types.ChannelView, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rank := func(a *activity) float64 { return a.active }
+	switch srt {
+	case types.SortActive:
+	case types.SortPopular:
+		rank = func(a *activity) float64 { return a.popular }
+	default:
+		return nil, fmt.Errorf("can't rank channels by %s", srt)
+	}
+	views := make([]types.ChannelView, 0, len(s.channels))
+	for _, c := range s.channels {
+		cv := s.channelView(c)
+		cv.Rank = math.Inf(-1)
+		if a, ok := s.activity[c.URI]; ok {
+			cv.Rank = rank(a)
+			at := a.lastActiveAt
+			cv.LastActiveAt = &at
+		}
+		if cursor != nil && !cursor.Lower(cv.Rank, cv.URI) {
+			continue
+		}
+		views = append(views, cv)
+	}
+	sort.Slice(views, func(i, j int) bool {
+		if views[i].Rank != views[j].Rank {
+			return views[i].Rank > views[j].Rank
+		}
+		return views[i].URI > views[j].URI
+	})
+	if len(views) > limit {
+		views = views[:limit]
+	}
+	return views, nil
+}
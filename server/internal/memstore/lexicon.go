@@ -0,0 +1,615 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"rvcx/internal/lex"
+	"rvcx/internal/store"
+	"rvcx/internal/types"
+	"sort"
+	"time"
+)
+
+func (s *Store) StoreSignet(signet *types.Signet, ctx context.Context) (wasNew bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.signets[signet.URI]; ok {
+		return false, nil
+	}
+	err = s.insertSignet(signet)
+	if err != nil {
+		return false, fmt.Errorf("SOMETHING BAD HAPPENED: %w", err)
+	}
+	return true, nil
+}
+
+// UpdateSignet is a plain insert, so it fails if the signet already exists
+func (s *Store) UpdateSignet(signet *types.Signet, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.signets[signet.URI]; ok {
+		return fmt.Errorf("SOMETHING BAD HAPPENED: signet already exists: %s", signet.URI)
+	}
+	err := s.insertSignet(signet)
+	if err != nil {
+		return fmt.Errorf("SOMETHING BAD HAPPENED: %w", err)
+	}
+	return nil
+}
+
+// insertSignet must hold mu
+func (s *Store) insertSignet(signet *types.Signet) error {
+	if _, ok := s.channels[signet.ChannelURI]; !ok {
+		return fmt.Errorf("no such channel: %s", signet.ChannelURI)
+	}
+	sig := *signet
+	sig.IndexedAt = time.Now()
+	s.signets[sig.URI] = &sig
+	return nil
+}
+
+func (s *Store) DeleteSignet(uri string, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteSignet(uri)
+	return nil
+}
+
+// deleteSignet takes everything posted under the signet with it. must hold mu
+func (s *Store) deleteSignet(uri string) {
+	delete(s.signets, uri)
+	for muri, m := range s.messages {
+		if m.SignetURI == uri {
+			delete(s.messages, muri)
+			delete(s.revs, muri)
+		}
+	}
+	for iuri, i := range s.images {
+		if i.SignetURI == uri {
+			delete(s.images, iuri)
+		}
+	}
+	for vuri, v := range s.videos {
+		if v.SignetURI == uri {
+			delete(s.videos, vuri)
+		}
+	}
+}
+
+func (s *Store) QuerySignet(channelUri string, id uint32, ctx context.Context) (signetUri string, signetHandle string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, sig := range s.signets {
+		if sig.ChannelURI == channelUri && sig.MessageID == id {
+			signetUri = sig.URI
+			if sig.AuthorHandle != nil {
+				signetHandle = *sig.AuthorHandle
+			}
+			return
+		}
+	}
+	err = fmt.Errorf("error scanning: %w", store.ErrNotFound)
+	return
+}
+
+func (s *Store) QuerySignetHandle(uri string, ctx context.Context) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sig, ok := s.signets[uri]
+	if !ok || sig.AuthorHandle == nil {
+		return "", store.ErrNotFound
+	}
+	return *sig.AuthorHandle, nil
+}
+
+func (s *Store) QuerySignetDid(uri string, ctx context.Context) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sig, ok := s.signets[uri]
+	if !ok {
+		return "", store.ErrNotFound
+	}
+	return sig.Author, nil
+}
+
+func (s *Store) QuerySignetChannelIdNum(uri string, ctx context.Context) (channelUri string, messageID uint32, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sig, ok := s.signets[uri]
+	if !ok {
+		err = store.ErrNotFound
+		return
+	}
+	return sig.ChannelURI, sig.MessageID, nil
+}
+
+func (s *Store) GetMsgChannelURI(signetURI string, ctx context.Context) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sig, ok := s.signets[signetURI]
+	if !ok {
+		return "", fmt.Errorf("error scanning: %w", store.ErrNotFound)
+	}
+	return sig.ChannelURI, nil
+}
+
+// GetSignetsAfter gets the first limit signets in a channel with an lrcID
+// greater than after, oldest first
+func (s *Store) GetSignetsAfter(channelURI string, limit int, after uint32, ctx context.Context) ([]types.SignetView, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sigs := make([]*types.Signet, 0)
+	for _, sig := range s.signets {
+		if sig.ChannelURI == channelURI && sig.MessageID > after {
+			sigs = append(sigs, sig)
+		}
+	}
+	sort.Slice(sigs, func(i, j int) bool {
+		return sigs[i].MessageID < sigs[j].MessageID
+	})
+	if len(sigs) > limit {
+		sigs = sigs[:limit]
+	}
+	views := make([]types.SignetView, 0, len(sigs))
+	for _, sig := range sigs {
+		views = append(views, signetView(sig))
+	}
+	return views, nil
+}
+
+func signetView(sig *types.Signet) types.SignetView {
+	return types.SignetView{
+		URI:          sig.URI,
+		Issuer:       sig.IssuerDID,
+		ChannelURI:   sig.ChannelURI,
+		LrcId:        sig.MessageID,
+		Author:       sig.Author,
+		AuthorHandle: sig.AuthorHandle,
+		StartedAt:    sig.StartedAt,
+	}
+}
+
+// GetSignetIDAt gets the lrcID of the last signet in a channel that started
+// at or before t, or 0 if there isn't one
+func (s *Store) GetSignetIDAt(channelURI string, t time.Time, ctx context.Context) (uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var id uint32
+	for _, sig := range s.signets {
+		if sig.ChannelURI == channelURI && !sig.StartedAt.After(t) && sig.MessageID > id {
+			id = sig.MessageID
+		}
+	}
+	return id, nil
+}
+
+func (s *Store) StoreMessage(message *types.Message, ctx context.Context) (wasNew bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.messages[message.URI]; ok {
+		return false, nil
+	}
+	if _, ok := s.signets[message.SignetURI]; !ok {
+		return false, fmt.Errorf("no such signet: %s", message.SignetURI)
+	}
+	m := *message
+	m.IndexedAt = time.Now()
+	s.messages[m.URI] = &m
+	s.countActivity(m.SignetURI, m.DID, m.IndexedAt)
+	return true, nil
+}
+
+func (s *Store) UpdateMessage(message *types.Message, ctx context.Context) (edited bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[message.URI]
+	if !ok {
+		return false, store.ErrNotFound
+	}
+	if m.CID == message.CID {
+		return false, nil
+	}
+	now := time.Now()
+	written := m.PostedAt
+	if m.EditedAt != nil {
+		written = *m.EditedAt
+	}
+	s.revs[m.URI] = append(s.revs[m.URI], types.MessageRevisionView{
+		CID:       m.CID,
+		Body:      m.Body,
+		Nick:      m.Nick,
+		Color:     m.Color,
+		WrittenAt: written,
+		RevisedAt: now,
+	})
+	m.CID = message.CID
+	m.Body = message.Body
+	m.Nick = message.Nick
+	m.Color = message.Color
+	m.EditedAt = &now
+	message.EditedAt = &now
+	return true, nil
+}
+
+func (s *Store) GetMessageRevisions(uri string, ctx context.Context) ([]types.MessageRevisionView, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	revisions := make([]types.MessageRevisionView, 0, len(s.revs[uri]))
+	for i := len(s.revs[uri]) - 1; i >= 0; i-- {
+		revisions = append(revisions, s.revs[uri][i])
+	}
+	return revisions, nil
+}
+
+func (s *Store) DeleteMessage(uri string, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.messages, uri)
+	delete(s.revs, uri)
+	return nil
+}
+
+// GetMessageChannelURI finds the channel a message was posted in by way of
+// its signet
+func (s *Store) GetMessageChannelURI(uri string, ctx context.Context) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.messages[uri]
+	if !ok {
+		return "", fmt.Errorf("error scanning: %w", store.ErrNotFound)
+	}
+	return s.signetChannelURI(m.SignetURI)
+}
+
+// signetChannelURI must hold mu
+func (s *Store) signetChannelURI(signetURI string) (string, error) {
+	sig, ok := s.signets[signetURI]
+	if !ok {
+		return "", fmt.Errorf("error scanning: %w", store.ErrNotFound)
+	}
+	return sig.ChannelURI, nil
+}
+
+// GetMessages only returns messages whose author's handle matches the one on
+// their signet, and pages through them newest first by lrcID
+func (s *Store) GetMessages(channelURI string, limit int, cursor *int, ctx context.Context) ([]types.SignedMessageView, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	msgs := make([]types.SignedMessageView, 0)
+	for _, m := range s.messages {
+		sig, ok := s.signets[m.SignetURI]
+		if !ok || sig.ChannelURI != channelURI {
+			continue
+		}
+		if cursor != nil && int64(sig.MessageID) >= int64(*cursor) {
+			continue
+		}
+		handle, ok := s.handleOf(m.DID)
+		if !ok || sig.AuthorHandle == nil || *sig.AuthorHandle != handle {
+			continue
+		}
+		issuer, ok := s.handleOf(sig.IssuerDID)
+		if !ok {
+			continue
+		}
+		var msg types.SignedMessageView
+		msg.URI = m.URI
+		msg.Author.DID = m.DID
+		msg.Author.Handle = handle
+		if p, ok := s.profiles[m.DID]; ok {
+			msg.Author.DisplayName = p.DisplayName
+			msg.Author.Status = p.Status
+			msg.Author.Color = p.Color
+			msg.Author.Avatar = p.AvatarCID
+			msg.Author.DefaultNick = p.DefaultNick
+		}
+		msg.Body = m.Body
+		msg.Nick = m.Nick
+		msg.Color = m.Color
+		msg.Signet = types.SignetView{
+			URI:          sig.URI,
+			Issuer:       issuer,
+			ChannelURI:   sig.ChannelURI,
+			LrcId:        sig.MessageID,
+			AuthorHandle: sig.AuthorHandle,
+			StartedAt:    sig.StartedAt,
+		}
+		msg.PostedAt = m.PostedAt
+		msg.Edited = m.EditedAt != nil
+		msg.EditedAt = m.EditedAt
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Signet.LrcId > msgs[j].Signet.LrcId
+	})
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+	return msgs, nil
+}
+
+func (s *Store) GetHistory(channelURI string, limit int, cursor *int, ctx context.Context) ([]types.SignedItemView, error) {
+	return s.history(channelURI, limit, func(id uint32) bool {
+		return cursor == nil || int64(id) < int64(*cursor)
+	}), nil
+}
+
+// GetHistoryBetween gets every item in a channel whose signet's lrcID is
+// after after and no later than through, newest first just like GetHistory
+func (s *Store) GetHistoryBetween(channelURI string, after uint32, through uint32, ctx context.Context) ([]types.SignedItemView, error) {
+	return s.history(channelURI, -1, func(id uint32) bool {
+		return id > after && id <= through
+	}), nil
+}
+
+// history collects the messages and media in a channel whose signet's lrcID
+// passes keep. like the union in db, items only count if they were posted by
+// whoever their signet was issued to, and if we know their handle and profile
+func (s *Store) history(channelURI string, limit int, keep func(id uint32) bool) []types.SignedItemView {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	type item struct {
+		id       uint32
+		postedAt time.Time
+		view     types.SignedItemView
+	}
+	items := make([]item, 0)
+	signed := func(did string, signetURI string) (*types.Signet, types.ProfileView, bool) {
+		sig, ok := s.signets[signetURI]
+		if !ok || sig.ChannelURI != channelURI || sig.Author != did || !keep(sig.MessageID) {
+			return nil, types.ProfileView{}, false
+		}
+		p, ok := s.profileView(did)
+		return sig, p, ok
+	}
+	base := s.identity
+	for _, m := range s.messages {
+		sig, p, ok := signed(m.DID, m.SignetURI)
+		if !ok {
+			continue
+		}
+		var msg types.SignedMessageView
+		msg.URI = m.URI
+		msg.Author = p
+		msg.Body = m.Body
+		if m.Nick != nil && *m.Nick != "" {
+			msg.Nick = m.Nick
+		}
+		if m.Color != nil && *m.Color != 0 {
+			msg.Color = m.Color
+		}
+		msg.Signet = signetView(sig)
+		msg.PostedAt = m.PostedAt
+		msg.Edited = m.EditedAt != nil
+		msg.EditedAt = m.EditedAt
+		items = append(items, item{sig.MessageID, m.PostedAt, msg})
+	}
+	for _, i := range s.images {
+		sig, p, ok := signed(i.DID, i.SignetURI)
+		if !ok {
+			continue
+		}
+		var imgview types.ImageView
+		imgview.Alt = i.Alt
+		imgview.AspectRatio = aspectRatio(i.Width, i.Height)
+		src := fmt.Sprintf("https://%s/xrpc/org.xcvr.lrc.getImage?uri=%s", base, i.URI)
+		imgview.Src = &src
+		img := mediaView(i.URI, p, i.Nick, i.Color, sig, i.PostedAt)
+		img.Image = &imgview
+		items = append(items, item{sig.MessageID, i.PostedAt, img})
+	}
+	for _, v := range s.videos {
+		sig, p, ok := signed(v.DID, v.SignetURI)
+		if !ok {
+			continue
+		}
+		var vidview types.VideoView
+		vidview.Alt = v.Alt
+		vidview.AspectRatio = aspectRatio(v.Width, v.Height)
+		src := fmt.Sprintf("https://%s/xrpc/org.xcvr.lrc.getVideo?uri=%s", base, v.URI)
+		vidview.Src = &src
+		vid := mediaView(v.URI, p, v.Nick, v.Color, sig, v.PostedAt)
+		vid.Video = &vidview
+		items = append(items, item{sig.MessageID, v.PostedAt, vid})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].id != items[j].id {
+			return items[i].id > items[j].id
+		}
+		return items[i].postedAt.After(items[j].postedAt)
+	})
+	if limit >= 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	views := make([]types.SignedItemView, 0, len(items))
+	for _, it := range items {
+		views = append(views, it.view)
+	}
+	return views
+}
+
+func aspectRatio(width *int64, height *int64) *lex.AspectRatio {
+	if width == nil || height == nil {
+		return nil
+	}
+	return &lex.AspectRatio{Width: *width, Height: *height}
+}
+
+func mediaView(uri string, p types.ProfileView, nick *string, color *uint32, sig *types.Signet, postedAt time.Time) types.SignedMediaView {
+	var m types.SignedMediaView
+	m.URI = uri
+	m.Author = p
+	if nick != nil && *nick != "" {
+		m.Nick = nick
+	}
+	if color != nil && *color != 0 {
+		m.Color = color
+	}
+	m.Signet = signetView(sig)
+	m.PostedAt = postedAt
+	return m
+}
+
+func (s *Store) StoreImage(image *types.Image, ctx context.Context) (wasNew bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.images[image.URI]; ok {
+		return false, nil
+	}
+	if _, ok := s.signets[image.SignetURI]; !ok {
+		return false, fmt.Errorf("effor storing image: no such signet: %s", image.SignetURI)
+	}
+	i := *image
+	i.IndexedAt = time.Now()
+	s.images[i.URI] = &i
+	s.countActivity(i.SignetURI, i.DID, i.IndexedAt)
+	return true, nil
+}
+
+func (s *Store) UpdateImage(image *types.Image, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.images[image.URI]
+	if !ok {
+		if _, ok := s.signets[image.SignetURI]; !ok {
+			return fmt.Errorf("effor updating image: no such signet: %s", image.SignetURI)
+		}
+		i := *image
+		i.IndexedAt = time.Now()
+		s.images[i.URI] = &i
+		return nil
+	}
+	old.BlobCID = image.BlobCID
+	old.BlobMIME = image.BlobMIME
+	old.Alt = image.Alt
+	old.Height = image.Height
+	old.Width = image.Width
+	old.Nick = image.Nick
+	old.Color = image.Color
+	old.CID = image.CID
+	return nil
+}
+
+func (s *Store) DeleteImage(uri string, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.images, uri)
+	return nil
+}
+
+func (s *Store) GetImage(uri string, ctx context.Context) (*types.Image, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.images[uri]
+	if !ok {
+		return nil, fmt.Errorf("error getting image: %w", store.ErrNotFound)
+	}
+	image := *i
+	return &image, nil
+}
+
+func (s *Store) GetImageDidCID(did string, cid string, ctx context.Context) (*types.Image, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, i := range s.images {
+		if i.DID == did && i.BlobCID != nil && *i.BlobCID == cid {
+			image := *i
+			return &image, nil
+		}
+	}
+	return nil, fmt.Errorf("error getting image: %w", store.ErrNotFound)
+}
+
+// GetImageChannelURI finds the channel an image was posted in by way of its
+// signet
+func (s *Store) GetImageChannelURI(uri string, ctx context.Context) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i, ok := s.images[uri]
+	if !ok {
+		return "", fmt.Errorf("error scanning: %w", store.ErrNotFound)
+	}
+	return s.signetChannelURI(i.SignetURI)
+}
+
+func (s *Store) StoreVideo(video *types.Video, ctx context.Context) (wasNew bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.videos[video.URI]; ok {
+		return false, nil
+	}
+	if _, ok := s.signets[video.SignetURI]; !ok {
+		return false, fmt.Errorf("error storing video: no such signet: %s", video.SignetURI)
+	}
+	v := *video
+	v.IndexedAt = time.Now()
+	s.videos[v.URI] = &v
+	s.countActivity(v.SignetURI, v.DID, v.IndexedAt)
+	return true, nil
+}
+
+func (s *Store) UpdateVideo(video *types.Video, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.videos[video.URI]
+	if !ok {
+		if _, ok := s.signets[video.SignetURI]; !ok {
+			return fmt.Errorf("error updating video: no such signet: %s", video.SignetURI)
+		}
+		v := *video
+		v.IndexedAt = time.Now()
+		s.videos[v.URI] = &v
+		return nil
+	}
+	old.BlobCID = video.BlobCID
+	old.BlobMIME = video.BlobMIME
+	old.Alt = video.Alt
+	old.Height = video.Height
+	old.Width = video.Width
+	old.Nick = video.Nick
+	old.Color = video.Color
+	old.CID = video.CID
+	return nil
+}
+
+func (s *Store) DeleteVideo(uri string, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.videos, uri)
+	return nil
+}
+
+func (s *Store) GetVideo(uri string, ctx context.Context) (*types.Video, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.videos[uri]
+	if !ok {
+		return nil, fmt.Errorf("error getting video: %w", store.ErrNotFound)
+	}
+	video := *v
+	return &video, nil
+}
+
+func (s *Store) GetVideoDidCID(did string, cid string, ctx context.Context) (*types.Video, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, v := range s.videos {
+		if v.DID == did && v.BlobCID != nil && *v.BlobCID == cid {
+			video := *v
+			return &video, nil
+		}
+	}
+	return nil, fmt.Errorf("error getting video: %w", store.ErrNotFound)
+}
+
+// GetVideoChannelURI finds the channel a video was posted in by way of its
+// signet
+func (s *Store) GetVideoChannelURI(uri string, ctx context.Context) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.videos[uri]
+	if !ok {
+		return "", fmt.Errorf("error scanning: %w", store.ErrNotFound)
+	}
+	return s.signetChannelURI(v.SignetURI)
+}
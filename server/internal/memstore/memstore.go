@@ -0,0 +1,528 @@
+// Package memstore keeps everything in memory, and is meant to behave just
+// like db.Store does so that anything above the db layer can run without
+// postgres
+package memstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rvcx/internal/atputils"
+	"rvcx/internal/config"
+	"rvcx/internal/store"
+	"rvcx/internal/types"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/auth/oauth"
+)
+
+type Store struct {
+	// identity is our hostname, which media srcs point at
+	identity string
+	mu       sync.RWMutex
+	handles  map[string]*types.DIDHandle
+	profiles map[string]*types.Profile
+	channels map[string]*types.Channel
+	lastIDs  map[string]uint32
+	subs     map[string]*types.Sub
+	signets  map[string]*types.Signet
+	messages map[string]*types.Message
+	images   map[string]*types.Image
+	videos   map[string]*types.Video
+	// revs are message_revisions by message uri, oldest first
+	revs map[string][]types.MessageRevisionView
+	// activity and posters are channel_activity and channel_posters, by
+	// channel uri
+	activity map[string]*activity
+	posters  map[string]map[string]time.Time
+	bans     []types.Ban
+	reports  []types.Report
+	cursors  map[string]int64
+	// outbox is kept in id order, outboxID is the last id handed out
+	outbox   []types.OutboxItem
+	outboxID int
+	sessions map[string]oauth.ClientSessionData
+	requests map[string]oauth.AuthRequestData
+}
+
+var _ store.Store = (*Store)(nil)
+
+func New(cfg *config.Config) *Store {
+	return &Store{
+		identity: cfg.Identity,
+		handles:  make(map[string]*types.DIDHandle),
+		profiles: make(map[string]*types.Profile),
+		channels: make(map[string]*types.Channel),
+		lastIDs:  make(map[string]uint32),
+		subs:     make(map[string]*types.Sub),
+		signets:  make(map[string]*types.Signet),
+		messages: make(map[string]*types.Message),
+		revs:     make(map[string][]types.MessageRevisionView),
+		images:   make(map[string]*types.Image),
+		videos:   make(map[string]*types.Video),
+		activity: make(map[string]*activity),
+		posters:  make(map[string]map[string]time.Time),
+		cursors:  make(map[string]int64),
+		sessions: make(map[string]oauth.ClientSessionData),
+		requests: make(map[string]oauth.AuthRequestData),
+	}
+}
+
+func (s *Store) Close() {}
+
+func (s *Store) ResolveHandle(handle string, ctx context.Context) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dh, ok := s.handles[handle]
+	if !ok {
+		return "", store.ErrNotFound
+	}
+	return dh.DID, nil
+}
+
+func (s *Store) FullResolveHandle(hdl string, ctx context.Context) (string, error) {
+	did, err := s.ResolveHandle(hdl, ctx)
+	if err == nil {
+		return did, nil
+	}
+	did, err = atputils.TryLookupHandle(ctx, hdl)
+	if err != nil {
+		return "", fmt.Errorf("couldn't resolve: %w", err)
+	}
+	s.StoreDidHandle(did, hdl, ctx)
+	return did, nil
+}
+
+func (s *Store) ResolveDid(did string, ctx context.Context) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	handle, ok := s.handleOf(did)
+	if !ok {
+		return "", fmt.Errorf("error scanning row for handle: %w", store.ErrNotFound)
+	}
+	return handle, nil
+}
+
+func (s *Store) FullResolveDid(did string, ctx context.Context) (string, error) {
+	hdl, err := s.ResolveDid(did, ctx)
+	if err == nil {
+		return hdl, nil
+	}
+	hdl, err = atputils.TryLookupDid(ctx, did)
+	if err != nil {
+		return "", fmt.Errorf("couldn't resolve: %w", err)
+	}
+	s.StoreDidHandle(did, hdl, ctx)
+	return hdl, nil
+}
+
+func (s *Store) GetDids(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dhs := make([]*types.DIDHandle, 0, len(s.handles))
+	for _, dh := range s.handles {
+		dhs = append(dhs, dh)
+	}
+	sort.Slice(dhs, func(i, j int) bool {
+		return dhs[i].IndexedAt.Before(dhs[j].IndexedAt)
+	})
+	dids := make([]string, 0, len(dhs))
+	for _, dh := range dhs {
+		dids = append(dids, dh.DID)
+	}
+	return dids, nil
+}
+
+// StoreDidHandle keeps the first did seen for a handle, and like the did
+// column in did_handles, a did can only have one handle
+func (s *Store) StoreDidHandle(did string, handle string, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.handles[handle]; ok {
+		return nil
+	}
+	if _, ok := s.handleOf(did); ok {
+		return fmt.Errorf("error storing did/handle: %s already has a handle", did)
+	}
+	s.handles[handle] = &types.DIDHandle{Handle: handle, DID: did, IndexedAt: time.Now()}
+	return nil
+}
+
+// handleOf must hold mu
+func (s *Store) handleOf(did string) (string, bool) {
+	for _, dh := range s.handles {
+		if dh.DID == did {
+			return dh.Handle, true
+		}
+	}
+	return "", false
+}
+
+func (s *Store) GetLastSeen(did string, ctx context.Context) (where *string, when *time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	handle, ok := s.handleOf(did)
+	if !ok {
+		return
+	}
+	for _, m := range s.messages {
+		if m.DID != did {
+			continue
+		}
+		sig, ok := s.signets[m.SignetURI]
+		if !ok || sig.AuthorHandle == nil || *sig.AuthorHandle != handle {
+			continue
+		}
+		if when == nil || m.PostedAt.After(*when) {
+			channelURI := sig.ChannelURI
+			postedAt := m.PostedAt
+			where = &channelURI
+			when = &postedAt
+		}
+	}
+	return
+}
+
+func (s *Store) InitializeProfile(did string,
+	displayname *string,
+	defaultnick *string,
+	status *string,
+	color *uint64,
+	ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.profiles[did]; ok {
+		return nil
+	}
+	s.profiles[did] = &types.Profile{
+		DID:         did,
+		DisplayName: displayname,
+		DefaultNick: defaultnick,
+		Status:      status,
+		Color:       color,
+		IndexedAt:   time.Now(),
+	}
+	return nil
+}
+
+func (s *Store) UpdateProfile(did string, displayname *string, defaultnick *string, status *string, color *uint64, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.profiles[did]
+	if !ok {
+		p = &types.Profile{DID: did}
+		s.profiles[did] = p
+	}
+	p.DisplayName = displayname
+	p.DefaultNick = defaultnick
+	p.Status = status
+	p.Color = color
+	p.IndexedAt = time.Now()
+	return nil
+}
+
+func (s *Store) DeleteProfile(did string, cid string, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.profiles, did)
+	return nil
+}
+
+func (s *Store) GetProfileView(did string, ctx context.Context) (*types.ProfileView, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.profileView(did)
+	if !ok {
+		return nil, fmt.Errorf("error scanning profile: %w", store.ErrNotFound)
+	}
+	return &p, nil
+}
+
+// profileView is the author of an item in history, which needs both a handle
+// and a profile. must hold mu
+func (s *Store) profileView(did string) (types.ProfileView, bool) {
+	handle, ok := s.handleOf(did)
+	if !ok {
+		return types.ProfileView{}, false
+	}
+	p, ok := s.profiles[did]
+	if !ok {
+		return types.ProfileView{}, false
+	}
+	return types.ProfileView{
+		DID:         did,
+		Handle:      handle,
+		DisplayName: p.DisplayName,
+		Status:      p.Status,
+		Color:       p.Color,
+		Avatar:      p.AvatarCID,
+		DefaultNick: p.DefaultNick,
+	}, true
+}
+
+func (s *Store) StoreChannel(channel *types.Channel, ctx context.Context) (wasNew bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.channels[channel.URI]; ok {
+		return false, nil
+	}
+	c := *channel
+	c.IndexedAt = time.Now()
+	s.channels[c.URI] = &c
+	return true, nil
+}
+
+// UpdateChannel is a plain insert, so it fails if the channel already exists
+func (s *Store) UpdateChannel(channel *types.Channel, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.channels[channel.URI]; ok {
+		return fmt.Errorf("channel already exists: %s", channel.URI)
+	}
+	c := *channel
+	c.IndexedAt = time.Now()
+	s.channels[c.URI] = &c
+	return nil
+}
+
+// DeleteChannel takes its signets, and everything posted under them, with it
+func (s *Store) DeleteChannel(uri string, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.channels, uri)
+	delete(s.lastIDs, uri)
+	delete(s.activity, uri)
+	delete(s.posters, uri)
+	for suri, sig := range s.signets {
+		if sig.ChannelURI == uri {
+			s.deleteSignet(suri)
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetChannelURI(handle string, title string, ctx context.Context) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found *types.Channel
+	for _, c := range s.channels {
+		if c.Title != title {
+			continue
+		}
+		h, ok := s.handleOf(c.DID)
+		if !ok || h != handle {
+			continue
+		}
+		if found == nil || c.CreatedAt.After(found.CreatedAt) {
+			found = c
+		}
+	}
+	if found == nil {
+		return "", store.ErrNotFound
+	}
+	return found.URI, nil
+}
+
+func (s *Store) GetChannelURIs(ctx context.Context) ([]types.URIHost, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	urihosts := make([]types.URIHost, 0, len(s.channels))
+	for _, c := range s.channels {
+		var urihost types.URIHost
+		urihost.URI = c.URI
+		urihost.Host = c.Host
+		if c.Topic != nil {
+			urihost.Topic = *c.Topic
+		}
+		urihost.LastID = s.lastIDs[c.URI]
+		for _, sig := range s.signets {
+			if sig.ChannelURI == c.URI && sig.MessageID > urihost.LastID {
+				urihost.LastID = sig.MessageID
+			}
+		}
+		urihosts = append(urihosts, urihost)
+	}
+	return urihosts, nil
+}
+
+func (s *Store) StoreLastID(uri string, lastID uint32, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.channels[uri]; ok && lastID > s.lastIDs[uri] {
+		s.lastIDs[uri] = lastID
+	}
+	return nil
+}
+
+// channelView must hold mu
+func (s *Store) channelView(c *types.Channel) types.ChannelView {
+	cv := types.ChannelView{
+		URI:       c.URI,
+		Host:      c.Host,
+		Title:     c.Title,
+		Topic:     c.Topic,
+		CreatedAt: c.CreatedAt,
+	}
+	p, ok := s.profiles[c.DID]
+	if ok {
+		cv.Creator.DisplayName = p.DisplayName
+		cv.Creator.Status = p.Status
+		cv.Creator.Color = p.Color
+		cv.Creator.Avatar = p.AvatarCID
+		if handle, ok := s.handleOf(c.DID); ok {
+			cv.Creator.DID = c.DID
+			cv.Creator.Handle = handle
+		}
+	}
+	return cv
+}
+
+func (s *Store) GetChannelViews(limit int, cursor *types.KeysetCursor, ctx context.Context) ([]types.ChannelView, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	chans := make([]*types.Channel, 0, len(s.channels))
+	for _, c := range s.channels {
+		if cursor != nil && !cursor.Older(c.CreatedAt, c.URI) {
+			continue
+		}
+		chans = append(chans, c)
+	}
+	sort.Slice(chans, func(i, j int) bool {
+		if !chans[i].CreatedAt.Equal(chans[j].CreatedAt) {
+			return chans[i].CreatedAt.After(chans[j].CreatedAt)
+		}
+		return chans[i].URI > chans[j].URI
+	})
+	if len(chans) > limit {
+		chans = chans[:limit]
+	}
+	views := make([]types.ChannelView, 0, len(chans))
+	for _, c := range chans {
+		views = append(views, s.channelView(c))
+	}
+	return views, nil
+}
+
+func (s *Store) GetChannelView(uri string, ctx context.Context) (*types.ChannelView, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.channels[uri]
+	if !ok {
+		return nil, store.ErrNotFound
+	}
+	cv := s.channelView(c)
+	return &cv, nil
+}
+
+func (s *Store) GetChannelViewHR(handle string, rkey string, ctx context.Context) (*types.ChannelView, error) {
+	did, err := s.ResolveHandle(handle, ctx)
+	if err != nil {
+		return nil, err
+	}
+	uri := fmt.Sprintf("at://%s/org.xcvr.feed.channel/%s", did, rkey)
+	return s.GetChannelView(uri, ctx)
+}
+
+func (s *Store) AddBan(did string, reason *string, till *time.Time, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addBan(did, reason, till)
+	return nil
+}
+
+// addBan must hold mu
+func (s *Store) addBan(did string, reason *string, till *time.Time) int {
+	id := len(s.bans) + 1
+	s.bans = append(s.bans, types.Ban{
+		Id:       id,
+		Did:      did,
+		Reason:   reason,
+		Till:     till,
+		BannedAt: time.Now(),
+	})
+	return id
+}
+
+func (s *Store) GetBanned(did string, ctx context.Context) (*types.Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := len(s.bans) - 1; i >= 0; i-- {
+		if s.bans[i].Did == did {
+			ban := s.bans[i]
+			return &ban, nil
+		}
+	}
+	return nil, store.ErrNotFound
+}
+
+func (s *Store) GetBanId(id int, ctx context.Context) (*types.Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id < 1 || id > len(s.bans) {
+		return nil, store.ErrNotFound
+	}
+	ban := s.bans[id-1]
+	return &ban, nil
+}
+
+// GetActiveBan gets the ban that currently applies to did, preferring
+// permanent bans and then whichever lasts the longest
+func (s *Store) GetActiveBan(did string, ctx context.Context) (*types.Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	found := s.activeBan(did)
+	if found == nil {
+		return nil, store.ErrNotFound
+	}
+	ban := *found
+	return &ban, nil
+}
+
+// activeBan must hold mu
+func (s *Store) activeBan(did string) *types.Ban {
+	now := time.Now()
+	var found *types.Ban
+	for i := range s.bans {
+		b := &s.bans[i]
+		if b.Did != did || (b.Till != nil && !b.Till.After(now)) {
+			continue
+		}
+		if found == nil || b.Till == nil || (found.Till != nil && b.Till.After(*found.Till)) {
+			found = b
+		}
+		if found.Till == nil {
+			break
+		}
+	}
+	return found
+}
+
+func (s *Store) IsBanned(did string, ctx context.Context) (bool, error) {
+	_, err := s.GetActiveBan(did, ctx)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) GetCursor(name string, ctx context.Context) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	timeUS, ok := s.cursors[name]
+	if !ok {
+		return 0, store.ErrNotFound
+	}
+	return timeUS, nil
+}
+
+func (s *Store) StoreCursor(name string, timeUS int64, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cursors[name] = timeUS
+	return nil
+}
@@ -0,0 +1,78 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+func (s *Store) GetSession(ctx context.Context, did syntax.DID, sessionID string) (*oauth.ClientSessionData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sess, ok := s.sessions[sessionID]
+	if !ok || sess.AccountDID != did {
+		return nil, errors.New("no such session")
+	}
+	sess.Scopes = append([]string(nil), sess.Scopes...)
+	return &sess, nil
+}
+
+func (s *Store) SaveSession(ctx context.Context, sess oauth.ClientSessionData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess.Scopes = append([]string(nil), sess.Scopes...)
+	s.sessions[sess.SessionID] = sess
+	return nil
+}
+
+func (s *Store) DeleteSession(ctx context.Context, did syntax.DID, sessionID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[sessionID]
+	if ok && sess.AccountDID == did {
+		delete(s.sessions, sessionID)
+	}
+	return nil
+}
+
+func (s *Store) DeleteAllSessions(ctx context.Context, did string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if sess.AccountDID.String() == did {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (s *Store) GetAuthRequestInfo(ctx context.Context, state string) (*oauth.AuthRequestData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, ok := s.requests[state]
+	if !ok {
+		return nil, errors.New("no such request")
+	}
+	info.Scopes = append([]string(nil), info.Scopes...)
+	return &info, nil
+}
+
+func (s *Store) SaveAuthRequestInfo(ctx context.Context, info oauth.AuthRequestData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.requests[info.State]; ok {
+		return errors.New("failed to insert: request already exists")
+	}
+	info.Scopes = append([]string(nil), info.Scopes...)
+	s.requests[info.State] = info
+	return nil
+}
+
+func (s *Store) DeleteAuthRequestInfo(ctx context.Context, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.requests, state)
+	return nil
+}
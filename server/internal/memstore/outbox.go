@@ -0,0 +1,165 @@
+package memstore
+
+import (
+	"context"
+	"fmt"
+	"rvcx/internal/store"
+	"rvcx/internal/types"
+	"time"
+)
+
+func (s *Store) EnqueueWrite(item *types.OutboxItem, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.outbox {
+		if o.URI == item.URI {
+			return fmt.Errorf("error enqueueing write: already queued %s", item.URI)
+		}
+	}
+	s.outboxID += 1
+	now := time.Now()
+	item.Id = s.outboxID
+	item.NextAttemptAt = now
+	item.CreatedAt = now
+	s.outbox = append(s.outbox, *item)
+	return nil
+}
+
+func (s *Store) GetDueWrites(now time.Time, limit int, ctx context.Context) ([]types.OutboxItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := make([]types.OutboxItem, 0, limit)
+	for _, o := range s.outbox {
+		if len(items) == limit {
+			break
+		}
+		if o.FailedAt == nil && !o.NextAttemptAt.After(now) && !s.heldBack(&o, now) {
+			items = append(items, o)
+		}
+	}
+	return items, nil
+}
+
+// heldBack reports whether the write o comes after is put off or given up
+// on. it must hold mu
+func (s *Store) heldBack(o *types.OutboxItem, now time.Time) bool {
+	if o.After == nil {
+		return false
+	}
+	for _, a := range s.outbox {
+		if a.URI == *o.After {
+			return a.FailedAt != nil || a.NextAttemptAt.After(now)
+		}
+	}
+	return false
+}
+
+// outboxIndex must hold mu
+func (s *Store) outboxIndex(id int) int {
+	for i, o := range s.outbox {
+		if o.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Store) CompleteWrite(id int, cid string, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.outboxIndex(id)
+	if i < 0 {
+		return store.ErrNotFound
+	}
+	uri := s.outbox[i].URI
+	s.outbox = append(s.outbox[:i], s.outbox[i+1:]...)
+	if sig, ok := s.signets[uri]; ok {
+		sig.CID = cid
+	}
+	if msg, ok := s.messages[uri]; ok {
+		msg.CID = cid
+	}
+	return nil
+}
+
+func (s *Store) DeferWrite(id int, lastErr string, next time.Time, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.outboxIndex(id)
+	if i < 0 {
+		return nil
+	}
+	s.outbox[i].Attempts += 1
+	s.outbox[i].LastError = &lastErr
+	s.outbox[i].NextAttemptAt = next
+	return nil
+}
+
+func (s *Store) FailWrite(id int, lastErr string, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.outboxIndex(id)
+	if i < 0 {
+		return nil
+	}
+	now := time.Now()
+	s.outbox[i].Attempts += 1
+	s.outbox[i].LastError = &lastErr
+	s.outbox[i].FailedAt = &now
+	return nil
+}
+
+func (s *Store) FailWritesAfter(uri string, lastErr string, ctx context.Context) ([]types.OutboxItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var items []types.OutboxItem
+	for i, o := range s.outbox {
+		if o.After == nil || *o.After != uri || o.FailedAt != nil {
+			continue
+		}
+		s.outbox[i].LastError = &lastErr
+		s.outbox[i].FailedAt = &now
+		items = append(items, s.outbox[i])
+	}
+	return items, nil
+}
+
+func (s *Store) CancelWrite(uri string, ctx context.Context) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, o := range s.outbox {
+		if o.URI == uri {
+			s.outbox = append(s.outbox[:i], s.outbox[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Store) GetFailedWrites(limit int, cursor *int, ctx context.Context) ([]types.OutboxItem, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	items := make([]types.OutboxItem, 0, limit)
+	for i := len(s.outbox) - 1; i >= 0 && len(items) < limit; i-- {
+		o := s.outbox[i]
+		if o.FailedAt == nil || (cursor != nil && o.Id >= *cursor) {
+			continue
+		}
+		items = append(items, o)
+	}
+	return items, nil
+}
+
+func (s *Store) RequeueWrite(id int, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.outboxIndex(id)
+	if i < 0 || s.outbox[i].FailedAt == nil {
+		return store.ErrNotFound
+	}
+	s.outbox[i].Attempts = 0
+	s.outbox[i].FailedAt = nil
+	s.outbox[i].NextAttemptAt = time.Now()
+	return nil
+}
@@ -0,0 +1,90 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rvcx/internal/store"
+	"rvcx/internal/types"
+	"time"
+)
+
+func (s *Store) StoreAuthReport(report *types.AuthReport, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	did := report.DID
+	s.addReport(types.Report{URI: report.URI, Reason: report.Reason, DID: &did, ReportedAt: report.ReportedAt})
+	return nil
+}
+
+func (s *Store) StoreAnonReport(report *types.AnonReport, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addr := report.Addr
+	s.addReport(types.Report{URI: report.URI, Reason: report.Reason, Addr: &addr, ReportedAt: report.ReportedAt})
+	return nil
+}
+
+// addReport must hold mu
+func (s *Store) addReport(report types.Report) {
+	report.Id = len(s.reports) + 1
+	s.reports = append(s.reports, report)
+}
+
+func (s *Store) CountReportsFromAddr(addr string, since time.Time, ctx context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	count := 0
+	for _, r := range s.reports {
+		if r.Addr != nil && *r.Addr == addr && r.ReportedAt.After(since) {
+			count += 1
+		}
+	}
+	return count, nil
+}
+
+// GetReports pages through reports newest first. the cursor is the id of the
+// last report on the previous page
+func (s *Store) GetReports(resolved bool, limit int, cursor *int, ctx context.Context) ([]types.Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	reports := make([]types.Report, 0, limit)
+	for i := len(s.reports) - 1; i >= 0 && len(reports) < limit; i-- {
+		r := s.reports[i]
+		if (r.ResolvedAt != nil) != resolved || (cursor != nil && r.Id >= *cursor) {
+			continue
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+func (s *Store) GetReport(id int, ctx context.Context) (*types.Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if id < 1 || id > len(s.reports) {
+		return nil, fmt.Errorf("error getting report: %w", store.ErrNotFound)
+	}
+	report := s.reports[id-1]
+	return &report, nil
+}
+
+// ResolveReport marks a report as dealt with. if ban is non nil, the ban is
+// created along with it and attached to the report
+func (s *Store) ResolveReport(id int, resolvedBy string, ban *types.Ban, ctx context.Context) (*types.Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id < 1 || id > len(s.reports) || s.reports[id-1].ResolvedAt != nil {
+		return nil, errors.New("report doesn't exist or was already resolved")
+	}
+	report := &s.reports[id-1]
+	if ban != nil {
+		bid := s.addBan(ban.Did, ban.Reason, ban.Till)
+		report.BanId = &bid
+	}
+	now := time.Now()
+	report.ResolvedAt = &now
+	report.ResolvedBy = &resolvedBy
+	r := *report
+	return &r, nil
+}
@@ -0,0 +1,138 @@
+package memstore
+
+import (
+	"context"
+	"html"
+	"rvcx/internal/types"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// SearchMessages finds messages that have every word of params.Query in
+// them, newest first. it doesn't understand quoting or negation the way
+// postgres does, but it skips the same messages: ones not posted by whoever
+// their signet was issued to, and ones by someone who is banned
+func (s *Store) SearchMessages(params types.SearchMessagesParams, ctx context.Context) ([]types.SearchResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	terms := make(map[string]bool)
+	for _, span := range wordSpans(params.Query) {
+		terms[strings.ToLower(params.Query[span[0]:span[1]])] = true
+	}
+	results := make([]types.SearchResult, 0)
+	if len(terms) == 0 {
+		return results, nil
+	}
+	for _, m := range s.messages {
+		if params.AuthorDID != nil && m.DID != *params.AuthorDID {
+			continue
+		}
+		if params.Since != nil && m.PostedAt.Before(*params.Since) {
+			continue
+		}
+		if params.Until != nil && !m.PostedAt.Before(*params.Until) {
+			continue
+		}
+		if params.Cursor != nil && !params.Cursor.Older(m.PostedAt, m.URI) {
+			continue
+		}
+		sig, ok := s.signets[m.SignetURI]
+		if !ok || sig.Author != m.DID {
+			continue
+		}
+		if params.ChannelURI != nil && sig.ChannelURI != *params.ChannelURI {
+			continue
+		}
+		handle, ok := s.handleOf(m.DID)
+		if !ok || sig.AuthorHandle == nil || *sig.AuthorHandle != handle {
+			continue
+		}
+		if params.AuthorHandle != nil && handle != *params.AuthorHandle {
+			continue
+		}
+		issuer, ok := s.handleOf(sig.IssuerDID)
+		if !ok || s.activeBan(m.DID) != nil {
+			continue
+		}
+		snippet, ok := highlight(m.Body, terms)
+		if !ok {
+			continue
+		}
+		var res types.SearchResult
+		msg := &res.Message
+		msg.URI = m.URI
+		msg.Author.DID = m.DID
+		msg.Author.Handle = handle
+		if p, ok := s.profiles[m.DID]; ok {
+			msg.Author.DisplayName = p.DisplayName
+			msg.Author.Status = p.Status
+			msg.Author.Color = p.Color
+			msg.Author.Avatar = p.AvatarCID
+			msg.Author.DefaultNick = p.DefaultNick
+		}
+		msg.Body = m.Body
+		msg.Nick = m.Nick
+		msg.Color = m.Color
+		msg.Signet = signetView(sig)
+		msg.Signet.Issuer = issuer
+		msg.PostedAt = m.PostedAt
+		msg.Edited = m.EditedAt != nil
+		msg.EditedAt = m.EditedAt
+		res.Snippet = snippet
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i].Message, results[j].Message
+		if !a.PostedAt.Equal(b.PostedAt) {
+			return a.PostedAt.After(b.PostedAt)
+		}
+		return a.URI > b.URI
+	})
+	if len(results) > params.Limit {
+		results = results[:params.Limit]
+	}
+	return results, nil
+}
+
+// highlight wraps the words of body that are in terms in <mark></mark>, and
+// reports whether every term was there. the rest of body is escaped, like
+// postgres does it, so the snippet is safe to use as html
+func highlight(body string, terms map[string]bool) (string, bool) {
+	var b strings.Builder
+	seen := make(map[string]bool, len(terms))
+	last := 0
+	for _, span := range wordSpans(body) {
+		word := strings.ToLower(body[span[0]:span[1]])
+		if !terms[word] {
+			continue
+		}
+		seen[word] = true
+		b.WriteString(html.EscapeString(body[last:span[0]]))
+		b.WriteString("<mark>")
+		b.WriteString(body[span[0]:span[1]])
+		b.WriteString("</mark>")
+		last = span[1]
+	}
+	b.WriteString(html.EscapeString(body[last:]))
+	return b.String(), len(seen) == len(terms)
+}
+
+// wordSpans gets the start and end of each run of letters and digits in s
+func wordSpans(s string) [][2]int {
+	spans := make([][2]int, 0)
+	start := -1
+	for i, r := range s {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if inWord && start < 0 {
+			start = i
+		} else if !inWord && start >= 0 {
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(s)})
+	}
+	return spans
+}
@@ -0,0 +1,129 @@
+package memstore
+
+import (
+	"context"
+	"rvcx/internal/types"
+	"sort"
+	"time"
+)
+
+func (s *Store) StoreSub(sub *types.Sub, ctx context.Context) (wasNew bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subs[sub.URI]; ok {
+		return false, nil
+	}
+	sb := *sub
+	sb.IndexedAt = time.Now()
+	s.subs[sb.URI] = &sb
+	return true, nil
+}
+
+func (s *Store) UpdateSub(sub *types.Sub, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sb := *sub
+	sb.IndexedAt = time.Now()
+	s.subs[sb.URI] = &sb
+	return nil
+}
+
+func (s *Store) DeleteSub(uri string, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, uri)
+	return nil
+}
+
+func (s *Store) GetSubURIs(did string, channelURI string, ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	uris := make([]string, 0, 1)
+	for _, sub := range s.subs {
+		if sub.DID == did && sub.ChannelURI == channelURI {
+			uris = append(uris, sub.URI)
+		}
+	}
+	return uris, nil
+}
+
+func (s *Store) GetSubscriptions(did string, limit int, cursor *types.KeysetCursor, ctx context.Context) ([]types.SubView, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	subs := make([]types.SubView, 0)
+	for _, sub := range s.subs {
+		if sub.DID != did || (cursor != nil && !cursor.Older(sub.CreatedAt, sub.URI)) {
+			continue
+		}
+		c, ok := s.channels[sub.ChannelURI]
+		if !ok {
+			continue
+		}
+		subs = append(subs, types.SubView{
+			URI:       sub.URI,
+			Channel:   s.channelView(c),
+			CreatedAt: sub.CreatedAt,
+		})
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		if !subs[i].CreatedAt.Equal(subs[j].CreatedAt) {
+			return subs[i].CreatedAt.After(subs[j].CreatedAt)
+		}
+		return subs[i].URI > subs[j].URI
+	})
+	if len(subs) > limit {
+		subs = subs[:limit]
+	}
+	return subs, nil
+}
+
+// GetMyChannels gets the channels did is subscribed to, most recently
+// active first. a channel is as active as the signet with the highest lrcID
+// in it, which is the last time anyone said anything
+func (s *Store) GetMyChannels(did string, limit int, cursor *types.KeysetCursor, ctx context.Context) ([]types.ChannelView, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	mine := make(map[string]bool)
+	for _, sub := range s.subs {
+		if sub.DID == did {
+			mine[sub.ChannelURI] = true
+		}
+	}
+	latest := make(map[string]*types.Signet)
+	for _, sig := range s.signets {
+		if !mine[sig.ChannelURI] {
+			continue
+		}
+		if l, ok := latest[sig.ChannelURI]; !ok || sig.MessageID > l.MessageID {
+			latest[sig.ChannelURI] = sig
+		}
+	}
+	chans := make([]types.ChannelView, 0)
+	for uri := range mine {
+		c, ok := s.channels[uri]
+		if !ok {
+			continue
+		}
+		activeAt := c.CreatedAt
+		if sig, ok := latest[uri]; ok {
+			activeAt = sig.StartedAt
+		}
+		if cursor != nil && !cursor.Older(activeAt, uri) {
+			continue
+		}
+		cv := s.channelView(c)
+		cv.LastActiveAt = &activeAt
+		chans = append(chans, cv)
+	}
+	sort.Slice(chans, func(i, j int) bool {
+		a, b := chans[i].LastActiveAt, chans[j].LastActiveAt
+		if !a.Equal(*b) {
+			return a.After(*b)
+		}
+		return chans[i].URI > chans[j].URI
+	})
+	if len(chans) > limit {
+		chans = chans[:limit]
+	}
+	return chans, nil
+}
@@ -0,0 +1,131 @@
+// Package metrics holds everything rvcx reports to prometheus. the
+// collectors are package level so that whatever is being measured can just
+// reach for them, rather than having them threaded through every constructor
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "rvcx"
+
+var (
+	XRPCDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "xrpc_request_duration_seconds",
+		Help:      "How long xrpc requests took to handle, by method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "status"})
+
+	JetstreamEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jetstream_events_total",
+		Help:      "Jetstream commits handled, by collection and operation.",
+	}, []string{"collection", "operation"})
+	JetstreamLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "jetstream_lag_seconds",
+		Help:      "How far behind realtime the last handled jetstream event was.",
+	})
+
+	PDSWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pds_write_duration_seconds",
+		Help:      "How long writes to a pds took, by client and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"client", "method"})
+	PDSWriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pds_write_failures_total",
+		Help:      "Writes to a pds that failed, by client and method.",
+	}, []string{"client", "method"})
+	PasswordSessionRenewals = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "password_session_renewals_total",
+		Help:      "Times the backend's own session was renewed, by whether it was refreshed, logged in again, or neither worked.",
+	}, []string{"result"})
+	OutboxWrites = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbox_writes_total",
+		Help:      "Attempts to write from the outbox to the backend's repo, by whether they landed, will be retried, or were given up on.",
+	}, []string{"result"})
+
+	LexStreamSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "lexstream_subscribers",
+		Help:      "Clients connected to subscribeLexStream.",
+	})
+	LexStreamDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lexstream_dropped_frames_total",
+		Help:      "Lex stream frames that couldn't be queued because the client fell behind.",
+	})
+
+	MediaCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "media_cache_requests_total",
+		Help:      "Media cache lookups, by whether the blob was already cached.",
+	}, []string{"result"})
+)
+
+// the clients PDSWriteDuration and PDSWriteFailures are labelled with
+const (
+	ClientPassword = "password"
+	ClientOAuth    = "oauth"
+)
+
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObservePDSWrite records a write that started at start, and whether it
+// failed. it takes a pointer so that it can be deferred with a named error
+func ObservePDSWrite(client string, method string, start time.Time, err *error) {
+	PDSWriteDuration.WithLabelValues(client, method).Observe(time.Since(start).Seconds())
+	if err != nil && *err != nil {
+		PDSWriteFailures.WithLabelValues(client, method).Inc()
+	}
+}
+
+var (
+	lrcdServersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "lrcd", "servers"),
+		"Lrcd servers that are running.",
+		nil, nil,
+	)
+	lrcdClientsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "lrcd", "clients"),
+		"Clients connected to a channel's lrcd server.",
+		[]string{"channel"}, nil,
+	)
+)
+
+// channelCollector asks for the number of connected clients in each running
+// lrcd server whenever it is scraped, since lrcd only lets us poll for it
+type channelCollector struct {
+	connected func() map[string]int
+}
+
+func (c channelCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lrcdServersDesc
+	ch <- lrcdClientsDesc
+}
+
+func (c channelCollector) Collect(ch chan<- prometheus.Metric) {
+	connected := c.connected()
+	ch <- prometheus.MustNewConstMetric(lrcdServersDesc, prometheus.GaugeValue, float64(len(connected)))
+	for uri, n := range connected {
+		ch <- prometheus.MustNewConstMetric(lrcdClientsDesc, prometheus.GaugeValue, float64(n), uri)
+	}
+}
+
+// WatchChannels reports the lrcd servers connected returns, which maps each
+// running server's channel uri to how many clients it has
+func WatchChannels(connected func() map[string]int) {
+	prometheus.MustRegister(channelCollector{connected})
+}
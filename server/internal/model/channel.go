@@ -3,12 +3,15 @@ package model
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"os"
-	"rvcx/internal/db"
+	"rvcx/internal/banpolicy"
+	"rvcx/internal/config"
 	"rvcx/internal/log"
 	"rvcx/internal/oauth"
 	"rvcx/internal/recordmanager"
+	"rvcx/internal/store"
 	"rvcx/internal/types"
 	"sync"
 	"time"
@@ -18,18 +21,32 @@ import (
 )
 
 type Model struct {
-	store  *db.Store
+	cfg    *config.Config
+	store  store.Store
 	uriMap map[string]*channelModel
 	logger *log.Logger
 	cli    *oauth.PasswordClient
 	mu     sync.Mutex
 	rm     *recordmanager.RecordManager
+	bans   *banpolicy.Policy
+	// clientBuffer is how many events a lex stream client can fall behind
+	// by before we give up on it
+	clientBuffer int
+	// closing is set once Shutdown is called, after which no more lrcd
+	// servers are started. guarded by mu
+	closing bool
+	// streams is every lex stream handler that's running, so that Shutdown
+	// can wait for them to say goodbye
+	streams sync.WaitGroup
 }
 
 type channelModel struct {
 	uri    string
 	logger *log.Logger
 	valid  bool
+	// host is the did of the backend that hosts the channel, it's only us
+	// if valid
+	host string
 
 	welcome       string
 	server        *lrcd.Server
@@ -38,9 +55,18 @@ type channelModel struct {
 	mediainitChan <-chan lrcd.MediaInitChanMsg
 	ctx           context.Context
 	cancel        func()
+	// done is closed once handleInitEvents has posted every signet the
+	// server handed out and returned
+	done chan struct{}
 
 	clients   map[*client]bool
 	clientsmu sync.Mutex
+	// seq is the sequence number of the last event broadcast to clients,
+	// guarded by clientsmu
+	seq uint64
+	// closed is set once clients have been sent away for shutdown, guarded
+	// by clientsmu
+	closed bool
 }
 
 func (m *Model) GetWSHandlerFrom(uri string) (http.HandlerFunc, error) {
@@ -52,26 +78,35 @@ func (m *Model) GetWSHandlerFrom(uri string) (http.HandlerFunc, error) {
 }
 
 func (m *Model) GetLexStreamFrom(uri string) (http.HandlerFunc, error) {
-	cm, ok := m.uriMap[uri]
-	if !ok {
+	cm := m.channel(uri)
+	if cm == nil {
 		return nil, errors.New("not a valid server")
 	}
 	return cm.WSHandler(uri, m), nil
 }
 
-func Init(store *db.Store, logger *log.Logger, cli *oauth.PasswordClient, rm *recordmanager.RecordManager) *Model {
+// channel gets the model for uri, or nil if there isn't one. uriMap is
+// scraped for metrics and written to by jetstream at the same time, so
+// nothing touches it without mu
+func (m *Model) channel(uri string) *channelModel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.uriMap[uri]
+}
+
+func Init(cfg *config.Config, store store.Store, logger *log.Logger, cli *oauth.PasswordClient, rm *recordmanager.RecordManager, bans *banpolicy.Policy) *Model {
 	uris, err := store.GetChannelURIs(context.Background())
 	if err != nil {
 		panic(err)
 	}
 	uriToServerModel := make(map[string]*channelModel, len(uris))
-	myid := os.Getenv("MY_DID")
 	for _, uri := range uris {
-		valid := (uri.Host == myid)
+		valid := (uri.Host == cfg.DID)
 		beep := channelModel{
 			welcome:   uri.Topic,
 			uri:       uri.URI,
-			logger:    logger,
+			logger:    logger.With("channel", uri.URI),
+			host:      uri.Host,
 			lastID:    uri.LastID,
 			valid:     valid,
 			clients:   make(map[*client]bool),
@@ -79,22 +114,38 @@ func Init(store *db.Store, logger *log.Logger, cli *oauth.PasswordClient, rm *re
 		}
 		uriToServerModel[uri.URI] = &beep
 	}
+	clientBuffer := cfg.LexStreamBuffer
+	if clientBuffer <= 0 {
+		clientBuffer = defaultClientBuffer
+	}
 	return &Model{
+		cfg,
 		store,
 		uriToServerModel,
 		logger,
 		cli,
 		sync.Mutex{},
 		rm,
+		bans,
+		clientBuffer,
+		false,
+		sync.WaitGroup{},
 	}
 }
 
 func (m *Model) AddChannel(c *types.Channel) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.addChannel(c)
+}
+
+// addChannel must hold mu
+func (m *Model) addChannel(c *types.Channel) error {
 	_, ok := m.uriMap[c.URI]
 	if ok {
 		return errors.New("tried to add existing server!")
 	}
-	valid := (c.Host == os.Getenv("MY_DID"))
+	valid := (c.Host == m.cfg.DID)
 	var welcome string
 	if c.Topic == nil {
 		welcome = "and now you're connected"
@@ -104,7 +155,8 @@ func (m *Model) AddChannel(c *types.Channel) error {
 	beep := channelModel{
 		welcome:   welcome,
 		uri:       c.URI,
-		logger:    m.logger,
+		logger:    m.logger.With("channel", c.URI),
+		host:      c.Host,
 		lastID:    1,
 		valid:     valid,
 		clients:   make(map[*client]bool),
@@ -115,17 +167,22 @@ func (m *Model) AddChannel(c *types.Channel) error {
 }
 
 func (m *Model) UpdateChannel(c *types.Channel) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	cm, ok := m.uriMap[c.URI]
 	if !ok {
-		return m.AddChannel(c)
+		return m.addChannel(c)
 	}
-	valid := (c.Host == os.Getenv("my_IDENTITY"))
+	cm.host = c.Host
+	valid := (c.Host == m.cfg.DID)
 	if valid != cm.valid {
 		if valid {
 			cm.valid = true
 		} else {
 			cm.valid = false
-			cm.cancel()
+			if cm.cancel != nil {
+				cm.cancel()
+			}
 		}
 	}
 	var welcome string
@@ -139,6 +196,8 @@ func (m *Model) UpdateChannel(c *types.Channel) error {
 }
 
 func (m *Model) DeleteChannel(uri string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	cm, ok := m.uriMap[uri]
 	if !ok {
 		return nil
@@ -147,12 +206,59 @@ func (m *Model) DeleteChannel(uri string) error {
 	// this case is for if a malformed channel record is ingested which
 	// doesn't create a channel, but it still shows up in uriMap. probs
 	// shouldn't be in uriMap but idk
-	if cm != nil {
+	if cm != nil && cm.cancel != nil {
 		cm.cancel()
 	}
 	return nil
 }
 
+// ChannelHost returns the did of the backend hosting a channel, and whether
+// that backend is us
+func (m *Model) ChannelHost(uri string) (host string, local bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cm := m.uriMap[uri]
+	if cm == nil {
+		return "", false, errors.New("uri doesn't refer to a channel i am aware of")
+	}
+	return cm.host, cm.valid, nil
+}
+
+// Connected maps each channel with a running lrcd server to how many clients
+// are connected to it
+func (m *Model) Connected() map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	connected := make(map[string]int)
+	for uri, cm := range m.uriMap {
+		if cm.server != nil {
+			connected[uri] = cm.server.Connected()
+		}
+	}
+	return connected
+}
+
+// ConnectedHere maps each of uris that is hosted on this backend to how
+// many clients are connected to it right now, which is 0 if its lrcd server
+// is idle. channels hosted elsewhere are left out
+func (m *Model) ConnectedHere(uris []string) map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	connected := make(map[string]int)
+	for _, uri := range uris {
+		cm := m.uriMap[uri]
+		if cm == nil || !cm.valid {
+			continue
+		}
+		n := 0
+		if cm.server != nil {
+			n = cm.server.Connected()
+		}
+		connected[uri] = n
+	}
+	return connected
+}
+
 func (m *Model) getServer(uri string) (*lrcd.Server, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -164,9 +270,12 @@ func (m *Model) getServer(uri string) (*lrcd.Server, error) {
 	if !cm.valid {
 		return nil, errors.New("Not hosted on this backend!")
 	}
+	if m.closing {
+		return nil, errors.New("shutting down")
+	}
 
 	if cm.server == nil {
-		m.logger.Deprintln("i think the server should exist, so i'm making it")
+		cm.logger.Debug("i think the server should exist, so i'm making it")
 		var err error
 		lastID := cm.lastID
 		initChan := make(chan lrcd.InitChanMsg, 100)
@@ -175,6 +284,9 @@ func (m *Model) getServer(uri string) (*lrcd.Server, error) {
 		server, err := lrcd.NewServer(
 			lrcd.WithResolver(func(externalID string, ctx context.Context) *string {
 				did, err := m.store.FullResolveHandle(externalID, ctx)
+				if err == nil && m.bans.IsBanned(did, ctx) {
+					return nil
+				}
 				if err != nil {
 					select {
 					case <-ctx.Done():
@@ -190,7 +302,7 @@ func (m *Model) getServer(uri string) (*lrcd.Server, error) {
 			lrcd.WithInitialID(lastID),
 			lrcd.WithInitChannel(initChan),
 			lrcd.WithMediainitChannel(mediainitChan),
-			lrcd.WithServerURIAndSecret(uri, os.Getenv("LRCD_SECRET")),
+			lrcd.WithServerURIAndSecret(uri, m.cfg.LrcdSecret),
 		)
 		if err != nil {
 			return nil, errors.New("Error creating server")
@@ -202,7 +314,7 @@ func (m *Model) getServer(uri string) (*lrcd.Server, error) {
 		}
 
 		if cm.cancel != nil {
-			m.logger.Println("that's weird, old cancel lying around")
+			cm.logger.Warn("that's weird, old cancel lying around")
 			cm.cancel()
 		}
 
@@ -212,60 +324,191 @@ func (m *Model) getServer(uri string) (*lrcd.Server, error) {
 		cm.mediainitChan = mediainitChan
 		cm.cancel = cancel
 		cm.ctx = ctx
+		cm.done = make(chan struct{})
 
 		go m.handleInitEvents(cm)
 	}
 	return cm.server, nil
 }
 
+// handleInitEvents posts a signet for every id the server hands out, and
+// stops the server once it has been empty for a while. the server and its
+// channels are held onto here, since cm's are cleared as soon as it stops
 func (m *Model) handleInitEvents(cm *channelModel) {
+	server := cm.server
+	initChan := cm.initChan
+	mediainitChan := cm.mediainitChan
+	ctx := cm.ctx
+	defer close(cm.done)
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-cm.ctx.Done():
-			cm.logger.Deprintln("i'm a handleinitevent goroutine and my context is done")
+		case <-ctx.Done():
+			cm.logger.Debug("i'm a handleinitevent goroutine and my context is done")
+			m.drainInits(cm.uri, initChan, mediainitChan)
 			return
 		case <-ticker.C:
-			c := cm.server.Connected()
-			if c == 0 {
-				cm.logger.Deprintln("i think the server is empty! gonna break some things")
-				lastID, err := cm.server.Stop()
-				if err != nil {
-					panic(err)
-				}
-				cm.lastID = lastID
-				cm.server = nil
-				cm.initChan = nil
-				cm.cancel()
-				cm.cancel = nil
-				return
+			if server.Connected() != 0 {
+				continue
 			}
-		case e, ok := <-cm.initChan:
-			if !ok {
-				cm.logger.Println("this is a weird case!")
-				return
+			cm.logger.Debug("i think the server is empty! gonna break some things")
+			m.mu.Lock()
+			if cm.server != server {
+				// Shutdown got to it first
+				m.mu.Unlock()
+				continue
 			}
-			err := m.rm.PostSignet(e.ResolvedId, e.Init, cm.uri, context.Background())
+			lastID, err := m.stopServer(cm)
+			m.mu.Unlock()
 			if err != nil {
-				m.logger.Println("error posting signet: " + err.Error())
+				// it's still running, so try again next time it's empty
+				cm.logger.Error("failed to stop empty server", "err", err)
+				continue
 			}
-		case me, ok := <-cm.mediainitChan:
+			m.drainInits(cm.uri, initChan, mediainitChan)
+			m.storeLastID(cm.uri, lastID, context.Background())
+			return
+		case e, ok := <-initChan:
 			if !ok {
-				cm.logger.Println("this is a weird case!")
-				return
+				// lrcd closes it when it stops, or if we fell behind
+				cm.logger.Debug("init channel closed")
+				initChan = nil
+				continue
 			}
-			e := lrcpb.Event_Init{
-				Init: &lrcpb.Init{
-					Id:         me.Mediainit.Mediainit.Id,
-					ExternalID: me.Mediainit.Mediainit.ExternalID,
-				},
+			m.postInit(cm.uri, e)
+		case me, ok := <-mediainitChan:
+			if !ok {
+				cm.logger.Debug("mediainit channel closed")
+				mediainitChan = nil
+				continue
 			}
-			err := m.rm.PostSignet(me.ResolvedId, e, cm.uri, context.Background())
-			if err != nil {
-				m.logger.Println("error posting signet: " + err.Error())
+			m.postMediainit(cm.uri, me)
+		}
+	}
+}
+
+func (m *Model) postInit(uri string, e lrcd.InitChanMsg) {
+	ctx := log.WithAttrs(context.Background(), "channel", uri)
+	err := m.rm.PostSignet(e.ResolvedId, e.Init, uri, ctx)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "error posting signet", "err", err)
+	}
+}
+
+func (m *Model) postMediainit(uri string, me lrcd.MediaInitChanMsg) {
+	e := lrcpb.Event_Init{
+		Init: &lrcpb.Init{
+			Id:         me.Mediainit.Mediainit.Id,
+			ExternalID: me.Mediainit.Mediainit.ExternalID,
+		},
+	}
+	ctx := log.WithAttrs(context.Background(), "channel", uri)
+	err := m.rm.PostSignet(me.ResolvedId, e, uri, ctx)
+	if err != nil {
+		m.logger.ErrorContext(ctx, "error posting signet", "err", err)
+	}
+}
+
+// drainInits posts signets for whatever inits were still queued up when the
+// server stopped, so that the ids it handed out aren't left without one
+func (m *Model) drainInits(uri string, initChan <-chan lrcd.InitChanMsg, mediainitChan <-chan lrcd.MediaInitChanMsg) {
+	for {
+		select {
+		case e, ok := <-initChan:
+			if !ok {
+				initChan = nil
+				continue
+			}
+			m.postInit(uri, e)
+		case me, ok := <-mediainitChan:
+			if !ok {
+				mediainitChan = nil
+				continue
 			}
+			m.postMediainit(uri, me)
+		default:
+			return
+		}
+	}
+}
+
+// stopServer stops cm's server and forgets about it, returning the last id it
+// handed out. handleInitEvents is told to finish up, but may still be running
+// when this returns. must hold mu
+func (m *Model) stopServer(cm *channelModel) (uint32, error) {
+	lastID, err := cm.server.Stop()
+	if err != nil {
+		return 0, err
+	}
+	cm.lastID = lastID
+	cm.server = nil
+	cm.initChan = nil
+	cm.mediainitChan = nil
+	cm.cancel()
+	cm.cancel = nil
+	return lastID, nil
+}
+
+func (m *Model) storeLastID(uri string, lastID uint32, ctx context.Context) {
+	err := m.store.StoreLastID(uri, lastID, ctx)
+	if err != nil {
+		m.logger.Error("failed to store last id", "channel", uri, "err", err)
+	}
+}
+
+// Shutdown stops every lrcd server, waits for the signets they handed out ids
+// for to be posted, and stores the last id each one got to so that a restart
+// carries on from there. lex stream clients are sent a goingAway frame. lrcd
+// doesn't let us at its connections, so lrc clients are just disconnected.
+// if ctx runs out first, whatever hasn't finished is abandoned
+func (m *Model) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closing = true
+	lastIDs := make(map[string]uint32)
+	var dones []chan struct{}
+	var errs []error
+	for uri, cm := range m.uriMap {
+		cm.goAway()
+		if cm.server == nil {
+			continue
 		}
+		done := cm.done
+		lastID, err := m.stopServer(cm)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop %s: %w", uri, err))
+			continue
+		}
+		lastIDs[uri] = lastID
+		dones = append(dones, done)
+	}
+	m.mu.Unlock()
+
+	for _, done := range dones {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("gave up waiting for signets to be posted: %w", ctx.Err()))
+			return errors.Join(errs...)
+		}
+	}
+	for uri, lastID := range lastIDs {
+		err := m.store.StoreLastID(uri, lastID, ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to store last id for %s: %w", uri, err))
+		}
+	}
+
+	streams := make(chan struct{})
+	go func() {
+		m.streams.Wait()
+		close(streams)
+	}()
+	select {
+	case <-streams:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("gave up waiting for lex streams to close: %w", ctx.Err()))
 	}
+	return errors.Join(errs...)
 }
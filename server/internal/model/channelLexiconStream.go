@@ -5,10 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"rvcx/internal/atputils"
 	"rvcx/internal/lex"
+	"rvcx/internal/metrics"
 	"rvcx/internal/types"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,11 +17,48 @@ import (
 
 type client struct {
 	conn *websocket.Conn
-	bus  chan any
+	bus  chan types.StreamEvent
+	// behind is set by broadcast, right before it closes bus, when the
+	// client couldn't keep up
+	behind bool
+	// goingAway is set by goAway, right before it closes bus, when the
+	// server is shutting down
+	goingAway bool
+	// last is the lrcID of the last signet the client was sent
+	last uint32
+	// open is the lrcID of every signet the client was sent but hasn't
+	// been sent the message or media for yet, by signet uri. a resync from
+	// after one of these would skip its item, so the cursor stays behind
+	// the oldest. only wsWriter and replay touch last and open
+	open map[string]uint32
+	// seq is the last live event the client was sent
+	seq uint64
 }
 
+// maxOpenSignets is how many signets without items a client remembers. a
+// signet whose message never comes would otherwise hold the cursor back
+// forever, so past this the oldest are given up on
+const maxOpenSignets = maxReplayLimit
+
+// pongWait is how long a lex stream client has to answer a ping
+const pongWait = 30 * time.Second
+
+// defaultClientBuffer is how many live events a lex stream client can have
+// queued up. it has to cover whatever arrives while we replay history
+const defaultClientBuffer = 64
+
+const (
+	defaultReplayLimit = 50
+	maxReplayLimit     = 100
+)
+
 func (cm *channelModel) WSHandler(uri string, m *Model) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		after, limit, replay, err := parseReplayParams(uri, m, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		upgrader := &websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
@@ -31,29 +69,254 @@ func (cm *channelModel) WSHandler(uri string, m *Model) http.HandlerFunc {
 			return
 		}
 		defer conn.Close()
+		m.streams.Add(1)
+		defer m.streams.Done()
+		metrics.LexStreamSubscribers.Inc()
+		defer metrics.LexStreamSubscribers.Dec()
 
-		bus := make(chan any, 10)
 		client := &client{
-			conn,
-			bus,
+			conn: conn,
+			bus:  make(chan types.StreamEvent, m.clientBuffer),
+			last: after,
+			open: make(map[string]uint32),
 		}
+		gone := make(chan struct{})
+		go client.readLoop(gone)
+		// the client is registered before we look at the db, so anything
+		// that happens while we replay queues up on the bus instead of
+		// falling into the gap between the two
 		cm.clientsmu.Lock()
+		if cm.closed {
+			cm.clientsmu.Unlock()
+			client.goAway()
+			return
+		}
 		cm.clients[client] = true
 		cm.clientsmu.Unlock()
 
-		client.wsWriter()
-		cm.logger.Deprintln("i am a lex stream wshandler and i am exiting")
+		var seen map[string]bool
+		if replay {
+			seen, err = m.replay(uri, after, limit, client, r.Context())
+			if err != nil {
+				cm.logger.Debug("failed to replay", "err", err)
+			}
+		}
+		if err == nil {
+			client.wsWriter(seen, gone)
+		}
+		cm.logger.Debug("i am a lex stream wshandler and i am exiting")
 
-		cm.clientsmu.Lock()
-		delete(cm.clients, client)
-		cm.clientsmu.Unlock()
+		cm.removeClient(client)
+	}
+}
+
+// removeClient stops broadcasting to c. bus is only ever closed here or in
+// broadcast, both under clientsmu and only while c is still in clients, so
+// it can't be closed twice
+func (cm *channelModel) removeClient(c *client) {
+	cm.clientsmu.Lock()
+	defer cm.clientsmu.Unlock()
+	if cm.clients[c] {
+		delete(cm.clients, c)
+		close(c.bus)
+	}
+}
+
+// parseReplayParams reads the cursor and limit a lex stream was asked for.
+// the cursor is either the lrcID of the last signet the client saw, or a
+// timestamp, in which case the client gets everything after it
+func parseReplayParams(uri string, m *Model, r *http.Request) (after uint32, limit int, replay bool, err error) {
+	limit = defaultReplayLimit
+	limitstr := r.URL.Query().Get("limit")
+	if limitstr != "" {
+		l, err := strconv.Atoi(limitstr)
+		if err != nil {
+			return 0, 0, false, errors.New("limit isn't an integer")
+		}
+		limit = max(min(l, maxReplayLimit), 1)
+	}
+	cursor := r.URL.Query().Get("cursor")
+	if cursor == "" {
+		return 0, limit, false, nil
+	}
+	id, err := strconv.ParseUint(cursor, 10, 32)
+	if err == nil {
+		return uint32(id), limit, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, cursor)
+	if err != nil {
+		return 0, 0, false, errors.New("cursor is neither an lrcID nor a timestamp")
+	}
+	after, err = m.store.GetSignetIDAt(uri, t, r.Context())
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return after, limit, true, nil
+}
+
+// replay writes every signet after the cursor, each followed by the messages
+// and media posted under it, straight to the client, reading limit signets
+// at a time. a client that resyncs after falling behind is owed all of them.
+// it returns the uris it wrote so that wsWriter can skip them if they also
+// show up live
+func (m *Model) replay(uri string, after uint32, limit int, c *client, ctx context.Context) (map[string]bool, error) {
+	seen := make(map[string]bool)
+	for {
+		signets, err := m.store.GetSignetsAfter(uri, limit, after, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get signets: %w", err)
+		}
+		if len(signets) == 0 {
+			return seen, nil
+		}
+		err = m.replayPage(uri, signets, seen, c, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(signets) < limit {
+			return seen, nil
+		}
+		after = signets[len(signets)-1].LrcId
+	}
+}
+
+// replayPage writes signets and their items to the client, adding what it
+// wrote to seen
+func (m *Model) replayPage(uri string, signets []types.SignetView, seen map[string]bool, c *client, ctx context.Context) error {
+	// every item under exactly these signets, since a limit here would cut
+	// off the oldest ones' items while the cursor moves past them anyway
+	items, err := m.store.GetHistoryBetween(uri, signets[0].LrcId-1, signets[len(signets)-1].LrcId, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get history: %w", err)
+	}
+	bySignet := make(map[string][]types.StreamEvent, len(items))
+	for i := len(items) - 1; i >= 0; i-- {
+		if items[i].IsMessage() {
+			smv, err := items[i].ToSignedMessageView()
+			if err != nil {
+				return err
+			}
+			e := types.StreamEvent{Type: types.StreamMessage, Data: smv.MessageView()}
+			bySignet[smv.Signet.URI] = append(bySignet[smv.Signet.URI], e)
+		} else if items[i].IsMedia() {
+			smv, err := items[i].ToSignedMediaView()
+			if err != nil {
+				return err
+			}
+			e := types.StreamEvent{Type: types.StreamMedia, Data: smv.MediaView()}
+			bySignet[smv.Signet.URI] = append(bySignet[smv.Signet.URI], e)
+		}
+	}
+	for _, sv := range signets {
+		if m.bans.IsBanned(sv.Author, ctx) {
+			continue
+		}
+		events := append([]types.StreamEvent{{Type: types.StreamSignet, Data: sv}}, bySignet[sv.URI]...)
+		for _, e := range events {
+			seen[createdURI(e)] = true
+			err = c.conn.WriteJSON(e)
+			if err != nil {
+				return err
+			}
+			c.sent(e)
+		}
+	}
+	return nil
+}
+
+// createdURI is the uri of the record a create event is about, or "" for
+// anything else. updates and deletes are never skipped, even if the record
+// was replayed, since they happened after
+func createdURI(e types.StreamEvent) string {
+	switch v := e.Data.(type) {
+	case types.SignetView:
+		if e.Type == types.StreamSignet {
+			return v.URI
+		}
+	case types.MessageView:
+		if e.Type == types.StreamMessage {
+			return v.URI
+		}
+	case types.MediaView:
+		if e.Type == types.StreamMedia {
+			return v.URI
+		}
+	}
+	return ""
+}
+
+// sent keeps track of where the client should resync from, given that it
+// was just sent e
+func (c *client) sent(e types.StreamEvent) {
+	switch v := e.Data.(type) {
+	case types.SignetView:
+		if e.Type != types.StreamSignet {
+			return
+		}
+		c.last = max(c.last, v.LrcId)
+		c.open[v.URI] = v.LrcId
+		if len(c.open) > maxOpenSignets {
+			oldest := ""
+			for uri, id := range c.open {
+				if oldest == "" || id < c.open[oldest] {
+					oldest = uri
+				}
+			}
+			delete(c.open, oldest)
+		}
+	case types.MessageView:
+		delete(c.open, v.SignetURI)
+	case types.MediaView:
+		delete(c.open, v.SignetURI)
+	case types.DeletedView:
+		if e.Type == types.StreamSignetDelete {
+			delete(c.open, v.URI)
+		}
+	}
+}
+
+// cursor is where the client should resync from: right before the oldest
+// signet it's still waiting on an item for, or else the last signet it saw
+func (c *client) cursor() uint32 {
+	cursor := c.last
+	for _, id := range c.open {
+		if id > 0 && id-1 < cursor {
+			cursor = id - 1
+		}
+	}
+	return cursor
+}
+
+// readLoop reads from the client until it goes away, then closes gone.
+// clients don't send us anything, but something has to read for their pongs
+// and close frames to be handled
+func (c *client) readLoop(gone chan<- struct{}) {
+	defer close(gone)
+	c.conn.SetReadLimit(512)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, _, err := c.conn.NextReader()
+		if err != nil {
+			return
+		}
 	}
 }
 
-func (c *client) wsWriter() {
+// wsWriter forwards live events to the client, skipping anything in seen
+// since it was already sent during replay, until the client goes away. if
+// the client fell behind, it still gets everything that was queued, and then
+// a fellBehind frame saying where to resync from before the connection is
+// closed
+func (c *client) wsWriter(seen map[string]bool, gone <-chan struct{}) {
 	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-gone:
+			return
 		case <-ticker.C:
 			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
 			if err != nil {
@@ -61,13 +324,77 @@ func (c *client) wsWriter() {
 			}
 		case e, ok := <-c.bus:
 			if !ok {
+				if c.behind {
+					c.resync()
+				} else if c.goingAway {
+					c.goAway()
+				}
 				return
 			}
-			c.conn.WriteJSON(e)
+			uri := createdURI(e)
+			if uri != "" && seen[uri] {
+				continue
+			}
+			err := c.conn.WriteJSON(e)
+			if err != nil {
+				return
+			}
+			c.seq = e.Seq
+			c.sent(e)
 		}
 	}
 }
 
+// resync tells a client that fell behind where to pick back up, and then
+// closes the connection properly rather than just dropping it
+func (c *client) resync() {
+	fb := types.StreamEvent{
+		Type: types.StreamFellBehind,
+		Data: types.FellBehindView{
+			Cursor: strconv.FormatUint(uint64(c.cursor()), 10),
+			Seq:    c.seq,
+		},
+	}
+	c.lastFrame(fb, websocket.CloseTryAgainLater, "fell behind")
+}
+
+// goAway tells a client that the server is shutting down and where to pick
+// back up once it's back
+func (c *client) goAway() {
+	ga := types.StreamEvent{
+		Type: types.StreamGoingAway,
+		Data: types.GoingAwayView{
+			Cursor: strconv.FormatUint(uint64(c.cursor()), 10),
+			Seq:    c.seq,
+		},
+	}
+	c.lastFrame(ga, websocket.CloseGoingAway, "shutting down")
+}
+
+func (c *client) lastFrame(e types.StreamEvent, code int, text string) {
+	deadline := time.Now().Add(5 * time.Second)
+	c.conn.SetWriteDeadline(deadline)
+	err := c.conn.WriteJSON(e)
+	if err != nil {
+		return
+	}
+	msg := websocket.FormatCloseMessage(code, text)
+	c.conn.WriteControl(websocket.CloseMessage, msg, deadline)
+}
+
+// goAway sends every client off with a goingAway frame, and stops any more
+// from joining
+func (cm *channelModel) goAway() {
+	cm.clientsmu.Lock()
+	defer cm.clientsmu.Unlock()
+	cm.closed = true
+	for cli := range cm.clients {
+		cli.goingAway = true
+		delete(cm.clients, cli)
+		close(cli.bus)
+	}
+}
+
 // func (cm *channelModel) cleanUp() {
 // 	cm.clientsmu.Lock()
 // 	defer cm.clientsmu.Unlock()
@@ -76,13 +403,25 @@ func (c *client) wsWriter() {
 // 	}
 // }
 
-func (cm *channelModel) broadcast(a any) {
+// broadcast wraps data in an event with the channel's next sequence number
+// and sends it to every client. once clients have been sent away for
+// shutdown it does nothing, since their goingAway cursors have to cover
+// everything they'll need to replay
+func (cm *channelModel) broadcast(t string, data any) {
 	cm.clientsmu.Lock()
 	defer cm.clientsmu.Unlock()
+	if cm.closed {
+		return
+	}
+	cm.seq += 1
+	e := types.StreamEvent{Type: t, Seq: cm.seq, Data: data}
 	for cli := range cm.clients {
 		select {
-		case cli.bus <- a:
+		case cli.bus <- e:
 		default:
+			cm.logger.Debug("a lex stream client fell behind")
+			metrics.LexStreamDropped.Inc()
+			cli.behind = true
 			delete(cm.clients, cli)
 			close(cli.bus)
 		}
@@ -90,10 +429,23 @@ func (cm *channelModel) broadcast(a any) {
 }
 
 func (m *Model) BroadcastSignet(uri string, s *types.Signet) error {
-	cm := m.uriMap[uri]
+	return m.broadcastSignet(types.StreamSignet, uri, s)
+}
+
+// BroadcastSignetUpdate tells clients that a signet changed, which is only
+// ever it landing in the issuer's repo, so it's no longer pending
+func (m *Model) BroadcastSignetUpdate(uri string, s *types.Signet) error {
+	return m.broadcastSignet(types.StreamSignetUpdate, uri, s)
+}
+
+func (m *Model) broadcastSignet(t string, uri string, s *types.Signet) error {
+	cm := m.channel(uri)
 	if cm == nil {
 		return errors.New("AAAAAAAAAAA")
 	}
+	if m.bans.IsBanned(s.Author, context.Background()) {
+		return nil
+	}
 	ihandle, err := m.store.ResolveDid(s.IssuerDID, context.Background())
 	if err != nil {
 		ihandle, err = atputils.TryLookupDid(context.Background(), s.IssuerDID)
@@ -110,19 +462,33 @@ func (m *Model) BroadcastSignet(uri string, s *types.Signet) error {
 		Author:       s.Author,
 		AuthorHandle: s.AuthorHandle,
 		StartedAt:    s.StartedAt,
+		Pending:      s.CID == "",
 	}
-	cm.broadcast(sv)
+	cm.broadcast(t, sv)
 	return nil
 }
 
 func (m *Model) BroadcastMessage(uri string, msg *types.Message) error {
-	cm := m.uriMap[uri]
+	return m.broadcastMessage(types.StreamMessage, uri, msg)
+}
+
+// BroadcastMessageUpdate tells clients that a message was edited, they
+// should replace whatever they had with the same uri
+func (m *Model) BroadcastMessageUpdate(uri string, msg *types.Message) error {
+	return m.broadcastMessage(types.StreamMessageUpdate, uri, msg)
+}
+
+func (m *Model) broadcastMessage(t string, uri string, msg *types.Message) error {
+	cm := m.channel(uri)
 	if cm == nil {
 		return errors.New("failed to map uri to lsm!")
 	}
+	if m.bans.IsBanned(msg.DID, context.Background()) {
+		return nil
+	}
 	pv, err := m.store.GetProfileView(msg.DID, context.Background())
 	if err != nil {
-		return errors.New("failed to get profile view: " + err.Error())
+		return fmt.Errorf("failed to get profile view: %w", err)
 	}
 	mv := types.MessageView{
 		URI:       msg.URI,
@@ -132,19 +498,35 @@ func (m *Model) BroadcastMessage(uri string, msg *types.Message) error {
 		Color:     msg.Color,
 		SignetURI: msg.SignetURI,
 		PostedAt:  msg.PostedAt,
+		Edited:    msg.EditedAt != nil,
+		EditedAt:  msg.EditedAt,
+		Pending:   msg.CID == "",
 	}
-	cm.broadcast(mv)
+	cm.broadcast(t, mv)
 	return nil
 }
 
 func (m *Model) BroadcastImage(uri string, media *types.Image) error {
-	cm := m.uriMap[uri]
+	return m.broadcastMedia(types.StreamMedia, uri, media)
+}
+
+// BroadcastImageUpdate tells clients that an image was edited, they should
+// replace whatever they had with the same uri
+func (m *Model) BroadcastImageUpdate(uri string, media *types.Image) error {
+	return m.broadcastMedia(types.StreamMediaUpdate, uri, media)
+}
+
+func (m *Model) broadcastMedia(t string, uri string, media *types.Image) error {
+	cm := m.channel(uri)
 	if cm == nil {
 		return errors.New("failed to map uri to lsm!")
 	}
+	if m.bans.IsBanned(media.DID, context.Background()) {
+		return nil
+	}
 	pv, err := m.store.GetProfileView(media.DID, context.Background())
 	if err != nil {
-		return errors.New("failed to get profile view: " + err.Error())
+		return fmt.Errorf("failed to get profile view: %w", err)
 	}
 	var ar *lex.AspectRatio
 	if media.Width != nil && media.Height != nil {
@@ -153,7 +535,7 @@ func (m *Model) BroadcastImage(uri string, media *types.Image) error {
 			Height: *media.Height,
 		}
 	}
-	src := fmt.Sprintf("https://%s/xrpc/org.xcvr.lrc.getImage?uri=%s", os.Getenv("MY_IDENTITY"), media.URI)
+	src := fmt.Sprintf("https://%s/xrpc/org.xcvr.lrc.getImage?uri=%s", m.cfg.Identity, media.URI)
 
 	img := types.ImageView{
 		Alt:         media.Alt,
@@ -169,6 +551,85 @@ func (m *Model) BroadcastImage(uri string, media *types.Image) error {
 		SignetURI: media.SignetURI,
 		PostedAt:  media.PostedAt,
 	}
-	cm.broadcast(mv)
+	cm.broadcast(t, mv)
+	return nil
+}
+
+func (m *Model) BroadcastVideo(uri string, video *types.Video) error {
+	return m.broadcastVideo(types.StreamMedia, uri, video)
+}
+
+// BroadcastVideoUpdate tells clients that a video was edited, they should
+// replace whatever they had with the same uri
+func (m *Model) BroadcastVideoUpdate(uri string, video *types.Video) error {
+	return m.broadcastVideo(types.StreamMediaUpdate, uri, video)
+}
+
+func (m *Model) broadcastVideo(t string, uri string, video *types.Video) error {
+	cm := m.channel(uri)
+	if cm == nil {
+		return errors.New("failed to map uri to lsm!")
+	}
+	if m.bans.IsBanned(video.DID, context.Background()) {
+		return nil
+	}
+	pv, err := m.store.GetProfileView(video.DID, context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to get profile view: %w", err)
+	}
+	var ar *lex.AspectRatio
+	if video.Width != nil && video.Height != nil {
+		ar = &lex.AspectRatio{
+			Width:  *video.Width,
+			Height: *video.Height,
+		}
+	}
+	src := fmt.Sprintf("https://%s/xrpc/org.xcvr.lrc.getVideo?uri=%s", m.cfg.Identity, video.URI)
+
+	vid := types.VideoView{
+		Alt:         video.Alt,
+		Src:         &src,
+		AspectRatio: ar,
+	}
+	mv := types.MediaView{
+		URI:       video.URI,
+		Author:    *pv,
+		Video:     &vid,
+		Nick:      video.Nick,
+		Color:     video.Color,
+		SignetURI: video.SignetURI,
+		PostedAt:  video.PostedAt,
+	}
+	cm.broadcast(t, mv)
+	return nil
+}
+
+// BroadcastSignetDelete tells clients that a signet is gone
+func (m *Model) BroadcastSignetDelete(uri string, signetURI string) error {
+	return m.broadcastDelete(types.StreamSignetDelete, uri, signetURI)
+}
+
+// BroadcastMessageDelete tells clients that a message is gone
+func (m *Model) BroadcastMessageDelete(uri string, messageURI string) error {
+	return m.broadcastDelete(types.StreamMessageDelete, uri, messageURI)
+}
+
+// BroadcastMediaDelete tells clients that an image or video is gone
+func (m *Model) BroadcastMediaDelete(uri string, mediaURI string) error {
+	return m.broadcastDelete(types.StreamMediaDelete, uri, mediaURI)
+}
+
+// BroadcastWriteFailed tells clients that a pending record is never going to
+// make it to its repo, unless someone retries it
+func (m *Model) BroadcastWriteFailed(uri string, recordURI string) error {
+	return m.broadcastDelete(types.StreamWriteFailed, uri, recordURI)
+}
+
+func (m *Model) broadcastDelete(t string, uri string, recordURI string) error {
+	cm := m.channel(uri)
+	if cm == nil {
+		return errors.New("failed to map uri to lsm!")
+	}
+	cm.broadcast(t, types.DeletedView{URI: recordURI})
 	return nil
 }
@@ -0,0 +1,289 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"rvcx/internal/types"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testChannel = "at://did:plc:here/org.xcvr.feed.channel/test"
+
+func newTestChannel(t *testing.T) (*Model, *channelModel) {
+	t.Helper()
+	m := newTestModel(t)
+	err := m.AddChannel(&types.Channel{URI: testChannel, Host: "did:plc:here"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, m.channel(testChannel)
+}
+
+func (cm *channelModel) numClients() int {
+	cm.clientsmu.Lock()
+	defer cm.clientsmu.Unlock()
+	return len(cm.clients)
+}
+
+// broadcast gets hammered from several goroutines while slow clients fall
+// behind, fast ones keep up, and handlers go away on their own, which has to
+// be fine under -race without anything closing a bus twice
+func TestBroadcastSlowClients(t *testing.T) {
+	_, cm := newTestChannel(t)
+	const broadcasters = 8
+	const perBroadcaster = 200
+	total := broadcasters * perBroadcaster
+
+	var wg sync.WaitGroup
+	var slow, fast, leaving []*client
+	for i := range 50 {
+		var c *client
+		switch i % 5 {
+		case 0:
+			c = &client{bus: make(chan types.StreamEvent, total)}
+			fast = append(fast, c)
+		case 1:
+			c = &client{bus: make(chan types.StreamEvent, 4)}
+			leaving = append(leaving, c)
+		default:
+			c = &client{bus: make(chan types.StreamEvent, 4)}
+			slow = append(slow, c)
+		}
+		cm.clients[c] = true
+	}
+	received := make(map[*client][]types.StreamEvent)
+	var receivedmu sync.Mutex
+	for _, c := range append(append(slow, fast...), leaving...) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var got []types.StreamEvent
+			for e := range c.bus {
+				got = append(got, e)
+				if len(got)%10 == 0 && cap(c.bus) < total {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			receivedmu.Lock()
+			received[c] = got
+			receivedmu.Unlock()
+		}()
+	}
+	for _, c := range leaving {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Millisecond)
+			cm.removeClient(c)
+		}()
+	}
+	var bwg sync.WaitGroup
+	for b := range broadcasters {
+		bwg.Add(1)
+		go func() {
+			defer bwg.Done()
+			for i := range perBroadcaster {
+				cm.broadcast(types.StreamMessageDelete, types.DeletedView{URI: fmt.Sprintf("at://%d/%d", b, i)})
+			}
+		}()
+	}
+	bwg.Wait()
+	cm.goAway()
+	wg.Wait()
+
+	for _, c := range fast {
+		if c.behind {
+			t.Error("a client with room for everything fell behind")
+		}
+		if !c.goingAway {
+			t.Error("a client that kept up wasn't sent away at shutdown")
+		}
+		if len(received[c]) != total {
+			t.Errorf("a client that kept up got %d events, want %d", len(received[c]), total)
+		}
+	}
+	for _, c := range slow {
+		if !c.behind {
+			t.Error("a slow client with a tiny buffer didn't fall behind")
+		}
+	}
+	for c, got := range received {
+		for i := 1; i < len(got); i++ {
+			if got[i].Seq <= got[i-1].Seq {
+				t.Fatalf("events out of order: %d after %d", got[i].Seq, got[i-1].Seq)
+			}
+		}
+		if c.behind && c.goingAway {
+			t.Error("a client was both behind and going away")
+		}
+	}
+	if n := cm.numClients(); n != 0 {
+		t.Errorf("%d clients left after going away", n)
+	}
+}
+
+func signetEvent(uri string, id uint32) types.StreamEvent {
+	return types.StreamEvent{Type: types.StreamSignet, Data: types.SignetView{URI: uri, LrcId: id}}
+}
+
+func messageEvent(signetURI string) types.StreamEvent {
+	return types.StreamEvent{Type: types.StreamMessage, Data: types.MessageView{URI: signetURI + "/msg", SignetURI: signetURI}}
+}
+
+// the resync cursor has to stay behind any signet whose item the client
+// hasn't got yet, or resyncing would skip it
+func TestResyncCursor(t *testing.T) {
+	c := &client{last: 3, open: make(map[string]uint32)}
+	if c.cursor() != 3 {
+		t.Fatalf("cursor %d before anything was sent, want the one asked for", c.cursor())
+	}
+	c.sent(signetEvent("s4", 4))
+	c.sent(messageEvent("s4"))
+	c.sent(signetEvent("s5", 5))
+	c.sent(signetEvent("s6", 6))
+	c.sent(types.StreamEvent{Type: types.StreamMedia, Data: types.MediaView{URI: "s6/media", SignetURI: "s6"}})
+	if c.cursor() != 4 {
+		t.Errorf("cursor %d with s5's message outstanding, want 4", c.cursor())
+	}
+	c.sent(messageEvent("s5"))
+	if c.cursor() != 6 {
+		t.Errorf("cursor %d with everything sent, want 6", c.cursor())
+	}
+	c.sent(signetEvent("s7", 7))
+	c.sent(types.StreamEvent{Type: types.StreamSignetDelete, Data: types.DeletedView{URI: "s7"}})
+	if c.cursor() != 7 {
+		t.Errorf("cursor %d after the open signet was deleted, want 7", c.cursor())
+	}
+
+	for i := range maxOpenSignets + 10 {
+		c.sent(signetEvent(fmt.Sprintf("abandoned%d", i), uint32(100+i)))
+	}
+	if len(c.open) != maxOpenSignets {
+		t.Errorf("remembering %d open signets, want at most %d", len(c.open), maxOpenSignets)
+	}
+	if c.cursor() != 109 {
+		t.Errorf("cursor %d after the oldest open signets were given up on, want 109", c.cursor())
+	}
+}
+
+// a client that closes its end gets its handler cleaned up right away, not
+// whenever the next ping fails to send
+func TestLexStreamClientCloses(t *testing.T) {
+	m, cm := newTestChannel(t)
+	srv := httptest.NewServer(cm.WSHandler(testChannel, m))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitFor(t, func() bool { return cm.numClients() == 1 })
+
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "bye")
+	err = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return cm.numClients() == 0 })
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected the close to be echoed, got %v", err)
+	}
+}
+
+// replay has to send every item under the signets it replays, however many
+// there are, and every signet after the cursor, however many more than limit
+// there are, since a client resyncing after falling behind is owed them all
+func TestReplayKeepsEveryItem(t *testing.T) {
+	m, cm := newTestChannel(t)
+	ctx := context.Background()
+	alice := "did:plc:alice"
+	handle := "alice.test"
+	m.store.StoreChannel(&types.Channel{URI: testChannel, Host: "did:plc:here"}, ctx)
+	m.store.StoreDidHandle(alice, handle, ctx)
+	m.store.InitializeProfile(alice, nil, nil, nil, nil, ctx)
+	start := time.Now().Add(-time.Hour)
+	for id := range uint32(4) {
+		signetURI := fmt.Sprintf("at://did:plc:here/org.xcvr.lrc.signet/%d", id+1)
+		_, err := m.store.StoreSignet(&types.Signet{
+			URI:          signetURI,
+			IssuerDID:    "did:plc:here",
+			Author:       alice,
+			AuthorHandle: &handle,
+			ChannelURI:   testChannel,
+			MessageID:    id + 1,
+			StartedAt:    start,
+		}, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range 3 {
+			_, err = m.store.StoreMessage(&types.Message{
+				URI:       fmt.Sprintf("at://%s/org.xcvr.lrc.message/%d-%d", alice, id+1, i),
+				DID:       alice,
+				SignetURI: signetURI,
+				Body:      "hi",
+				PostedAt:  start.Add(time.Duration(i) * time.Second),
+			}, ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	srv := httptest.NewServer(cm.WSHandler(testChannel, m))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"?cursor=0&limit=2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var replayed []string
+	var ids []uint32
+	for range 16 {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("after %v: %s", replayed, err)
+		}
+		var e struct {
+			Type string `json:"$type"`
+			Data struct {
+				LrcId uint32 `json:"lrcID"`
+			} `json:"data"`
+		}
+		json.Unmarshal(b, &e)
+		e.Type = strings.TrimPrefix(e.Type, "org.xcvr.lrc.subscribeLexStream#")
+		replayed = append(replayed, e.Type)
+		if e.Type == "signet" {
+			ids = append(ids, e.Data.LrcId)
+		}
+	}
+	want := strings.Repeat("signet message message message ", 4)
+	if got := strings.Join(replayed, " ") + " "; got != want {
+		t.Errorf("replayed %s, want %s", got, want)
+	}
+	if !slices.Equal(ids, []uint32{1, 2, 3, 4}) {
+		t.Errorf("replayed signets %v, want every one after the cursor in order", ids)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,119 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"rvcx/internal/banpolicy"
+	"rvcx/internal/config"
+	"rvcx/internal/log"
+	"rvcx/internal/memstore"
+	"rvcx/internal/types"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestModel(t *testing.T) *Model {
+	t.Helper()
+	cfg := &config.Config{DID: "did:plc:here", Identity: "here.test"}
+	s := memstore.New(cfg)
+	logger := log.New(io.Discard, false)
+	return Init(cfg, s, logger, nil, nil, banpolicy.New(s, logger))
+}
+
+// channels come and go from jetstream while metrics are scraped and
+// broadcasts go out, which has to be fine under -race
+func TestChannelsConcurrently(t *testing.T) {
+	m := newTestModel(t)
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	uris := make([]string, 20)
+	for i := range uris {
+		uris[i] = fmt.Sprintf("at://did:plc:here/org.xcvr.feed.channel/%d", i)
+	}
+	readers := []func(){
+		func() { m.Connected() },
+		func() { m.ConnectedHere(uris) },
+		func() { m.ChannelHost(uris[0]) },
+		func() { m.GetLexStreamFrom(uris[1]) },
+		func() { m.BroadcastMessageDelete(uris[2], "at://did:plc:a/org.xcvr.lrc.message/1") },
+	}
+	var started sync.WaitGroup
+	for _, read := range readers {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					read()
+				}
+			}
+		}()
+	}
+	started.Wait()
+	for range 200 {
+		for i, uri := range uris {
+			host := "did:plc:here"
+			if i%2 == 0 {
+				host = "did:plc:elsewhere"
+			}
+			c := &types.Channel{URI: uri, Host: host}
+			err := m.AddChannel(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Host = "did:plc:here"
+			err = m.UpdateChannel(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, uri := range uris {
+			err := m.DeleteChannel(uri)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestConnectedHere(t *testing.T) {
+	m := newTestModel(t)
+	here := "at://did:plc:here/org.xcvr.feed.channel/here"
+	there := "at://did:plc:there/org.xcvr.feed.channel/there"
+	m.AddChannel(&types.Channel{URI: here, Host: "did:plc:here"})
+	m.AddChannel(&types.Channel{URI: there, Host: "did:plc:there"})
+	connected := m.ConnectedHere([]string{here, there, "at://nope"})
+	if len(connected) != 1 || connected[here] != 0 {
+		t.Fatalf("got %v, want only %s with nobody connected", connected, here)
+	}
+}
+
+// anything jetstream or the outbox broadcasts after clients were sent away
+// has to wait for them to resume, rather than using up sequence numbers
+func TestShutdownStopsBroadcasts(t *testing.T) {
+	m, cm := newTestChannel(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := m.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.BroadcastMessageDelete(testChannel, "at://did:plc:a/org.xcvr.lrc.message/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.clientsmu.Lock()
+	defer cm.clientsmu.Unlock()
+	if cm.seq != 0 {
+		t.Errorf("broadcast %d events after shutting down", cm.seq)
+	}
+}
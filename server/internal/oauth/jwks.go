@@ -2,11 +2,10 @@ package oauth
 
 import (
 	"github.com/bluesky-social/indigo/atproto/crypto"
-	"os"
 )
 
-func GetPrivateKey() (crypto.PrivateKeyExportable, error) {
-	csk := os.Getenv("CLIENT_SECRET_KEY")
+// GetPrivateKey parses the multibase CLIENT_SECRET_KEY
+func GetPrivateKey(csk string) (crypto.PrivateKeyExportable, error) {
 	key, err := crypto.ParsePrivateMultibase(csk)
 	if err != nil {
 		return nil, err
@@ -1,14 +1,7 @@
 package oauth
 
 import (
-	"fmt"
-	"os"
-)
-
-var (
-	mi             string
-	mp             string
-	clientMetadata *ClientMetadata
+	"rvcx/internal/config"
 )
 
 type ClientMetadata struct {
@@ -29,61 +22,30 @@ type ClientMetadata struct {
 	TokenEndpointAuthSigningAlg string   `json:"token_endpoint_auth_signing_alg"`
 }
 
-func GetClientMetadata() ClientMetadata {
-	if clientMetadata == nil {
-		mi = os.Getenv("MY_IDENTITY")
-		mp = os.Getenv("MY_METADATA_PATH")
-		clientMetadata = &ClientMetadata{
-			ClientId:                    getClientId(),
-			ClientName:                  getClientName(),
-			ClientUri:                   getClientUri(),
-			LogoUri:                     getLogoUri(),
-			TosUri:                      getTOSUri(),
-			PolicyUrl:                   getPolicyUri(),
-			RedirectUris:                []string{getOauthCallback()},
-			GrantTypes:                  []string{"authorization_code", "refresh_token"},
-			ResponseTypes:               []string{"code"},
-			ApplicationType:             "web",
-			DPOPBoundAccessTokens:       true,
-			JWKSUri:                     getJWKSUri(),
-			Scope:                       "atproto transition:generic",
-			TokenEndpointAuthMethod:     "private_key_jwt",
-			TokenEndpointAuthSigningAlg: "ES256",
-		}
+func NewClientMetadata(cfg *config.Config) ClientMetadata {
+	return ClientMetadata{
+		ClientId:                    clientId(cfg),
+		ClientName:                  cfg.Name,
+		ClientUri:                   cfg.ClientURI(),
+		LogoUri:                     cfg.ClientURI() + cfg.LogoPath,
+		TosUri:                      cfg.ClientURI() + cfg.TOSPath,
+		PolicyUrl:                   cfg.ClientURI() + cfg.PolicyPath,
+		RedirectUris:                []string{oauthCallback(cfg)},
+		GrantTypes:                  []string{"authorization_code", "refresh_token"},
+		ResponseTypes:               []string{"code"},
+		ApplicationType:             "web",
+		DPOPBoundAccessTokens:       true,
+		JWKSUri:                     cfg.ClientURI() + cfg.JWKSPath,
+		Scope:                       "atproto transition:generic",
+		TokenEndpointAuthMethod:     "private_key_jwt",
+		TokenEndpointAuthSigningAlg: "ES256",
 	}
-	return *clientMetadata
-}
-
-func getClientId() string {
-	mi = os.Getenv("MY_IDENTITY")
-	mp = os.Getenv("MY_METADATA_PATH")
-	return fmt.Sprintf("https://%s%s", mi, mp)
-}
-
-func getClientName() string {
-	return os.Getenv("MY_NAME")
-}
-
-func getClientUri() string {
-	return fmt.Sprintf("https://%s", mi)
-}
-
-func getLogoUri() string {
-	return fmt.Sprintf("%s%s", getClientUri(), os.Getenv("MY_LOGO_PATH"))
-}
-
-func getTOSUri() string {
-	return fmt.Sprintf("%s%s", getClientUri(), os.Getenv("MY_TOS_PATH"))
-}
-
-func getPolicyUri() string {
-	return fmt.Sprintf("%s%s", getClientUri(), os.Getenv("MY_POLICY_PATH"))
 }
 
-func getOauthCallback() string {
-	return fmt.Sprintf("%s%s", getClientUri(), os.Getenv("MY_OAUTH_CALLBACK"))
+func clientId(cfg *config.Config) string {
+	return cfg.ClientURI() + cfg.MetadataPath
 }
 
-func getJWKSUri() string {
-	return fmt.Sprintf("%s%s", getClientUri(), os.Getenv("MY_JWKS_PATH"))
+func oauthCallback(cfg *config.Config) string {
+	return cfg.ClientURI() + cfg.OAuthCallback
 }
@@ -17,7 +17,10 @@ import (
 	"mime/multipart"
 	"rvcx/internal/lex"
 	"rvcx/internal/log"
+	"rvcx/internal/metrics"
+	"rvcx/internal/store"
 	"rvcx/internal/types"
+	"time"
 )
 
 type OauthXRPCClient struct {
@@ -29,6 +32,12 @@ func (c *OauthXRPCClient) GetSession() *types.Session {
 	return c.session
 }
 
+// post is APIClient.Post, but measured
+func post(ctx context.Context, c *atpclient.APIClient, endpoint syntax.NSID, body any, out any) (err error) {
+	defer metrics.ObservePDSWrite(metrics.ClientOAuth, endpoint.String(), time.Now(), &err)
+	return c.Post(ctx, endpoint, body, out)
+}
+
 func MakeBskyPost(cs *oauth.ClientSession, text string, ctx context.Context) error {
 	c := cs.APIClient()
 	body := map[string]any{
@@ -40,9 +49,9 @@ func MakeBskyPost(cs *oauth.ClientSession, text string, ctx context.Context) err
 			"createdAt": syntax.DatetimeNow(),
 		},
 	}
-	err := c.Post(ctx, "com.atproto.repo.createRecord", body, nil)
+	err := post(ctx, c, "com.atproto.repo.createRecord", body, nil)
 	if err != nil {
-		return errors.New("failed to tweet: " + err.Error())
+		return fmt.Errorf("failed to tweet: %w", err)
 	}
 	return nil
 }
@@ -51,7 +60,7 @@ func CreateXCVRProfile(cs *oauth.ClientSession, profile *lex.ProfileRecord, ctx
 	c := cs.APIClient()
 	nsid, err := syntax.ParseNSID("com.atproto.repo.getRecord")
 	if err != nil {
-		return nil, errors.New("failed to parse: " + err.Error())
+		return nil, fmt.Errorf("failed to parse: %w", err)
 	}
 	var getOut atproto.RepoGetRecord_Output
 	body := map[string]any{
@@ -77,9 +86,9 @@ func CreateXCVRProfile(cs *oauth.ClientSession, profile *lex.ProfileRecord, ctx
 	}
 	body["record"] = profile
 	var out atproto.RepoCreateRecord_Output
-	err = c.Post(ctx, "com.atproto.repo.createRecord", body, &out)
+	err = post(ctx, c, "com.atproto.repo.createRecord", body, &out)
 	if err != nil {
-		err = errors.New("oops! failed to create a profile: " + err.Error())
+		err = fmt.Errorf("oops! failed to create a profile: %w", err)
 		return
 	}
 	return profile, nil
@@ -93,9 +102,9 @@ func CreateXCVRChannel(cs *oauth.ClientSession, channel *lex.ChannelRecord, ctx
 		"record":     channel,
 	}
 	var out atproto.RepoCreateRecord_Output
-	err = c.Post(ctx, "com.atproto.repo.createRecord", body, &out)
+	err = post(ctx, c, "com.atproto.repo.createRecord", body, &out)
 	if err != nil {
-		err = errors.New("oops! failed to create a channel: " + err.Error())
+		err = fmt.Errorf("oops! failed to create a channel: %w", err)
 		return
 	}
 	uri = out.Uri
@@ -119,13 +128,45 @@ func DeleteXCVRChannel(cs *oauth.ClientSession, rkey string, ctx context.Context
 		return nil
 	}
 	body["swapRecord"] = getOut.Cid
-	err = c.Post(ctx, "com.atproto.repo.deleteRecord", body, nil)
+	err = post(ctx, c, "com.atproto.repo.deleteRecord", body, nil)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+func CreateXCVRSub(cs *oauth.ClientSession, sub *lex.SubRecord, ctx context.Context) (uri string, cid string, err error) {
+	c := cs.APIClient()
+	body := map[string]any{
+		"collection": "org.xcvr.feed.sub",
+		"repo":       *c.AccountDID,
+		"record":     sub,
+	}
+	var out atproto.RepoCreateRecord_Output
+	err = post(ctx, c, "com.atproto.repo.createRecord", body, &out)
+	if err != nil {
+		err = fmt.Errorf("failed to create a sub: %w", err)
+		return
+	}
+	uri = out.Uri
+	cid = out.Cid
+	return
+}
+
+func DeleteXCVRSub(cs *oauth.ClientSession, rkey string, ctx context.Context) error {
+	c := cs.APIClient()
+	body := map[string]any{
+		"collection": "org.xcvr.feed.sub",
+		"repo":       *c.AccountDID,
+		"rkey":       rkey,
+	}
+	err := post(ctx, c, "com.atproto.repo.deleteRecord", body, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete a sub: %w", err)
+	}
+	return nil
+}
+
 func CreateXCVRMessage(cs *oauth.ClientSession, message *lex.MessageRecord, ctx context.Context) (uri string, cid string, err error) {
 	c := cs.APIClient()
 	body := map[string]any{
@@ -134,9 +175,9 @@ func CreateXCVRMessage(cs *oauth.ClientSession, message *lex.MessageRecord, ctx
 		"record":     message,
 	}
 	var out atproto.RepoCreateRecord_Output
-	err = c.Post(ctx, "com.atproto.repo.createRecord", body, &out)
+	err = post(ctx, c, "com.atproto.repo.createRecord", body, &out)
 	if err != nil {
-		err = errors.New("oops! failed to create a message: " + err.Error())
+		err = fmt.Errorf("oops! failed to create a message: %w", err)
 		return
 	}
 	uri = out.Uri
@@ -169,23 +210,24 @@ func UpdateXCVRProfile(cs *oauth.ClientSession, profile *lex.ProfileRecord, ctx
 		"record":     profile,
 	}
 	var out atproto.RepoCreateRecord_Output
-	err = c.Post(ctx, "com.atproto.repo.createRecord", body, &out)
+	err = post(ctx, c, "com.atproto.repo.createRecord", body, &out)
 	if err != nil {
-		err = errors.New("oops! failed to create a profile: " + err.Error())
+		err = fmt.Errorf("oops! failed to create a profile: %w", err)
 		return
 	}
 	return profile, nil
 }
 
-func UploadBLOB(cs *oauth.ClientSession, file multipart.File, fileHeader *multipart.FileHeader, ctx context.Context) (*lexutil.BlobSchema, error) {
+func UploadBLOB(cs *oauth.ClientSession, file multipart.File, fileHeader *multipart.FileHeader, ctx context.Context) (blob *lexutil.BlobSchema, err error) {
 	client := cs.APIClient()
 
 	fileBytes, err := io.ReadAll(file)
 	if err != nil {
-		return nil, errors.New("failed to readall: " + err.Error())
+		return nil, fmt.Errorf("failed to readall: %w", err)
 	}
 	fileReader := bytes.NewReader(fileBytes)
 
+	defer metrics.ObservePDSWrite(metrics.ClientOAuth, "com.atproto.repo.uploadBlob", time.Now(), &err)
 	req := atpclient.NewAPIRequest("POST", "com.atproto.repo.uploadBlob", fileReader)
 	contentType := fileHeader.Header.Get("Content-Type")
 	if contentType == "" {
@@ -208,7 +250,7 @@ func UploadBLOB(cs *oauth.ClientSession, file multipart.File, fileHeader *multip
 	decoder := json.NewDecoder(resp.Body)
 	err = decoder.Decode(&uploadResp)
 	if err != nil {
-		return nil, errors.New("failed to decode: " + err.Error())
+		return nil, fmt.Errorf("failed to decode: %w", err)
 	}
 	return uploadResp.Blob, nil
 }
@@ -221,12 +263,125 @@ func CreateXCVRMedia(cs *oauth.ClientSession, imr *lex.MediaRecord, ctx context.
 		"record":     imr,
 	}
 	var out atproto.RepoCreateRecord_Output
-	err = c.Post(ctx, "com.atproto.repo.createRecord", body, &out)
+	err = post(ctx, c, "com.atproto.repo.createRecord", body, &out)
 	if err != nil {
-		err = errors.New("oops! failed to create a media: " + err.Error())
+		err = fmt.Errorf("oops! failed to create a media: %w", err)
 		return
 	}
 	uri = out.Uri
 	cid = out.Cid
 	return
 }
+
+// getXCVRRecord gets one of the session's records into out, along with its
+// cid so that it can be swapped out safely. the value is decoded by hand since
+// not every xcvr record is registered with lexutil. it returns
+// store.ErrNotFound if there's no such record
+func getXCVRRecord(c *atpclient.APIClient, collection string, rkey string, out any, ctx context.Context) (cid string, err error) {
+	params := map[string]any{
+		"collection": collection,
+		"repo":       c.AccountDID.String(),
+		"rkey":       rkey,
+	}
+	var getOut struct {
+		Cid   *string         `json:"cid"`
+		Value json.RawMessage `json:"value"`
+	}
+	err = c.Get(ctx, "com.atproto.repo.getRecord", params, &getOut)
+	if err != nil {
+		var apiErr *atpclient.APIError
+		if errors.As(err, &apiErr) && apiErr.Name == "RecordNotFound" {
+			return "", fmt.Errorf("no %s %s: %w", collection, rkey, store.ErrNotFound)
+		}
+		return "", fmt.Errorf("failed to get record: %w", err)
+	}
+	if getOut.Cid == nil {
+		return "", errors.New("record came back without a cid")
+	}
+	err = json.Unmarshal(getOut.Value, out)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal record: %w", err)
+	}
+	return *getOut.Cid, nil
+}
+
+// putXCVRRecord replaces one of the session's records, as long as it's still
+// the version with cid swap
+func putXCVRRecord(c *atpclient.APIClient, collection string, rkey string, record any, swap string, ctx context.Context) (uri string, cid string, err error) {
+	body := map[string]any{
+		"collection": collection,
+		"repo":       *c.AccountDID,
+		"rkey":       rkey,
+		"record":     record,
+		"swapRecord": swap,
+	}
+	var out atproto.RepoPutRecord_Output
+	err = post(ctx, c, "com.atproto.repo.putRecord", body, &out)
+	if err != nil {
+		return
+	}
+	uri = out.Uri
+	cid = out.Cid
+	return
+}
+
+func deleteXCVRRecord(c *atpclient.APIClient, collection string, rkey string, ctx context.Context) error {
+	body := map[string]any{
+		"collection": collection,
+		"repo":       *c.AccountDID,
+		"rkey":       rkey,
+	}
+	return post(ctx, c, "com.atproto.repo.deleteRecord", body, nil)
+}
+
+func GetXCVRMessage(cs *oauth.ClientSession, rkey string, ctx context.Context) (message *lex.MessageRecord, cid string, err error) {
+	message = &lex.MessageRecord{}
+	cid, err = getXCVRRecord(cs.APIClient(), "org.xcvr.lrc.message", rkey, message, ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return message, cid, nil
+}
+
+func UpdateXCVRMessage(cs *oauth.ClientSession, rkey string, message *lex.MessageRecord, swap string, ctx context.Context) (uri string, cid string, err error) {
+	message.LexiconTypeID = "org.xcvr.lrc.message"
+	uri, cid, err = putXCVRRecord(cs.APIClient(), "org.xcvr.lrc.message", rkey, message, swap, ctx)
+	if err != nil {
+		err = fmt.Errorf("oops! failed to update a message: %w", err)
+	}
+	return
+}
+
+func DeleteXCVRMessage(cs *oauth.ClientSession, rkey string, ctx context.Context) error {
+	err := deleteXCVRRecord(cs.APIClient(), "org.xcvr.lrc.message", rkey, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete a message: %w", err)
+	}
+	return nil
+}
+
+func GetXCVRMedia(cs *oauth.ClientSession, rkey string, ctx context.Context) (media *lex.MediaRecord, cid string, err error) {
+	media = &lex.MediaRecord{}
+	cid, err = getXCVRRecord(cs.APIClient(), "org.xcvr.lrc.media", rkey, media, ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return media, cid, nil
+}
+
+func UpdateXCVRMedia(cs *oauth.ClientSession, rkey string, media *lex.MediaRecord, swap string, ctx context.Context) (uri string, cid string, err error) {
+	media.LexiconTypeID = "org.xcvr.lrc.media"
+	uri, cid, err = putXCVRRecord(cs.APIClient(), "org.xcvr.lrc.media", rkey, media, swap, ctx)
+	if err != nil {
+		err = fmt.Errorf("oops! failed to update a media: %w", err)
+	}
+	return
+}
+
+func DeleteXCVRMedia(cs *oauth.ClientSession, rkey string, ctx context.Context) error {
+	err := deleteXCVRRecord(cs.APIClient(), "org.xcvr.lrc.media", rkey, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete a media: %w", err)
+	}
+	return nil
+}
@@ -2,66 +2,208 @@ package oauth
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/bluesky-social/indigo/api/atproto"
 	"github.com/bluesky-social/indigo/atproto/client"
 	"github.com/bluesky-social/indigo/lex/util"
-	"os"
+	"net/http"
+	"rvcx/internal/atputils"
+	"rvcx/internal/config"
 	"rvcx/internal/lex"
 	"rvcx/internal/log"
+	"rvcx/internal/metrics"
+	"strings"
+	"sync"
+	"time"
 )
 
 type PasswordClient struct {
 	logger     *log.Logger
 	xrpc       *client.APIClient
+	did        *string
+	identifier string
+	password   string
+	// mu guards the session, which is swapped out whenever it's refreshed.
+	// writes go out concurrently, so nothing sets the session on xrpc
+	// itself, each request gets its own copy of the client instead
+	mu         sync.RWMutex
 	accessjwt  *string
 	refreshjwt *string
-	did        *string
+	// expiresAt is when accessjwt expires, or zero if it couldn't be read
+	expiresAt time.Time
 }
 
-func NewPasswordClient(did string, host string, l *log.Logger) *PasswordClient {
+// refreshMargin is how long before the access token expires that it gets
+// refreshed, instead of waiting for the pds to reject it
+const refreshMargin = time.Minute
+
+// NewPasswordClient makes a client for the backend's own repo on host, which
+// logs in with the app password in cfg
+func NewPasswordClient(cfg *config.Config, host string, l *log.Logger) *PasswordClient {
+	did := cfg.DID
 	return &PasswordClient{
-		xrpc:   client.NewAPIClient(host),
-		did:    &did,
-		logger: l,
+		xrpc:       client.NewAPIClient(host),
+		did:        &did,
+		identifier: cfg.Identity,
+		password:   cfg.Secret,
+		logger:     l,
 	}
 }
 
 func (c *PasswordClient) CreateSession(ctx context.Context) error {
-	c.logger.Deprintln("creating session...")
-	secret := os.Getenv("MY_SECRET")
-	identity := os.Getenv("MY_IDENTITY")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.login(ctx)
+}
+
+// RefreshSession trades the refresh token for a new session, and logs in
+// again with the app password if that doesn't work
+func (c *PasswordClient) RefreshSession(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.refresh(ctx)
+}
+
+// login must be called holding mu
+func (c *PasswordClient) login(ctx context.Context) error {
+	c.logger.DebugContext(ctx, "creating session")
 	input := atproto.ServerCreateSession_Input{
-		Identifier: identity,
-		Password:   secret,
+		Identifier: c.identifier,
+		Password:   c.password,
 	}
 	var out atproto.ServerCreateSession_Output
 	err := c.xrpc.LexDo(ctx, "POST", "application/json", "com.atproto.server.createSession", nil, input, &out)
 	if err != nil {
-		return errors.New("I couldn't create a session: " + err.Error())
+		return fmt.Errorf("I couldn't create a session: %w", err)
 	}
-	c.accessjwt = &out.AccessJwt
-	c.refreshjwt = &out.RefreshJwt
-	c.logger.Deprintln("created session!")
+	c.setSession(out.AccessJwt, out.RefreshJwt)
+	c.logger.DebugContext(ctx, "created session", "expires_at", c.expiresAt)
 	return nil
 }
 
-func (c *PasswordClient) RefreshSession(ctx context.Context) error {
-	c.logger.Deprintln("refreshing session")
-	c.xrpc.Headers.Set("Authorization", fmt.Sprintf("Bearer %s", *c.refreshjwt))
+// refresh must be called holding mu
+func (c *PasswordClient) refresh(ctx context.Context) error {
+	if c.refreshjwt == nil {
+		return errors.New("must create a session first")
+	}
+	c.logger.DebugContext(ctx, "refreshing session")
 	var out atproto.ServerRefreshSession_Output
-	err := c.xrpc.LexDo(ctx, "POST", "application/json", "com.atproto.server.refreshSession", nil, nil, &out)
-	if err != nil {
-		c.logger.Println("FAILED TO REFRESH RESSION")
-		return errors.New("failed to refresh session! " + err.Error())
+	err := c.authed(*c.refreshjwt).LexDo(ctx, "POST", "application/json", "com.atproto.server.refreshSession", nil, nil, &out)
+	if err == nil {
+		c.setSession(out.AccessJwt, out.RefreshJwt)
+		metrics.PasswordSessionRenewals.WithLabelValues("refresh").Inc()
+		c.logger.DebugContext(ctx, "refreshed session", "expires_at", c.expiresAt)
+		return nil
 	}
-	c.accessjwt = &out.AccessJwt
-	c.refreshjwt = &out.RefreshJwt
-	c.logger.Deprintln("refreshed session!")
+	// the refresh token expires too, or the pds may have forgotten it, so
+	// there's still the app password to fall back on
+	c.logger.WarnContext(ctx, "failed to refresh session, logging in again", "err", err)
+	lerr := c.login(ctx)
+	if lerr != nil {
+		metrics.PasswordSessionRenewals.WithLabelValues("failed").Inc()
+		return fmt.Errorf("failed to refresh session (%w) or log in again: %w", err, lerr)
+	}
+	metrics.PasswordSessionRenewals.WithLabelValues("login").Inc()
 	return nil
 }
 
+// setSession must be called holding mu
+func (c *PasswordClient) setSession(access string, refresh string) {
+	c.accessjwt = &access
+	c.refreshjwt = &refresh
+	c.expiresAt = jwtExpiry(access)
+}
+
+// authed is xrpc with token as its bearer token
+func (c *PasswordClient) authed(token string) *client.APIClient {
+	xrpc := *c.xrpc
+	xrpc.Headers = c.xrpc.Headers.Clone()
+	xrpc.Headers.Set("Authorization", "Bearer "+token)
+	return &xrpc
+}
+
+// accessToken is the current access token, refreshed first if it's about to
+// expire
+func (c *PasswordClient) accessToken(ctx context.Context) (string, error) {
+	c.mu.RLock()
+	if c.accessjwt == nil {
+		c.mu.RUnlock()
+		return "", errors.New("must create a session first")
+	}
+	token := *c.accessjwt
+	fresh := c.expiresAt.IsZero() || time.Until(c.expiresAt) > refreshMargin
+	c.mu.RUnlock()
+	if fresh {
+		return token, nil
+	}
+	return c.renew(ctx, token)
+}
+
+// renew refreshes the session, unless it's already been refreshed since
+// stale was handed out, which happens whenever several writes find the token
+// has expired at once. it returns the access token to use now
+func (c *PasswordClient) renew(ctx context.Context, stale string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accessjwt != nil && *c.accessjwt != stale {
+		return *c.accessjwt, nil
+	}
+	err := c.refresh(ctx)
+	if err != nil {
+		return "", err
+	}
+	return *c.accessjwt, nil
+}
+
+// withSession runs do with a client authed as the backend, and if the pds
+// says the token has expired, refreshes the session and runs it again
+func (c *PasswordClient) withSession(ctx context.Context, do func(xrpc *client.APIClient) error) error {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	err = do(c.authed(token))
+	if !isExpiredToken(err) {
+		return err
+	}
+	c.logger.DebugContext(ctx, "access token expired")
+	token, rerr := c.renew(ctx, token)
+	if rerr != nil {
+		return fmt.Errorf("%w, then %w", err, rerr)
+	}
+	return do(c.authed(token))
+}
+
+func isExpiredToken(err error) bool {
+	var apiErr *client.APIError
+	return errors.As(err, &apiErr) && apiErr.Name == "ExpiredToken"
+}
+
+// jwtExpiry reads the exp claim out of token without verifying anything,
+// since all it's used for is guessing when to refresh. it's zero if token
+// doesn't have one
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
 func (c *PasswordClient) CreateXCVRMessage(message *lex.MessageRecord, ctx context.Context) (cid string, uri string, err error) {
 	input := atproto.RepoCreateRecord_Input{
 		Collection: "org.xcvr.lrc.message",
@@ -90,36 +232,116 @@ func (c *PasswordClient) CreateXCVRChannel(channel *lex.ChannelRecord, ctx conte
 }
 
 func (c *PasswordClient) createMyRecord(input atproto.RepoCreateRecord_Input, ctx context.Context) (cid string, uri string, err error) {
-	if c.accessjwt == nil {
-		err = errors.New("must create a session first")
+	defer metrics.ObservePDSWrite(metrics.ClientPassword, "com.atproto.repo.createRecord", time.Now(), &err)
+	var out atproto.RepoCreateRecord_Output
+	err = c.withSession(ctx, func(xrpc *client.APIClient) error {
+		out = atproto.RepoCreateRecord_Output{}
+		return xrpc.LexDo(ctx, "POST", "application/json", "com.atproto.repo.createRecord", nil, input, &out)
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to create %s: %w", input.Collection, err)
 		return
 	}
-	c.xrpc.Headers.Set("Authorization", fmt.Sprintf("Bearer %s", *c.accessjwt))
-	var out atproto.RepoCreateRecord_Output
-	err = c.xrpc.LexDo(ctx, "POST", "application/json", "com.atproto.repo.createRecord", nil, input, &out)
+	cid = out.Cid
+	uri = out.Uri
+	return
+}
+
+// PutMyRecord writes record to rkey in collection. unlike creating a record,
+// doing it twice is harmless, which matters to the outbox since a write that
+// seemed to fail may have landed anyway
+func (c *PasswordClient) PutMyRecord(collection string, rkey string, record *util.LexiconTypeDecoder, ctx context.Context) (cid string, err error) {
+	defer metrics.ObservePDSWrite(metrics.ClientPassword, "com.atproto.repo.putRecord", time.Now(), &err)
+	input := atproto.RepoPutRecord_Input{
+		Collection: collection,
+		Repo:       *c.did,
+		Rkey:       rkey,
+		Record:     record,
+	}
+	var out atproto.RepoPutRecord_Output
+	err = c.withSession(ctx, func(xrpc *client.APIClient) error {
+		out = atproto.RepoPutRecord_Output{}
+		return xrpc.LexDo(ctx, "POST", "application/json", "com.atproto.repo.putRecord", nil, input, &out)
+	})
 	if err != nil {
-		err1 := err.Error()
-		err = c.RefreshSession(ctx)
-		if err != nil {
-			err = errors.New(fmt.Sprintf("failed to refresh session while creating %s! first %s then %s", input.Collection, err1, err.Error()))
-			return
+		err = fmt.Errorf("failed to put %s: %w", collection, err)
+		return
+	}
+	cid = out.Cid
+	return
+}
+
+// MyRecord is one record in a CreateMyRecords batch
+type MyRecord struct {
+	Collection string
+	Rkey       string
+	Record     *util.LexiconTypeDecoder
+}
+
+// CreateMyRecords creates every record in records with a single applyWrites,
+// which either all land or none do. it returns their cids in the same order
+func (c *PasswordClient) CreateMyRecords(records []MyRecord, ctx context.Context) (cids []string, err error) {
+	defer metrics.ObservePDSWrite(metrics.ClientPassword, "com.atproto.repo.applyWrites", time.Now(), &err)
+	input := atproto.RepoApplyWrites_Input{
+		Repo:   *c.did,
+		Writes: make([]*atproto.RepoApplyWrites_Input_Writes_Elem, 0, len(records)),
+	}
+	for _, r := range records {
+		rkey := r.Rkey
+		input.Writes = append(input.Writes, &atproto.RepoApplyWrites_Input_Writes_Elem{
+			RepoApplyWrites_Create: &atproto.RepoApplyWrites_Create{
+				Collection: r.Collection,
+				Rkey:       &rkey,
+				Value:      r.Record,
+			},
+		})
+	}
+	var out atproto.RepoApplyWrites_Output
+	err = c.withSession(ctx, func(xrpc *client.APIClient) error {
+		out = atproto.RepoApplyWrites_Output{}
+		return xrpc.LexDo(ctx, "POST", "application/json", "com.atproto.repo.applyWrites", nil, input, &out)
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to apply %d writes: %w", len(records), err)
+		return
+	}
+	// results should come back in order, but they say which record they're
+	// for, so there's no need to rely on it
+	byURI := make(map[string]string, len(out.Results))
+	for _, res := range out.Results {
+		if res != nil && res.RepoApplyWrites_CreateResult != nil {
+			byURI[res.RepoApplyWrites_CreateResult.Uri] = res.RepoApplyWrites_CreateResult.Cid
 		}
-		c.xrpc.Headers.Set("Authorization", fmt.Sprintf("Bearer %s", *c.accessjwt))
-		out = atproto.RepoCreateRecord_Output{}
-		err = c.xrpc.LexDo(ctx, "POST", "application/json", "com.atproto.repo.createRecord", nil, input, &out)
-		if err != nil {
-			err = errors.New(fmt.Sprintf("not good, failed to create %s after failing then refreshing session! first %s then %s", input.Collection, err1, err.Error()))
+	}
+	cids = make([]string, len(records))
+	for i, r := range records {
+		cid, ok := byURI[atputils.URI(*c.did, r.Collection, r.Rkey)]
+		if !ok {
+			err = fmt.Errorf("applyWrites didn't say what happened to %s", r.Rkey)
 			return
 		}
-		cid = out.Cid
-		uri = out.Uri
-		return
+		cids[i] = cid
 	}
-	cid = out.Cid
-	uri = out.Uri
 	return
 }
 
+// DeleteMyRecord deletes rkey in collection, whatever it is
+func (c *PasswordClient) DeleteMyRecord(collection string, rkey string, ctx context.Context) error {
+	input := atproto.RepoDeleteRecord_Input{
+		Repo:       *c.did,
+		Collection: collection,
+		Rkey:       rkey,
+	}
+	return c.deleteMyRecord(input, ctx)
+}
+
+// IsRejected reports whether the pds turned a write down because of what was
+// in it, which trying again won't fix
+func IsRejected(err error) bool {
+	var apiErr *client.APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest && apiErr.Name != "ExpiredToken"
+}
+
 func (c *PasswordClient) DeleteXCVRSignet(rkey string, ctx context.Context) (bool, error) {
 	getOut, err := atproto.RepoGetRecord(ctx, c.xrpc, "", "org.xcvr.lrc.signet", *c.did, rkey)
 	if err != nil {
@@ -133,32 +355,19 @@ func (c *PasswordClient) DeleteXCVRSignet(rkey string, ctx context.Context) (boo
 	}
 	err = c.deleteMyRecord(input, ctx)
 	if err != nil {
-		return false, errors.New("failed to delete")
+		return false, fmt.Errorf("failed to delete: %w", err)
 	}
 	return true, nil
 }
 
 func (c *PasswordClient) deleteMyRecord(input atproto.RepoDeleteRecord_Input, ctx context.Context) (err error) {
-	if c.accessjwt == nil {
-		err = errors.New("must create a session first")
-		return
-	}
-	c.xrpc.Headers.Set("Authorization", fmt.Sprintf("Bearer %s", *c.accessjwt))
-	var out atproto.RepoDeleteRecord_Output
-	err = c.xrpc.LexDo(ctx, "POST", "application/json", "com.atproto.repo.deleteRecord", nil, input, &out)
+	defer metrics.ObservePDSWrite(metrics.ClientPassword, "com.atproto.repo.deleteRecord", time.Now(), &err)
+	err = c.withSession(ctx, func(xrpc *client.APIClient) error {
+		var out atproto.RepoDeleteRecord_Output
+		return xrpc.LexDo(ctx, "POST", "application/json", "com.atproto.repo.deleteRecord", nil, input, &out)
+	})
 	if err != nil {
-		err1 := err.Error()
-		err = c.RefreshSession(ctx)
-		if err != nil {
-			err = errors.New(fmt.Sprintf("failed to refresh session while deleting %s! first %s then %s", input.Collection, err1, err.Error()))
-			return
-		}
-		c.xrpc.Headers.Set("Authorization", fmt.Sprintf("Bearer %s", *c.accessjwt))
-		err = c.xrpc.LexDo(ctx, "POST", "application/json", "com.atproto.repo.deleteRecord", nil, input, &out)
-		if err != nil {
-			err = errors.New(fmt.Sprintf("not good, failed to delete %s after failing then refreshing session! first %s then %s", input.Collection, err1, err.Error()))
-			return
-		}
+		err = fmt.Errorf("failed to delete %s: %w", input.Collection, err)
 	}
 	return
 }
@@ -2,25 +2,29 @@ package oauth
 
 import (
 	"context"
+	"fmt"
 	"net/url"
-	"rvcx/internal/db"
+	"rvcx/internal/config"
+	"rvcx/internal/store"
 
 	"github.com/bluesky-social/indigo/atproto/auth/oauth"
 	"github.com/bluesky-social/indigo/atproto/syntax"
-	"os"
 )
 
 type Service struct {
 	App *oauth.ClientApp
 }
 
-func NewService(store db.Store) (*Service, error) {
-	config := oauth.NewPublicConfig(getClientId(), getOauthCallback(), []string{"atproto", "transition:generic"})
-	key, err := GetPrivateKey()
+func NewService(cfg *config.Config, store store.OAuth) (*Service, error) {
+	config := oauth.NewPublicConfig(clientId(cfg), oauthCallback(cfg), []string{"atproto", "transition:generic"})
+	key, err := GetPrivateKey(cfg.ClientSecretKey)
 	if err != nil {
 		return nil, err
 	}
-	err = config.SetClientSecret(key, os.Getenv("CLIENT_SECRET_KEY_ID"))
+	err = config.SetClientSecret(key, cfg.ClientSecretKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set client secret: %w", err)
+	}
 	app := oauth.NewClientApp(&config, store)
 	return &Service{app}, nil
 }
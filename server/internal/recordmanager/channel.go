@@ -16,14 +16,14 @@ import (
 func (rm *RecordManager) AcceptChannel(c *types.Channel, ctx context.Context) error {
 	wasNew, err := rm.storeChannel(c, ctx)
 	if err != nil {
-		return errors.New("failed to store channel: " + err.Error())
+		return fmt.Errorf("failed to store channel: %w", err)
 	}
 	if !wasNew {
 		return nil
 	}
 	err = rm.initChannel(c)
 	if err != nil {
-		return errors.New("failed to initialize channel: " + err.Error())
+		return fmt.Errorf("failed to initialize channel: %w", err)
 	}
 	return nil
 }
@@ -31,11 +31,11 @@ func (rm *RecordManager) AcceptChannel(c *types.Channel, ctx context.Context) er
 func (rm *RecordManager) AcceptChannelUpdate(c *types.Channel, ctx context.Context) error {
 	err := rm.updateChanneldb(c, ctx)
 	if err != nil {
-		return errors.New("failed to update channel: " + err.Error())
+		return fmt.Errorf("failed to update channel: %w", err)
 	}
 	err = rm.updateChannelmodel(c)
 	if err != nil {
-		return errors.New("failed to update channel model: " + err.Error())
+		return fmt.Errorf("failed to update channel model: %w", err)
 	}
 	return nil
 }
@@ -43,7 +43,7 @@ func (rm *RecordManager) AcceptChannelUpdate(c *types.Channel, ctx context.Conte
 func (rm *RecordManager) AcceptChannelDelete(uri string, ctx context.Context) error {
 	err := rm.db.DeleteChannel(uri, ctx)
 	if err != nil {
-		return errors.New("failed to delete channel: " + err.Error())
+		return fmt.Errorf("failed to delete channel: %w", err)
 	}
 	return rm.broadcaster.DeleteChannel(uri)
 }
@@ -59,7 +59,7 @@ func (rm *RecordManager) PostChannel(cs *atoauth.ClientSession, ctx context.Cont
 func (rm *RecordManager) DeleteChannel(cs *atoauth.ClientSession, rkey string, ctx context.Context) error {
 	err := oauth.DeleteXCVRChannel(cs, rkey, ctx)
 	if err != nil {
-		return errors.New("failed to delete channel: " + err.Error())
+		return fmt.Errorf("failed to delete channel: %w", err)
 	}
 	return rm.AcceptChannelDelete(fmt.Sprintf("at://%s/org.xcvr.feed.channel/%s", cs.Data.AccountDID.String(), rkey), ctx)
 }
@@ -67,17 +67,17 @@ func (rm *RecordManager) DeleteChannel(cs *atoauth.ClientSession, rkey string, c
 func (rm *RecordManager) postchannelflow(f func(*lex.ChannelRecord, *time.Time, context.Context) (*types.Channel, error), ctx context.Context, pcr *types.PostChannelRequest) (did string, uri string, err error) {
 	lcr, now, err := rm.validateChannel(pcr)
 	if err != nil {
-		err = errors.New("couldn't validate channel: " + err.Error())
+		err = fmt.Errorf("couldn't validate channel: %w", err)
 		return
 	}
 	channel, err := f(lcr, now, ctx)
 	if err != nil {
-		err = errors.New("couldn't create channel: " + err.Error())
+		err = fmt.Errorf("couldn't create channel: %w", err)
 		return
 	}
 	wasNew, err := rm.storeChannel(channel, ctx)
 	if err != nil {
-		err = errors.New("couldn't store channel: " + err.Error())
+		err = fmt.Errorf("couldn't store channel: %w", err)
 		return
 	}
 	if !wasNew {
@@ -87,7 +87,7 @@ func (rm *RecordManager) postchannelflow(f func(*lex.ChannelRecord, *time.Time,
 	}
 	err = rm.initChannel(channel)
 	if err != nil {
-		err = errors.New("couldn't init channel: " + err.Error())
+		err = fmt.Errorf("couldn't init channel: %w", err)
 		return
 	}
 	did = channel.DID
@@ -115,7 +115,7 @@ func (rm *RecordManager) createChannel(cs *atoauth.ClientSession) func(*lex.Chan
 	return func(lcr *lex.ChannelRecord, now *time.Time, ctx context.Context) (*types.Channel, error) {
 		uri, cid, err := oauth.CreateXCVRChannel(cs, lcr, ctx)
 		if err != nil {
-			return nil, errors.New("something bad probs happened when posting a channel " + err.Error())
+			return nil, fmt.Errorf("something bad probs happened when posting a channel %w", err)
 		}
 		channel := types.Channel{
 			URI:       uri,
@@ -135,12 +135,12 @@ func (rm *RecordManager) createMyChannel() func(*lex.ChannelRecord, *time.Time,
 	return func(lcr *lex.ChannelRecord, now *time.Time, ctx context.Context) (*types.Channel, error) {
 		cid, uri, err := rm.myClient.CreateXCVRChannel(lcr, ctx)
 		if err != nil {
-			return nil, errors.New("something bad probs happened when posting a channel " + err.Error())
+			return nil, fmt.Errorf("something bad probs happened when posting a channel %w", err)
 		}
 		channel := types.Channel{
 			URI:       uri,
 			CID:       cid,
-			DID:       atputils.GetMyDid(),
+			DID:       rm.cfg.DID,
 			Host:      lcr.Host,
 			Title:     lcr.Title,
 			Topic:     lcr.Topic,
@@ -11,6 +11,7 @@ import (
 	"os"
 	"rvcx/internal/atputils"
 	"rvcx/internal/lex"
+	"rvcx/internal/log"
 	"rvcx/internal/oauth"
 	"rvcx/internal/types"
 	"time"
@@ -20,43 +21,34 @@ func (rm *RecordManager) PostImage(cs *atoauth.ClientSession, file multipart.Fil
 	return oauth.UploadBLOB(cs, file, fileHeader, ctx)
 }
 
-func (rm *RecordManager) AddImageToCache(did string, cid string, ctx context.Context) (string, error) {
-	ib, err := rm.db.IsBanned(did, ctx)
+// OpenBlob opens a blob from the media cache, fetching it from did's pds if
+// it isn't cached. the caller has to close it
+func (rm *RecordManager) OpenBlob(did string, cid string, ctx context.Context) (*os.File, error) {
+	ban, err := rm.bans.Ban(did, ctx)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if ib {
-		return "", errors.New("user banned")
+	if ban != nil {
+		return nil, errors.New("user banned")
 	}
-	uploadDir := "./uploads"
-	_, err = os.Stat(uploadDir)
-	if os.IsNotExist(err) {
-		os.Mkdir(uploadDir, 0755)
+	if rm.media == nil {
+		return nil, errors.New("no media cache")
 	}
+	return rm.media.Open(did, cid, ctx)
+}
 
-	imgPath := fmt.Sprintf("%s/%s%s", uploadDir, did, cid)
-	_, err = os.Stat(imgPath)
-	if err != nil {
-		blob, err := atputils.SyncGetBlob(did, cid, ctx)
-		if err != nil {
-			return "", err
-		}
-		file, err := os.Create(imgPath)
-		if err != nil {
-			return "", err
-		}
-		_, err = file.Write(blob)
-		if err != nil {
-			return "", err
-		}
-	}
-	return imgPath, nil
+// PurgeMedia drops everything did has in the media cache, call it when they
+// get banned
+func (rm *RecordManager) PurgeMedia(did string) {
+	rm.media.PurgeDid(did)
 }
 
 func (rm *RecordManager) PostMedia(cs *atoauth.ClientSession, mr *types.ParseMediaRequest, ctx context.Context) error {
 	switch mr.Type {
 	case "image":
 		return rm.postImageRecord(cs, mr, ctx)
+	case "video":
+		return rm.postVideoRecord(cs, mr, ctx)
 	default:
 		return nil
 	}
@@ -72,7 +64,7 @@ func (rm *RecordManager) AcceptImage(img *types.Image, ctx context.Context) erro
 	}
 	err = rm.forwardImage(img, ctx)
 	if err != nil {
-		return errors.New("error forwarding image: " + err.Error())
+		return fmt.Errorf("error forwarding image: %w", err)
 	}
 	return nil
 }
@@ -82,36 +74,129 @@ func (rm *RecordManager) AcceptImageUpdate(img *types.Image, ctx context.Context
 	if err != nil {
 		return err
 	}
-	return nil
+	curi, err := rm.db.GetMsgChannelURI(img.SignetURI, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get curi: %w", err)
+	}
+	return rm.broadcaster.BroadcastImageUpdate(curi, img)
 }
 
-func (rm *RecordManager) AcceptImageDelete(img *types.Image, ctx context.Context) error {
-	err := rm.db.DeleteImage(img.URI, ctx)
+// AcceptMediaDelete deletes an image or a video. deletes don't say which
+// one the record was, so we check for an image first
+func (rm *RecordManager) AcceptMediaDelete(uri string, ctx context.Context) error {
+	curi, err := rm.db.GetImageChannelURI(uri, ctx)
+	if err == nil {
+		img, err := rm.db.GetImage(uri, ctx)
+		if err == nil && img.BlobCID != nil {
+			rm.media.Purge(img.DID, *img.BlobCID)
+		}
+		err = rm.db.DeleteImage(uri, ctx)
+		if err != nil {
+			return err
+		}
+		return rm.broadcaster.BroadcastMediaDelete(curi, uri)
+	}
+	curi, err = rm.db.GetVideoChannelURI(uri, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find media: %w", err)
+	}
+	video, err := rm.db.GetVideo(uri, ctx)
+	if err == nil && video.BlobCID != nil {
+		rm.media.Purge(video.DID, *video.BlobCID)
+	}
+	err = rm.db.DeleteVideo(uri, ctx)
 	if err != nil {
 		return err
 	}
-	return nil
+	return rm.broadcaster.BroadcastMediaDelete(curi, uri)
+}
+
+// EditMedia rewrites one of the session's images or videos in their repo,
+// then stores and broadcasts the new version without waiting for jetstream
+func (rm *RecordManager) EditMedia(cs *atoauth.ClientSession, emr *types.EditMediaRequest, ctx context.Context) error {
+	did := cs.Data.AccountDID.String()
+	ctx = log.WithAttrs(ctx, "did", did, "uri", emr.URI)
+	rkey, err := ownRkey(did, "org.xcvr.lrc.media", emr.URI)
+	if err != nil {
+		return err
+	}
+	mr, swap, err := oauth.GetXCVRMedia(cs, rkey, ctx)
+	if err != nil {
+		return err
+	}
+	if emr.Alt != nil {
+		switch {
+		case mr.Image != nil:
+			mr.Image.Alt = *emr.Alt
+		case mr.Video != nil:
+			mr.Video.Alt = *emr.Alt
+		}
+	}
+	if emr.Nick != nil {
+		if atputils.ValidateLength(*emr.Nick, 16) {
+			return errors.New("that nick is too long")
+		}
+		mr.Nick = emr.Nick
+	}
+	if emr.Color != nil {
+		color := uint64(*emr.Color)
+		if color > 16777215 {
+			return errors.New("that color is too big")
+		}
+		mr.Color = &color
+	}
+	rm.log.DebugContext(ctx, "rewriting media in pds")
+	uri, cid, err := oauth.UpdateXCVRMedia(cs, rkey, mr, swap, ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case mr.Image != nil:
+		return rm.AcceptImageUpdate(imageFromRecord(uri, cid, did, mr), ctx)
+	case mr.Video != nil:
+		return rm.AcceptVideoUpdate(videoFromRecord(uri, cid, did, mr), ctx)
+	default:
+		return nil
+	}
+}
+
+// DeleteMedia deletes one of the session's images or videos from their repo
+// and from ours
+func (rm *RecordManager) DeleteMedia(cs *atoauth.ClientSession, uri string, ctx context.Context) error {
+	did := cs.Data.AccountDID.String()
+	ctx = log.WithAttrs(ctx, "did", did, "uri", uri)
+	rkey, err := ownRkey(did, "org.xcvr.lrc.media", uri)
+	if err != nil {
+		return err
+	}
+	rm.log.DebugContext(ctx, "deleting media from pds")
+	err = oauth.DeleteXCVRMedia(cs, rkey, ctx)
+	if err != nil {
+		return err
+	}
+	return rm.AcceptMediaDelete(uri, ctx)
 }
 
 func (rm *RecordManager) postImageRecord(cs *atoauth.ClientSession, mr *types.ParseMediaRequest, ctx context.Context) error {
-	imr, now, err := rm.validateImageRecord(mr, ctx)
+	mr.Video = nil
+	imr, now, err := rm.validateMediaRecord(mr, ctx)
 	if err != nil {
-		return errors.New("coudlnt validate media record: " + err.Error())
+		return fmt.Errorf("coudlnt validate media record: %w", err)
 	}
 	img, err := rm.createImageRecord(cs, imr, now, ctx)
 	if err != nil {
-		return errors.New("coudlnt validate media record: " + err.Error())
+		return fmt.Errorf("coudlnt validate media record: %w", err)
 	}
 	wasNew, err := rm.db.StoreImage(img, ctx)
 	if err != nil {
-		return errors.New("beeped that up!: " + err.Error())
+		return fmt.Errorf("beeped that up!: %w", err)
 	}
 	if !wasNew {
 		return nil
 	}
 	err = rm.forwardImage(img, ctx)
 	if err != nil {
-		return errors.New("YIEKRSa, " + err.Error())
+		return fmt.Errorf("YIEKRSa, %w", err)
 	}
 	return nil
 }
@@ -119,12 +204,12 @@ func (rm *RecordManager) postImageRecord(cs *atoauth.ClientSession, mr *types.Pa
 func (rm *RecordManager) forwardImage(i *types.Image, ctx context.Context) error {
 	curi, err := rm.db.GetMsgChannelURI(i.SignetURI, ctx)
 	if err != nil {
-		return errors.New("failed to get curi: " + err.Error())
+		return fmt.Errorf("failed to get curi: %w", err)
 	}
 	return rm.broadcaster.BroadcastImage(curi, i)
 }
 
-func (rm *RecordManager) validateImageRecord(mr *types.ParseMediaRequest, ctx context.Context) (*lex.MediaRecord, *time.Time, error) {
+func (rm *RecordManager) validateMediaRecord(mr *types.ParseMediaRequest, ctx context.Context) (*lex.MediaRecord, *time.Time, error) {
 	var imr lex.MediaRecord
 	if mr.SignetURI == nil {
 		if mr.ChannelURI == nil || mr.MessageID == nil {
@@ -144,6 +229,7 @@ func (rm *RecordManager) validateImageRecord(mr *types.ParseMediaRequest, ctx co
 		imr.Color = &cnum
 	}
 	imr.Image = mr.Image
+	imr.Video = mr.Video
 	nowsyn := syntax.DatetimeNow()
 	imr.PostedAt = nowsyn.String()
 	nt := nowsyn.Time()
@@ -154,7 +240,7 @@ func (rm *RecordManager) validateImageRecord(mr *types.ParseMediaRequest, ctx co
 func (rm *RecordManager) createImageRecord(cs *atoauth.ClientSession, imr *lex.MediaRecord, now *time.Time, ctx context.Context) (*types.Image, error) {
 	uri, cid, err := oauth.CreateXCVRMedia(cs, imr, ctx)
 	if err != nil {
-		return nil, errors.New("beeped up: " + err.Error())
+		return nil, fmt.Errorf("beeped up: %w", err)
 	}
 	var img types.Image
 	img.URI = uri
@@ -181,3 +267,37 @@ func (rm *RecordManager) createImageRecord(cs *atoauth.ClientSession, imr *lex.M
 	}
 	return &img, nil
 }
+
+// imageFromRecord is the image mr describes, for when it's already been
+// written
+func imageFromRecord(uri string, cid string, did string, mr *lex.MediaRecord) *types.Image {
+	then, err := syntax.ParseDatetimeTime(mr.PostedAt)
+	if err != nil {
+		then = time.Now()
+	}
+	img := types.Image{
+		URI:       uri,
+		DID:       did,
+		SignetURI: mr.SignetURI,
+		Alt:       mr.Image.Alt,
+		Nick:      mr.Nick,
+		CID:       cid,
+		PostedAt:  then,
+	}
+	if mr.Image.Blob != nil {
+		img.BlobMIME = &mr.Image.Blob.MimeType
+		icid := mr.Image.Blob.Ref.String()
+		img.BlobCID = &icid
+	}
+	if mr.Image.AspectRatio != nil {
+		w := mr.Image.AspectRatio.Width
+		h := mr.Image.AspectRatio.Height
+		img.Width = &w
+		img.Height = &h
+	}
+	if mr.Color != nil {
+		c := uint32(*mr.Color)
+		img.Color = &c
+	}
+	return &img
+}
@@ -3,13 +3,16 @@ package recordmanager
 import (
 	"context"
 	"errors"
+	"fmt"
 	atoauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
 	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/lex/util"
 	"github.com/rachel-mp4/lrcd"
-	"os"
 	"rvcx/internal/atputils"
 	"rvcx/internal/lex"
+	"rvcx/internal/log"
 	"rvcx/internal/oauth"
+	"rvcx/internal/store"
 	"rvcx/internal/types"
 	"slices"
 	"time"
@@ -18,45 +21,142 @@ import (
 func (rm *RecordManager) AcceptMessage(m *types.Message, ctx context.Context) error {
 	wasNew, err := rm.storeMessage(m, ctx)
 	if err != nil {
-		return errors.New("failed to store message: " + err.Error())
+		return fmt.Errorf("failed to store message: %w", err)
 	}
 	if !wasNew {
 		return nil
 	}
 	err = rm.forwardMessage(m, ctx)
 	if err != nil {
-		return errors.New("failed to forward message: " + err.Error())
+		return fmt.Errorf("failed to forward message: %w", err)
 	}
 	return nil
 }
 
+// AcceptMessageUpdate stores a new version of a message and tells its
+// channel. if we never saw the message in the first place, it's accepted as
+// though it were new
 func (rm *RecordManager) AcceptMessageUpdate(m *types.Message, did string, ctx context.Context) error {
-	err := rm.updateMessage(m, ctx)
+	err := rm.acceptMessageUpdate(m, ctx)
 	if err != nil {
-		return errors.New("failed to store message: " + err.Error())
+		return err
 	}
 	err = rm.checkInterference(m, did, ctx)
 	if err != nil {
-		return errors.New("error while checking interference: " + err.Error())
+		return fmt.Errorf("error while checking interference: %w", err)
 	}
 	return nil
 }
 
-func (rm *RecordManager) AcceptMessageDelete(uri string, ctx context.Context) error {
-	err := rm.db.DeleteMessage(uri, ctx)
+func (rm *RecordManager) acceptMessageUpdate(m *types.Message, ctx context.Context) error {
+	edited, err := rm.db.UpdateMessage(m, ctx)
+	if errors.Is(err, store.ErrNotFound) {
+		return rm.AcceptMessage(m, ctx)
+	}
 	if err != nil {
-		return errors.New("failed to delete message: " + err.Error())
+		return fmt.Errorf("failed to store message: %w", err)
+	}
+	if !edited {
+		return nil
+	}
+	err = rm.forwardMessageUpdate(m, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to forward message update: %w", err)
 	}
 	return nil
 }
 
+func (rm *RecordManager) AcceptMessageDelete(uri string, ctx context.Context) error {
+	curi, err := rm.db.GetMessageChannelURI(uri, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find message: %w", err)
+	}
+	err = rm.db.DeleteMessage(uri, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete message: %w", err)
+	}
+	return rm.broadcaster.BroadcastMessageDelete(curi, uri)
+}
+
+// EditMessage rewrites one of the session's messages in their repo, then
+// stores and broadcasts the new version without waiting for jetstream to
+// bring it back around
+func (rm *RecordManager) EditMessage(cs *atoauth.ClientSession, emr *types.EditMessageRequest, ctx context.Context) error {
+	did := cs.Data.AccountDID.String()
+	ctx = log.WithAttrs(ctx, "did", did, "uri", emr.URI)
+	rkey, err := ownRkey(did, "org.xcvr.lrc.message", emr.URI)
+	if err != nil {
+		return err
+	}
+	lmr, swap, err := oauth.GetXCVRMessage(cs, rkey, ctx)
+	if err != nil {
+		return err
+	}
+	lmr.Body = emr.Body
+	if emr.Nick != nil {
+		if atputils.ValidateLength(*emr.Nick, 16) {
+			return errors.New("that nick is too long")
+		}
+		lmr.Nick = emr.Nick
+	}
+	if emr.Color != nil {
+		color := uint64(*emr.Color)
+		if color > 16777215 {
+			return errors.New("that color is too big")
+		}
+		lmr.Color = &color
+	}
+	rm.log.DebugContext(ctx, "rewriting message in pds")
+	uri, cid, err := oauth.UpdateXCVRMessage(cs, rkey, lmr, swap, ctx)
+	if err != nil {
+		return err
+	}
+	then, err := syntax.ParseDatetimeTime(lmr.PostedAt)
+	if err != nil {
+		then = time.Now()
+	}
+	var coloruint32ptr *uint32
+	if lmr.Color != nil {
+		color := uint32(*lmr.Color)
+		coloruint32ptr = &color
+	}
+	m := &types.Message{
+		URI:       uri,
+		DID:       did,
+		CID:       cid,
+		SignetURI: lmr.SignetURI,
+		Body:      lmr.Body,
+		Nick:      lmr.Nick,
+		Color:     coloruint32ptr,
+		PostedAt:  then,
+	}
+	return rm.acceptMessageUpdate(m, ctx)
+}
+
+// DeleteMessage deletes one of the session's messages from their repo and
+// from ours
+func (rm *RecordManager) DeleteMessage(cs *atoauth.ClientSession, uri string, ctx context.Context) error {
+	did := cs.Data.AccountDID.String()
+	ctx = log.WithAttrs(ctx, "did", did, "uri", uri)
+	rkey, err := ownRkey(did, "org.xcvr.lrc.message", uri)
+	if err != nil {
+		return err
+	}
+	rm.log.DebugContext(ctx, "deleting message from pds")
+	err = oauth.DeleteXCVRMessage(cs, rkey, ctx)
+	if err != nil {
+		return err
+	}
+	return rm.AcceptMessageDelete(uri, ctx)
+}
+
 func (rm *RecordManager) checkInterference(m *types.Message, did string, ctx context.Context) error {
 	handle, err := rm.db.QuerySignetHandle(m.SignetURI, ctx)
 	if err != nil {
 		return errors.New("couldn't find signet")
 	}
 	sdid, err := atputils.DidFromUri(m.SignetURI)
-	if sdid != atputils.GetMyDid() {
+	if sdid != rm.cfg.DID {
 		return nil
 	}
 	mhandle, err := rm.db.ResolveDid(did, ctx)
@@ -74,28 +174,30 @@ func (rm *RecordManager) checkInterference(m *types.Message, did string, ctx con
 }
 
 func (rm *RecordManager) PostMessage(cs *atoauth.ClientSession, ctx context.Context, pmr *types.PostMessageRequest) error {
-	rm.log.Deprintln("validate")
+	ctx = log.WithAttrs(ctx, "did", cs.Data.AccountDID.String())
+	rm.log.DebugContext(ctx, "validating message")
 	lmr, now, _, _, err := rm.validateMessage(pmr, ctx)
 	if err != nil {
-		return errors.New("failed to validate message: " + err.Error())
+		return fmt.Errorf("failed to validate message: %w", err)
 	}
-	rm.log.Deprintln("create")
+	ctx = log.WithAttrs(ctx, "signet", lmr.SignetURI)
+	rm.log.DebugContext(ctx, "writing message to pds")
 	m, err := rm.createMessage(cs, lmr, now, ctx)
 	if err != nil {
-		return errors.New("failed to create message: " + err.Error())
+		return fmt.Errorf("failed to create message: %w", err)
 	}
-	rm.log.Deprintln("store")
+	ctx = log.WithAttrs(ctx, "uri", m.URI)
+	rm.log.DebugContext(ctx, "storing message")
 	wasNew, err := rm.storeMessage(m, ctx)
 	if err != nil {
-		return errors.New("failed to store message: " + err.Error())
+		return fmt.Errorf("failed to store message: %w", err)
 	}
 	if !wasNew {
 		return nil
 	}
-	rm.log.Deprintln("forward")
 	err = rm.forwardMessage(m, ctx)
 	if err != nil {
-		return errors.New("failed to forward message: " + err.Error())
+		return fmt.Errorf("failed to forward message: %w", err)
 	}
 	return nil
 }
@@ -103,49 +205,59 @@ func (rm *RecordManager) PostMessage(cs *atoauth.ClientSession, ctx context.Cont
 func (rm *RecordManager) PostMyMessage(ctx context.Context, pmr *types.PostMessageRequest) error {
 	lmr, now, handle, nonce, err := rm.validateMessage(pmr, ctx)
 	if err != nil {
-		return errors.New("failed to validate message: " + err.Error())
+		return fmt.Errorf("failed to validate message: %w", err)
 	}
+	ctx = log.WithAttrs(ctx, "signet", lmr.SignetURI)
 	err = rm.validateHandleAndNonce(handle, nonce, lmr.SignetURI, ctx)
 	if err != nil {
-		return errors.New("failed to validate my handle and nonce: " + err.Error())
+		return fmt.Errorf("failed to validate my handle and nonce: %w", err)
 	}
+	rm.log.DebugContext(ctx, "queueing message for my pds")
 	m, err := rm.createMyMessage(lmr, now, ctx)
 	if err != nil {
-		return errors.New("failed to create message: " + err.Error())
+		return fmt.Errorf("failed to create message: %w", err)
 	}
+	ctx = log.WithAttrs(ctx, "uri", m.URI)
+	rm.log.DebugContext(ctx, "storing message")
 	wasNew, err := rm.storeMessage(m, ctx)
 	if err != nil {
-		return errors.New("failed to store message: " + err.Error())
+		return fmt.Errorf("failed to store message: %w", err)
 	}
 	if !wasNew {
 		return nil
 	}
 	err = rm.forwardMessage(m, ctx)
 	if err != nil {
-		return errors.New("failed to forward message: " + err.Error())
+		return fmt.Errorf("failed to forward message: %w", err)
 	}
 	return nil
 }
 
 func (rm *RecordManager) validateHandleAndNonce(handle *string, nonce []byte, signetUri string, ctx context.Context) error {
-	if handle == nil || *handle != atputils.GetMyHandle() {
+	if handle == nil || *handle != rm.cfg.Identity {
 		return errors.New("i only post my messages")
 	}
+	author, err := rm.db.QuerySignetDid(signetUri, ctx)
+	if err == nil && rm.bans.IsBanned(author, ctx) {
+		return errors.New("signet author is banned")
+	}
 	curi, mid, err := rm.db.QuerySignetChannelIdNum(signetUri, ctx)
 	if err != nil {
 		return errors.New("failed to find signet")
 	}
-	correctNonce := lrcd.GenerateNonce(mid, curi, os.Getenv("LRCD_SECRET"))
+	correctNonce := lrcd.GenerateNonce(mid, curi, rm.cfg.LrcdSecret)
 	if !slices.Equal(nonce, correctNonce) {
 		return errors.New("i think user tried to post someone else's post")
 	}
 	return nil
 }
 
+// createMyMessage queues lmr to be written to my repo. like with signets,
+// the message it returns has no cid until the write lands
 func (rm *RecordManager) createMyMessage(lmr *lex.MessageRecord, now *time.Time, ctx context.Context) (*types.Message, error) {
-	cid, uri, err := rm.myClient.CreateXCVRMessage(lmr, ctx)
+	uri, err := rm.enqueueWrite("org.xcvr.lrc.message", &util.LexiconTypeDecoder{Val: lmr}, &lmr.SignetURI, ctx)
 	if err != nil {
-		return nil, errors.New("couldn't add to user repo: " + err.Error())
+		return nil, fmt.Errorf("couldn't queue message: %w", err)
 	}
 	var coloruint32ptr *uint32
 	if lmr.Color != nil {
@@ -154,8 +266,7 @@ func (rm *RecordManager) createMyMessage(lmr *lex.MessageRecord, now *time.Time,
 	}
 	message := &types.Message{
 		URI:       uri,
-		DID:       atputils.GetMyDid(),
-		CID:       cid,
+		DID:       rm.cfg.DID,
 		SignetURI: lmr.SignetURI,
 		Body:      lmr.Body,
 		Nick:      lmr.Nick,
@@ -168,7 +279,7 @@ func (rm *RecordManager) createMyMessage(lmr *lex.MessageRecord, now *time.Time,
 func (rm *RecordManager) createMessage(cs *atoauth.ClientSession, lmr *lex.MessageRecord, now *time.Time, ctx context.Context) (*types.Message, error) {
 	uri, cid, err := oauth.CreateXCVRMessage(cs, lmr, ctx)
 	if err != nil {
-		return nil, errors.New("couldn't add to user repo: " + err.Error())
+		return nil, fmt.Errorf("couldn't add to user repo: %w", err)
 	}
 	var coloruint32ptr *uint32
 	if lmr.Color != nil {
@@ -188,10 +299,6 @@ func (rm *RecordManager) createMessage(cs *atoauth.ClientSession, lmr *lex.Messa
 	return message, nil
 }
 
-func (rm *RecordManager) updateMessage(m *types.Message, ctx context.Context) error {
-	return rm.db.UpdateMessage(m, ctx)
-}
-
 func (rm *RecordManager) storeMessage(m *types.Message, ctx context.Context) (wasNew bool, err error) {
 	return rm.db.StoreMessage(m, ctx)
 }
@@ -199,11 +306,21 @@ func (rm *RecordManager) storeMessage(m *types.Message, ctx context.Context) (wa
 func (rm *RecordManager) forwardMessage(m *types.Message, ctx context.Context) error {
 	curi, err := rm.db.GetMsgChannelURI(m.SignetURI, ctx)
 	if err != nil {
-		return errors.New("aaaaaaaaaaaa " + err.Error())
+		return fmt.Errorf("aaaaaaaaaaaa %w", err)
 	}
+	rm.log.DebugContext(log.WithAttrs(ctx, "channel", curi), "broadcasting message")
 	return rm.broadcaster.BroadcastMessage(curi, m)
 }
 
+func (rm *RecordManager) forwardMessageUpdate(m *types.Message, ctx context.Context) error {
+	curi, err := rm.db.GetMsgChannelURI(m.SignetURI, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find channel: %w", err)
+	}
+	rm.log.DebugContext(log.WithAttrs(ctx, "channel", curi), "broadcasting message update")
+	return rm.broadcaster.BroadcastMessageUpdate(curi, m)
+}
+
 func (rm *RecordManager) validateMessage(mr *types.PostMessageRequest, ctx context.Context) (lmr *lex.MessageRecord, now *time.Time, handle *string, nonce []byte, err error) {
 	lmr = &lex.MessageRecord{}
 	if mr.SignetURI == nil {
@@ -213,7 +330,7 @@ func (rm *RecordManager) validateMessage(mr *types.PostMessageRequest, ctx conte
 		}
 		signetUri, signetHandle, yorks := rm.db.QuerySignet(*mr.ChannelURI, *mr.MessageID, ctx)
 		if yorks != nil {
-			err = errors.New("i couldn't find the signet :c : " + yorks.Error())
+			err = fmt.Errorf("i couldn't find the signet :c : %w", yorks)
 			return
 		}
 		mr.SignetURI = &signetUri
@@ -221,7 +338,7 @@ func (rm *RecordManager) validateMessage(mr *types.PostMessageRequest, ctx conte
 	} else {
 		signetHandle, yorks := rm.db.QuerySignetHandle(*mr.SignetURI, ctx)
 		if yorks != nil {
-			err = errors.New("yorks skooby 💀" + yorks.Error())
+			err = fmt.Errorf("yorks skooby 💀%w", yorks)
 			return
 		}
 		handle = &signetHandle
@@ -0,0 +1,190 @@
+package recordmanager
+
+import (
+	"context"
+	"errors"
+	"rvcx/internal/memstore"
+	"rvcx/internal/types"
+	"slices"
+	"testing"
+	"time"
+)
+
+const (
+	testChannel = "at://did:plc:there/org.xcvr.feed.channel/a"
+	testSignet  = "at://did:plc:there/org.xcvr.lrc.signet/s"
+	testMessage = "at://did:plc:alice/org.xcvr.lrc.message/m"
+)
+
+// seedChannel stores a channel hosted elsewhere with alice in it, so that
+// jetstream can deliver her records
+func seedChannel(t *testing.T, s *memstore.Store) {
+	t.Helper()
+	ctx := context.Background()
+	_, err := s.StoreChannel(&types.Channel{URI: testChannel, Host: "did:plc:there"}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for did, handle := range map[string]string{"did:plc:alice": "alice.test", "did:plc:there": "there.test"} {
+		err = s.StoreDidHandle(did, handle, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.InitializeProfile("did:plc:alice", nil, nil, nil, nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testSignetRecord() *types.Signet {
+	handle := "alice.test"
+	return &types.Signet{
+		URI:          testSignet,
+		IssuerDID:    "did:plc:there",
+		Author:       "did:plc:alice",
+		AuthorHandle: &handle,
+		ChannelURI:   testChannel,
+		MessageID:    1,
+		CID:          "sig",
+		StartedAt:    time.Now(),
+	}
+}
+
+func testMessageRecord(body string, cid string) *types.Message {
+	return &types.Message{
+		URI:       testMessage,
+		DID:       "did:plc:alice",
+		SignetURI: testSignet,
+		Body:      body,
+		CID:       cid,
+		PostedAt:  time.Now(),
+	}
+}
+
+// jetstream replays records after a reconnect, and backfill goes over ones we
+// already have, so accepting something twice can't broadcast it twice
+func TestAcceptIsIdempotent(t *testing.T) {
+	rm, s, _, b := newTestRecordManager(t)
+	seedChannel(t, s)
+	ctx := context.Background()
+	for range 2 {
+		err := rm.AcceptSignet(testSignetRecord(), ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rm.AcceptMessage(testMessageRecord("hi", "a"), ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = rm.AcceptMessageUpdate(testMessageRecord("hi", "a"), "did:plc:alice", ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := rm.AcceptMessageUpdate(testMessageRecord("hello", "b"), "did:plc:alice", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"signet " + testChannel + " " + testSignet,
+		"message " + testChannel + " " + testMessage,
+		"messageUpdate " + testChannel + " " + testMessage,
+	}
+	if got := b.broadcast(); !slices.Equal(got, want) {
+		t.Errorf("broadcast\n%v\nwant\n%v", got, want)
+	}
+	msgs, err := s.GetMessages(testChannel, 10, nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 || msgs[0].Body != "hello" || !msgs[0].Edited {
+		t.Errorf("stored %+v, want just the edited message", msgs)
+	}
+	revisions, err := s.GetMessageRevisions(testMessage, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 {
+		t.Errorf("got %d revisions, want the one from before the edit", len(revisions))
+	}
+}
+
+// a message update for a message we never saw is just a new message
+func TestAcceptMessageUpdateOfUnknownMessage(t *testing.T) {
+	rm, s, _, b := newTestRecordManager(t)
+	seedChannel(t, s)
+	ctx := context.Background()
+	err := rm.AcceptSignet(testSignetRecord(), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rm.AcceptMessageUpdate(testMessageRecord("hi", "a"), "did:plc:alice", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"signet " + testChannel + " " + testSignet,
+		"message " + testChannel + " " + testMessage,
+	}
+	if got := b.broadcast(); !slices.Equal(got, want) {
+		t.Errorf("broadcast\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestAcceptDeletes(t *testing.T) {
+	rm, s, _, b := newTestRecordManager(t)
+	seedChannel(t, s)
+	ctx := context.Background()
+	err := rm.AcceptSignet(testSignetRecord(), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rm.AcceptMessage(testMessageRecord("hi", "a"), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rm.AcceptMessageDelete(testMessage, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rm.AcceptSignetDelete(testSignet, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rm.AcceptMessageDelete(testMessage, ctx)
+	if err == nil {
+		t.Error("deleted a message that was already gone")
+	}
+	want := []string{
+		"signet " + testChannel + " " + testSignet,
+		"message " + testChannel + " " + testMessage,
+		"messageDelete " + testChannel + " " + testMessage,
+		"signetDelete " + testChannel + " " + testSignet,
+	}
+	if got := b.broadcast(); !slices.Equal(got, want) {
+		t.Errorf("broadcast\n%v\nwant\n%v", got, want)
+	}
+	msgs, err := s.GetMessages(testChannel, 10, nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("still have %d messages", len(msgs))
+	}
+}
+
+func TestOwnRkey(t *testing.T) {
+	rkey, err := ownRkey("did:plc:alice", "org.xcvr.lrc.message", testMessage)
+	if err != nil || rkey != "m" {
+		t.Errorf("got %q, %v for alice's own message", rkey, err)
+	}
+	_, err = ownRkey("did:plc:bob", "org.xcvr.lrc.message", testMessage)
+	if !errors.Is(err, ErrNotYours) {
+		t.Errorf("bob got %v for alice's message, want ErrNotYours", err)
+	}
+	_, err = ownRkey("did:plc:alice", "org.xcvr.lrc.media", testMessage)
+	if !errors.Is(err, ErrNotYours) {
+		t.Errorf("got %v for a message passed off as media, want ErrNotYours", err)
+	}
+}
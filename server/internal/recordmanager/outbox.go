@@ -0,0 +1,349 @@
+package recordmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/lex/util"
+	"rvcx/internal/atputils"
+	"rvcx/internal/lex"
+	"rvcx/internal/log"
+	"rvcx/internal/metrics"
+	"rvcx/internal/oauth"
+	"rvcx/internal/store"
+	"rvcx/internal/types"
+	"slices"
+	"time"
+)
+
+const (
+	// outboxPoll is how often the outbox looks for writes that have come due
+	// without being kicked
+	outboxPoll  = 5 * time.Second
+	outboxBatch = 50
+	// a write is given up on after outboxAttempts tries, which with the
+	// backoff below is a little over half an hour
+	outboxAttempts   = 10
+	outboxMinBackoff = 5 * time.Second
+	outboxMaxBackoff = 10 * time.Minute
+	// signets are written in applyWrites batches of up to signetBatch, and
+	// the outbox waits outboxWindow after being kicked so that a burst of
+	// them can pile up first
+	signetBatch  = 25
+	outboxWindow = 200 * time.Millisecond
+)
+
+// enqueueWrite puts a write of record to collection in my repo in the outbox,
+// and returns the uri it will have once it lands. the rkey is picked here
+// rather than by my pds so that the record can be stored and broadcast
+// before then. if after is set, the write waits for the write for that uri
+// to land first
+func (rm *RecordManager) enqueueWrite(collection string, record *util.LexiconTypeDecoder, after *string, ctx context.Context) (string, error) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal record: %w", err)
+	}
+	rkey := rm.tids.Next().String()
+	item := types.OutboxItem{
+		URI:        atputils.URI(rm.cfg.DID, collection, rkey),
+		Collection: collection,
+		Rkey:       rkey,
+		Record:     b,
+		After:      after,
+	}
+	err = rm.db.EnqueueWrite(&item, ctx)
+	if err != nil {
+		return "", err
+	}
+	rm.kickOutbox()
+	return item.URI, nil
+}
+
+func (rm *RecordManager) kickOutbox() {
+	select {
+	case rm.kick <- struct{}{}:
+	default:
+	}
+}
+
+// RunOutbox writes whatever is in the outbox to my pds until ctx is done.
+// anything left over is still there next time
+func (rm *RecordManager) RunOutbox(ctx context.Context) {
+	ticker := time.NewTicker(outboxPoll)
+	defer ticker.Stop()
+	for {
+		rm.flushOutbox(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-rm.kick:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(outboxWindow):
+			}
+		}
+	}
+}
+
+func (rm *RecordManager) flushOutbox(ctx context.Context) {
+	// held is the uris of writes that didn't land this time around. anything
+	// that comes after one of them waits, GetDueWrites keeps it back from
+	// then on
+	held := make(map[string]bool)
+	for ctx.Err() == nil {
+		items, err := rm.db.GetDueWrites(time.Now(), outboxBatch, ctx)
+		if err != nil {
+			rm.log.ErrorContext(ctx, "failed to get due writes", "err", err)
+			return
+		}
+		// writes go out in the order they were queued, a message must not
+		// land before its signet or ingesters won't have anything to hang it
+		// off of. runs of signets in between are batched
+		signets := make([]types.OutboxItem, 0, len(items))
+		flushSignets := func() {
+			for batch := range slices.Chunk(signets, signetBatch) {
+				for _, uri := range rm.attemptBatch(batch, ctx) {
+					held[uri] = true
+				}
+			}
+			signets = signets[:0]
+		}
+		for _, item := range items {
+			if item.Collection == "org.xcvr.lrc.signet" {
+				signets = append(signets, item)
+				continue
+			}
+			flushSignets()
+			if item.After != nil && held[*item.After] {
+				rm.log.DebugContext(ctx, "holding write back", "uri", item.URI, "after", *item.After)
+				held[item.URI] = true
+				continue
+			}
+			if !rm.attemptWrite(&item, ctx) {
+				held[item.URI] = true
+			}
+		}
+		flushSignets()
+		if len(items) < outboxBatch {
+			return
+		}
+	}
+}
+
+// attemptBatch creates every write in batch at once. if that doesn't work
+// they're each tried on their own, which finds out which of them is the
+// problem, and copes with the batch having landed after all. it returns the
+// uris of the writes that didn't land
+func (rm *RecordManager) attemptBatch(batch []types.OutboxItem, ctx context.Context) []string {
+	var unlanded []string
+	records := make([]oauth.MyRecord, 0, len(batch))
+	good := make([]types.OutboxItem, 0, len(batch))
+	for _, item := range batch {
+		var record util.LexiconTypeDecoder
+		err := json.Unmarshal(item.Record, &record)
+		if err != nil {
+			rm.failWrite(&item, fmt.Errorf("failed to unmarshal record: %w", err), log.WithAttrs(ctx, "uri", item.URI))
+			unlanded = append(unlanded, item.URI)
+			continue
+		}
+		records = append(records, oauth.MyRecord{Collection: item.Collection, Rkey: item.Rkey, Record: &record})
+		good = append(good, item)
+	}
+	attemptEach := func() []string {
+		for _, item := range good {
+			if !rm.attemptWrite(&item, ctx) {
+				unlanded = append(unlanded, item.URI)
+			}
+		}
+		return unlanded
+	}
+	if len(good) <= 1 {
+		return attemptEach()
+	}
+	cids, err := rm.myClient.CreateMyRecords(records, ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			for _, item := range good {
+				unlanded = append(unlanded, item.URI)
+			}
+			return unlanded
+		}
+		rm.log.WarnContext(ctx, "failed to write batch, trying one at a time", "err", err, "size", len(good))
+		return attemptEach()
+	}
+	metrics.OutboxWrites.WithLabelValues("written").Add(float64(len(good)))
+	for i, item := range good {
+		rm.completeWrite(&item, cids[i], log.WithAttrs(ctx, "uri", item.URI))
+	}
+	return unlanded
+}
+
+// attemptWrite writes item, and reports whether it landed
+func (rm *RecordManager) attemptWrite(item *types.OutboxItem, ctx context.Context) bool {
+	ctx = log.WithAttrs(ctx, "uri", item.URI, "attempt", item.Attempts+1)
+	var record util.LexiconTypeDecoder
+	err := json.Unmarshal(item.Record, &record)
+	if err != nil {
+		rm.failWrite(item, fmt.Errorf("failed to unmarshal record: %w", err), ctx)
+		return false
+	}
+	cid, err := rm.myClient.PutMyRecord(item.Collection, item.Rkey, &record, ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		if oauth.IsRejected(err) || item.Attempts+1 >= outboxAttempts {
+			rm.failWrite(item, err, ctx)
+			return false
+		}
+		next := time.Now().Add(outboxBackoff(item.Attempts + 1))
+		rm.log.WarnContext(ctx, "failed to write, will try again", "err", err, "next", next)
+		metrics.OutboxWrites.WithLabelValues("deferred").Inc()
+		err = rm.db.DeferWrite(item.Id, err.Error(), next, ctx)
+		if err != nil {
+			rm.log.ErrorContext(ctx, "failed to defer write", "err", err)
+		}
+		return false
+	}
+	metrics.OutboxWrites.WithLabelValues("written").Inc()
+	rm.completeWrite(item, cid, ctx)
+	return true
+}
+
+// completeWrite records that item landed with cid
+func (rm *RecordManager) completeWrite(item *types.OutboxItem, cid string, ctx context.Context) {
+	err := rm.db.CompleteWrite(item.Id, cid, ctx)
+	if errors.Is(err, store.ErrNotFound) {
+		// it was cancelled while it was being written, so the record
+		// shouldn't be there
+		rm.log.DebugContext(ctx, "write was cancelled, deleting it")
+		err = rm.myClient.DeleteMyRecord(item.Collection, item.Rkey, ctx)
+	}
+	if err != nil {
+		rm.log.ErrorContext(ctx, "failed to complete write", "err", err)
+		return
+	}
+	rm.announceWrite(item, cid, ctx)
+}
+
+func (rm *RecordManager) failWrite(item *types.OutboxItem, cause error, ctx context.Context) {
+	rm.log.ErrorContext(ctx, "giving up on write", "err", cause)
+	metrics.OutboxWrites.WithLabelValues("failed").Inc()
+	err := rm.db.FailWrite(item.Id, cause.Error(), ctx)
+	if err != nil {
+		rm.log.ErrorContext(ctx, "failed to fail write", "err", err)
+		return
+	}
+	rm.announceWrite(item, "", ctx)
+	// whatever was waiting on it would point at a record that isn't there
+	dependents, err := rm.db.FailWritesAfter(item.URI, "gave up on "+item.URI, ctx)
+	if err != nil {
+		rm.log.ErrorContext(ctx, "failed to fail writes after it", "err", err)
+		return
+	}
+	for _, d := range dependents {
+		rm.log.WarnContext(ctx, "giving up on write after it", "dependent", d.URI)
+		metrics.OutboxWrites.WithLabelValues("failed").Inc()
+		rm.announceWrite(&d, "", ctx)
+	}
+}
+
+// announceWrite tells clients that item isn't pending anymore. it either
+// landed with cid, or if there's no cid, it was given up on
+func (rm *RecordManager) announceWrite(item *types.OutboxItem, cid string, ctx context.Context) {
+	var err error
+	switch item.Collection {
+	case "org.xcvr.lrc.signet":
+		err = rm.announceSignet(item, cid, ctx)
+	case "org.xcvr.lrc.message":
+		err = rm.announceMessage(item, cid, ctx)
+	}
+	if err != nil {
+		rm.log.WarnContext(ctx, "failed to announce write", "err", err)
+	}
+}
+
+func (rm *RecordManager) announceSignet(item *types.OutboxItem, cid string, ctx context.Context) error {
+	var lsr lex.SignetRecord
+	err := json.Unmarshal(item.Record, &lsr)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal signet: %w", err)
+	}
+	if cid == "" {
+		return rm.broadcaster.BroadcastWriteFailed(lsr.ChannelURI, item.URI)
+	}
+	signet := &types.Signet{
+		URI:          item.URI,
+		IssuerDID:    rm.cfg.DID,
+		Author:       lsr.Author,
+		AuthorHandle: lsr.AuthorHandle,
+		ChannelURI:   lsr.ChannelURI,
+		MessageID:    uint32(lsr.LRCID),
+		CID:          cid,
+	}
+	if lsr.StartedAt != nil {
+		signet.StartedAt, err = syntax.ParseDatetimeTime(*lsr.StartedAt)
+		if err != nil {
+			return fmt.Errorf("signet has a strange startedAt: %w", err)
+		}
+	}
+	return rm.broadcaster.BroadcastSignetUpdate(lsr.ChannelURI, signet)
+}
+
+func (rm *RecordManager) announceMessage(item *types.OutboxItem, cid string, ctx context.Context) error {
+	var lmr lex.MessageRecord
+	err := json.Unmarshal(item.Record, &lmr)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	if cid == "" {
+		curi, err := rm.db.GetMsgChannelURI(lmr.SignetURI, ctx)
+		if err != nil {
+			return fmt.Errorf("failed to find channel: %w", err)
+		}
+		return rm.broadcaster.BroadcastWriteFailed(curi, item.URI)
+	}
+	then, err := syntax.ParseDatetimeTime(lmr.PostedAt)
+	if err != nil {
+		return fmt.Errorf("message has a strange postedAt: %w", err)
+	}
+	var color *uint32
+	if lmr.Color != nil {
+		c := uint32(*lmr.Color)
+		color = &c
+	}
+	message := &types.Message{
+		URI:       item.URI,
+		DID:       rm.cfg.DID,
+		SignetURI: lmr.SignetURI,
+		Body:      lmr.Body,
+		Nick:      lmr.Nick,
+		Color:     color,
+		CID:       cid,
+		PostedAt:  then,
+	}
+	return rm.forwardMessageUpdate(message, ctx)
+}
+
+// outboxBackoff is how long to wait after the attempt'th failed attempt
+func outboxBackoff(attempt int) time.Duration {
+	backoff := outboxMinBackoff
+	for i := 1; i < attempt && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, outboxMaxBackoff)
+}
+
+// RetryWrite gives a write that was given up on another go
+func (rm *RecordManager) RetryWrite(id int, ctx context.Context) error {
+	err := rm.db.RequeueWrite(id, ctx)
+	if err != nil {
+		return err
+	}
+	rm.kickOutbox()
+	return nil
+}
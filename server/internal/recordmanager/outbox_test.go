@@ -0,0 +1,193 @@
+package recordmanager
+
+import (
+	"context"
+	"net/http"
+	"rvcx/internal/lex"
+	"rvcx/internal/types"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/lex/util"
+)
+
+// testQueue enqueues signets and messages the way createSignet and
+// createMyMessage do, without storing anything
+type testQueue struct {
+	t  *testing.T
+	rm *RecordManager
+}
+
+func (q testQueue) enqueue(collection string, record util.CBOR, after *string) string {
+	q.t.Helper()
+	uri, err := q.rm.enqueueWrite(collection, &util.LexiconTypeDecoder{Val: record}, after, context.Background())
+	if err != nil {
+		q.t.Fatal(err)
+	}
+	return uri
+}
+
+func (q testQueue) signet() string {
+	q.t.Helper()
+	return q.enqueue("org.xcvr.lrc.signet", &lex.SignetRecord{ChannelURI: "at://did:plc:here/org.xcvr.feed.channel/a", Author: "did:plc:alice"}, nil)
+}
+
+func (q testQueue) message(signetURI string) string {
+	q.t.Helper()
+	return q.enqueue("org.xcvr.lrc.message", &lex.MessageRecord{SignetURI: signetURI, Body: "hi"}, &signetURI)
+}
+
+// messages have to reach the pds after the signet they hang off of, or
+// anyone ingesting them won't know where they go
+func TestFlushOutboxKeepsOrder(t *testing.T) {
+	rm, _, pds, _ := newTestRecordManager(t)
+	ctx := context.Background()
+	q := testQueue{t, rm}
+	signet, message := q.signet, q.message
+	s1 := signet()
+	m1 := message(s1)
+	s2 := signet()
+	s3 := signet()
+	m3 := message(s3)
+	s4 := signet()
+
+	rm.flushOutbox(ctx)
+	want := []string{s1, m1, s2, s3, m3, s4}
+	if got := pds.written(); !slices.Equal(got, want) {
+		t.Errorf("written in order\n%v\nwant\n%v", got, want)
+	}
+}
+
+// clients are told when a pending write lands, and when it's given up on, so
+// nothing stays pending forever
+func TestOutboxAnnouncesWrites(t *testing.T) {
+	rm, s, pds, b := newTestRecordManager(t)
+	ctx := context.Background()
+	channel := "at://did:plc:here/org.xcvr.feed.channel/a"
+	_, err := s.StoreChannel(&types.Channel{URI: channel, Host: "did:plc:here"}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := "alice.test"
+	startedAt := syntax.DatetimeNow()
+	lsr := &lex.SignetRecord{ChannelURI: channel, LRCID: 1, Author: "did:plc:alice", AuthorHandle: &handle, StartedAt: (*string)(&startedAt)}
+	signet, err := rm.createSignet(lsr, ptr(startedAt.Time()), 1, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.StoreSignet(signet, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func() string {
+		t.Helper()
+		now := time.Now()
+		m, err := rm.createMyMessage(&lex.MessageRecord{SignetURI: signet.URI, Body: "hi", PostedAt: syntax.DatetimeNow().String()}, &now, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.URI
+	}
+	landed := post()
+	rm.flushOutbox(ctx)
+	pds.rejectWrites("org.xcvr.lrc.message")
+	failed := post()
+	rm.flushOutbox(ctx)
+
+	want := []string{
+		"signetUpdate " + channel + " " + signet.URI,
+		"messageUpdate " + channel + " " + landed,
+		"writeFailed " + channel + " " + failed,
+	}
+	if got := b.broadcast(); !slices.Equal(got, want) {
+		t.Errorf("broadcast\n%v\nwant\n%v", got, want)
+	}
+}
+
+// a signet that's put off holds back the messages after it, both when it's
+// tried on its own and when it's in a batch that has to be split up
+func TestFlushOutboxHoldsWritesAfterDeferredSignet(t *testing.T) {
+	for _, batched := range []bool{false, true} {
+		rm, s, pds, _ := newTestRecordManager(t)
+		ctx := context.Background()
+		q := testQueue{t, rm}
+		var s1, m1, s2, m2 string
+		if batched {
+			s1, s2 = q.signet(), q.signet()
+			m1, m2 = q.message(s1), q.message(s2)
+		} else {
+			s1 = q.signet()
+			m1 = q.message(s1)
+			s2 = q.signet()
+			m2 = q.message(s2)
+		}
+		pds.breakWrites(s1, http.StatusInternalServerError)
+
+		rm.flushOutbox(ctx)
+		rm.flushOutbox(ctx)
+		want := []string{s2, m2}
+		if got := pds.written(); !slices.Equal(got, want) {
+			t.Errorf("batched %t: written\n%v\nwant\n%v", batched, got, want)
+		}
+		due, err := s.GetDueWrites(time.Now().Add(time.Hour), 10, ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(due) != 2 || due[0].URI != s1 || due[1].URI != m1 {
+			t.Errorf("batched %t: due once the signet is, got %+v, want it and its message", batched, due)
+		}
+	}
+}
+
+// once a signet is given up on, the messages in it never will land, so
+// they're given up on too rather than written pointing at nothing
+func TestFlushOutboxFailsWritesAfterFailedSignet(t *testing.T) {
+	rm, s, pds, b := newTestRecordManager(t)
+	ctx := context.Background()
+	channel := "at://did:plc:here/org.xcvr.feed.channel/a"
+	_, err := s.StoreChannel(&types.Channel{URI: channel, Host: "did:plc:here"}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startedAt := syntax.DatetimeNow()
+	lsr := &lex.SignetRecord{ChannelURI: channel, LRCID: 1, Author: "did:plc:alice", StartedAt: (*string)(&startedAt)}
+	signet, err := rm.createSignet(lsr, ptr(startedAt.Time()), 1, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.StoreSignet(signet, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	m, err := rm.createMyMessage(&lex.MessageRecord{SignetURI: signet.URI, Body: "hi", PostedAt: syntax.DatetimeNow().String()}, &now, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pds.breakWrites(signet.URI, http.StatusBadRequest)
+
+	rm.flushOutbox(ctx)
+	if got := pds.written(); len(got) != 0 {
+		t.Errorf("wrote %v after the signet was turned down", got)
+	}
+	failed, err := s.GetFailedWrites(10, nil, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 2 {
+		t.Errorf("got %d failed writes, want the signet and its message", len(failed))
+	}
+	want := []string{
+		"writeFailed " + channel + " " + signet.URI,
+		"writeFailed " + channel + " " + m.URI,
+	}
+	if got := b.broadcast(); !slices.Equal(got, want) {
+		t.Errorf("broadcast\n%v\nwant\n%v", got, want)
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
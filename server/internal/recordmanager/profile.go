@@ -3,6 +3,7 @@ package recordmanager
 import (
 	"context"
 	"errors"
+	"fmt"
 	"rvcx/internal/atputils"
 	"rvcx/internal/lex"
 	"rvcx/internal/oauth"
@@ -14,7 +15,7 @@ import (
 func (rm *RecordManager) AcceptProfile(p lex.ProfileRecord, did string, ctx context.Context) error {
 	err := rm.storeProfile(did, &p, ctx)
 	if err != nil {
-		return errors.New("failed to store profile: " + err.Error())
+		return fmt.Errorf("failed to store profile: %w", err)
 	}
 	return nil
 }
@@ -29,17 +30,17 @@ func (rm *RecordManager) CreateInitialProfile(sessData *atoauth.ClientSessionDat
 	color := uint64(3702605)
 	handle, err := rm.db.FullResolveDid(sessData.AccountDID.String(), ctx)
 	if err != nil {
-		return errors.New("i couldn't find the handle, so i couldn't create default profile record. gootbye")
+		return fmt.Errorf("i couldn't find the handle, so i couldn't create default profile record. gootbye: %w", err)
 	}
 
 	p, err := rm.createProfile(&handle, &nick, &status, &color, sessData, ctx)
 	if err != nil {
-		return errors.New("AAAAA error creating profile" + err.Error())
+		return fmt.Errorf("AAAAA error creating profile: %w", err)
 	}
-	rm.log.Deprintln("initializing profile....")
+	rm.log.DebugContext(ctx, "initializing profile", "did", sessData.AccountDID.String())
 	err = rm.db.InitializeProfile(sessData.AccountDID.String(), p.DisplayName, p.DefaultNick, p.Status, p.Color, ctx)
 	if err != nil {
-		return errors.New("failed to initialize profile: " + err.Error())
+		return fmt.Errorf("failed to initialize profile: %w", err)
 	}
 	return nil
 
@@ -48,15 +49,15 @@ func (rm *RecordManager) CreateInitialProfile(sessData *atoauth.ClientSessionDat
 func (rm *RecordManager) PostProfile(cs *atoauth.ClientSession, ctx context.Context, p *types.PostProfileRequest) error {
 	err := rm.validateProfile(p)
 	if err != nil {
-		return errors.New("couldn't validate profile: " + err.Error())
+		return fmt.Errorf("couldn't validate profile: %w", err)
 	}
 	pr, err := rm.updateProfile(cs, p.DisplayName, p.DefaultNick, p.Status, p.Color, ctx)
 	if err != nil {
-		return errors.New("couldn't create profile: " + err.Error())
+		return fmt.Errorf("couldn't create profile: %w", err)
 	}
 	err = rm.storeProfile(cs.Data.AccountDID.String(), pr, ctx)
 	if err != nil {
-		return errors.New("couldn't store profile: " + err.Error())
+		return fmt.Errorf("couldn't store profile: %w", err)
 	}
 	return nil
 }
@@ -64,7 +65,7 @@ func (rm *RecordManager) PostProfile(cs *atoauth.ClientSession, ctx context.Cont
 func (rm *RecordManager) storeProfile(did string, p *lex.ProfileRecord, ctx context.Context) error {
 	err := rm.db.UpdateProfile(did, p.DisplayName, p.DefaultNick, p.Status, p.Color, ctx)
 	if err != nil {
-		return errors.New("error updating profile: " + err.Error())
+		return fmt.Errorf("error updating profile: %w", err)
 	}
 	return nil
 }
@@ -96,7 +97,7 @@ func (rm *RecordManager) createProfile(name *string, nick *string, status *strin
 	}
 	p, err := oauth.CreateXCVRProfile(client, profilerecord, ctx)
 	if err != nil {
-		return nil, errors.New("failed to create profile: " + err.Error())
+		return nil, fmt.Errorf("failed to create profile: %w", err)
 	}
 	return p, nil
 }
@@ -1,33 +1,109 @@
 package recordmanager
 
 import (
-	"rvcx/internal/db"
+	"errors"
+	"fmt"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"rvcx/internal/atputils"
+	"rvcx/internal/banpolicy"
+	"rvcx/internal/config"
 	"rvcx/internal/log"
+	"rvcx/internal/mediacache"
 	"rvcx/internal/oauth"
+	"rvcx/internal/store"
 	"rvcx/internal/types"
 )
 
+// ErrNotYours is returned when a session tries to change a record that isn't
+// in its repo
+var ErrNotYours = errors.New("not yours")
+
 type LexBroadcaster interface {
 	BroadcastSignet(uri string, s *types.Signet) error
+	BroadcastSignetUpdate(uri string, s *types.Signet) error
 	BroadcastMessage(uri string, m *types.Message) error
+	BroadcastMessageUpdate(uri string, m *types.Message) error
 	BroadcastImage(uri string, i *types.Image) error
+	BroadcastImageUpdate(uri string, i *types.Image) error
+	BroadcastVideo(uri string, v *types.Video) error
+	BroadcastVideoUpdate(uri string, v *types.Video) error
+	BroadcastSignetDelete(uri string, signetURI string) error
+	BroadcastMessageDelete(uri string, messageURI string) error
+	BroadcastMediaDelete(uri string, mediaURI string) error
+	BroadcastWriteFailed(uri string, recordURI string) error
 	AddChannel(c *types.Channel) error
 	UpdateChannel(c *types.Channel) error
 	DeleteChannel(uri string) error
 }
 
 type RecordManager struct {
+	cfg         *config.Config
 	log         *log.Logger
-	db          *db.Store
+	db          store.Store
 	myClient    *oauth.PasswordClient
 	service     *oauth.Service
 	broadcaster LexBroadcaster
+	bans        *banpolicy.Policy
+	media       *mediacache.Cache
+	// tids mints the rkeys of records written through the outbox, and kick
+	// wakes the outbox up when there's something new in it
+	tids syntax.TIDClock
+	kick chan struct{}
 }
 
-func New(log *log.Logger, db *db.Store, myClient *oauth.PasswordClient, service *oauth.Service) *RecordManager {
-	return &RecordManager{log, db, myClient, service, nil}
+func New(cfg *config.Config, log *log.Logger, db store.Store, myClient *oauth.PasswordClient, service *oauth.Service, bans *banpolicy.Policy, media *mediacache.Cache) *RecordManager {
+	return &RecordManager{
+		cfg:      cfg,
+		log:      log,
+		db:       db,
+		myClient: myClient,
+		service:  service,
+		bans:     bans,
+		media:    media,
+		tids:     syntax.NewTIDClock(0),
+		kick:     make(chan struct{}, 1),
+		// until there's a model to tell, records are just stored, which is
+		// all backfill wants
+		broadcaster: nobody{},
+	}
 }
 
 func (rm *RecordManager) SetBroadcaster(b LexBroadcaster) {
 	rm.broadcaster = b
 }
+
+// nobody is a LexBroadcaster with nobody listening
+type nobody struct{}
+
+func (nobody) BroadcastSignet(uri string, s *types.Signet) error          { return nil }
+func (nobody) BroadcastSignetUpdate(uri string, s *types.Signet) error    { return nil }
+func (nobody) BroadcastMessage(uri string, m *types.Message) error        { return nil }
+func (nobody) BroadcastMessageUpdate(uri string, m *types.Message) error  { return nil }
+func (nobody) BroadcastImage(uri string, i *types.Image) error            { return nil }
+func (nobody) BroadcastImageUpdate(uri string, i *types.Image) error      { return nil }
+func (nobody) BroadcastVideo(uri string, v *types.Video) error            { return nil }
+func (nobody) BroadcastVideoUpdate(uri string, v *types.Video) error      { return nil }
+func (nobody) BroadcastSignetDelete(uri string, signetURI string) error   { return nil }
+func (nobody) BroadcastMessageDelete(uri string, messageURI string) error { return nil }
+func (nobody) BroadcastMediaDelete(uri string, mediaURI string) error     { return nil }
+func (nobody) BroadcastWriteFailed(uri string, recordURI string) error    { return nil }
+func (nobody) AddChannel(c *types.Channel) error                          { return nil }
+func (nobody) UpdateChannel(c *types.Channel) error                       { return nil }
+func (nobody) DeleteChannel(uri string) error                             { return nil }
+
+// ownRkey gets the rkey of uri, as long as it's a record in collection that
+// belongs to did
+func ownRkey(did string, collection string, uri string) (string, error) {
+	udid, err := atputils.DidFromUri(uri)
+	if err != nil {
+		return "", fmt.Errorf("strange uri: %w", err)
+	}
+	ucollection, err := atputils.CollectionFromUri(uri)
+	if err != nil {
+		return "", fmt.Errorf("strange uri: %w", err)
+	}
+	if udid != did || ucollection != collection {
+		return "", ErrNotYours
+	}
+	return atputils.RkeyFromUri(uri)
+}
@@ -0,0 +1,247 @@
+package recordmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"rvcx/internal/banpolicy"
+	"rvcx/internal/config"
+	"rvcx/internal/log"
+	"rvcx/internal/memstore"
+	"rvcx/internal/oauth"
+	"rvcx/internal/types"
+	"sync"
+	"testing"
+)
+
+// fakePDS is just enough of a pds for my repo to be written to. it remembers
+// every write in the order it landed
+type fakePDS struct {
+	*httptest.Server
+	mu     sync.Mutex
+	writes []string
+	// reject makes writes to a collection fail as if the record were invalid,
+	// and broken makes writes of a uri fail with a status. both guarded by mu
+	reject map[string]bool
+	broken map[string]int
+}
+
+func newFakePDS(t *testing.T) *fakePDS {
+	t.Helper()
+	pds := &fakePDS{reject: make(map[string]bool), broken: make(map[string]int)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /xrpc/com.atproto.server.createSession", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"accessJwt": "access", "refreshJwt": "refresh", "handle": "here.test", "did": "did:plc:here"})
+	})
+	mux.HandleFunc("POST /xrpc/com.atproto.repo.putRecord", func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Collection string `json:"collection"`
+			Rkey       string `json:"rkey"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		uri, status := pds.write(in.Collection, in.Rkey)
+		if status != http.StatusOK {
+			fail(w, status)
+			return
+		}
+		writeJSON(w, map[string]any{"uri": uri, "cid": "cid:" + uri})
+	})
+	mux.HandleFunc("POST /xrpc/com.atproto.repo.applyWrites", func(w http.ResponseWriter, r *http.Request) {
+		var in struct {
+			Writes []struct {
+				Collection string `json:"collection"`
+				Rkey       string `json:"rkey"`
+			} `json:"writes"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		for _, wr := range in.Writes {
+			if status := pds.status(wr.Collection, wr.Rkey); status != http.StatusOK {
+				fail(w, status)
+				return
+			}
+		}
+		results := make([]map[string]any, 0, len(in.Writes))
+		for _, wr := range in.Writes {
+			uri, _ := pds.write(wr.Collection, wr.Rkey)
+			results = append(results, map[string]any{
+				"$type": "com.atproto.repo.applyWrites#createResult",
+				"uri":   uri,
+				"cid":   "cid:" + uri,
+			})
+		}
+		writeJSON(w, map[string]any{"results": results})
+	})
+	mux.HandleFunc("POST /xrpc/com.atproto.repo.deleteRecord", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{})
+	})
+	pds.Server = httptest.NewServer(mux)
+	t.Cleanup(pds.Close)
+	return pds
+}
+
+// status is what a write of rkey to collection would get back
+func (pds *fakePDS) status(collection string, rkey string) int {
+	pds.mu.Lock()
+	defer pds.mu.Unlock()
+	return pds.statusLocked(collection, rkey)
+}
+
+func (pds *fakePDS) statusLocked(collection string, rkey string) int {
+	if pds.reject[collection] {
+		return http.StatusBadRequest
+	}
+	if status, ok := pds.broken[fmt.Sprintf("at://did:plc:here/%s/%s", collection, rkey)]; ok {
+		return status
+	}
+	return http.StatusOK
+}
+
+func fail(w http.ResponseWriter, status int) {
+	w.WriteHeader(status)
+	if status == http.StatusBadRequest {
+		writeJSON(w, map[string]any{"error": "InvalidRecord", "message": "no thanks"})
+		return
+	}
+	writeJSON(w, map[string]any{"error": "InternalServerError", "message": "oops"})
+}
+
+func (pds *fakePDS) rejectWrites(collection string) {
+	pds.mu.Lock()
+	defer pds.mu.Unlock()
+	pds.reject[collection] = true
+}
+
+func (pds *fakePDS) breakWrites(uri string, status int) {
+	pds.mu.Lock()
+	defer pds.mu.Unlock()
+	pds.broken[uri] = status
+}
+
+func (pds *fakePDS) write(collection string, rkey string) (string, int) {
+	pds.mu.Lock()
+	defer pds.mu.Unlock()
+	if status := pds.statusLocked(collection, rkey); status != http.StatusOK {
+		return "", status
+	}
+	uri := fmt.Sprintf("at://did:plc:here/%s/%s", collection, rkey)
+	pds.writes = append(pds.writes, uri)
+	return uri, http.StatusOK
+}
+
+func (pds *fakePDS) written() []string {
+	pds.mu.Lock()
+	defer pds.mu.Unlock()
+	return append([]string{}, pds.writes...)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// fakeBroadcaster remembers what would have been broadcast, as the name of
+// the method, the channel, and the record, along with whether the record was
+// pending
+type fakeBroadcaster struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (b *fakeBroadcaster) add(method string, channel string, uri string, pending bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := method + " " + channel + " " + uri
+	if pending {
+		e += " pending"
+	}
+	b.events = append(b.events, e)
+	return nil
+}
+
+func (b *fakeBroadcaster) broadcast() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string{}, b.events...)
+}
+
+func (b *fakeBroadcaster) BroadcastSignet(uri string, s *types.Signet) error {
+	return b.add("signet", uri, s.URI, s.CID == "")
+}
+
+func (b *fakeBroadcaster) BroadcastSignetUpdate(uri string, s *types.Signet) error {
+	return b.add("signetUpdate", uri, s.URI, s.CID == "")
+}
+
+func (b *fakeBroadcaster) BroadcastMessage(uri string, m *types.Message) error {
+	return b.add("message", uri, m.URI, m.CID == "")
+}
+
+func (b *fakeBroadcaster) BroadcastMessageUpdate(uri string, m *types.Message) error {
+	return b.add("messageUpdate", uri, m.URI, m.CID == "")
+}
+
+func (b *fakeBroadcaster) BroadcastImage(uri string, i *types.Image) error {
+	return b.add("image", uri, i.URI, false)
+}
+
+func (b *fakeBroadcaster) BroadcastImageUpdate(uri string, i *types.Image) error {
+	return b.add("imageUpdate", uri, i.URI, false)
+}
+
+func (b *fakeBroadcaster) BroadcastVideo(uri string, v *types.Video) error {
+	return b.add("video", uri, v.URI, false)
+}
+
+func (b *fakeBroadcaster) BroadcastVideoUpdate(uri string, v *types.Video) error {
+	return b.add("videoUpdate", uri, v.URI, false)
+}
+
+func (b *fakeBroadcaster) BroadcastSignetDelete(uri string, signetURI string) error {
+	return b.add("signetDelete", uri, signetURI, false)
+}
+
+func (b *fakeBroadcaster) BroadcastMessageDelete(uri string, messageURI string) error {
+	return b.add("messageDelete", uri, messageURI, false)
+}
+
+func (b *fakeBroadcaster) BroadcastMediaDelete(uri string, mediaURI string) error {
+	return b.add("mediaDelete", uri, mediaURI, false)
+}
+
+func (b *fakeBroadcaster) BroadcastWriteFailed(uri string, recordURI string) error {
+	return b.add("writeFailed", uri, recordURI, false)
+}
+
+func (b *fakeBroadcaster) AddChannel(c *types.Channel) error {
+	return b.add("addChannel", c.URI, c.URI, false)
+}
+
+func (b *fakeBroadcaster) UpdateChannel(c *types.Channel) error {
+	return b.add("updateChannel", c.URI, c.URI, false)
+}
+
+func (b *fakeBroadcaster) DeleteChannel(uri string) error {
+	return b.add("deleteChannel", uri, uri, false)
+}
+
+// newTestRecordManager makes a record manager for did:plc:here, backed by a
+// memstore, writing to a fake pds, and broadcasting to a fake broadcaster
+func newTestRecordManager(t *testing.T) (*RecordManager, *memstore.Store, *fakePDS, *fakeBroadcaster) {
+	t.Helper()
+	cfg := &config.Config{DID: "did:plc:here", Identity: "here.test"}
+	s := memstore.New(cfg)
+	logger := log.New(io.Discard, false)
+	pds := newFakePDS(t)
+	pc := oauth.NewPasswordClient(cfg, pds.URL, logger)
+	err := pc.CreateSession(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm := New(cfg, logger, s, pc, nil, banpolicy.New(s, logger), nil)
+	b := &fakeBroadcaster{}
+	rm.SetBroadcaster(b)
+	return rm, s, pds, b
+}
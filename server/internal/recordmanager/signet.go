@@ -3,34 +3,45 @@ package recordmanager
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/bluesky-social/indigo/atproto/syntax"
+	"github.com/bluesky-social/indigo/lex/util"
 	lrcpb "github.com/rachel-mp4/lrcproto/gen/go"
 	"rvcx/internal/atputils"
 	"rvcx/internal/lex"
+	"rvcx/internal/log"
 	"rvcx/internal/types"
 	"time"
 )
 
 func (rm *RecordManager) PostSignet(resolvedId *string, e lrcpb.Event_Init, uri string, ctx context.Context) error {
+	ctx = log.WithAttrs(ctx, "channel", uri)
 	lsr, now, err := rm.validateSignet(resolvedId, e, uri, ctx)
 	if err != nil {
-		return errors.New("failed to validate signet: " + err.Error())
+		return fmt.Errorf("failed to validate signet: %w", err)
 	}
+	ctx = log.WithAttrs(ctx, "did", lsr.Author, "lrc_id", lsr.LRCID)
+	if rm.bans.IsBanned(lsr.Author, ctx) {
+		return errors.New("won't sign for a banned author")
+	}
+	rm.log.DebugContext(ctx, "queueing signet for my pds")
 	signet, err := rm.createSignet(lsr, now, *e.Init.Id, ctx)
 	if err != nil {
-		return errors.New("failed to create signet: " + err.Error())
+		return fmt.Errorf("failed to create signet: %w", err)
 	}
+	ctx = log.WithAttrs(ctx, "uri", signet.URI)
+	rm.log.DebugContext(ctx, "storing signet")
 	wasNew, err := rm.storeSignet(signet, ctx)
 	if err != nil {
-		return errors.New("failed to store signet: " + err.Error())
+		return fmt.Errorf("failed to store signet: %w", err)
 	}
 	if !wasNew {
 		return nil
 	}
-	rm.log.Deprintln("i was new, so i am forwarding")
+	rm.log.DebugContext(ctx, "i was new, so i am forwarding")
 	err = rm.forwardSignet(signet, uri)
 	if err != nil {
-		return errors.New("failed to forward signet: " + err.Error())
+		return fmt.Errorf("failed to forward signet: %w", err)
 	}
 	return nil
 }
@@ -38,33 +49,50 @@ func (rm *RecordManager) PostSignet(resolvedId *string, e lrcpb.Event_Init, uri
 func (rm *RecordManager) DeleteSignet(uri string, ctx context.Context) error {
 	rkey, err := atputils.RkeyFromUri(uri)
 	if err != nil {
-		return errors.New("invalid signet uri: " + err.Error())
+		return fmt.Errorf("invalid signet uri: %w", err)
 	}
-	_, err = rm.myClient.DeleteXCVRSignet(rkey, ctx)
+	pending, err := rm.db.CancelWrite(uri, ctx)
 	if err != nil {
-		return errors.New("failed to delete signet record from repo: " + err.Error())
+		return fmt.Errorf("failed to cancel signet write: %w", err)
 	}
-	err = rm.db.DeleteSignet(uri, ctx)
+	if pending {
+		return rm.deleteSignet(uri, ctx)
+	}
+	_, err = rm.myClient.DeleteXCVRSignet(rkey, ctx)
 	if err != nil {
-		return errors.New("failed to delete signet from database")
+		return fmt.Errorf("failed to delete signet record from repo: %w", err)
 	}
-	return nil
+	return rm.deleteSignet(uri, ctx)
 }
 
 func (rm *RecordManager) AcceptSignet(s *types.Signet, ctx context.Context) error {
 	wasNew, err := rm.storeSignet(s, ctx)
 	if err != nil {
-		return errors.New("failed to store signet: " + err.Error())
+		return fmt.Errorf("failed to store signet: %w", err)
 	}
 	if !wasNew {
 		return nil
 	}
-	rm.log.Deprintln("i was new & originated elsewhere, so i am forwarding")
+	rm.log.DebugContext(ctx, "i was new & originated elsewhere, so i am forwarding")
 	return rm.forwardSignet(s, s.ChannelURI)
 }
 
 func (rm *RecordManager) AcceptSignetDelete(uri string, ctx context.Context) error {
-	return rm.db.DeleteSignet(uri, ctx)
+	return rm.deleteSignet(uri, ctx)
+}
+
+// deleteSignet removes a signet from the database and tells the channel it
+// was in. we have to look up the channel first, since afterwards it's gone
+func (rm *RecordManager) deleteSignet(uri string, ctx context.Context) error {
+	curi, _, err := rm.db.QuerySignetChannelIdNum(uri, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find signet: %w", err)
+	}
+	err = rm.db.DeleteSignet(uri, ctx)
+	if err != nil {
+		return errors.New("failed to delete signet from database")
+	}
+	return rm.broadcaster.BroadcastSignetDelete(curi, uri)
 }
 
 func (rm *RecordManager) AcceptSignetUpdate(s *types.Signet, ctx context.Context) error {
@@ -98,22 +126,23 @@ func (rm *RecordManager) validateSignet(resolvedId *string, e lrcpb.Event_Init,
 	return &signet, &nowTime, nil
 }
 
+// createSignet queues lsr to be written to my repo. the signet it returns has
+// no cid until the write lands
 func (rm *RecordManager) createSignet(lsr *lex.SignetRecord, now *time.Time, id uint32, ctx context.Context) (*types.Signet, error) {
-	cid, recorduri, err := rm.myClient.CreateXCVRSignet(lsr, ctx)
+	recorduri, err := rm.enqueueWrite("org.xcvr.lrc.signet", &util.LexiconTypeDecoder{Val: lsr}, nil, ctx)
 	if err != nil {
-		return nil, errors.New("couldn't create signet: " + err.Error())
+		return nil, fmt.Errorf("couldn't queue signet: %w", err)
 	}
 	if now == nil {
 		return nil, errors.New("wasn't provided time")
 	}
 	sr := types.Signet{
 		URI:          recorduri,
-		IssuerDID:    atputils.GetMyDid(),
+		IssuerDID:    rm.cfg.DID,
 		Author:       lsr.Author,
 		AuthorHandle: lsr.AuthorHandle,
 		ChannelURI:   lsr.ChannelURI,
 		MessageID:    id,
-		CID:          cid,
 		StartedAt:    *now,
 	}
 	return &sr, nil
@@ -0,0 +1,107 @@
+package recordmanager
+
+import (
+	"context"
+	"fmt"
+	atoauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+	"rvcx/internal/atputils"
+	"rvcx/internal/lex"
+	"rvcx/internal/log"
+	"rvcx/internal/oauth"
+	"rvcx/internal/types"
+)
+
+func (rm *RecordManager) AcceptSub(sub *types.Sub, ctx context.Context) error {
+	_, err := rm.db.StoreSub(sub, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to store sub: %w", err)
+	}
+	return nil
+}
+
+func (rm *RecordManager) AcceptSubUpdate(sub *types.Sub, ctx context.Context) error {
+	err := rm.db.UpdateSub(sub, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to update sub: %w", err)
+	}
+	return nil
+}
+
+func (rm *RecordManager) AcceptSubDelete(uri string, ctx context.Context) error {
+	err := rm.db.DeleteSub(uri, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to delete sub: %w", err)
+	}
+	return nil
+}
+
+// Subscribe writes a sub for channelURI to the session's repo, unless they
+// are already subscribed, in which case it hands back the sub they have
+func (rm *RecordManager) Subscribe(cs *atoauth.ClientSession, channelURI string, ctx context.Context) (uri string, err error) {
+	did := cs.Data.AccountDID.String()
+	ctx = log.WithAttrs(ctx, "did", did, "channel", channelURI)
+	_, err = rm.db.GetChannelView(channelURI, ctx)
+	if err != nil {
+		err = fmt.Errorf("couldn't find channel: %w", err)
+		return
+	}
+	uris, err := rm.db.GetSubURIs(did, channelURI, ctx)
+	if err != nil {
+		err = fmt.Errorf("couldn't check for existing subs: %w", err)
+		return
+	}
+	if len(uris) != 0 {
+		rm.log.DebugContext(ctx, "already subscribed")
+		uri = uris[0]
+		return
+	}
+	dtn := syntax.DatetimeNow()
+	lsr := lex.SubRecord{
+		ChannelURI: channelURI,
+		CreatedAt:  dtn.String(),
+	}
+	rm.log.DebugContext(ctx, "writing sub to pds")
+	uri, cid, err := oauth.CreateXCVRSub(cs, &lsr, ctx)
+	if err != nil {
+		return
+	}
+	ctx = log.WithAttrs(ctx, "uri", uri)
+	rm.log.DebugContext(ctx, "storing sub")
+	sub := types.Sub{
+		URI:        uri,
+		CID:        cid,
+		DID:        did,
+		ChannelURI: channelURI,
+		CreatedAt:  dtn.Time(),
+	}
+	err = rm.AcceptSub(&sub, ctx)
+	return
+}
+
+// Unsubscribe deletes every sub the session has for channelURI, from their
+// repo and from ours
+func (rm *RecordManager) Unsubscribe(cs *atoauth.ClientSession, channelURI string, ctx context.Context) error {
+	did := cs.Data.AccountDID.String()
+	ctx = log.WithAttrs(ctx, "did", did, "channel", channelURI)
+	uris, err := rm.db.GetSubURIs(did, channelURI, ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't find subs: %w", err)
+	}
+	for _, uri := range uris {
+		rkey, err := atputils.RkeyFromUri(uri)
+		if err != nil {
+			return fmt.Errorf("bad sub uri: %w", err)
+		}
+		rm.log.DebugContext(log.WithAttrs(ctx, "uri", uri), "deleting sub")
+		err = oauth.DeleteXCVRSub(cs, rkey, ctx)
+		if err != nil {
+			return err
+		}
+		err = rm.AcceptSubDelete(uri, ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
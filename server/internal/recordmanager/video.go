@@ -0,0 +1,147 @@
+package recordmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"rvcx/internal/lex"
+	"rvcx/internal/oauth"
+	"rvcx/internal/types"
+	"time"
+
+	atoauth "github.com/bluesky-social/indigo/atproto/auth/oauth"
+	"github.com/bluesky-social/indigo/atproto/syntax"
+)
+
+func (rm *RecordManager) AcceptVideo(video *types.Video, ctx context.Context) error {
+	wasNew, err := rm.db.StoreVideo(video, ctx)
+	if err != nil {
+		return err
+	}
+	if !wasNew {
+		return nil
+	}
+	err = rm.forwardVideo(video, ctx)
+	if err != nil {
+		return fmt.Errorf("error forwarding video: %w", err)
+	}
+	return nil
+}
+
+func (rm *RecordManager) AcceptVideoUpdate(video *types.Video, ctx context.Context) error {
+	err := rm.db.UpdateVideo(video, ctx)
+	if err != nil {
+		return err
+	}
+	curi, err := rm.db.GetMsgChannelURI(video.SignetURI, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get curi: %w", err)
+	}
+	return rm.broadcaster.BroadcastVideoUpdate(curi, video)
+}
+
+func (rm *RecordManager) postVideoRecord(cs *atoauth.ClientSession, mr *types.ParseMediaRequest, ctx context.Context) error {
+	if mr.Video == nil {
+		return errors.New("no video to post")
+	}
+	mr.Image = nil
+	vmr, now, err := rm.validateMediaRecord(mr, ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't validate media record: %w", err)
+	}
+	video, err := rm.createVideoRecord(cs, vmr, now, ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't create media record: %w", err)
+	}
+	wasNew, err := rm.db.StoreVideo(video, ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't store video: %w", err)
+	}
+	if !wasNew {
+		return nil
+	}
+	err = rm.forwardVideo(video, ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't forward video: %w", err)
+	}
+	return nil
+}
+
+func (rm *RecordManager) forwardVideo(v *types.Video, ctx context.Context) error {
+	curi, err := rm.db.GetMsgChannelURI(v.SignetURI, ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get curi: %w", err)
+	}
+	return rm.broadcaster.BroadcastVideo(curi, v)
+}
+
+func (rm *RecordManager) createVideoRecord(cs *atoauth.ClientSession, vmr *lex.MediaRecord, now *time.Time, ctx context.Context) (*types.Video, error) {
+	uri, cid, err := oauth.CreateXCVRMedia(cs, vmr, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create record: %w", err)
+	}
+	var video types.Video
+	video.URI = uri
+	video.DID = cs.Data.AccountDID.String()
+	video.SignetURI = vmr.SignetURI
+	if vmr.Video != nil {
+		video.Alt = vmr.Video.Alt
+		if vmr.Video.Blob != nil {
+			video.BlobMIME = &vmr.Video.Blob.MimeType
+			vcid := vmr.Video.Blob.Ref.String()
+			video.BlobCID = &vcid
+		}
+		if vmr.Video.AspectRatio != nil {
+			w := vmr.Video.AspectRatio.Width
+			h := vmr.Video.AspectRatio.Height
+			video.Width = &w
+			video.Height = &h
+		}
+	}
+	video.Nick = vmr.Nick
+	video.CID = cid
+	if vmr.Color != nil {
+		c := uint32(*vmr.Color)
+		video.Color = &c
+	}
+	if now != nil {
+		video.PostedAt = *now
+	} else {
+		video.PostedAt = time.Now()
+	}
+	return &video, nil
+}
+
+// videoFromRecord is the video mr describes, for when it's already been
+// written
+func videoFromRecord(uri string, cid string, did string, mr *lex.MediaRecord) *types.Video {
+	then, err := syntax.ParseDatetimeTime(mr.PostedAt)
+	if err != nil {
+		then = time.Now()
+	}
+	video := types.Video{
+		URI:       uri,
+		DID:       did,
+		SignetURI: mr.SignetURI,
+		Alt:       mr.Video.Alt,
+		Nick:      mr.Nick,
+		CID:       cid,
+		PostedAt:  then,
+	}
+	if mr.Video.Blob != nil {
+		video.BlobMIME = &mr.Video.Blob.MimeType
+		vcid := mr.Video.Blob.Ref.String()
+		video.BlobCID = &vcid
+	}
+	if mr.Video.AspectRatio != nil {
+		w := mr.Video.AspectRatio.Width
+		h := mr.Video.AspectRatio.Height
+		video.Width = &w
+		video.Height = &h
+	}
+	if mr.Color != nil {
+		c := uint32(*mr.Color)
+		video.Color = &c
+	}
+	return &video
+}
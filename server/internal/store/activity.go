@@ -0,0 +1,33 @@
+package store
+
+import (
+	"math"
+	"time"
+)
+
+// channel activity is kept as exponentially decaying counts, one of messages
+// and media, and one of new posters. a poster only counts as new if they
+// haven't posted in the channel for PosterWindow.
+//
+// rather than storing the counts themselves, which would all have to be
+// decayed whenever they're compared, each is stored as a rank: the log of the
+// count as it would be at the unix epoch. decaying multiplies every count by
+// the same factor, so ranks never need touching except when something new
+// happens, and ordering by rank is ordering by how active a channel is now
+const (
+	ActiveHalfLife  = 6 * time.Hour
+	PopularHalfLife = 3 * 24 * time.Hour
+	PosterWindow    = 24 * time.Hour
+)
+
+// Rank is the rank of a single event at t, for a count with halfLife
+func Rank(t time.Time, halfLife time.Duration) float64 {
+	tau := halfLife.Seconds() / math.Ln2
+	return float64(t.UnixMicro()) / 1e6 / tau
+}
+
+// AddRanks is the rank of two counts added together. it is what the db does
+// in sql, written so that it can't overflow
+func AddRanks(a float64, b float64) float64 {
+	return max(a, b) + math.Log1p(math.Exp(-math.Abs(a-b)))
+}
@@ -0,0 +1,192 @@
+// Package store describes everything rvcx keeps around between restarts.
+// db.Store keeps it in postgres, and memstore keeps it in memory for tests
+// and tooling that don't want a database
+package store
+
+import (
+	"context"
+	"errors"
+	"rvcx/internal/types"
+	"time"
+
+	"github.com/bluesky-social/indigo/atproto/auth/oauth"
+)
+
+// ErrNotFound is returned by lookups where not finding anything is an
+// expected outcome rather than a failure, so callers can tell the two apart
+var ErrNotFound = errors.New("not found")
+
+type Store interface {
+	Identities
+	Channels
+	Subs
+	Signets
+	Messages
+	Images
+	Bans
+	Reports
+	Cursors
+	Outbox
+	OAuth
+	Close()
+}
+
+// Identities covers did/handle mappings and the profiles that go with them
+type Identities interface {
+	ResolveHandle(handle string, ctx context.Context) (string, error)
+	FullResolveHandle(hdl string, ctx context.Context) (string, error)
+	ResolveDid(did string, ctx context.Context) (string, error)
+	FullResolveDid(did string, ctx context.Context) (string, error)
+	GetDids(ctx context.Context) ([]string, error)
+	StoreDidHandle(did string, handle string, ctx context.Context) error
+	GetLastSeen(did string, ctx context.Context) (where *string, when *time.Time)
+
+	InitializeProfile(did string, displayname *string, defaultnick *string, status *string, color *uint64, ctx context.Context) error
+	UpdateProfile(did string, displayname *string, defaultnick *string, status *string, color *uint64, ctx context.Context) error
+	DeleteProfile(did string, cid string, ctx context.Context) error
+	GetProfileView(did string, ctx context.Context) (*types.ProfileView, error)
+}
+
+type Channels interface {
+	StoreChannel(channel *types.Channel, ctx context.Context) (wasNew bool, err error)
+	UpdateChannel(channel *types.Channel, ctx context.Context) error
+	DeleteChannel(uri string, ctx context.Context) error
+	GetChannelURI(handle string, title string, ctx context.Context) (string, error)
+	GetChannelURIs(ctx context.Context) ([]types.URIHost, error)
+	StoreLastID(uri string, lastID uint32, ctx context.Context) error
+	// GetChannelViews pages through channels newest first, keyed on when
+	// they were created
+	GetChannelViews(limit int, cursor *types.KeysetCursor, ctx context.Context) ([]types.ChannelView, error)
+	// GetRankedChannelViews pages through channels by how active or popular
+	// they are right now. see Rank for how that is kept
+	GetRankedChannelViews(sort types.ChannelSort, limit int, cursor *types.RankCursor, ctx context.Context) ([]types.ChannelView, error)
+	GetChannelView(uri string, ctx context.Context) (*types.ChannelView, error)
+	GetChannelViewHR(handle string, rkey string, ctx context.Context) (*types.ChannelView, error)
+}
+
+// Subs covers org.xcvr.feed.sub records. subs to channels we don't know
+// about are kept, but left out of views until the channel shows up
+type Subs interface {
+	StoreSub(sub *types.Sub, ctx context.Context) (wasNew bool, err error)
+	UpdateSub(sub *types.Sub, ctx context.Context) error
+	DeleteSub(uri string, ctx context.Context) error
+	GetSubURIs(did string, channelURI string, ctx context.Context) ([]string, error)
+	GetSubscriptions(did string, limit int, cursor *types.KeysetCursor, ctx context.Context) ([]types.SubView, error)
+	// GetMyChannels gets the channels did is subscribed to, most recently
+	// active first
+	GetMyChannels(did string, limit int, cursor *types.KeysetCursor, ctx context.Context) ([]types.ChannelView, error)
+}
+
+type Signets interface {
+	StoreSignet(signet *types.Signet, ctx context.Context) (wasNew bool, err error)
+	UpdateSignet(signet *types.Signet, ctx context.Context) error
+	DeleteSignet(uri string, ctx context.Context) error
+	QuerySignet(channelUri string, id uint32, ctx context.Context) (signetUri string, signetHandle string, err error)
+	QuerySignetHandle(uri string, ctx context.Context) (string, error)
+	QuerySignetDid(uri string, ctx context.Context) (string, error)
+	QuerySignetChannelIdNum(uri string, ctx context.Context) (channelUri string, messageID uint32, err error)
+	GetMsgChannelURI(signetURI string, ctx context.Context) (string, error)
+	GetSignetsAfter(channelURI string, limit int, after uint32, ctx context.Context) ([]types.SignetView, error)
+	GetSignetIDAt(channelURI string, t time.Time, ctx context.Context) (uint32, error)
+}
+
+// Messages covers messages along with channel history, which mixes
+// messages and media
+type Messages interface {
+	StoreMessage(message *types.Message, ctx context.Context) (wasNew bool, err error)
+	// UpdateMessage replaces a message with a new version of it, keeping the
+	// old one as a revision and setting message.EditedAt. it reports false
+	// if message is the version already stored, and returns ErrNotFound if
+	// there's no message to replace
+	UpdateMessage(message *types.Message, ctx context.Context) (edited bool, err error)
+	// GetMessageRevisions gets the versions a message had before it was
+	// edited, newest first
+	GetMessageRevisions(uri string, ctx context.Context) ([]types.MessageRevisionView, error)
+	DeleteMessage(uri string, ctx context.Context) error
+	GetMessageChannelURI(uri string, ctx context.Context) (string, error)
+	GetMessages(channelURI string, limit int, cursor *int, ctx context.Context) ([]types.SignedMessageView, error)
+	GetHistory(channelURI string, limit int, cursor *int, ctx context.Context) ([]types.SignedItemView, error)
+	// GetHistoryBetween gets every item whose signet's lrcID is after after
+	// and no later than through, newest first. there's no limit, so keep the
+	// range small
+	GetHistoryBetween(channelURI string, after uint32, through uint32, ctx context.Context) ([]types.SignedItemView, error)
+	SearchMessages(params types.SearchMessagesParams, ctx context.Context) ([]types.SearchResult, error)
+}
+
+// Images covers media, which is images and videos
+type Images interface {
+	StoreImage(image *types.Image, ctx context.Context) (wasNew bool, err error)
+	UpdateImage(image *types.Image, ctx context.Context) error
+	DeleteImage(uri string, ctx context.Context) error
+	GetImage(uri string, ctx context.Context) (*types.Image, error)
+	GetImageDidCID(did string, cid string, ctx context.Context) (*types.Image, error)
+	GetImageChannelURI(uri string, ctx context.Context) (string, error)
+
+	StoreVideo(video *types.Video, ctx context.Context) (wasNew bool, err error)
+	UpdateVideo(video *types.Video, ctx context.Context) error
+	DeleteVideo(uri string, ctx context.Context) error
+	GetVideo(uri string, ctx context.Context) (*types.Video, error)
+	GetVideoDidCID(did string, cid string, ctx context.Context) (*types.Video, error)
+	GetVideoChannelURI(uri string, ctx context.Context) (string, error)
+}
+
+type Bans interface {
+	AddBan(did string, reason *string, till *time.Time, ctx context.Context) error
+	GetBanned(did string, ctx context.Context) (*types.Ban, error)
+	GetBanId(id int, ctx context.Context) (*types.Ban, error)
+	// GetActiveBan returns ErrNotFound if did isn't banned right now
+	GetActiveBan(did string, ctx context.Context) (*types.Ban, error)
+	IsBanned(did string, ctx context.Context) (bool, error)
+}
+
+type Reports interface {
+	StoreAuthReport(report *types.AuthReport, ctx context.Context) error
+	StoreAnonReport(report *types.AnonReport, ctx context.Context) error
+	CountReportsFromAddr(addr string, since time.Time, ctx context.Context) (int, error)
+	GetReports(resolved bool, limit int, cursor *int, ctx context.Context) ([]types.Report, error)
+	GetReport(id int, ctx context.Context) (*types.Report, error)
+	ResolveReport(id int, resolvedBy string, ban *types.Ban, ctx context.Context) (*types.Report, error)
+}
+
+type Cursors interface {
+	// GetCursor returns ErrNotFound if nothing has been stored under name
+	GetCursor(name string, ctx context.Context) (int64, error)
+	StoreCursor(name string, timeUS int64, ctx context.Context) error
+}
+
+// Outbox is writes to my repo that are waiting to land. the signets and
+// messages they're for are stored straight away with an empty cid, which
+// CompleteWrite fills in
+type Outbox interface {
+	EnqueueWrite(item *types.OutboxItem, ctx context.Context) error
+	// GetDueWrites gets up to limit writes that haven't failed and are due by
+	// now, oldest first. a write isn't due while the write it comes after is
+	// put off or given up on
+	GetDueWrites(now time.Time, limit int, ctx context.Context) ([]types.OutboxItem, error)
+	// CompleteWrite drops a write from the outbox and sets the cid of the
+	// record it was for. it returns ErrNotFound if the write was cancelled
+	CompleteWrite(id int, cid string, ctx context.Context) error
+	// DeferWrite counts a failed attempt and puts off the next one until next
+	DeferWrite(id int, lastErr string, next time.Time, ctx context.Context) error
+	// FailWrite counts a failed attempt and gives up on the write
+	FailWrite(id int, lastErr string, ctx context.Context) error
+	// FailWritesAfter gives up on every write that's waiting for the write
+	// for uri to land, and returns them
+	FailWritesAfter(uri string, lastErr string, ctx context.Context) ([]types.OutboxItem, error)
+	// CancelWrite drops the write for uri if it hasn't landed, and reports
+	// whether there was one
+	CancelWrite(uri string, ctx context.Context) (bool, error)
+	// GetFailedWrites pages through failed writes newest first. the cursor is
+	// the id of the last write on the previous page
+	GetFailedWrites(limit int, cursor *int, ctx context.Context) ([]types.OutboxItem, error)
+	// RequeueWrite gives a failed write another go. it returns ErrNotFound if
+	// there's no failed write with id
+	RequeueWrite(id int, ctx context.Context) error
+}
+
+// OAuth is what the oauth client app needs to keep sessions and in flight
+// requests around
+type OAuth interface {
+	oauth.ClientAuthStore
+	DeleteAllSessions(ctx context.Context, did string) error
+}
@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"rvcx/internal/lex"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -66,6 +69,14 @@ type Channel struct {
 	IndexedAt time.Time
 }
 
+// URIHost is what we need to know about a channel to start serving it
+type URIHost struct {
+	URI    string
+	Host   string
+	Topic  string
+	LastID uint32
+}
+
 type PostChannelRequest struct {
 	Title string  `json:"title"`
 	Topic *string `json:"topic,omitempty"`
@@ -95,8 +106,36 @@ type ChannelView struct {
 	Creator        ProfileView `json:"creator"`
 	Title          string      `json:"title"`
 	ConnectedCount *int        `json:"connectedCount,omitempty"`
+	HostedHere     *bool       `json:"hostedHere,omitempty"`
 	Topic          *string     `json:"topic,omitempty"`
 	CreatedAt      time.Time   `json:"createdAt"`
+	// LastActiveAt is roughly when something was last said in the channel:
+	// for getMyChannels when the last signet started, or when the channel
+	// was created if nobody has said anything yet, and for ranked feeds when
+	// something was last counted. it's only filled in by feeds that are
+	// ordered by activity
+	LastActiveAt *time.Time `json:"lastActiveAt,omitempty"`
+	// Rank is where a ranked feed put the channel, for its cursor
+	Rank float64 `json:"-"`
+}
+
+// ChannelSort is how getChannels orders channels
+type ChannelSort string
+
+const (
+	SortRecent  ChannelSort = "recent"
+	SortActive  ChannelSort = "active"
+	SortPopular ChannelSort = "popular"
+)
+
+func ParseChannelSort(s string) (ChannelSort, error) {
+	switch sort := ChannelSort(s); sort {
+	case "":
+		return SortRecent, nil
+	case SortRecent, SortActive, SortPopular:
+		return sort, nil
+	}
+	return "", errors.New("sort must be recent, active or popular")
 }
 
 func (c ChannelView) MarshalJSON() ([]byte, error) {
@@ -110,6 +149,58 @@ func (c ChannelView) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// Sub is an org.xcvr.feed.sub record, which is someone subscribing to a
+// channel
+type Sub struct {
+	URI        string
+	CID        string
+	DID        string
+	ChannelURI string
+	CreatedAt  time.Time
+	IndexedAt  time.Time
+}
+
+type SubView struct {
+	Type      string      `json:"$type,const=org.xcvr.feed.defs#subView"`
+	URI       string      `json:"uri"`
+	Channel   ChannelView `json:"channel"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+func (v SubView) MarshalJSON() ([]byte, error) {
+	type Alias SubView
+	return json.Marshal(&struct {
+		Type string `json:"$type"`
+		*Alias
+	}{
+		Type:  "org.xcvr.feed.defs#subView",
+		Alias: (*Alias)(&v),
+	})
+}
+
+type SubscribeRequest struct {
+	ChannelURI string `json:"channelUri"`
+}
+
+type SubscribeOut struct {
+	URI string `json:"uri"`
+}
+
+type GetSubscriptionsOut struct {
+	Subscriptions []SubView `json:"subscriptions"`
+	Cursor        *string   `json:"cursor,omitempty"`
+}
+
+type GetChannelsOut struct {
+	Channels []ChannelView `json:"channels"`
+	Cursor   *string       `json:"cursor,omitempty"`
+}
+
+type GetMyChannelsOut struct {
+	Channels []ChannelView `json:"channels"`
+	Cursor   *string       `json:"cursor,omitempty"`
+}
+
 type Signet struct {
 	URI          string
 	IssuerDID    string
@@ -131,6 +222,9 @@ type SignetView struct {
 	Author       string    `json:"author"`
 	AuthorHandle *string   `json:"authorHandle,omitempty"`
 	StartedAt    time.Time `json:"startedAt"`
+	// Pending is set on live events for signets that haven't been written to
+	// the issuer's repo yet
+	Pending bool `json:"pending,omitempty"`
 }
 
 func (s SignetView) MarshalJSON() ([]byte, error) {
@@ -153,6 +247,8 @@ type Message struct {
 	Color     *uint32
 	CID       string
 	PostedAt  time.Time
+	// EditedAt is when the message was last edited, or nil if it never was
+	EditedAt  *time.Time
 	IndexedAt time.Time
 }
 
@@ -166,6 +262,15 @@ type PostMessageRequest struct {
 	Nonce      []byte  `json:"nonce,omitempty"`
 }
 
+// EditMessageRequest replaces the body of a message. nick and color stay as
+// they were unless they're set
+type EditMessageRequest struct {
+	URI   string  `json:"uri"`
+	Body  string  `json:"body"`
+	Nick  *string `json:"nick,omitempty"`
+	Color *uint32 `json:"color,omitempty"`
+}
+
 type MessageView struct {
 	Type      string      `json:"$type,const=org.xcvr.lrc.defs#messageView"`
 	URI       string      `json:"uri"`
@@ -175,6 +280,11 @@ type MessageView struct {
 	Color     *uint32     `json:"color,omitempty"`
 	SignetURI string      `json:"signetURI"`
 	PostedAt  time.Time   `json:"postedAt"`
+	Edited    bool        `json:"edited,omitempty"`
+	EditedAt  *time.Time  `json:"editedAt,omitempty"`
+	// Pending is set on live events for messages that haven't been written
+	// to the author's repo yet
+	Pending bool `json:"pending,omitempty"`
 }
 
 func (m MessageView) MarshalJSON() ([]byte, error) {
@@ -197,6 +307,8 @@ type SignedMessageView struct {
 	Color    *uint32     `json:"color,omitempty"`
 	Signet   SignetView  `json:"signet"`
 	PostedAt time.Time   `json:"postedAt"`
+	Edited   bool        `json:"edited,omitempty"`
+	EditedAt *time.Time  `json:"editedAt,omitempty"`
 }
 
 func (m SignedMessageView) MarshalJSON() ([]byte, error) {
@@ -210,11 +322,129 @@ func (m SignedMessageView) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// MessageView drops the signet down to its uri, which is how messages look
+// on the lex stream
+func (m SignedMessageView) MessageView() MessageView {
+	return MessageView{
+		URI:       m.URI,
+		Author:    m.Author,
+		Body:      m.Body,
+		Nick:      m.Nick,
+		Color:     m.Color,
+		SignetURI: m.Signet.URI,
+		PostedAt:  m.PostedAt,
+		Edited:    m.Edited,
+		EditedAt:  m.EditedAt,
+	}
+}
+
+// MessageRevisionView is a version of a message that has since been edited.
+// WrittenAt is when that version was posted or edited in, and RevisedAt is
+// when it was replaced
+type MessageRevisionView struct {
+	CID       string    `json:"cid"`
+	Body      string    `json:"body"`
+	Nick      *string   `json:"nick,omitempty"`
+	Color     *uint32   `json:"color,omitempty"`
+	WrittenAt time.Time `json:"writtenAt"`
+	RevisedAt time.Time `json:"revisedAt"`
+}
+
+type GetMessageRevisionsOut struct {
+	URI       string                `json:"uri"`
+	Revisions []MessageRevisionView `json:"revisions"`
+}
+
 type GetMessagesOut struct {
 	Messages []SignedMessageView `json:"messages"`
 	Cursor   *string             `json:"cursor,omitempty"`
 }
 
+// KeysetCursor is where the last page of something ordered newest first,
+// with ties broken by uri, left off. postgres only keeps microseconds, so
+// that is all the cursor keeps too
+type KeysetCursor struct {
+	At  time.Time
+	URI string
+}
+
+func (c KeysetCursor) String() string {
+	return fmt.Sprintf("%d::%s", c.At.UnixMicro(), c.URI)
+}
+
+// Older reports whether something at t with uri belongs on a later page
+// than the cursor
+func (c KeysetCursor) Older(t time.Time, uri string) bool {
+	t, at := t.Truncate(time.Microsecond), c.At.Truncate(time.Microsecond)
+	return t.Before(at) || (t.Equal(at) && uri < c.URI)
+}
+
+func ParseKeysetCursor(s string) (*KeysetCursor, error) {
+	micros, uri, ok := strings.Cut(s, "::")
+	if !ok || uri == "" {
+		return nil, errors.New("malformed cursor")
+	}
+	t, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor: %w", err)
+	}
+	return &KeysetCursor{At: time.UnixMicro(t).UTC(), URI: uri}, nil
+}
+
+// RankCursor is where the last page of something ordered by rank, highest
+// first, with ties broken by uri, left off
+type RankCursor struct {
+	Rank float64
+	URI  string
+}
+
+func (c RankCursor) String() string {
+	return strconv.FormatFloat(c.Rank, 'g', -1, 64) + "::" + c.URI
+}
+
+// Lower reports whether something with rank and uri belongs on a later page
+// than the cursor
+func (c RankCursor) Lower(rank float64, uri string) bool {
+	return rank < c.Rank || (rank == c.Rank && uri < c.URI)
+}
+
+func ParseRankCursor(s string) (*RankCursor, error) {
+	rankstr, uri, ok := strings.Cut(s, "::")
+	if !ok || uri == "" {
+		return nil, errors.New("malformed cursor")
+	}
+	rank, err := strconv.ParseFloat(rankstr, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed cursor: %w", err)
+	}
+	return &RankCursor{Rank: rank, URI: uri}, nil
+}
+
+// SearchMessagesParams narrows down org.xcvr.lrc.searchMessages. everything
+// but Query is optional
+type SearchMessagesParams struct {
+	Query        string
+	ChannelURI   *string
+	AuthorDID    *string
+	AuthorHandle *string
+	Since        *time.Time
+	Until        *time.Time
+	Limit        int
+	Cursor       *KeysetCursor
+}
+
+// SearchResult is a message that matched a search, along with a snippet of
+// its body where the matching words are wrapped in <mark></mark>
+type SearchResult struct {
+	Message SignedMessageView `json:"message"`
+	Snippet string            `json:"snippet"`
+}
+
+type SearchMessagesOut struct {
+	Results []SearchResult `json:"results"`
+	Cursor  *string        `json:"cursor,omitempty"`
+}
+
 type Image struct {
 	URI       string
 	DID       string
@@ -231,11 +461,28 @@ type Image struct {
 	IndexedAt time.Time
 }
 
+type Video struct {
+	URI       string
+	DID       string
+	SignetURI string
+	BlobCID   *string
+	BlobMIME  *string
+	Alt       string
+	Nick      *string
+	Color     *uint32
+	CID       string
+	Width     *int64
+	Height    *int64
+	PostedAt  time.Time
+	IndexedAt time.Time
+}
+
 type MediaView struct {
 	Type      string      `json:"$type,const=org.xcvr.lrc.defs#mediaView"`
 	URI       string      `json:"uri"`
 	Author    ProfileView `json:"author"`
 	Image     *ImageView  `json:"imageView,omitempty"`
+	Video     *VideoView  `json:"videoView,omitempty"`
 	Nick      *string     `json:"nick,omitempty"`
 	Color     *uint32     `json:"color,omitempty"`
 	SignetURI string      `json:"signetURI"`
@@ -248,6 +495,12 @@ type ImageView struct {
 	AspectRatio *lex.AspectRatio `json:"AspectRatio,omitempty"`
 }
 
+type VideoView struct {
+	Alt         string           `json:"alt"`
+	Src         *string          `json:"src,omitempty"`
+	AspectRatio *lex.AspectRatio `json:"AspectRatio,omitempty"`
+}
+
 type ParseMediaRequest struct {
 	Nick       *string    `json:"nick,omitempty"`
 	Color      *uint32    `json:"color,omitempty"`
@@ -255,9 +508,19 @@ type ParseMediaRequest struct {
 	ChannelURI *string    `json:"channelURI,omitempty"`
 	MessageID  *uint32    `json:"messageID,omitempty"`
 	Image      *lex.Image `json:"image,omitempty"`
+	Video      *lex.Video `json:"video,omitempty"`
 	Type       string     `json:"type"`
 }
 
+// EditMediaRequest changes the alt text, nick, or color of an image or video.
+// anything left unset stays as it was, and the blob can't be changed
+type EditMediaRequest struct {
+	URI   string  `json:"uri"`
+	Alt   *string `json:"alt,omitempty"`
+	Nick  *string `json:"nick,omitempty"`
+	Color *uint32 `json:"color,omitempty"`
+}
+
 func (m MediaView) MarshalJSON() ([]byte, error) {
 	type Alias MediaView
 	return json.Marshal(&struct {
@@ -274,6 +537,7 @@ type SignedMediaView struct {
 	URI      string      `json:"uri"`
 	Author   ProfileView `json:"author"`
 	Image    *ImageView  `json:"imageView,omitempty"`
+	Video    *VideoView  `json:"videoView,omitempty"`
 	Nick     *string     `json:"nick,omitempty"`
 	Color    *uint32     `json:"color,omitempty"`
 	Signet   SignetView  `json:"signet"`
@@ -291,6 +555,21 @@ func (m SignedMediaView) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// MediaView drops the signet down to its uri, which is how media looks on the
+// lex stream
+func (m SignedMediaView) MediaView() MediaView {
+	return MediaView{
+		URI:       m.URI,
+		Author:    m.Author,
+		Image:     m.Image,
+		Video:     m.Video,
+		Nick:      m.Nick,
+		Color:     m.Color,
+		SignetURI: m.Signet.URI,
+		PostedAt:  m.PostedAt,
+	}
+}
+
 type SignedItemView interface {
 	IsMedia() bool
 	IsMessage() bool
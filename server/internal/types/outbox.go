@@ -0,0 +1,34 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OutboxItem is a write to my repo that hasn't landed yet. Record is the
+// record as json with its $type, so it can be decoded without knowing the
+// collection ahead of time. After is the uri of a write that has to land
+// first, if there is one. once FailedAt is set it's given up on until an
+// admin retries it
+type OutboxItem struct {
+	Id            int             `json:"id"`
+	URI           string          `json:"uri"`
+	Collection    string          `json:"collection"`
+	Rkey          string          `json:"rkey"`
+	Record        json.RawMessage `json:"record"`
+	After         *string         `json:"after,omitempty"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"nextAttemptAt"`
+	LastError     *string         `json:"lastError,omitempty"`
+	FailedAt      *time.Time      `json:"failedAt,omitempty"`
+	CreatedAt     time.Time       `json:"createdAt"`
+}
+
+type RetryWriteRequest struct {
+	Id int `json:"id"`
+}
+
+type GetFailedWritesOut struct {
+	Writes []OutboxItem `json:"writes"`
+	Cursor *string      `json:"cursor,omitempty"`
+}
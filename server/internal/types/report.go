@@ -22,3 +22,30 @@ type AuthReport struct {
 	Reason     string    `json:"reason"`
 	ReportedAt time.Time `json:"reportedAt"`
 }
+
+type Report struct {
+	Id         int        `json:"id"`
+	URI        string     `json:"uri"`
+	Reason     string     `json:"reason"`
+	DID        *string    `json:"did,omitempty"`
+	Addr       *string    `json:"addr,omitempty"`
+	ReportedAt time.Time  `json:"reportedAt"`
+	ResolvedAt *time.Time `json:"resolvedAt,omitempty"`
+	ResolvedBy *string    `json:"resolvedBy,omitempty"`
+	BanId      *int       `json:"banId,omitempty"`
+}
+
+type ResolveReportRequest struct {
+	Id  int         `json:"id"`
+	Ban *BanRequest `json:"ban,omitempty"`
+}
+
+type BanRequest struct {
+	Days   *int    `json:"days,omitempty"`
+	Reason *string `json:"reason,omitempty"`
+}
+
+type GetReportsOut struct {
+	Reports []Report `json:"reports"`
+	Cursor  *string  `json:"cursor,omitempty"`
+}
@@ -0,0 +1,47 @@
+package types
+
+// the $types of frames sent down org.xcvr.lrc.subscribeLexStream
+const (
+	StreamSignet        = "org.xcvr.lrc.subscribeLexStream#signet"
+	StreamSignetUpdate  = "org.xcvr.lrc.subscribeLexStream#signetUpdate"
+	StreamSignetDelete  = "org.xcvr.lrc.subscribeLexStream#signetDelete"
+	StreamMessage       = "org.xcvr.lrc.subscribeLexStream#message"
+	StreamMessageUpdate = "org.xcvr.lrc.subscribeLexStream#messageUpdate"
+	StreamMessageDelete = "org.xcvr.lrc.subscribeLexStream#messageDelete"
+	StreamMedia         = "org.xcvr.lrc.subscribeLexStream#media"
+	StreamMediaUpdate   = "org.xcvr.lrc.subscribeLexStream#mediaUpdate"
+	StreamMediaDelete   = "org.xcvr.lrc.subscribeLexStream#mediaDelete"
+	StreamWriteFailed   = "org.xcvr.lrc.subscribeLexStream#writeFailed"
+	StreamFellBehind    = "org.xcvr.lrc.subscribeLexStream#fellBehind"
+	StreamGoingAway     = "org.xcvr.lrc.subscribeLexStream#goingAway"
+)
+
+// StreamEvent wraps everything sent down a lex stream. Seq goes up by one for
+// every live event in a channel, so a client that sees a gap knows it missed
+// something. replayed history has no Seq
+type StreamEvent struct {
+	Type string `json:"$type"`
+	Seq  uint64 `json:"seq,omitempty"`
+	Data any    `json:"data"`
+}
+
+// DeletedView is the data of a delete event, the record it refers to is gone
+// so all we can say is which one it was. writeFailed events use it too
+type DeletedView struct {
+	URI string `json:"uri"`
+}
+
+// FellBehindView is the data of the last frame a client gets if it couldn't
+// keep up. it should reconnect with Cursor to fill in what it missed
+type FellBehindView struct {
+	Cursor string `json:"cursor"`
+	Seq    uint64 `json:"seq"`
+}
+
+// GoingAwayView is the data of the last frame a client gets when the server is
+// shutting down. like with FellBehindView, reconnecting with Cursor picks up
+// where it left off
+type GoingAwayView struct {
+	Cursor string `json:"cursor"`
+	Seq    uint64 `json:"seq"`
+}